@@ -0,0 +1,425 @@
+package boltdb
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Operations recorded on the audit log
+const (
+	// AuditIssue is recorded for every code and token pair stored
+	AuditIssue = "issue"
+	// AuditRevoke is recorded for every code and token pair removed, with the revocation reason
+	AuditRevoke = "revoke"
+)
+
+// AuditFormat is the format ExportAudit writes
+type AuditFormat int
+
+const (
+	// AuditJSON writes an AuditEntry in JSON per line
+	AuditJSON AuditFormat = iota
+	// AuditCEF writes an ArcSight Common Event Format record per line
+	AuditCEF
+)
+
+// AuditEntry records the issuance or revocation of a code or token pair on the audit log.
+// Entries are chained by their hashes, so deleting or editing one breaks the chain
+type AuditEntry struct {
+	// Seq is the position of the entry on the log, starting at 1
+	Seq       uint64
+	Time      time.Time
+	Operation string
+	// Reason is the revocation reason of AuditRevoke entries
+	Reason string
+	// CodeHash, AccessHash and RefreshHash are the hex encoded SHA-256 of the keys of the tokens,
+	// like Revocation.KeyHash, empty when not affected. The tokens themselves are not recorded
+	CodeHash    string
+	AccessHash  string
+	RefreshHash string
+	UserID      string
+	ClientID    string
+	// GrantType is inferred from the token information of AuditIssue entries, as oauth2.v3
+	// doesn't store it: authorization_code for codes and the pairs with a redirect URI,
+	// client_credentials for the pairs without user and password for the rest
+	GrantType string
+	// PrevHash is the Hash of the previous entry, empty for the first one
+	PrevHash string
+	// Hash is the hex encoded HMAC-SHA256 of PrevHash and the rest of the entry, keyed with a key
+	// derived from Config.HashKeysSecret or Config.EncryptionKey, or their SHA-256 without them
+	Hash string
+}
+
+// createAuditBucket creates the audit log bucket when the log is enabled
+func (ts *TokenStore) createAuditBucket() error {
+	if !ts.audit {
+		return nil
+	}
+
+	return createBuckets(ts.db, ts.bucketAuditName)
+}
+
+// auditTokenHash returns the hash recorded for a token, the hash of its key like the
+// revocations record, empty when there's no token
+func (ts *TokenStore) auditTokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	return revocationKeyHash(ts.tokenKey(token))
+}
+
+// grantType infers the grant type a code or token pair was issued with
+func grantType(info tokenKeys) string {
+	if info.GetCode() != "" {
+		return "authorization_code"
+	}
+
+	if r, ok := info.(interface{ GetRedirectURI() string }); ok && r.GetRedirectURI() != "" {
+		return "authorization_code"
+	}
+
+	if info.GetUserID() == "" {
+		return "client_credentials"
+	}
+
+	return "password"
+}
+
+// auditIssue records the issuance of info on the audit log when it's enabled
+func (ts *TokenStore) auditIssue(tx *bolt.Tx, info tokenKeys) error {
+	event := createEvent(info)
+
+	return ts.appendAudit(tx, AuditIssue, grantType(info), event)
+}
+
+// auditRevoke records the removal of keys on the audit log when it's enabled.
+// It must be called before the keys are deleted
+func (ts *TokenStore) auditRevoke(tx *bolt.Tx, reason string, keys ...[]byte) error {
+	if tx.Bucket(ts.bucketAuditName) == nil || reason == "" {
+		return nil
+	}
+
+	return ts.appendAudit(tx, AuditRevoke, "", ts.tokenEvents(tx, reason, keys...)...)
+}
+
+// appendAudit appends an entry per event to the audit log, chained to the last one
+func (ts *TokenStore) appendAudit(tx *bolt.Tx, operation, grant string, events ...TokenEvent) error {
+	log := tx.Bucket(ts.bucketAuditName)
+	if log == nil || len(events) == 0 {
+		return nil
+	}
+
+	var prevHash string
+
+	if _, v := log.Cursor().Last(); v != nil {
+		last, err := ts.decodeAudit(v)
+		if err != nil {
+			return err
+		}
+
+		prevHash = last.Hash
+	}
+
+	for _, event := range events {
+		seq, err := log.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		entry := AuditEntry{
+			Seq:         seq,
+			Time:        ts.clock.Now().UTC(),
+			Operation:   operation,
+			Reason:      event.Reason,
+			CodeHash:    ts.auditTokenHash(event.Code),
+			AccessHash:  ts.auditTokenHash(event.Access),
+			RefreshHash: ts.auditTokenHash(event.Refresh),
+			UserID:      event.UserID,
+			ClientID:    event.ClientID,
+			GrantType:   grant,
+			PrevHash:    prevHash,
+		}
+
+		entry.Hash, err = auditHash(ts.auditKey, &entry)
+		if err != nil {
+			return err
+		}
+
+		jv, err := ts.codec.Marshal(&entry)
+		if err != nil {
+			return err
+		}
+
+		jv, err = ts.cipher.seal(jv)
+		if err != nil {
+			return err
+		}
+
+		err = log.Put(auditKey(seq), jv)
+		if err != nil {
+			return err
+		}
+
+		prevHash = entry.Hash
+	}
+
+	return nil
+}
+
+// auditKey returns the key of the entry seq, so entries are ordered by it
+func auditKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// auditHash returns the hash of entry, computed without its Hash, keyed with key when it's set
+func auditHash(key []byte, entry *AuditEntry) (string, error) {
+	unhashed := *entry
+	unhashed.Hash = ""
+	// codecs may decode the time on another location
+	unhashed.Time = unhashed.Time.UTC()
+
+	jv, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+
+	if key == nil {
+		sum := sha256.Sum256(jv)
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(jv)
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// rechainAudit recomputes the hashes of the audit log entries, when the log exists, with
+// newKey instead of oldKey. Entries must be readable with the cipher of ts. Broken chains
+// are left as they are, so VerifyAudit keeps failing
+func (ts *TokenStore) rechainAudit(tx *bolt.Tx, oldKey, newKey []byte) error {
+	log := tx.Bucket(ts.bucketAuditName)
+	if log == nil {
+		return nil
+	}
+
+	var (
+		entries []*AuditEntry
+		prev    *AuditEntry
+	)
+
+	err := log.ForEach(func(_, v []byte) error {
+		entry, err := ts.decodeAudit(v)
+		if err != nil {
+			return err
+		}
+
+		err = verifyAuditEntry(oldKey, prev, entry)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, entry)
+		prev = entry
+		return nil
+	})
+	if errors.Is(err, ErrAuditTampered) {
+		ts.logger.Printf("boltdb: audit log of bucket %s not rechained: %v", ts.bucketName, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var prevHash string
+
+	for _, entry := range entries {
+		entry.PrevHash = prevHash
+
+		entry.Hash, err = auditHash(newKey, entry)
+		if err != nil {
+			return err
+		}
+
+		jv, err := ts.codec.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		jv, err = ts.cipher.seal(jv)
+		if err != nil {
+			return err
+		}
+
+		err = log.Put(auditKey(entry.Seq), jv)
+		if err != nil {
+			return err
+		}
+
+		prevHash = entry.Hash
+	}
+
+	return nil
+}
+
+// decodeAudit decodes an audit log entry
+func (ts *TokenStore) decodeAudit(value []byte) (*AuditEntry, error) {
+	jv, err := ts.cipher.open(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry AuditEntry
+
+	err = ts.codec.Unmarshal(jv, &entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// eachAudit calls fn with the audit log entries, oldest first
+func (ts *TokenStore) eachAudit(fn func(entry *AuditEntry) error) error {
+	return ts.view(context.Background(), func(tx *bolt.Tx) error {
+		log := tx.Bucket(ts.bucketAuditName)
+		if log == nil {
+			return nil
+		}
+
+		return log.ForEach(func(_, v []byte) error {
+			entry, err := ts.decodeAudit(v)
+			if err != nil {
+				return err
+			}
+
+			return fn(entry)
+		})
+	})
+}
+
+// ExportAudit writes the audit log entries recorded since the given time to w, oldest first, one per line
+func (ts *TokenStore) ExportAudit(w io.Writer, since time.Time, format AuditFormat) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	err := ts.eachAudit(func(entry *AuditEntry) error {
+		if entry.Time.Before(since) {
+			return nil
+		}
+
+		if format == AuditCEF {
+			_, err := io.WriteString(bw, cefRecord(entry))
+			return err
+		}
+
+		return enc.Encode(entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// VerifyAudit checks the hash chain of the audit log, failing with ErrAuditTampered
+// at the first entry that was edited, or that follows a deleted one
+func (ts *TokenStore) VerifyAudit() error {
+	var prev *AuditEntry
+
+	return ts.eachAudit(func(entry *AuditEntry) error {
+		err := verifyAuditEntry(ts.auditKey, prev, entry)
+		if err != nil {
+			return err
+		}
+
+		prev = entry
+		return nil
+	})
+}
+
+// verifyAuditEntry checks the hash of entry, keyed with key, and its link to prev, the entry
+// before it or nil for the first one, failing with ErrAuditTampered
+func verifyAuditEntry(key []byte, prev, entry *AuditEntry) error {
+	hash, err := auditHash(key, entry)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case hash != entry.Hash:
+		return fmt.Errorf("%w: entry %d was modified", ErrAuditTampered, entry.Seq)
+	case prev == nil && entry.PrevHash != "":
+		return fmt.Errorf("%w: entries before %d were deleted", ErrAuditTampered, entry.Seq)
+	case prev != nil && (entry.PrevHash != prev.Hash || entry.Seq != prev.Seq+1):
+		return fmt.Errorf("%w: entries between %d and %d were deleted", ErrAuditTampered, prev.Seq, entry.Seq)
+	}
+
+	return nil
+}
+
+// cefHeaderEscaper escapes the header fields of CEF records
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+
+// cefValueEscaper escapes the extension values of CEF records
+var cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// cefRecord returns entry as a CEF record, with its newline
+func cefRecord(entry *AuditEntry) string {
+	name := "Token issued"
+	if entry.Operation == AuditRevoke {
+		name = "Token revoked"
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "CEF:0|naxhh|go-oauth2-boltdb|1|%s|%s|3|",
+		cefHeaderEscaper.Replace("token_"+entry.Operation), name)
+
+	extensions := []struct{ key, label, value string }{
+		{"rt", "", fmt.Sprint(entry.Time.UnixNano() / int64(time.Millisecond))},
+		{"act", "", entry.Operation},
+		{"reason", "", entry.Reason},
+		{"suser", "", entry.UserID},
+		{"cs1", "clientId", entry.ClientID},
+		{"cs2", "grantType", entry.GrantType},
+		{"cs3", "codeHash", entry.CodeHash},
+		{"cs4", "accessHash", entry.AccessHash},
+		{"cs5", "refreshHash", entry.RefreshHash},
+		{"cs6", "hash", entry.Hash},
+		{"cn1", "seq", fmt.Sprint(entry.Seq)},
+	}
+
+	sep := ""
+	for _, ext := range extensions {
+		if ext.value == "" {
+			continue
+		}
+
+		if ext.label != "" {
+			fmt.Fprintf(&b, "%s%sLabel=%s", sep, ext.key, ext.label)
+			sep = " "
+		}
+
+		fmt.Fprintf(&b, "%s%s=%s", sep, ext.key, cefValueEscaper.Replace(ext.value))
+		sep = " "
+	}
+
+	b.WriteString("\n")
+	return b.String()
+}
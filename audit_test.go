@@ -0,0 +1,275 @@
+package boltdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// auditPair issues a token pair on ts and removes its access token, recording two audit entries
+func auditPair(t *testing.T, ts *TokenStore) {
+	t.Helper()
+
+	err := ts.Create(&models.Token{
+		ClientID:         "client",
+		UserID:           "user",
+		Access:           "s3cr3t-access",
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  time.Hour,
+		Refresh:          "s3cr3t-refresh",
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if clock, ok := ts.clock.(*testutil.FakeClock); ok {
+		clock.Advance(time.Hour)
+	}
+
+	if err := ts.RemoveByAccess("s3cr3t-access"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// forgeAudit edits the user of the first audit entry and rehashes the chain with key
+func forgeAudit(t *testing.T, ts *TokenStore, key []byte) {
+	t.Helper()
+
+	err := ts.db.Update(func(tx *bolt.Tx) error {
+		log := tx.Bucket(ts.bucketAuditName)
+
+		var prevHash string
+
+		return log.ForEach(func(k, v []byte) error {
+			entry, err := ts.decodeAudit(v)
+			if err != nil {
+				return err
+			}
+
+			if entry.Seq == 1 {
+				entry.UserID = "mallory"
+			}
+
+			entry.PrevHash = prevHash
+
+			entry.Hash, err = auditHash(key, entry)
+			if err != nil {
+				return err
+			}
+
+			jv, err := ts.codec.Marshal(entry)
+			if err != nil {
+				return err
+			}
+
+			jv, err = ts.cipher.seal(jv)
+			if err != nil {
+				return err
+			}
+
+			prevHash = entry.Hash
+			return log.Put(k, jv)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportAudit(t *testing.T) {
+	start := time.Now()
+
+	tests := []struct {
+		name   string
+		since  time.Time
+		format AuditFormat
+		want   []string
+	}{
+		{"json", start, AuditJSON, []string{AuditIssue, AuditRevoke}},
+		{"json since the removal", start.Add(30 * time.Minute), AuditJSON, []string{AuditRevoke}},
+		{"cef", start, AuditCEF, []string{"act=" + AuditIssue, "act=" + AuditRevoke}},
+		{"future", start.Add(2 * time.Hour), AuditJSON, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestStore(t, Config{Audit: true, Clock: testutil.NewFakeClock(start)})
+			auditPair(t, ts)
+
+			var buf bytes.Buffer
+
+			if err := ts.ExportAudit(&buf, tt.since, tt.format); err != nil {
+				t.Fatal(err)
+			}
+
+			var lines []string
+			for scanner := bufio.NewScanner(&buf); scanner.Scan(); {
+				lines = append(lines, scanner.Text())
+			}
+
+			if len(lines) != len(tt.want) {
+				t.Fatalf("ExportAudit wrote %d lines, want %d: %q", len(lines), len(tt.want), lines)
+			}
+
+			for i, line := range lines {
+				if strings.Contains(line, "s3cr3t") {
+					t.Errorf("line %d records the token: %s", i, line)
+				}
+
+				if tt.format == AuditCEF {
+					if !strings.HasPrefix(line, "CEF:0|") || !strings.Contains(line, tt.want[i]) {
+						t.Errorf("line %d = %s, want a CEF record with %s", i, line, tt.want[i])
+					}
+
+					continue
+				}
+
+				var entry AuditEntry
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatal(err)
+				}
+
+				if entry.Operation != tt.want[i] || entry.UserID != "user" || entry.ClientID != "client" {
+					t.Errorf("line %d = %+v, want a %s entry of the pair", i, entry, tt.want[i])
+				}
+
+				// the hashes are the ones of the revocations
+				if want := revocationKeyHash(ts.tokenKey("s3cr3t-access")); entry.AccessHash != want {
+					t.Errorf("line %d access hash = %s, want %s", i, entry.AccessHash, want)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyAuditDetectsForgedChains(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		err    error
+	}{
+		// without a secret anyone writing the file can recompute the chain
+		{"no secret", Config{}, nil},
+		{"hash keys secret", Config{HashKeys: true, HashKeysSecret: []byte("secret")}, ErrAuditTampered},
+		{"encryption key", Config{EncryptionKey: testOldKey}, ErrAuditTampered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.Audit = true
+
+			ts := newTestStore(t, config)
+			auditPair(t, ts)
+
+			if err := ts.VerifyAudit(); err != nil {
+				t.Fatalf("VerifyAudit = %v, want nil", err)
+			}
+
+			forgeAudit(t, ts, nil)
+
+			if err := ts.VerifyAudit(); !errors.Is(err, tt.err) {
+				t.Fatalf("VerifyAudit of the forged chain = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAuditIsRechainedWithTheRotatedKey(t *testing.T) {
+	ts := rotatedStore(t, &Config{Audit: true}, func(ts *TokenStore) {
+		auditPair(t, ts)
+	})
+
+	if err := ts.VerifyAudit(); err != nil {
+		t.Fatalf("VerifyAudit after the rotation = %v, want nil", err)
+	}
+}
+
+func TestAuditMigrationRechainsIntactLogs(t *testing.T) {
+	tests := []struct {
+		name string
+		// forged is set when the unkeyed chain was edited before the migration
+		forged bool
+		err    error
+	}{
+		{"intact", false, nil},
+		{"tampered", true, ErrAuditTampered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				DbName:         filepath.Join(t.TempDir(), "oauth2.db"),
+				BucketName:     "oauthTokens",
+				Audit:          true,
+				HashKeys:       true,
+				HashKeysSecret: []byte("secret"),
+			}
+
+			store, closeFn, err := NewTokenStore(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ts := store.(*TokenStore)
+			auditPair(t, ts)
+
+			// logs of the previous schema are chained with SHA-256
+			err = ts.db.Update(func(tx *bolt.Tx) error {
+				return ts.rechainAudit(tx, ts.auditKey, nil)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.forged {
+				// edited without recomputing the chain, so the migration leaves it broken
+				err = ts.db.Update(func(tx *bolt.Tx) error {
+					log := tx.Bucket(ts.bucketAuditName)
+					_, v := log.Cursor().First()
+
+					entry, err := ts.decodeAudit(v)
+					if err != nil {
+						return err
+					}
+
+					entry.UserID = "mallory"
+
+					jv, err := ts.codec.Marshal(entry)
+					if err != nil {
+						return err
+					}
+
+					return log.Put(auditKey(entry.Seq), jv)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			closeFn()
+
+			setSchemaVersion(t, config, 11)
+
+			store, closeFn, err = NewTokenStore(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+
+			if err := store.(*TokenStore).VerifyAudit(); !errors.Is(err, tt.err) {
+				t.Fatalf("VerifyAudit after migrating = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
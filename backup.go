@@ -0,0 +1,212 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backup writes a consistent copy of the whole database to w.
+// It runs on a read transaction, so the store keeps working while it runs
+func (ts *TokenStore) Backup(w io.Writer) error {
+	if err := ts.checkOpen(context.Background()); err != nil {
+		return err
+	}
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+
+	return closedError(err)
+}
+
+// BackupHandler returns an http.Handler that downloads a backup of the database.
+// Closed stores answer 503 Service Unavailable. Errors once the backup started are only
+// logged, the download is then cut short of its Content-Length
+func (ts *TokenStore) BackupHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ts.checkOpen(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		var written int64
+
+		err := ts.db.View(func(tx *bolt.Tx) error {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.db"`, ts.bucketName))
+			w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+
+			var err error
+			written, err = tx.WriteTo(w)
+			return err
+		})
+
+		err = closedError(err)
+		if err == nil {
+			return
+		}
+
+		ts.logger.Printf("boltdb: backup: %v", err)
+		ts.reportError("backup", err)
+
+		if written > 0 {
+			return
+		}
+
+		w.Header().Del("Content-Disposition")
+		w.Header().Del("Content-Length")
+
+		status := http.StatusInternalServerError
+		if err == ErrStoreClosed {
+			status = http.StatusServiceUnavailable
+		}
+
+		http.Error(w, err.Error(), status)
+	})
+}
+
+// RestoreFrom replaces the tokens of the store, with their indexes, side buckets, sessions and
+// logs, with the ones of a backup created by Backup. The buckets are replaced on a single
+// transaction, so the store keeps working while it runs. Logs the store doesn't keep are not
+// restored, and the buckets the backup doesn't have are left empty.
+// The backup must have the shards, encryption key and codec of the store. Backups of older
+// schema versions are migrated, newer ones fail with ErrUnsupportedSchema.
+// Codes on Config.CodeDbName are restored with RestoreCodesFrom
+func (ts *TokenStore) RestoreFrom(r io.Reader) error {
+	return restoreFrom(r, func(backupTx *bolt.Tx) error {
+		if shards := ts.recordedShards(backupTx); shards != ts.shards {
+			return fmt.Errorf("%w: backup of bucket %s has %d shards, the config %d",
+				ErrShardsMismatch, ts.bucketName, shards, ts.shards)
+		}
+
+		err := ts.checkRecordedSettings(backupTx)
+		if err != nil {
+			return err
+		}
+
+		version := ts.schemaVersion(backupTx)
+		if version > SchemaVersion {
+			return fmt.Errorf("%w: backup of bucket %s has schema version %d, this version supports up to %d",
+				ErrUnsupportedSchema, ts.bucketName, version, SchemaVersion)
+		}
+
+		return ts.update(context.Background(), func(tx *bolt.Tx) error {
+			for _, name := range ts.ownedBuckets() {
+				// the meta bucket describes the database file, not its tokens
+				if bytes.Equal(name, ts.bucketMetaName) || tx.Bucket(name) == nil {
+					continue
+				}
+
+				err := replaceBucket(tx, backupTx, name)
+				if err != nil {
+					return err
+				}
+			}
+
+			// the layout of the restored buckets is upgraded to the one of the store
+			for ; version < SchemaVersion; version++ {
+				err := migrations[version](ts, tx)
+				if err != nil {
+					return fmt.Errorf("migrate backup of bucket %s to schema version %d: %w", ts.bucketName, version+1, err)
+				}
+			}
+
+			ts.cache.purge(tx)
+
+			return nil
+		})
+	})
+}
+
+// BackupCodes writes a consistent copy of the database of the authorization codes on
+// Config.CodeDbName to w. Without it codes are stored with the tokens, on Backup
+func (ts *TokenStore) BackupCodes(w io.Writer) error {
+	if ts.codes == nil {
+		return ErrNoCodeDb
+	}
+
+	return ts.codes.Backup(w)
+}
+
+// RestoreCodesFrom replaces the authorization codes on Config.CodeDbName with the ones of
+// a backup created by BackupCodes
+func (ts *TokenStore) RestoreCodesFrom(r io.Reader) error {
+	if ts.codes == nil {
+		return ErrNoCodeDb
+	}
+
+	return ts.codes.RestoreFrom(r)
+}
+
+// restoreFrom copies the backup read from r to a temporary file and calls fn with a
+// read transaction on it
+func restoreFrom(r io.Reader, fn func(backupTx *bolt.Tx) error) error {
+	f, err := os.CreateTemp("", "oauth2-boltdb-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	backup, err := bolt.Open(f.Name(), 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	return backup.View(fn)
+}
+
+// replaceBucket replaces the bucket name of tx with its copy on from.
+// The bucket is left empty when from doesn't have it
+func replaceBucket(tx, from *bolt.Tx, name []byte) error {
+	err := tx.DeleteBucket(name)
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+
+	bucket, err := tx.CreateBucket(name)
+	if err != nil {
+		return err
+	}
+
+	source := from.Bucket(name)
+	if source == nil {
+		return nil
+	}
+
+	return copyBucket(bucket, source)
+}
+
+// copyBucket copies the keys and nested buckets of source to bucket
+func copyBucket(bucket, source *bolt.Bucket) error {
+	return source.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return bucket.Put(k, v)
+		}
+
+		// nested buckets, like the days of the TTL bucket, have nil values
+		nested, err := bucket.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+
+		return copyBucket(nested, source.Bucket(k))
+	})
+}
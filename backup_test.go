@@ -0,0 +1,272 @@
+package boltdb
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestRestoreFromRestoresEveryBucket(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		DbName:     filepath.Join(dir, "oauth2.db"),
+		CodeDbName: filepath.Join(dir, "codes.db"),
+		BucketName: "oauthTokens",
+	}
+
+	store, closeFn, err := NewTokenStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ts := store.(*TokenStore)
+	now := time.Now()
+
+	err = ts.Create(&models.Token{
+		UserID:          "user",
+		Scope:           "read",
+		Access:          "access",
+		AccessCreateAt:  now,
+		AccessExpiresIn: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ts.Create(&models.Token{
+		UserID:        "user",
+		Code:          "code",
+		CodeCreateAt:  now,
+		CodeExpiresIn: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = NewConsentStore(ts).SaveConsent("user", "client", []string{"read"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var backup, codes bytes.Buffer
+
+	if err := ts.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.BackupCodes(&codes); err != nil {
+		t.Fatal(err)
+	}
+
+	// everything stored after the backup is lost on restore
+	if _, err := ts.RevokeByScope("read"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.RemoveByCode("code"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewConsentStore(ts).RevokeConsent("user", "client"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.RestoreFrom(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.RestoreCodesFrom(&codes); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		check func() error
+	}{
+		{"access token", func() error {
+			_, err := ts.GetByAccess("access")
+			return err
+		}},
+		{"code", func() error {
+			_, err := ts.GetByCode("code")
+			return err
+		}},
+		{"session", func() error {
+			session, err := ts.GetSessionByAccess("access")
+			if err == nil && session == nil {
+				err = ErrTokenNotFound
+			}
+			return err
+		}},
+		{"consent", func() error {
+			_, err := NewConsentStore(ts).GetConsent("user", "client")
+			return err
+		}},
+		{"scope index", func() error {
+			revoked, err := ts.RevokeByScope("read")
+			if err == nil && revoked != 1 {
+				t.Errorf("RevokeByScope revoked %d pairs, want the restored one", revoked)
+			}
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.check(); err != nil {
+				t.Errorf("%s after RestoreFrom: %v", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestBackupCodesWithoutCodeDb(t *testing.T) {
+	store, closeFn, err := NewTokenStore(&Config{
+		DbName:     filepath.Join(t.TempDir(), "oauth2.db"),
+		BucketName: "oauthTokens",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	var codes bytes.Buffer
+
+	if err := store.(*TokenStore).BackupCodes(&codes); err != ErrNoCodeDb {
+		t.Fatalf("BackupCodes = %v, want ErrNoCodeDb", err)
+	}
+}
+
+func TestBackupHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		closed bool
+		status int
+	}{
+		{"open", false, http.StatusOK},
+		{"closed", true, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{DbName: filepath.Join(t.TempDir(), "oauth2.db"), BucketName: "oauthTokens"}
+
+			store, closeFn, err := NewTokenStore(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+
+			ts := store.(*TokenStore)
+
+			err = ts.Create(&models.Token{Access: "access", AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.closed {
+				closeFn()
+			}
+
+			rec := httptest.NewRecorder()
+			ts.BackupHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/backup", nil))
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			if tt.status != http.StatusOK {
+				if rec.Header().Get("Content-Disposition") != "" {
+					t.Error("failed backups are served as attachments")
+				}
+
+				return
+			}
+
+			if length := rec.Header().Get("Content-Length"); length != strconv.Itoa(rec.Body.Len()) {
+				t.Errorf("Content-Length = %s, want %d", length, rec.Body.Len())
+			}
+
+			restored := newTestStore(t, Config{})
+			if err := restored.RestoreFrom(rec.Body); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := restored.GetByAccess("access"); err != nil {
+				t.Fatalf("GetByAccess on the downloaded backup = %v", err)
+			}
+		})
+	}
+}
+
+// backupOf returns a backup of a store of config holding an access token, recorded with
+// schema version when it's not 0
+func backupOf(t *testing.T, config Config, version uint64) *bytes.Buffer {
+	t.Helper()
+
+	config.DbName = filepath.Join(t.TempDir(), "oauth2.db")
+	config.BucketName = "oauthTokens"
+
+	store, closeFn, err := NewTokenStore(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Create(&models.Token{Access: "access", AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeFn()
+
+	if version != 0 {
+		setSchemaVersion(t, &config, version)
+	}
+
+	data, err := os.ReadFile(config.DbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.NewBuffer(data)
+}
+
+func TestRestoreFromChecksTheBackup(t *testing.T) {
+	tests := []struct {
+		name    string
+		backup  Config
+		version uint64
+		err     error
+	}{
+		{"same settings", Config{}, 0, nil},
+		{"older schema", Config{}, SchemaVersion - 1, nil},
+		{"newer schema", Config{}, SchemaVersion + 1, ErrUnsupportedSchema},
+		{"another key", Config{EncryptionKey: testOldKey}, 0, ErrEncryptionKeyMismatch},
+		{"another codec", Config{Codec: GobCodec}, 0, ErrCodecMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := backupOf(t, tt.backup, tt.version)
+			ts := newTestStore(t, Config{})
+
+			err := ts.RestoreFrom(backup)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("RestoreFrom = %v, want %v", err, tt.err)
+			}
+
+			_, err = ts.GetByAccess("access")
+			if restored := err == nil; restored != (tt.err == nil) {
+				t.Fatalf("GetByAccess after RestoreFrom = %v, want the token restored: %v", err, tt.err == nil)
+			}
+		})
+	}
+}
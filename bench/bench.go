@@ -0,0 +1,289 @@
+// Package bench measures go-oauth2-boltdb on realistic workloads: mixes of token creations,
+// validations and refreshes at several concurrencies and database sizes. Results are printed
+// in the format of go test -bench, so two runs can be compared with benchstat
+package bench
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+
+	boltdb "github.com/naxhh/go-oauth2-boltdb"
+)
+
+// Workload is a mix of operations, each one is picked with a probability proportional to its weight
+type Workload struct {
+	Name string
+	// Creates store a new token pair
+	Creates int
+	// Validates read an access token, like the resource servers on every request
+	Validates int
+	// Refreshes read a refresh token, store the new pair and remove the old one
+	Refreshes int
+}
+
+// Workloads are the workloads run by default
+var Workloads = []Workload{
+	{Name: "Create", Creates: 1},
+	{Name: "Validate", Validates: 1},
+	{Name: "Refresh", Refreshes: 1},
+	// most requests validate a token, some log in and a few refresh
+	{Name: "Mixed", Creates: 1, Validates: 18, Refreshes: 1},
+}
+
+// Options configure a run
+type Options struct {
+	// Config is the configuration of the stores, DbName is set to a temporary file per benchmark
+	Config boltdb.Config
+	// Workloads default to Workloads
+	Workloads []Workload
+	// Concurrency are the numbers of goroutines running the workload, default to 1, 8 and 64
+	Concurrency []int
+	// Sizes are the numbers of token pairs stored before each benchmark, default to 1000 and 100000
+	Sizes []int
+	// Dir holds the temporary databases, defaults to os.TempDir
+	Dir string
+}
+
+// defaults fills the unset options
+func (o *Options) defaults() {
+	if o.Config.BucketName == "" {
+		o.Config.BucketName = "oauthTokens"
+	}
+
+	if len(o.Workloads) == 0 {
+		o.Workloads = Workloads
+	}
+
+	if len(o.Concurrency) == 0 {
+		o.Concurrency = []int{1, 8, 64}
+	}
+
+	if len(o.Sizes) == 0 {
+		o.Sizes = []int{1000, 100000}
+	}
+}
+
+// Run runs every workload at every size and concurrency, writing a line per benchmark to w
+func Run(w io.Writer, opts Options) error {
+	opts.defaults()
+
+	fmt.Fprintf(w, "goos: %s\ngoarch: %s\npkg: github.com/naxhh/go-oauth2-boltdb/bench\n", runtime.GOOS, runtime.GOARCH)
+
+	for _, workload := range opts.Workloads {
+		for _, size := range opts.Sizes {
+			for _, concurrency := range opts.Concurrency {
+				result, err := runOne(opts, workload, size, concurrency)
+				if err != nil {
+					return fmt.Errorf("%s/size=%d/conc=%d: %v", workload.Name, size, concurrency, err)
+				}
+
+				fmt.Fprintf(w, "Benchmark%s/size=%d/conc=%d-%d\t%s\t%s\n",
+					workload.Name, size, concurrency, runtime.GOMAXPROCS(0), result.String(), result.MemString())
+			}
+		}
+	}
+
+	return nil
+}
+
+// runOne benchmarks workload on a new database holding size token pairs
+func runOne(opts Options, workload Workload, size, concurrency int) (testing.BenchmarkResult, error) {
+	dir, err := os.MkdirTemp(opts.Dir, "boltbench-")
+	if err != nil {
+		return testing.BenchmarkResult{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	config := opts.Config
+	config.DbName = filepath.Join(dir, "bench.db")
+
+	store, closeStore, err := boltdb.NewTokenStore(&config)
+	if err != nil {
+		return testing.BenchmarkResult{}, err
+	}
+	defer closeStore()
+
+	ts := store.(*boltdb.TokenStore)
+
+	stored, err := populate(ts, size)
+	if err != nil {
+		return testing.BenchmarkResult{}, err
+	}
+
+	var opErr atomic.Value
+
+	result := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+
+		// every goroutine refreshes its own token pairs, so they never race on the same one
+		workers := make([]*worker, concurrency)
+		for i := range workers {
+			workers[i] = &worker{ts: ts, workload: workload, stored: stored, seed: uint64(i + 1)}
+
+			if err := workers[i].start(); err != nil {
+				opErr.Store(err)
+				return
+			}
+		}
+
+		var wg sync.WaitGroup
+		b.ResetTimer()
+
+		for i, w := range workers {
+			n := b.N / concurrency
+			if i < b.N%concurrency {
+				n++
+			}
+
+			wg.Add(1)
+			go func(w *worker, n int) {
+				defer wg.Done()
+
+				for j := 0; j < n; j++ {
+					if err := w.next(); err != nil {
+						opErr.Store(err)
+						return
+					}
+				}
+			}(w, n)
+		}
+
+		wg.Wait()
+	})
+
+	if err, ok := opErr.Load().(error); ok {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// populate stores size token pairs, returning their access tokens
+func populate(ts *boltdb.TokenStore, size int) ([]string, error) {
+	stored := make([]string, 0, size)
+	batch := make([]oauth2.TokenInfo, 0, 1000)
+
+	for len(stored) < size {
+		info := newToken()
+		batch = append(batch, info)
+		stored = append(stored, info.Access)
+
+		if len(batch) == cap(batch) || len(stored) == size {
+			if err := ts.CreateBatch(batch); err != nil {
+				return nil, err
+			}
+
+			batch = batch[:0]
+		}
+	}
+
+	return stored, nil
+}
+
+// randomString returns a random hex string, like the tokens of the manager
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// newToken returns a token pair like the ones of the authorization code grant
+func newToken() *models.Token {
+	now := time.Now()
+
+	return &models.Token{
+		ClientID:         "bench-client",
+		UserID:           randomString(),
+		Scope:            "read write",
+		Access:           randomString(),
+		AccessCreateAt:   now,
+		AccessExpiresIn:  2 * time.Hour,
+		Refresh:          randomString(),
+		RefreshCreateAt:  now,
+		RefreshExpiresIn: 72 * time.Hour,
+	}
+}
+
+// worker runs the operations of a goroutine
+type worker struct {
+	ts       *boltdb.TokenStore
+	workload Workload
+	stored   []string
+	// current is the token pair refreshed by the worker
+	current *models.Token
+	seed    uint64
+}
+
+// start stores the token pair refreshed by the worker
+func (w *worker) start() error {
+	w.current = newToken()
+	return w.ts.Create(w.current)
+}
+
+// random returns a pseudo-random number below n, with an xorshift so workers don't contend on a lock
+func (w *worker) random(n int) int {
+	w.seed ^= w.seed << 13
+	w.seed ^= w.seed >> 7
+	w.seed ^= w.seed << 17
+
+	return int(w.seed % uint64(n))
+}
+
+// next runs an operation of the workload
+func (w *worker) next() error {
+	pick := w.random(w.workload.Creates + w.workload.Validates + w.workload.Refreshes)
+
+	switch {
+	case pick < w.workload.Creates:
+		return w.ts.Create(newToken())
+
+	case pick < w.workload.Creates+w.workload.Validates:
+		access := w.current.Access
+		if len(w.stored) > 0 {
+			access = w.stored[w.random(len(w.stored))]
+		}
+
+		_, err := w.ts.GetByAccess(access)
+		return err
+
+	default:
+		return w.refresh()
+	}
+}
+
+// refresh exchanges the refresh token of the worker for a new token pair
+func (w *worker) refresh() error {
+	_, err := w.ts.GetByRefresh(w.current.Refresh)
+	if err != nil {
+		return err
+	}
+
+	next := newToken()
+	next.UserID = w.current.UserID
+
+	err = w.ts.Create(next)
+	if err != nil {
+		return err
+	}
+
+	err = w.ts.RemoveByRefresh(w.current.Refresh)
+	if err != nil {
+		return err
+	}
+
+	w.current = next
+	return nil
+}
@@ -0,0 +1,276 @@
+// Package boltdbadmin contains net/http handlers to manage the tokens of a boltdb.TokenStore:
+// listing them, looking one up, revoking it, reading the statistics and triggering a sweep
+// or a compaction. Every endpoint is guarded by the auth middleware of the Options
+package boltdbadmin
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	boltdb "github.com/naxhh/go-oauth2-boltdb"
+
+	"gopkg.in/oauth2.v3"
+)
+
+// ReasonAdminRevoked is recorded for the tokens revoked without a reason
+const ReasonAdminRevoked = "admin_revoked"
+
+// ErrAuthRequired is returned by NewHandler when Options.Auth is not set
+var ErrAuthRequired = errors.New("boltdbadmin: auth middleware required")
+
+// Middleware wraps a handler, like the auth middleware of the endpoints
+type Middleware func(http.Handler) http.Handler
+
+// Options configure the admin handler
+type Options struct {
+	// Auth guards every endpoint, it's required. BasicAuth and BearerToken cover the simple
+	// cases, any middleware rejecting the unauthorized requests works
+	Auth Middleware
+	// CompactDir is the directory POST /compact writes the compacted copies to.
+	// The endpoint responds 404 when it's empty
+	CompactDir string
+}
+
+// handler serves the admin endpoints of a store
+type handler struct {
+	store      *boltdb.TokenStore
+	compactDir string
+}
+
+// NewHandler returns the admin endpoints of store, relative to where it's mounted:
+//
+//	GET  /tokens?user_id=&client_id=&limit=&cursor=  a page of ListTokens
+//	GET  /token?token=                               the Introspect result of a token
+//	POST /revoke  token=&reason=                     Revoke, with ReasonAdminRevoked by default
+//	GET  /stats                                      Stats
+//	POST /sweep                                      DeleteExpired
+//	POST /compact                                    Compact to a new file on Options.CompactDir
+//
+// Responses are JSON, and errors plain text like http.Error writes them
+func NewHandler(store *boltdb.TokenStore, opts Options) (http.Handler, error) {
+	if opts.Auth == nil {
+		return nil, ErrAuthRequired
+	}
+
+	h := &handler{store: store, compactDir: opts.CompactDir}
+
+	mux := http.NewServeMux()
+	mux.Handle("/tokens", allow(http.MethodGet, h.listTokens))
+	mux.Handle("/token", allow(http.MethodGet, h.getToken))
+	mux.Handle("/revoke", allow(http.MethodPost, h.revoke))
+	mux.Handle("/stats", allow(http.MethodGet, h.stats))
+	mux.Handle("/sweep", allow(http.MethodPost, h.sweep))
+	mux.Handle("/compact", allow(http.MethodPost, h.compact))
+
+	return opts.Auth(mux), nil
+}
+
+// BasicAuth returns a middleware accepting the requests with the HTTP basic credentials
+// user and password
+func BasicAuth(user, password string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+			if !ok || !equal(u, user) || !equal(p, password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="boltdbadmin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BearerToken returns a middleware accepting the requests with the Authorization header
+// Bearer token
+func BearerToken(token string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || !equal(strings.TrimPrefix(auth, "Bearer "), token) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="boltdbadmin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// equal compares credentials in constant time
+func equal(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// allow only lets requests with method reach fn
+func allow(method string, fn http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fn(w, r)
+	})
+}
+
+// tokensPage is the response of GET /tokens
+type tokensPage struct {
+	Tokens []oauth2.TokenInfo `json:"tokens"`
+	// Next is the cursor of the next page, empty on the last one
+	Next string `json:"next"`
+}
+
+// listTokens writes a page of tokens
+func (h *handler) listTokens(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	opts := boltdb.ListOptions{
+		UserID:   query.Get("user_id"),
+		ClientID: query.Get("client_id"),
+		Cursor:   query.Get("cursor"),
+	}
+
+	if _, err := hex.DecodeString(opts.Cursor); err != nil {
+		http.Error(w, "invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		opts.Limit = n
+	}
+
+	tokens, next, err := h.store.ListTokens(opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tokensPage{Tokens: tokens, Next: next})
+}
+
+// getToken writes the introspection of the token query parameter
+func (h *handler) getToken(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "token required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.store.Introspect(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if result.Status == boltdb.TokenUnknown {
+		http.Error(w, boltdb.ErrTokenNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// revoke revokes the token form value, and the tokens issued with it.
+// Unknown tokens are already revoked, so they respond 204 too
+func (h *handler) revoke(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "token required", http.StatusBadRequest)
+		return
+	}
+
+	reason := r.FormValue("reason")
+	if reason == "" {
+		reason = ReasonAdminRevoked
+	}
+
+	err := h.store.Revoke(token, reason)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stats writes the statistics of the store
+func (h *handler) stats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.store.Stats()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// sweep deletes the expired tokens, writing how many keys were deleted
+func (h *handler) sweep(w http.ResponseWriter, r *http.Request) {
+	deleted, err := h.store.DeleteExpired()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": deleted})
+}
+
+// compact writes a compacted copy of the database to the compaction directory, writing its path
+func (h *handler) compact(w http.ResponseWriter, r *http.Request) {
+	if h.compactDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := fmt.Sprintf("compact-%s.db", time.Now().UTC().Format("20060102T150405.000000000"))
+	path := filepath.Join(h.compactDir, name)
+
+	err := h.store.Compact(path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"path": path})
+}
+
+// writeJSON writes v as the JSON response with status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err with the status of its kind
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, boltdb.ErrTokenNotFound), errors.Is(err, boltdb.ErrTokenExpired):
+		status = http.StatusNotFound
+	case errors.Is(err, boltdb.ErrReadOnly):
+		status = http.StatusConflict
+	case errors.Is(err, boltdb.ErrStoreClosed):
+		status = http.StatusServiceUnavailable
+	}
+
+	http.Error(w, err.Error(), status)
+}
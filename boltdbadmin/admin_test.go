@@ -0,0 +1,213 @@
+package boltdbadmin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	boltdb "github.com/naxhh/go-oauth2-boltdb"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+// testStore returns a store holding a token pair
+func testStore(t *testing.T) *boltdb.TokenStore {
+	t.Helper()
+
+	store, closeFn, err := boltdb.NewTokenStore(&boltdb.Config{
+		DbName:     filepath.Join(t.TempDir(), "oauth2.db"),
+		BucketName: "oauthTokens",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeFn)
+
+	err = store.Create(&models.Token{
+		UserID:           "user",
+		ClientID:         "client",
+		Access:           "access",
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  time.Hour,
+		Refresh:          "refresh",
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store.(*boltdb.TokenStore)
+}
+
+func TestNewHandlerRequiresAuth(t *testing.T) {
+	if _, err := NewHandler(testStore(t), Options{}); err != ErrAuthRequired {
+		t.Fatalf("NewHandler = %v, want ErrAuthRequired", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		form       url.Values
+		token      string
+		compactDir bool
+		status     int
+		// check checks the response body and the store afterwards
+		check func(t *testing.T, store *boltdb.TokenStore, body string)
+	}{
+		{name: "unauthorized", method: http.MethodGet, target: "/stats", token: "wrong", status: http.StatusUnauthorized},
+		{name: "method not allowed", method: http.MethodPost, target: "/tokens", status: http.StatusMethodNotAllowed},
+		{
+			name:   "tokens",
+			method: http.MethodGet,
+			target: "/tokens?user_id=user&limit=10",
+			status: http.StatusOK,
+			check: func(t *testing.T, store *boltdb.TokenStore, body string) {
+				var page struct {
+					Tokens []json.RawMessage `json:"tokens"`
+					Next   string            `json:"next"`
+				}
+
+				if err := json.Unmarshal([]byte(body), &page); err != nil || len(page.Tokens) != 1 || page.Next != "" {
+					t.Errorf("page = %s, %v, want the token pair", body, err)
+				}
+			},
+		},
+		{name: "tokens with an invalid limit", method: http.MethodGet, target: "/tokens?limit=0", status: http.StatusBadRequest},
+		{name: "tokens with an invalid cursor", method: http.MethodGet, target: "/tokens?cursor=zz", status: http.StatusBadRequest},
+		{
+			name:   "token",
+			method: http.MethodGet,
+			target: "/token?token=access",
+			status: http.StatusOK,
+			check: func(t *testing.T, store *boltdb.TokenStore, body string) {
+				if !strings.Contains(body, `"client"`) {
+					t.Errorf("introspection = %s, want the client of the token", body)
+				}
+			},
+		},
+		{name: "unknown token", method: http.MethodGet, target: "/token?token=unknown", status: http.StatusNotFound},
+		{name: "token required", method: http.MethodGet, target: "/token", status: http.StatusBadRequest},
+		{
+			name:   "revoke",
+			method: http.MethodPost,
+			target: "/revoke",
+			form:   url.Values{"token": {"refresh"}},
+			status: http.StatusNoContent,
+			check: func(t *testing.T, store *boltdb.TokenStore, body string) {
+				if _, err := store.GetByAccess("access"); err != boltdb.ErrTokenNotFound {
+					t.Errorf("GetByAccess after revoking = %v, want ErrTokenNotFound", err)
+				}
+			},
+		},
+		{name: "revoke unknown token", method: http.MethodPost, target: "/revoke", form: url.Values{"token": {"unknown"}}, status: http.StatusNoContent},
+		{name: "revoke without token", method: http.MethodPost, target: "/revoke", status: http.StatusBadRequest},
+		{name: "stats", method: http.MethodGet, target: "/stats", status: http.StatusOK},
+		{
+			name:   "sweep",
+			method: http.MethodPost,
+			target: "/sweep",
+			status: http.StatusOK,
+			check: func(t *testing.T, store *boltdb.TokenStore, body string) {
+				if strings.TrimSpace(body) != `{"deleted":0}` {
+					t.Errorf("sweep = %s, want nothing deleted", body)
+				}
+			},
+		},
+		{name: "compact without a directory", method: http.MethodPost, target: "/compact", status: http.StatusNotFound},
+		{
+			name:       "compact",
+			method:     http.MethodPost,
+			target:     "/compact",
+			compactDir: true,
+			status:     http.StatusOK,
+			check: func(t *testing.T, store *boltdb.TokenStore, body string) {
+				var result map[string]string
+				if err := json.Unmarshal([]byte(body), &result); err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := os.Stat(result["path"]); err != nil {
+					t.Errorf("compacted copy: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := testStore(t)
+
+			opts := Options{Auth: BearerToken("secret")}
+			if tt.compactDir {
+				opts.CompactDir = t.TempDir()
+			}
+
+			handler, err := NewHandler(store, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			token := tt.token
+			if token == "" {
+				token = "secret"
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			if tt.check != nil {
+				tt.check(t, store, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		status   int
+	}{
+		{"valid", "admin", "password", http.StatusOK},
+		{"wrong password", "admin", "guess", http.StatusUnauthorized},
+		{"wrong user", "root", "password", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := NewHandler(testStore(t), Options{Auth: BasicAuth("admin", "password")})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+			req.SetBasicAuth(tt.user, tt.password)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
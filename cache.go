@@ -0,0 +1,239 @@
+package boltdb
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+// tokenCache is a LRU cache of decoded token information by code, access or refresh key.
+// A nil tokenCache caches nothing
+type tokenCache struct {
+	mu      sync.Mutex
+	size    int
+	clock   Clock
+	entries *list.List
+	keys    map[string]*list.Element
+	// generation changes on every invalidation, so reads that started before it aren't cached
+	generation uint64
+}
+
+// cacheEntry is a cached token information and when it expires. A zero expiry never expires
+type cacheEntry struct {
+	key    string
+	value  interface{}
+	expiry time.Time
+}
+
+// newTokenCache creates a cache of up to size token information, expiring them by clock.
+// It returns nil when size is not positive
+func newTokenCache(size int, clock Clock) *tokenCache {
+	if size <= 0 {
+		return nil
+	}
+
+	return &tokenCache{
+		size:    size,
+		clock:   clock,
+		entries: list.New(),
+		keys:    map[string]*list.Element{},
+	}
+}
+
+// capacity returns the maximum number of cached token information
+func (c *tokenCache) capacity() int {
+	if c == nil {
+		return 0
+	}
+
+	return c.size
+}
+
+// get returns the token information cached under key, or nil when missing or expired
+func (c *tokenCache) get(key []byte) interface{} {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.keys[string(key)]
+	if !ok {
+		return nil
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expiry.IsZero() && !c.clock.Now().Before(entry.expiry) {
+		c.removeElement(elem)
+		return nil
+	}
+
+	c.entries.MoveToFront(elem)
+
+	return entry.value
+}
+
+// version returns the current generation, to be passed to add after reading from the database
+func (c *tokenCache) version() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// add caches the token information read when the cache was at generation.
+// It's discarded when a write invalidated the cache since then
+func (c *tokenCache) add(key []byte, value interface{}, expiry time.Time, generation uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if elem, ok := c.keys[string(key)]; ok {
+		c.removeElement(elem)
+	}
+
+	c.keys[string(key)] = c.entries.PushFront(&cacheEntry{
+		key:    string(key),
+		value:  value,
+		expiry: expiry,
+	})
+
+	for c.entries.Len() > c.size {
+		c.removeElement(c.entries.Back())
+	}
+}
+
+// invalidate removes keys from the cache once tx is committed
+func (c *tokenCache) invalidate(tx *bolt.Tx, keys ...[]byte) {
+	if c == nil {
+		return
+	}
+
+	tx.OnCommit(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.generation++
+
+		for _, key := range keys {
+			if elem, ok := c.keys[string(key)]; ok {
+				c.removeElement(elem)
+			}
+		}
+	})
+}
+
+// purge removes all the cached token information once tx is committed
+func (c *tokenCache) purge(tx *bolt.Tx) {
+	if c == nil {
+		return
+	}
+
+	tx.OnCommit(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.generation++
+		c.entries.Init()
+		c.keys = map[string]*list.Element{}
+	})
+}
+
+// removeElement removes a cached entry, the lock must be held
+func (c *tokenCache) removeElement(elem *list.Element) {
+	c.entries.Remove(elem)
+	delete(c.keys, elem.Value.(*cacheEntry).key)
+}
+
+// preloadCache loads the most recently created access tokens into the cache, newest first,
+// until Config.CachePreload are cached or Config.CachePreloadBudget runs out.
+// Tokens that can't be read are skipped, like they are by ListTokens
+func (ts *TokenStore) preloadCache() {
+	limit := ts.cachePreload
+	if limit > ts.cache.capacity() {
+		limit = ts.cache.capacity()
+	}
+
+	if limit <= 0 {
+		return
+	}
+
+	start := time.Now()
+	deadline := start.Add(ts.cachePreloadBudget)
+	generation := ts.cache.version()
+	loaded := 0
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		index := tx.Bucket(ts.bucketCreatedIndexName)
+		if index == nil {
+			// read-only databases older than the index
+			return nil
+		}
+
+		bucket := ts.tokenBucket(tx)
+		c := index.Cursor()
+
+		for k, basicID := c.Last(); k != nil && loaded < limit && time.Now().Before(deadline); k, basicID = c.Prev() {
+			stored, err := ts.decodeStored(bucket.Get(basicID))
+			if err != nil || stored == nil || stored.Access == "" {
+				continue
+			}
+
+			key := ts.tokenKey(stored.Access)
+
+			sealed, expiry, _, err := ts.readTx(tx, key, true)
+			if err != nil {
+				// expired tokens are left to the cleaner
+				continue
+			}
+
+			jv, err := ts.cipher.open(sealed)
+			if err != nil {
+				continue
+			}
+
+			var tm models.Token
+			if ts.codec.Unmarshal(jv, &tm) != nil {
+				continue
+			}
+
+			ts.cache.add(key, tm, expiry, generation)
+			loaded++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		ts.logger.Printf("boltdb: preload cache: %v", err)
+		ts.reportError("preload", err)
+	}
+
+	ts.logger.Printf("boltdb: preloaded %d access tokens into the cache in %v", loaded, time.Since(start))
+}
+
+// earliest returns the earliest of two expirations, where zero means no expiration
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+
+	return a
+}
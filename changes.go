@@ -0,0 +1,300 @@
+package boltdb
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Operations recorded on the change log
+const (
+	// ChangeCreate is recorded for every code and token pair stored
+	ChangeCreate = "create"
+	// ChangeRemove is recorded for every code and token pair removed, with the revocation reason
+	ChangeRemove = "remove"
+	// ChangeExpire is recorded for the keys deleted once expired
+	ChangeExpire = "expire"
+)
+
+// DefaultWatchInterval is how often Watch polls the change log
+const DefaultWatchInterval = time.Second
+
+// ChangeEvent is an entry of the change log, written on the same transaction as the change
+type ChangeEvent struct {
+	// Seq increases with every change, starting at 1
+	Seq       uint64
+	Time      time.Time
+	Operation string
+	// Reason is the revocation reason of ChangeRemove events
+	Reason string
+	// KeyHashes are the hex encoded SHA-256 of the keys written or deleted, like
+	// Revocation.KeyHash. KeyHash returns the hash of a token to match them
+	KeyHashes []string
+}
+
+// changeSource reads the change log of a store
+type changeSource interface {
+	// lastChange returns the sequence of the last change
+	lastChange() (uint64, error)
+	// changesSince returns the changes after the sequence last, and the sequence to read from
+	// next. The next sequence is lower than last when the change log was replaced by an older one
+	changesSince(last uint64) ([]ChangeEvent, uint64, error)
+}
+
+// createChangeBucket creates the change log bucket when the log is enabled
+func (ts *TokenStore) createChangeBucket() error {
+	if ts.changeRetention <= 0 {
+		return nil
+	}
+
+	return createBuckets(ts.db, ts.bucketChangesName)
+}
+
+// KeyHash returns the hash of the key of a code, access or refresh token, as recorded on
+// ChangeEvent.KeyHashes and Revocation.KeyHash
+func (ts *TokenStore) KeyHash(token string) string {
+	return revocationKeyHash(ts.tokenKey(token))
+}
+
+// recordChange appends the change of keys to the change log when it's enabled
+func (ts *TokenStore) recordChange(tx *bolt.Tx, operation, reason string, keys ...[]byte) error {
+	log := tx.Bucket(ts.bucketChangesName)
+	if log == nil || len(keys) == 0 {
+		return nil
+	}
+
+	seq, err := log.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	event := ChangeEvent{
+		Seq:       seq,
+		Time:      ts.clock.Now().UTC(),
+		Operation: operation,
+		Reason:    reason,
+		KeyHashes: make([]string, len(keys)),
+	}
+
+	for i, key := range keys {
+		event.KeyHashes[i] = revocationKeyHash(key)
+	}
+
+	jv, err := ts.codec.Marshal(&event)
+	if err != nil {
+		return err
+	}
+
+	jv, err = ts.cipher.seal(jv)
+	if err != nil {
+		return err
+	}
+
+	return log.Put(changeKey(seq), jv)
+}
+
+// changeKey returns the key of the change seq, so changes are ordered by it
+func changeKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// decodeChange decodes a change log entry
+func (ts *TokenStore) decodeChange(value []byte) (*ChangeEvent, error) {
+	jv, err := ts.cipher.open(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var event ChangeEvent
+
+	err = ts.codec.Unmarshal(jv, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// lastChange returns the sequence of the last change, failing with ErrChangeLogDisabled
+// when the database has no change log
+func (ts *TokenStore) lastChange() (uint64, error) {
+	var last uint64
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		log := tx.Bucket(ts.bucketChangesName)
+		if log == nil {
+			return ErrChangeLogDisabled
+		}
+
+		last = log.Sequence()
+		return nil
+	})
+
+	return last, err
+}
+
+// changesSince returns the changes after last and the sequence of the last change
+func (ts *TokenStore) changesSince(last uint64) ([]ChangeEvent, uint64, error) {
+	var events []ChangeEvent
+	next := last
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		log := tx.Bucket(ts.bucketChangesName)
+		if log == nil {
+			return ErrChangeLogDisabled
+		}
+
+		next = log.Sequence()
+		if next <= last {
+			return nil
+		}
+
+		c := log.Cursor()
+
+		for k, v := c.Seek(changeKey(last + 1)); k != nil; k, v = c.Next() {
+			event, err := ts.decodeChange(v)
+			if err != nil {
+				return err
+			}
+
+			events = append(events, *event)
+		}
+
+		return nil
+	})
+
+	return events, next, err
+}
+
+// purgeChanges deletes the changes older than the retention. Sweeps only open
+// a write transaction when the oldest change is due
+func (ts *TokenStore) purgeChanges() (int, error) {
+	if ts.changeRetention <= 0 || ts.db.IsReadOnly() {
+		return 0, nil
+	}
+
+	purged := 0
+	min := ts.clock.Now().Add(-ts.changeRetention)
+
+	due, err := ts.changesDue(min)
+	if err != nil || !due {
+		return 0, err
+	}
+
+	err = ts.db.Update(func(tx *bolt.Tx) error {
+		log := tx.Bucket(ts.bucketChangesName)
+		if log == nil {
+			return nil
+		}
+
+		c := log.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			event, err := ts.decodeChange(v)
+			if err == nil && !event.Time.Before(min) {
+				return nil
+			}
+
+			// entries that can't be decoded can't be watched either
+			if err := c.Delete(); err != nil {
+				return err
+			}
+
+			purged++
+		}
+
+		return nil
+	})
+
+	return purged, err
+}
+
+// changesDue reports if the oldest change was made before min, or can't be decoded
+func (ts *TokenStore) changesDue(min time.Time) (bool, error) {
+	due := false
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		log := tx.Bucket(ts.bucketChangesName)
+		if log == nil {
+			return nil
+		}
+
+		k, v := log.Cursor().First()
+		if k == nil {
+			return nil
+		}
+
+		event, err := ts.decodeChange(v)
+		due = err != nil || event.Time.Before(min)
+		return nil
+	})
+
+	return due, err
+}
+
+// Watch returns a channel receiving the changes of the store, and of any other process writing
+// its database, made after it's called. It polls the change log every Config.WatchInterval, so
+// the database must have been written with Config.ChangeRetention, which must be longer than the
+// interval for no change to be missed. The channel is closed when ctx is done or the store closed
+func (ts *TokenStore) Watch(ctx context.Context) (<-chan ChangeEvent, error) {
+	if err := ts.checkOpen(ctx); err != nil {
+		return nil, err
+	}
+
+	return watchChanges(ctx, ts, ts.watchInterval, ts.closed, func(err error) {
+		ts.logger.Printf("boltdb: watch: %v", err)
+		ts.reportError("watch", err)
+	})
+}
+
+// watchChanges polls source every interval, sending the new changes to the returned
+// channel until ctx is done or stop is closed. Failed polls are passed to onError and retried
+func watchChanges(ctx context.Context, source changeSource, interval time.Duration, stop <-chan struct{}, onError func(err error)) (<-chan ChangeEvent, error) {
+	last, err := source.lastChange()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan ChangeEvent)
+
+	go func() {
+		defer close(events)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			}
+
+			changes, next, err := source.changesSince(last)
+			if err != nil {
+				onError(err)
+				continue
+			}
+
+			last = next
+
+			for _, change := range changes {
+				select {
+				case events <- change:
+				case <-ctx.Done():
+					return
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
@@ -0,0 +1,216 @@
+package boltdb
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestPurgeChangesOnlyWritesWhenDue(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now())
+
+	store, closeFn, err := NewTokenStore(&Config{
+		DbName:          filepath.Join(t.TempDir(), "oauth2.db"),
+		BucketName:      "oauthTokens",
+		ExpiryStrategy:  LazyExpiry,
+		ChangeRetention: time.Hour,
+		Clock:           clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ts := store.(*TokenStore)
+
+	err = ts.Create(&models.Token{Access: "access", AccessCreateAt: clock.Now(), AccessExpiresIn: 3 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		purged  int
+		writes  bool
+	}{
+		{"within the retention", 30 * time.Minute, 0, false},
+		{"after the retention", time.Hour, 1, true},
+		{"nothing left", time.Hour, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.Advance(tt.advance)
+			before := lastTxID(t, ts)
+
+			purged, err := ts.purgeChanges()
+			if err != nil || purged != tt.purged {
+				t.Fatalf("purgeChanges = %d, %v, want %d", purged, err, tt.purged)
+			}
+
+			if writes := lastTxID(t, ts) != before; writes != tt.writes {
+				t.Fatalf("wrote = %v, want %v", writes, tt.writes)
+			}
+		})
+	}
+}
+
+// watchPair returns the token pair of the watch tests, expiring after ttl
+func watchPair(ttl time.Duration, now time.Time) *models.Token {
+	return &models.Token{
+		Access:           "access",
+		AccessCreateAt:   now,
+		AccessExpiresIn:  ttl,
+		Refresh:          "refresh",
+		RefreshCreateAt:  now,
+		RefreshExpiresIn: ttl,
+	}
+}
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup runs before watching, change after it
+		setup     func(ts *TokenStore, clock *testutil.FakeClock) error
+		change    func(ts *TokenStore, clock *testutil.FakeClock) error
+		operation string
+		reason    string
+	}{
+		{
+			name:  "create",
+			setup: func(ts *TokenStore, clock *testutil.FakeClock) error { return nil },
+			change: func(ts *TokenStore, clock *testutil.FakeClock) error {
+				return ts.Create(watchPair(time.Hour, clock.Now()))
+			},
+			operation: ChangeCreate,
+		},
+		{
+			name: "remove",
+			setup: func(ts *TokenStore, clock *testutil.FakeClock) error {
+				return ts.Create(watchPair(time.Hour, clock.Now()))
+			},
+			change: func(ts *TokenStore, clock *testutil.FakeClock) error {
+				return ts.RemoveByRefresh("refresh")
+			},
+			operation: ChangeRemove,
+			reason:    ReasonRemoved,
+		},
+		{
+			name: "expire",
+			setup: func(ts *TokenStore, clock *testutil.FakeClock) error {
+				return ts.Create(watchPair(time.Minute, clock.Now()))
+			},
+			change: func(ts *TokenStore, clock *testutil.FakeClock) error {
+				clock.Advance(2 * time.Minute)
+
+				_, err := ts.sweep(context.Background())
+				return err
+			},
+			operation: ChangeExpire,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testutil.NewFakeClock(time.Now())
+			ts := newTestStore(t, Config{
+				ExpiryStrategy:  LazyExpiry,
+				ChangeRetention: time.Hour,
+				WatchInterval:   10 * time.Millisecond,
+				Clock:           clock,
+			})
+
+			if err := tt.setup(ts, clock); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			events, err := ts.Watch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.change(ts, clock); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case event := <-events:
+				if event.Operation != tt.operation || event.Reason != tt.reason {
+					t.Fatalf("event = %+v, want a %s event with reason %q", event, tt.operation, tt.reason)
+				}
+
+				found := false
+				for _, hash := range event.KeyHashes {
+					found = found || hash == ts.KeyHash("access")
+				}
+
+				if !found {
+					t.Fatalf("event key hashes %v don't have the access token", event.KeyHashes)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event received")
+			}
+		})
+	}
+}
+
+func TestWatchStops(t *testing.T) {
+	tests := []struct {
+		name string
+		// stop stops watching, with the context of the watch or the close function of the store
+		stop func(cancel, closeFn func())
+	}{
+		{"context done", func(cancel, closeFn func()) { cancel() }},
+		{"store closed", func(cancel, closeFn func()) { closeFn() }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, closeFn, err := NewTokenStore(&Config{
+				DbName:          filepath.Join(t.TempDir(), "oauth2.db"),
+				BucketName:      "oauthTokens",
+				ChangeRetention: time.Hour,
+				WatchInterval:   10 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			events, err := store.(*TokenStore).Watch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.stop(cancel, closeFn)
+
+			select {
+			case _, ok := <-events:
+				if ok {
+					t.Fatal("received an event, want the channel closed")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the channel wasn't closed")
+			}
+		})
+	}
+}
+
+func TestWatchWithoutChangeLog(t *testing.T) {
+	ts := newTestStore(t, Config{})
+
+	if _, err := ts.Watch(context.Background()); err != ErrChangeLogDisabled {
+		t.Fatalf("Watch = %v, want ErrChangeLogDisabled", err)
+	}
+}
@@ -0,0 +1,142 @@
+package boltdb
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// ErrClientNotFound is returned when the client id is not stored
+var ErrClientNotFound = errors.New("client not found")
+
+// NewClientStore creates a client store based on boltdb
+func NewClientStore(config *Config) (*ClientStore, func(), error) {
+	err := config.Validate()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = config.createDir()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := openDB(config.dbPath(), config.fileMode(), config.boltOptions())
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cs, _, err := NewClientStoreWithDB(db, config)
+
+	if err != nil {
+		closeDB(db)
+		return nil, nil, err
+	}
+
+	var closeOnce sync.Once
+
+	closeFunction := func() {
+		closeOnce.Do(func() {
+			closeDB(db)
+		})
+	}
+
+	return cs, closeFunction, nil
+}
+
+// NewClientStoreWithDB creates a client store on an already open database,
+// so it can be shared with the token store or application data.
+// config.DbName and config.BoltOptions are ignored and the close function doesn't close db
+func NewClientStoreWithDB(db *bolt.DB, config *Config) (*ClientStore, func(), error) {
+	if config.BucketName == "" {
+		return nil, nil, ErrBucketNameRequired
+	}
+
+	bucketName := []byte(config.BucketName)
+
+	err := createBuckets(db, bucketName)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cs := &ClientStore{
+		db:         db,
+		bucketName: bucketName,
+	}
+
+	return cs, func() {}, nil
+}
+
+// ClientStore client storage based on bbolt(https://github.com/etcd-io/bbolt)
+type ClientStore struct {
+	db         *bolt.DB
+	bucketName []byte
+}
+
+// GetByID according to the ID for the client information
+func (cs *ClientStore) GetByID(id string) (oauth2.ClientInfo, error) {
+	var client models.Client
+
+	err := cs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(cs.bucketName)
+
+		jv := bucket.Get([]byte(id))
+		if jv == nil {
+			return ErrClientNotFound
+		}
+
+		return json.Unmarshal(jv, &client)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &client, nil
+}
+
+// Set creates or replaces the client information
+func (cs *ClientStore) Set(id string, cli oauth2.ClientInfo) error {
+	jv, err := json.Marshal(&models.Client{
+		ID:     cli.GetID(),
+		Secret: cli.GetSecret(),
+		Domain: cli.GetDomain(),
+		UserID: cli.GetUserID(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if cs.db.IsReadOnly() {
+		return ErrReadOnly
+	}
+
+	return cs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(cs.bucketName)
+
+		return bucket.Put([]byte(id), jv)
+	})
+}
+
+// Delete removes the client information
+func (cs *ClientStore) Delete(id string) error {
+	if cs.db.IsReadOnly() {
+		return ErrReadOnly
+	}
+
+	return cs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(cs.bucketName)
+
+		return bucket.Delete([]byte(id))
+	})
+}
@@ -0,0 +1,168 @@
+package boltdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// newTestClientStore returns a client store on the database of config
+func newTestClientStore(t *testing.T, config Config) *ClientStore {
+	t.Helper()
+
+	cs, closeFn, err := NewClientStore(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeFn)
+
+	return cs
+}
+
+func TestClientStore(t *testing.T) {
+	web := &models.Client{ID: "web", Secret: "secret", Domain: "https://example.com", UserID: "alice"}
+
+	tests := []struct {
+		name string
+		// run changes the store before looking up the client
+		run  func(cs *ClientStore) error
+		want *models.Client
+	}{
+		{"missing", func(*ClientStore) error { return nil }, nil},
+		{"set", func(cs *ClientStore) error { return cs.Set("web", web) }, web},
+		{
+			"replace",
+			func(cs *ClientStore) error {
+				if err := cs.Set("web", web); err != nil {
+					return err
+				}
+
+				return cs.Set("web", &models.Client{ID: "web", Secret: "rotated"})
+			},
+			&models.Client{ID: "web", Secret: "rotated"},
+		},
+		{
+			"delete",
+			func(cs *ClientStore) error {
+				if err := cs.Set("web", web); err != nil {
+					return err
+				}
+
+				return cs.Delete("web")
+			},
+			nil,
+		},
+		{"delete missing", func(cs *ClientStore) error { return cs.Delete("web") }, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{DbName: filepath.Join(t.TempDir(), "oauth2.db"), BucketName: "oauthClients"}
+			cs := newTestClientStore(t, config)
+
+			if err := tt.run(cs); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := cs.GetByID("web")
+			if tt.want == nil {
+				if err != ErrClientNotFound {
+					t.Fatalf("GetByID = %v, %v, want ErrClientNotFound", info, err)
+				}
+
+				return
+			}
+
+			if err != nil || *info.(*models.Client) != *tt.want {
+				t.Fatalf("GetByID = %v, %v, want %v", info, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientStorePersists(t *testing.T) {
+	config := Config{DbName: filepath.Join(t.TempDir(), "oauth2.db"), BucketName: "oauthClients"}
+
+	cs, closeFn, err := NewClientStore(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.Set("web", &models.Client{ID: "web", Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	closeFn()
+
+	config.BoltOptions = &bolt.Options{ReadOnly: true}
+	cs = newTestClientStore(t, config)
+
+	if info, err := cs.GetByID("web"); err != nil || info.GetSecret() != "secret" {
+		t.Fatalf("GetByID = %v, %v, want the client set before reopening", info, err)
+	}
+
+	if err := cs.Set("cli", &models.Client{ID: "cli"}); err != ErrReadOnly {
+		t.Fatalf("Set = %v, want ErrReadOnly", err)
+	}
+
+	if err := cs.Delete("web"); err != ErrReadOnly {
+		t.Fatalf("Delete = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestClientStoreWithDB(t *testing.T) {
+	ts := newTestStore(t, Config{})
+
+	tests := []struct {
+		name       string
+		bucketName string
+		err        error
+	}{
+		{"no bucket name", "", ErrBucketNameRequired},
+		{"own bucket", "oauthClients", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, closeFn, err := NewClientStoreWithDB(ts.db, &Config{BucketName: tt.bucketName})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("NewClientStoreWithDB = %v, want %v", err, tt.err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			// the close function leaves the shared database open
+			closeFn()
+
+			if err := cs.Set("web", &models.Client{ID: "web"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := ts.GetByAccess("web"); err != ErrTokenNotFound {
+				t.Fatalf("GetByAccess = %v, want the client kept out of the tokens", err)
+			}
+		})
+	}
+}
+
+func TestClientStoreReadOnlyWithoutBucket(t *testing.T) {
+	dbName := filepath.Join(t.TempDir(), "oauth2.db")
+
+	// creates the database file without the clients bucket
+	_, closeFn, err := NewClientStore(&Config{DbName: dbName, BucketName: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closeFn()
+
+	_, _, err = NewClientStore(&Config{DbName: dbName, BucketName: "oauthClients", BoltOptions: &bolt.Options{ReadOnly: true}})
+	if !errors.Is(err, ErrBucketMissing) {
+		t.Fatalf("NewClientStore = %v, want ErrBucketMissing", err)
+	}
+}
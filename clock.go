@@ -0,0 +1,16 @@
+package boltdb
+
+import "time"
+
+// Clock tells the time used to expire tokens, so tests can control it
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+// Now returns the current time
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,144 @@
+// Command boltbench runs the workloads of the bench package, printing the results in the
+// format of go test -bench so two runs can be compared with benchstat
+//
+//	boltbench -count 6 > new.txt
+//	benchstat bench/testdata/baseline.txt new.txt
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	boltdb "github.com/naxhh/go-oauth2-boltdb"
+	"github.com/naxhh/go-oauth2-boltdb/bench"
+)
+
+// codecs are the codecs selectable with -codec
+var codecs = map[string]boltdb.Codec{
+	"json":    boltdb.JSONCodec,
+	"gob":     boltdb.GobCodec,
+	"msgpack": boltdb.MsgpackCodec,
+}
+
+// compressions are the compressions selectable with -compression
+var compressions = map[string]boltdb.Compression{
+	"none":   boltdb.NoCompression,
+	"gzip":   boltdb.GzipCompression,
+	"snappy": boltdb.SnappyCompression,
+}
+
+func main() {
+	err := run(os.Args[1:])
+
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "boltbench:", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the flags and runs the benchmarks count times
+func run(args []string) error {
+	flags := flag.NewFlagSet("boltbench", flag.ContinueOnError)
+	workloads := flags.String("workload", "", "comma separated workloads to run, all when empty")
+	concurrency := flags.String("conc", "1,8,64", "comma separated numbers of goroutines")
+	sizes := flags.String("sizes", "1000,100000", "comma separated numbers of token pairs stored before each benchmark")
+	codec := flags.String("codec", "json", "token codec: json, gob or msgpack")
+	compression := flags.String("compression", "none", "token compression: none, gzip or snappy")
+	batchWrites := flags.Bool("batch", false, "coalesce concurrent writes")
+	hashKeys := flags.Bool("hash-keys", false, "store hashed keys")
+	shards := flags.Int("shards", 0, "number of shards of the token bucket, not sharded when 1 or less")
+	count := flags.Int("count", 1, "number of runs, benchstat needs several to report the variance")
+	dir := flags.String("dir", "", "directory of the temporary databases")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	opts := bench.Options{
+		Config: boltdb.Config{
+			Codec:       codecs[*codec],
+			BatchWrites: *batchWrites,
+			HashKeys:    *hashKeys,
+			// the benchmark databases are temporary, the secret doesn't matter
+			HashKeysSecret: []byte("boltbench"),
+			Shards:         *shards,
+		},
+		Dir: *dir,
+	}
+
+	if opts.Config.Codec == nil {
+		return fmt.Errorf("unknown codec %q", *codec)
+	}
+
+	var ok bool
+
+	opts.Config.Compression, ok = compressions[*compression]
+	if !ok {
+		return fmt.Errorf("unknown compression %q", *compression)
+	}
+
+	if *workloads != "" {
+		for _, name := range strings.Split(*workloads, ",") {
+			workload, ok := findWorkload(name)
+			if !ok {
+				return fmt.Errorf("unknown workload %q", name)
+			}
+
+			opts.Workloads = append(opts.Workloads, workload)
+		}
+	}
+
+	opts.Concurrency, err = parseInts(*concurrency)
+	if err != nil {
+		return err
+	}
+
+	opts.Sizes, err = parseInts(*sizes)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < *count; i++ {
+		err = bench.Run(os.Stdout, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findWorkload returns the default workload named name
+func findWorkload(name string) (bench.Workload, bool) {
+	for _, workload := range bench.Workloads {
+		if strings.EqualFold(workload.Name, name) {
+			return workload, true
+		}
+	}
+
+	return bench.Workload{}, false
+}
+
+// parseInts parses a comma separated list of numbers
+func parseInts(list string) ([]int, error) {
+	var ints []int
+
+	for _, s := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", s)
+		}
+
+		ints = append(ints, n)
+	}
+
+	return ints, nil
+}
@@ -0,0 +1,243 @@
+// Command boltoauth inspects and manages a token database of go-oauth2-boltdb
+//
+//	boltoauth -db oauth2.db -bucket oauthTokens <command> [arguments]
+//
+// Commands:
+//
+//	list [-user id] [-client id] [-limit n]  lists the active tokens
+//	show <token>                             shows a code, access or refresh token
+//	delete <token>...                        deletes tokens and the tokens issued with them
+//	purge                                    deletes the expired tokens
+//	dump                                     writes all the active tokens as JSON
+//	stats                                    reports the database statistics
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	boltdb "github.com/naxhh/go-oauth2-boltdb"
+)
+
+// cliReason is the revocation reason of the tokens deleted by the tool
+const cliReason = "boltoauth"
+
+// commands run against the store, the ones that write open the database writable
+var commands = map[string]struct {
+	run   func(ts *boltdb.TokenStore, args []string, out io.Writer) error
+	write bool
+}{
+	"list":   {run: list},
+	"show":   {run: show},
+	"delete": {run: remove, write: true},
+	"purge":  {run: purge, write: true},
+	"dump":   {run: dump},
+	"stats":  {run: stats},
+}
+
+var errUsage = errors.New("usage: boltoauth -db file -bucket name <list|show|delete|purge|dump|stats> [arguments]")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "boltoauth:", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the global flags and runs the command
+func run(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("boltoauth", flag.ContinueOnError)
+	dbName := flags.String("db", "", "database file")
+	bucketName := flags.String("bucket", "oauthTokens", "token bucket name")
+	key := flags.String("key", "", "hex encoded encryption key, if the database is encrypted")
+	hashKeys := flags.Bool("hash-keys", false, "the database stores hashed keys")
+	hashKeysSecret := flags.String("hash-keys-secret", "", "hex encoded secret of the hashed keys, the encryption key when empty")
+	timeout := flags.Duration("timeout", time.Second, "time to wait for the database lock")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return errUsage
+	}
+
+	encryptionKey, err := hex.DecodeString(*key)
+	if err != nil {
+		return fmt.Errorf("invalid key: %v", err)
+	}
+
+	secret, err := hex.DecodeString(*hashKeysSecret)
+	if err != nil {
+		return fmt.Errorf("invalid hash keys secret: %v", err)
+	}
+
+	command, ok := commands[flags.Arg(0)]
+	if !ok {
+		return errUsage
+	}
+
+	config := &boltdb.Config{
+		DbName:         *dbName,
+		BucketName:     *bucketName,
+		BoltOptions:    &bolt.Options{Timeout: *timeout},
+		EncryptionKey:  encryptionKey,
+		HashKeys:       *hashKeys,
+		HashKeysSecret: secret,
+		// the tool never sweeps in the background
+		ExpiryStrategy: boltdb.LazyExpiry,
+		ReadOnly:       !command.write,
+	}
+
+	// the codec and shards are the ones the database was created with
+	err = config.LoadRecordedSettings()
+	if err != nil {
+		return err
+	}
+
+	store, closeStore, err := boltdb.NewTokenStore(config)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	return command.run(store.(*boltdb.TokenStore), flags.Args()[1:], out)
+}
+
+// list prints the active tokens, one per line
+func list(ts *boltdb.TokenStore, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	userID := flags.String("user", "", "only list the tokens of the user")
+	clientID := flags.String("client", "", "only list the tokens issued to the client")
+	limit := flags.Int("limit", 0, "maximum number of tokens, all when zero")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	opts := boltdb.ListOptions{UserID: *userID, ClientID: *clientID}
+
+	for {
+		infos, cursor, err := ts.ListTokens(opts)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			if *limit > 0 && count == *limit {
+				return nil
+			}
+
+			fmt.Fprintf(out, "user=%q client=%q code=%q access=%q refresh=%q\n",
+				info.GetUserID(), info.GetClientID(), info.GetCode(), info.GetAccess(), info.GetRefresh())
+			count++
+		}
+
+		if cursor == "" {
+			return nil
+		}
+
+		opts.Cursor = cursor
+	}
+}
+
+// show prints the introspection of a token as JSON
+func show(ts *boltdb.TokenStore, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: boltoauth show <token>")
+	}
+
+	result, err := ts.Introspect(args[0])
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(out, result)
+}
+
+// remove deletes the tokens, recording them on the revocation log when it's enabled
+func remove(ts *boltdb.TokenStore, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: boltoauth delete <token>...")
+	}
+
+	for _, token := range args {
+		err := ts.Revoke(token, cliReason)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "deleted %q\n", token)
+	}
+
+	return nil
+}
+
+// purge deletes the expired tokens
+func purge(ts *boltdb.TokenStore, args []string, out io.Writer) error {
+	n, err := ts.DeleteExpired()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "deleted %d expired keys\n", n)
+	return nil
+}
+
+// dump writes all the active tokens as a JSON array
+func dump(ts *boltdb.TokenStore, args []string, out io.Writer) error {
+	tokens := []interface{}{}
+	opts := boltdb.ListOptions{}
+
+	for {
+		infos, cursor, err := ts.ListTokens(opts)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			tokens = append(tokens, info)
+		}
+
+		if cursor == "" {
+			return writeJSON(out, tokens)
+		}
+
+		opts.Cursor = cursor
+	}
+}
+
+// stats prints the database statistics as JSON
+func stats(ts *boltdb.TokenStore, args []string, out io.Writer) error {
+	s, err := ts.Stats()
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(out, s)
+}
+
+// writeJSON writes v as indented JSON
+func writeJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
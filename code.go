@@ -0,0 +1,109 @@
+package boltdb
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3"
+)
+
+// newCodeStore opens the store of the authorization codes on config.CodeDbName, with its own cleaner
+func newCodeStore(config *Config) (*TokenStore, error) {
+	codeConfig := *config
+	codeConfig.DbName = config.CodeDbName
+	codeConfig.CodeDbName = ""
+	// the metrics of the store are registered under the same bucket name
+	codeConfig.MetricsRegisterer = nil
+
+	codes, _, err := newTokenStore(&codeConfig)
+
+	return codes, err
+}
+
+// ConsumeByCode returns the token information of the authorization code and deletes it on the
+// same transaction, so a code can only be redeemed once: replays get ErrTokenNotFound
+func (ts *TokenStore) ConsumeByCode(code string) (oauth2.TokenInfo, error) {
+	if ts.codes != nil {
+		return ts.codes.ConsumeByCode(code)
+	}
+
+	return ts.decode(ts.consume(context.Background(), ts.tokenKey(code)))
+}
+
+// createCodeBatch stores the authorization codes of infos on the code store and the rest on ts,
+// merging the errors of both batches by their index on infos
+func (ts *TokenStore) createCodeBatch(infos []oauth2.TokenInfo) error {
+	var codes, pairs []oauth2.TokenInfo
+	var codeIndexes, pairIndexes []int
+
+	for i, info := range infos {
+		if info.GetCode() != "" {
+			codes = append(codes, info)
+			codeIndexes = append(codeIndexes, i)
+		} else {
+			pairs = append(pairs, info)
+			pairIndexes = append(pairIndexes, i)
+		}
+	}
+
+	batchErr := BatchError{}
+
+	for _, batch := range []struct {
+		store   *TokenStore
+		infos   []oauth2.TokenInfo
+		indexes []int
+	}{
+		{ts.codes, codes, codeIndexes},
+		{ts, pairs, pairIndexes},
+	} {
+		if len(batch.infos) == 0 {
+			continue
+		}
+
+		err := batch.store.createBatch(batch.infos)
+
+		storeErr, ok := err.(BatchError)
+		if err != nil && !ok {
+			return err
+		}
+
+		for i, err := range storeErr {
+			batchErr[batch.indexes[i]] = err
+		}
+	}
+
+	if len(batchErr) > 0 {
+		return batchErr
+	}
+
+	return nil
+}
+
+// consume returns the decrypted token information of the code key and deletes it inside
+// a single write transaction. Expired codes return ErrTokenExpired and are left to the sweep
+func (ts *TokenStore) consume(ctx context.Context, key []byte) ([]byte, error) {
+	var sealed []byte
+
+	err := ts.update(ctx, func(tx *bolt.Tx) error {
+		value := ts.tokenBucket(tx).Get(key)
+		if value == nil {
+			return ErrTokenNotFound
+		}
+
+		if ts.ttlBuckets(tx).expired(key, ts.clock.Now()) {
+			return ErrTokenExpired
+		}
+
+		// values are only valid during the transaction
+		sealed = append([]byte(nil), value...)
+
+		return ts.deleteKeys(tx, ReasonConsumed, key)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ts.cipher.open(sealed)
+}
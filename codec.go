@@ -0,0 +1,127 @@
+package boltdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes the token information before it is stored.
+// Changing the codec of an existing database makes its tokens unreadable
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes with encoding/json, it is the default codec
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes with encoding/gob
+	GobCodec Codec = gobCodec{}
+	// MsgpackCodec encodes with msgpack(https://github.com/vmihailenco/msgpack)
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+// codecKey is the key of the name of the codec on the meta bucket
+var codecKey = []byte("codec")
+
+// codecName returns the name of codec recorded on the meta bucket.
+// Codecs other than the ones of the package are named by their type
+func codecName(codec Codec) string {
+	if c, ok := codec.(encodingCodec); ok {
+		codec = c.codec
+	}
+
+	switch codec {
+	case JSONCodec:
+		return "json"
+	case GobCodec:
+		return "gob"
+	case MsgpackCodec:
+		return "msgpack"
+	}
+
+	return fmt.Sprintf("%T", codec)
+}
+
+// codecNamed returns the codec of the package recorded as name, false when it's not one of them
+func codecNamed(name string) (Codec, bool) {
+	for _, codec := range []Codec{JSONCodec, GobCodec, MsgpackCodec} {
+		if codecName(codec) == name {
+			return codec, true
+		}
+	}
+
+	return nil, false
+}
+
+type jsonCodec struct{}
+
+// Marshal encodes v as JSON
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes JSON data into v
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+// Marshal encodes v as gob
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes gob data into v
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+// Marshal encodes v as msgpack
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal decodes msgpack data into v
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// encodingCodec wraps the errors of a codec with ErrEncoding
+type encodingCodec struct {
+	codec Codec
+}
+
+// Marshal encodes v with the codec
+func (c encodingCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEncoding, err)
+	}
+
+	return data, nil
+}
+
+// Unmarshal decodes data into v with the codec
+func (c encodingCodec) Unmarshal(data []byte, v interface{}) error {
+	err := c.codec.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrEncoding, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package boltdb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+var testCodecs = []struct {
+	name  string
+	codec Codec
+}{
+	{"json", JSONCodec},
+	{"gob", GobCodec},
+	{"msgpack", MsgpackCodec},
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	token := benchPair("", 1)
+	token.AccessCreateAt = token.AccessCreateAt.UTC().Truncate(time.Microsecond)
+	token.RefreshCreateAt = token.AccessCreateAt
+
+	for _, tt := range testCodecs {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.codec.Marshal(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded models.Token
+
+			err = tt.codec.Unmarshal(data, &decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded.AccessCreateAt = decoded.AccessCreateAt.UTC()
+			decoded.RefreshCreateAt = decoded.RefreshCreateAt.UTC()
+
+			if !reflect.DeepEqual(&decoded, token) {
+				t.Fatalf("decoded %+v, want %+v", decoded, *token)
+			}
+		})
+	}
+}
+
+func TestCodecsStoreTokens(t *testing.T) {
+	for _, tt := range testCodecs {
+		t.Run(tt.name, func(t *testing.T) {
+			checkCreateGetRemove(t, newTestStore(t, Config{Codec: tt.codec}))
+		})
+	}
+}
+
+func TestCodecErrorsAreEncodingErrors(t *testing.T) {
+	for _, tt := range testCodecs {
+		t.Run(tt.name, func(t *testing.T) {
+			var token models.Token
+
+			err := (encodingCodec{tt.codec}).Unmarshal([]byte{0xc1, 0xff}, &token)
+			if !errors.Is(err, ErrEncoding) {
+				t.Fatalf("Unmarshal = %v, want ErrEncoding", err)
+			}
+		})
+	}
+}
+
+func BenchmarkCodecMarshal(b *testing.B) {
+	token := benchPair("", 1)
+
+	for _, tt := range testCodecs {
+		b.Run(tt.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := tt.codec.Marshal(token); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCodecUnmarshal(b *testing.B) {
+	token := benchPair("", 1)
+
+	for _, tt := range testCodecs {
+		b.Run(tt.name, func(b *testing.B) {
+			data, err := tt.codec.Marshal(token)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportMetric(float64(len(data)), "bytes")
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				var decoded models.Token
+				if err := tt.codec.Unmarshal(data, &decoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCodecGetByAccess(b *testing.B) {
+	for _, tt := range testCodecs {
+		b.Run(tt.name, func(b *testing.B) {
+			ts := newTestStore(b, Config{
+				Codec:          tt.codec,
+				ExpiryStrategy: LazyExpiry,
+				BoltOptions:    &bolt.Options{NoSync: true},
+			})
+
+			fillStore(b, ts, 1000)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := ts.GetByAccess("access-" + strconv.Itoa(i%1000)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMsgpackBasicIDsAreNotTokenInformation(t *testing.T) {
+	// msgpack decodes values starting with these bytes into empty tokens without failing
+	for _, prefix := range []byte{0x80, 0x90, 0xc0} {
+		t.Run(fmt.Sprintf("%#x", prefix), func(t *testing.T) {
+			ts := newTestStore(t, Config{
+				Codec:          MsgpackCodec,
+				ExpiryStrategy: LazyExpiry,
+				IDGenerator: func() []byte {
+					return append([]byte{prefix}, randomUUID()[1:]...)
+				},
+			})
+
+			err := ts.Create(benchPair("", 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := ts.Vacuum()
+			if err != nil || report != (VacuumReport{}) {
+				t.Fatalf("Vacuum = %+v, %v, want nothing removed", report, err)
+			}
+
+			err = ts.RebuildTTLIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			infos, _, err := ts.ListTokens(ListOptions{})
+			if err != nil || len(infos) != 1 || infos[0].GetAccess() != "access-1" {
+				t.Fatalf("ListTokens = %v, %v, want the stored pair", infos, err)
+			}
+
+			info, err := ts.GetByAccess("access-1")
+			if err != nil || info == nil || info.GetRefresh() != "refresh-1" {
+				t.Fatalf("GetByAccess = %v, %v, want the stored pair", info, err)
+			}
+
+			expiry, _ := expiryOf(t, ts, ts.tokenKey("access-1"))
+			if !expiry.After(time.Now().Add(30 * time.Minute)) {
+				t.Fatalf("access expires at %s after rebuilding the TTL index, want in an hour", expiry)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package boltdb
+
+import (
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxMaxSize is the number of bytes copied per transaction while compacting,
+// the same default of the bbolt command
+const compactTxMaxSize = 65536
+
+// Compact writes a copy of the whole database without free pages to destPath, which
+// must not exist. It runs on a read transaction, so the store keeps working while it runs.
+// Replace the database file with the copy while it's closed to reclaim the space.
+// The copy is created with Config.FileMode
+func (ts *TokenStore) Compact(destPath string) error {
+	return compact(ts.db, destPath, ts.fileMode)
+}
+
+// compact copies src to a new database on destPath, created with mode
+func compact(src *bolt.DB, destPath string, mode os.FileMode) error {
+	if _, err := os.Stat(destPath); err == nil {
+		return &os.PathError{Op: "compact", Path: destPath, Err: os.ErrExist}
+	}
+
+	dst, err := bolt.Open(destPath, mode, nil)
+	if err != nil {
+		return err
+	}
+
+	err = bolt.Compact(dst, src, compactTxMaxSize)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(destPath)
+		return err
+	}
+
+	return nil
+}
+
+// freeRatio returns the fraction of the database file taken by free pages
+func freeRatio(db *bolt.DB) (float64, error) {
+	var size int64
+
+	err := db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+
+	if err != nil || size == 0 {
+		return 0, err
+	}
+
+	free := int64(db.Stats().FreePageN) * int64(db.Info().PageSize)
+
+	return float64(free) / float64(size), nil
+}
+
+// openCompacted opens the database of config, compacting it first when
+// the free pages take more than config.CompactFreeRatio of the file
+func openCompacted(config *Config) (*bolt.DB, error) {
+	db, err := openRecovering(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CompactFreeRatio <= 0 || db.IsReadOnly() {
+		return db, nil
+	}
+
+	ratio, err := freeRatio(db)
+	if err != nil {
+		closeDB(db)
+		return nil, err
+	}
+
+	if ratio <= config.CompactFreeRatio {
+		return db, nil
+	}
+
+	path := config.dbPath()
+	tmpPath := path + ".compact"
+	os.Remove(tmpPath)
+
+	err = compact(db, tmpPath, config.fileMode())
+	if err != nil {
+		closeDB(db)
+		return nil, err
+	}
+
+	closeDB(db)
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	config.logger().Printf("boltdb: compacted %s, %.0f%% of it was free", path, ratio*100)
+
+	return openDB(path, config.fileMode(), config.boltOptions())
+}
@@ -0,0 +1,55 @@
+package boltdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompactUsesTheFileMode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"default", 0},
+		{"configured", 0640},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			store, closeFn, err := NewTokenStore(&Config{
+				DbName:     filepath.Join(dir, "oauth2.db"),
+				BucketName: "oauthTokens",
+				FileMode:   tt.mode,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+
+			dest := filepath.Join(dir, "compacted.db")
+
+			err = store.(*TokenStore).Compact(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// both files are created with the mode, less the umask
+			want, err := os.Stat(filepath.Join(dir, "oauth2.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.Stat(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Mode().Perm() != want.Mode().Perm() {
+				t.Fatalf("mode = %o, want %o", got.Mode().Perm(), want.Mode().Perm())
+			}
+		})
+	}
+}
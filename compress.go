@@ -0,0 +1,86 @@
+package boltdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// Compression compresses the token information before it is encrypted and stored
+type Compression int
+
+const (
+	// NoCompression stores the token information as encoded by the codec. It's the default
+	NoCompression Compression = iota
+	// GzipCompression compresses with gzip, smaller but slower than snappy
+	GzipCompression
+	// SnappyCompression compresses with the framing format of snappy
+	SnappyCompression
+)
+
+// compressedMarker starts every compressed value, followed by the Compression it was compressed
+// with. No codec output starts with a zero byte, so values stored as is are never taken for it
+const compressedMarker = 0x00
+
+// compress compresses plain, keeping it as is when compressing doesn't make it smaller
+func (c Compression) compress(plain []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	buf.Write([]byte{compressedMarker, byte(c)})
+
+	switch c {
+	case GzipCompression:
+		w = gzip.NewWriter(&buf)
+	case SnappyCompression:
+		w = snappy.NewBufferedWriter(&buf)
+	default:
+		return plain, nil
+	}
+
+	_, err := w.Write(plain)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if buf.Len() >= len(plain) {
+		return plain, nil
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompress decompresses a value stored by compress, whatever the configured compression,
+// so it can be changed on an existing database. Values without the marker are returned as is
+func decompress(value []byte) ([]byte, error) {
+	if len(value) < 2 || value[0] != compressedMarker {
+		return value, nil
+	}
+
+	var r io.Reader
+	stream := bytes.NewReader(value[2:])
+
+	switch Compression(value[1]) {
+	case GzipCompression:
+		zr, err := gzip.NewReader(stream)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		r = zr
+	case SnappyCompression:
+		r = snappy.NewReader(stream)
+	default:
+		return nil, fmt.Errorf("%w: unknown compression %d", ErrEncoding, value[1])
+	}
+
+	return io.ReadAll(r)
+}
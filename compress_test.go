@@ -0,0 +1,90 @@
+package boltdb
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestCompressRoundTrips(t *testing.T) {
+	plain := []byte(strings.Repeat(`{"Scope":"read write"}`, 20))
+
+	tests := []struct {
+		name        string
+		compression Compression
+	}{
+		{"none", NoCompression},
+		{"gzip", GzipCompression},
+		{"snappy", SnappyCompression},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, err := tt.compression.compress(plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// values are only marked when compressing made them smaller
+			marked := compressed[0] == compressedMarker
+			if smaller := len(compressed) < len(plain); marked != smaller {
+				t.Fatalf("marked = %v, want %v", marked, smaller)
+			}
+
+			if tt.compression == GzipCompression && !marked {
+				t.Fatal("gzip didn't compress a repetitive value")
+			}
+
+			got, err := decompress(compressed)
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Fatalf("decompress = %q, %v, want %q", got, err, plain)
+			}
+		})
+	}
+}
+
+func TestDecompressOnlyMarkedValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+		err   error
+	}{
+		{"gzip magic", []byte{0x1f, 0x8b, 0x08, 0x00}, nil},
+		{"snappy magic", []byte("\xff\x06\x00\x00sNaPpY"), nil},
+		{"short", []byte{compressedMarker}, nil},
+		{"unknown compression", []byte{compressedMarker, 9, 1, 2}, ErrEncoding},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decompress(tt.value)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("decompress error = %v, want %v", err, tt.err)
+			}
+
+			if tt.err == nil && !bytes.Equal(got, tt.value) {
+				t.Fatalf("decompress = %q, want the value as is", got)
+			}
+		})
+	}
+}
+
+func TestCodecOutputIsNeverMarked(t *testing.T) {
+	codecs := map[string]Codec{"json": JSONCodec, "gob": GobCodec, "msgpack": MsgpackCodec}
+
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			jv, err := codec.Marshal(&models.Token{ClientID: "client", Access: "access"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if jv[0] == compressedMarker {
+				t.Fatalf("%s output starts with the compressed marker", name)
+			}
+		})
+	}
+}
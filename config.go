@@ -1,6 +1,493 @@
 package boltdb
 
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// DefaultCleanupInterval is the maximum time between two sweeps of expired keys
+	DefaultCleanupInterval = 30 * time.Second
+	// DefaultCleanupBatchSize is the maximum number of keys deleted on a single transaction
+	DefaultCleanupBatchSize = 1000
+	// DefaultUsageFlushInterval is the maximum time the uses of access tokens are kept in memory
+	DefaultUsageFlushInterval = 10 * time.Second
+	// DefaultCachePreloadBudget is the maximum time spent preloading the cache when a store is opened
+	DefaultCachePreloadBudget = time.Second
+)
+
 type Config struct {
 	DbName     string
 	BucketName string
+
+	// CleanupInterval is the maximum time between two sweeps. Defaults to DefaultCleanupInterval
+	CleanupInterval time.Duration
+	// CleanupBatchSize is the maximum number of expired keys deleted per transaction.
+	// Defaults to DefaultCleanupBatchSize
+	CleanupBatchSize int
+	// SweepIOLimit spreads the deletes of a sweep over small transactions with pauses between
+	// them, so reads keep a stable latency on slow disks while it runs. Unlimited when zero
+	SweepIOLimit SweepIOLimit
+	// VacuumInterval runs Vacuum from the cleaner this often, e.g. weekly. Disabled when zero
+	VacuumInterval time.Duration
+	// ShardTTLByDay stores the TTL entries on a bucket per expiration day, so sweeps only
+	// open the days already due and empty days are dropped as a whole. It can be changed
+	// at any time, the entries stored before are still swept
+	ShardTTLByDay bool
+	// Shards splits the token bucket, and the TTL buckets with it, on this many nested buckets
+	// by the hash of the key, so writes touch smaller B+trees. Not sharded when it's 1 or less.
+	// It's fixed when the bucket is created: opening a bucket with tokens with another number
+	// fails with ErrShardsMismatch
+	Shards int
+
+	// BoltOptions are passed to bolt.Open, use them to set a lock Timeout
+	// instead of waiting forever when another process holds the file.
+	// When ReadOnly is set buckets must already exist and the cleaner is not started
+	BoltOptions *bolt.Options
+
+	// OnCorruption decides what to do when the database file is corrupted: fail, the default,
+	// recreate it empty or restore a backup. See FailOnCorruption, RecreateOnCorruption and
+	// RestoreOnCorruption. When set the whole file is checked when opened
+	OnCorruption CorruptionPolicy
+
+	// FileMode is the mode of the database file when it's created. Defaults to 0600
+	FileMode os.FileMode
+
+	// DirMode is the mode of the missing directories of DbName, created when the store opens it
+	// writable. Defaults to 0700
+	DirMode os.FileMode
+
+	// CodeDbName stores the authorization codes on their own database file, with their own
+	// cleaner, so their churn doesn't fragment the file of the long-lived token pairs.
+	// It must differ from DbName. Ignored by NewTokenStoreWithDB
+	CodeDbName string
+
+	// ReadOnly opens the database read-only, e.g. for analytics tooling, so other processes
+	// can open it read-only too. Buckets must already exist, the cleaner is not started
+	// and writes return ErrReadOnly
+	ReadOnly bool
+
+	// EncryptionKey enables encryption at rest when set. It must be a 16, 24 or 32 bytes
+	// AES key. Token information is encrypted with AES-GCM and the code, access and
+	// refresh keys are stored as HMAC-SHA256. Use RotateEncryptionKey to change it
+	EncryptionKey []byte
+
+	// DeleteExpiredOnRead deletes the expired keys found while reading
+	// instead of waiting for the cleaner to sweep them
+	DeleteExpiredOnRead bool
+
+	// NilOnNotFound makes the Get methods return a nil token and a nil error for
+	// missing tokens, like the go-oauth2 stores do, instead of ErrTokenNotFound
+	NilOnNotFound bool
+
+	// MetricsRegisterer registers prometheus metrics of the store operations,
+	// the cleaner and the database size when set
+	MetricsRegisterer prometheus.Registerer
+
+	// TracerProvider traces the creates, reads, removals and sweeps of the store on OpenTelemetry
+	// spans when set. Spans are children of the span of the context given to ContextTokenStore
+	TracerProvider trace.TracerProvider
+
+	// Logger receives the errors that can't be returned to the caller, like the
+	// ones of the cleaner, and sweep statistics. Nothing is logged by default
+	Logger Logger
+
+	// OnError is called with the storage errors, so they can reach the alerting, including the
+	// ones that can't be returned to the caller, like the ones of the cleaner. op is "create",
+	// "remove", "sweep", "vacuum", "flush_usage", "backup" or, for replicas, "reload"
+	OnError func(op string, err error)
+
+	// IDGenerator generates the basic IDs the token pairs are stored under.
+	// Defaults to random version 4 UUIDs read from crypto/rand
+	IDGenerator IDGenerator
+
+	// Codec encodes the token information. Defaults to JSONCodec
+	Codec Codec
+
+	// Compression compresses the token information before it is encrypted and stored.
+	// Compressed values are marked and decompressed whatever the setting, so it can be changed
+	// on an existing database
+	Compression Compression
+
+	// BatchWrites coalesces concurrent creates and removes on shared transactions with
+	// bolt's DB.Batch, trading a few milliseconds of latency for throughput.
+	// Tune it with the MaxBatchDelay and MaxBatchSize fields of bolt.DB
+	BatchWrites bool
+
+	// KeyHasher stores a hash of the code, access and refresh tokens as keys instead of the
+	// tokens, e.g. SHA256KeyHasher for JWT access tokens. Must not change once tokens are stored
+	KeyHasher KeyHasher
+
+	// HashKeys stores the HMAC-SHA256 of the code, access and refresh tokens as keys, so the
+	// tokens can't be replayed from the keys of the database file. Token information values
+	// still contain the tokens, set EncryptionKey too to keep them out of the file.
+	// Keys are already hashed when EncryptionKey is set. Must not change once tokens are stored
+	HashKeys bool
+
+	// HashKeysSecret is the HMAC key of HashKeys, keep it out of the database file.
+	// Defaults to EncryptionKey, one of them is required with HashKeys
+	HashKeysSecret []byte
+
+	// RevocationRetention enables the revocation log when set: removed tokens leave a tombstone,
+	// kept for this long, with the hash of their key, the reason and when they were removed.
+	// Read it with ListRevocations
+	RevocationRetention time.Duration
+
+	// ChangeRetention enables the change log when set: every code and token pair stored,
+	// removed or expired appends an event, with hashes of the keys, kept for this long.
+	// Other stores and processes on the database read it with Watch
+	ChangeRetention time.Duration
+	// WatchInterval is how often Watch polls the change log. Defaults to DefaultWatchInterval
+	WatchInterval time.Duration
+
+	// Audit enables the audit log: the issuance and revocation of every code and token pair is
+	// appended to a hash chained log, with hashes of the tokens. The chain is keyed with
+	// HashKeysSecret or EncryptionKey, set one of them. Export it with ExportAudit
+	Audit bool
+
+	// Hooks are called when tokens are created, removed or expired
+	Hooks Hooks
+
+	// CacheSize caches up to this number of decoded token information in memory, evicting
+	// the least recently used. Entries are invalidated when their tokens are removed or
+	// expire. Disabled when zero. Don't enable it when other processes write the database
+	CacheSize int
+	// CachePreload loads up to this number of the most recently created access tokens into
+	// the cache when the store is opened, so the first requests after a restart don't read
+	// the database. It needs CacheSize, which also caps it
+	CachePreload int
+	// CachePreloadBudget stops the preload after this long. Defaults to DefaultCachePreloadBudget
+	CachePreloadBudget time.Duration
+
+	// CompactFreeRatio compacts the database when it's opened if free pages take more than
+	// this fraction of the file, e.g. 0.5, since bolt files never shrink. Disabled when zero
+	CompactFreeRatio float64
+
+	// TrackUsage records when access tokens were last read with GetByAccess and how many times,
+	// for GetUsageByAccess and RevokeIdleSince. Uses are buffered in memory and written every
+	// UsageFlushInterval, so some are lost if the process crashes. Ignored when ReadOnly is set
+	TrackUsage bool
+	// UsageFlushInterval is how often the uses are written. Defaults to DefaultUsageFlushInterval
+	UsageFlushInterval time.Duration
+
+	// RefreshGracePeriod keeps refresh tokens usable for this long after they expire, so
+	// clock drift or a refresh racing the cleaner doesn't log users out. Access tokens still
+	// expire on time. It applies to the tokens created once it's set
+	RefreshGracePeriod time.Duration
+
+	// TTLOverrides caps the TTL of the tokens by the grant type they were issued with, like
+	// "client_credentials", whatever expiration the manager set. Tokens without expiration get it.
+	// oauth2.v3 doesn't store the grant type, so it's inferred like AuditEntry.GrantType does.
+	// It applies to the tokens created once it's set
+	TTLOverrides map[string]time.Duration
+
+	// ConsumeCodes makes GetByCode delete the authorization code on the same transaction,
+	// like ConsumeByCode, so replayed codes fail even before RemoveByCode is called
+	ConsumeCodes bool
+
+	// MaxTokensPerUser and MaxTokensPerClient cap the token pairs of a user or a client, like
+	// concurrent sessions. Authorization codes and expired token pairs don't count. Zero means
+	// no limit. QuotaPolicy decides what creating one more does, rejecting it by default
+	MaxTokensPerUser   int
+	MaxTokensPerClient int
+	QuotaPolicy        QuotaPolicy
+
+	// CacheExpiryForecast reuses the results of ExpiryForecast until the next sweep
+	CacheExpiryForecast bool
+
+	// OnRefreshReuse is called when GetByRefresh is given a refresh token exchanged with
+	// RotateRefresh, which usually means it was stolen. Returning true revokes the current
+	// tokens of the family, as OAuth 2.1 recommends. GetByRefresh returns ErrRefreshTokenReused
+	OnRefreshReuse func(reuse RefreshReuse) bool
+
+	// Clock tells the time tokens are created and expire at. Defaults to the wall clock,
+	// tests can set a testutil.FakeClock to expire tokens without sleeping
+	Clock Clock
+
+	// ExpiryStrategy decides when expired tokens are deleted. Defaults to SweepExpiry
+	ExpiryStrategy ExpiryStrategy
+
+	// CleanerContext is passed to the expiry strategy, the cleaner of SweepExpiry stops
+	// after a final sweep when it is done. Defaults to context.Background, so the
+	// cleaner runs until the store is closed
+	CleanerContext context.Context
+}
+
+// reservedBucketSuffixes are the suffixes of the buckets derived from Config.BucketName
+var reservedBucketSuffixes = []string{
+	"-ttl",
+	"-ttl-index",
+	"-user-index",
+	"-client-index",
+	"-scope-index",
+	"-created-index",
+	"-revocations",
+	"-revocations-index",
+	"-audit",
+	"-changes",
+	"-meta",
+	"-metadata",
+	"-usage",
+	"-rotated",
+	"-devices",
+	"-user-codes",
+	"-challenges",
+	"-sessions",
+	"-session-members",
+	"-consents",
+	clientBucketSuffix,
+}
+
+// Validate checks the config before opening a database
+func (c *Config) Validate() error {
+	if c.DbName == "" {
+		return ErrDbNameRequired
+	}
+
+	if c.CodeDbName == c.DbName {
+		return ErrCodeDbNameConflict
+	}
+
+	return c.validateWithDB()
+}
+
+// validateWithDB checks the fields still used when the database is already open: the bucket
+// name and the secret of HashKeys
+func (c *Config) validateWithDB() error {
+	if c.HashKeys && len(c.hashKeysSecret()) == 0 {
+		return ErrHashKeysSecretRequired
+	}
+
+	if c.BucketName == "" {
+		return ErrBucketNameRequired
+	}
+
+	if strings.HasPrefix(c.BucketName, tenantBucketPrefix) {
+		return ErrBucketNameReserved
+	}
+
+	if hasReservedSuffix(c.BucketName) {
+		return ErrBucketNameReserved
+	}
+
+	return nil
+}
+
+// hasReservedSuffix reports if name ends like the buckets derived from a bucket name
+func hasReservedSuffix(name string) bool {
+	for _, suffix := range reservedBucketSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// boltOptions returns BoltOptions, read-only when ReadOnly is set
+func (c *Config) boltOptions() *bolt.Options {
+	if !c.ReadOnly {
+		return c.BoltOptions
+	}
+
+	options := bolt.Options{}
+	if c.BoltOptions != nil {
+		options = *c.BoltOptions
+	}
+	options.ReadOnly = true
+
+	return &options
+}
+
+// forecastCache returns the cache of the expiry forecasts, nil when they are not cached
+func (c *Config) forecastCache() *forecastCache {
+	if !c.CacheExpiryForecast {
+		return nil
+	}
+
+	return &forecastCache{}
+}
+
+// dbPath returns DbName with the separators of the OS, so slash separated paths, like the ones
+// of io/fs, also work on Windows
+func (c *Config) dbPath() string {
+	return filepath.FromSlash(c.DbName)
+}
+
+// fileMode returns the configured mode of the database file or the default one
+func (c *Config) fileMode() os.FileMode {
+	if c.FileMode == 0 {
+		return 0600
+	}
+
+	return c.FileMode
+}
+
+// createDir creates the missing directories of the database file with DirMode,
+// unless it's opened read-only and must already exist
+func (c *Config) createDir() error {
+	if c.ReadOnly || (c.BoltOptions != nil && c.BoltOptions.ReadOnly) {
+		return nil
+	}
+
+	mode := c.DirMode
+	if mode == 0 {
+		mode = 0700
+	}
+
+	return os.MkdirAll(filepath.Dir(c.dbPath()), mode)
+}
+
+// shards returns the number of shards of the token bucket, 0 when it's not sharded
+func (c *Config) shards() int {
+	if c.Shards <= 1 {
+		return 0
+	}
+
+	return c.Shards
+}
+
+// cleanupInterval returns the configured sweep interval or the default one
+func (c *Config) cleanupInterval() time.Duration {
+	if c.CleanupInterval <= 0 {
+		return DefaultCleanupInterval
+	}
+
+	return c.CleanupInterval
+}
+
+// cachePreloadBudget returns the configured cache preload budget or the default one
+func (c *Config) cachePreloadBudget() time.Duration {
+	if c.CachePreloadBudget <= 0 {
+		return DefaultCachePreloadBudget
+	}
+
+	return c.CachePreloadBudget
+}
+
+// watchInterval returns the configured change log polling interval or the default one
+func (c *Config) watchInterval() time.Duration {
+	if c.WatchInterval <= 0 {
+		return DefaultWatchInterval
+	}
+
+	return c.WatchInterval
+}
+
+// cleanupBatchSize returns the configured sweep batch size or the default one
+func (c *Config) cleanupBatchSize() int {
+	if c.CleanupBatchSize <= 0 {
+		return DefaultCleanupBatchSize
+	}
+
+	return c.CleanupBatchSize
+}
+
+// cleanerContext returns the context of the cleaner or context.Background when not set
+func (c *Config) cleanerContext() context.Context {
+	if c.CleanerContext == nil {
+		return context.Background()
+	}
+
+	return c.CleanerContext
+}
+
+// expiryStrategy returns the expiry strategy or SweepExpiry when not set
+func (c *Config) expiryStrategy() ExpiryStrategy {
+	if c.ExpiryStrategy == nil {
+		return SweepExpiry
+	}
+
+	return c.ExpiryStrategy
+}
+
+// keyHasher returns KeyHasher, hashed with HMAC-SHA256 when HashKeys is set
+func (c *Config) keyHasher() KeyHasher {
+	if c.HashKeys {
+		return hmacKeyHasher(c.KeyHasher, c.hashKeysSecret())
+	}
+
+	return c.KeyHasher
+}
+
+// hashKeysSecret returns HashKeysSecret or EncryptionKey when it's not set
+func (c *Config) hashKeysSecret() []byte {
+	if len(c.HashKeysSecret) == 0 {
+		return c.EncryptionKey
+	}
+
+	return c.HashKeysSecret
+}
+
+// auditKey returns the HMAC key of the audit log chain, derived from HashKeysSecret or
+// EncryptionKey, or nil when neither is set
+func (c *Config) auditKey() []byte {
+	secret := c.hashKeysSecret()
+	if len(secret) == 0 {
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("go-oauth2-boltdb audit"))
+
+	return mac.Sum(nil)
+}
+
+// logger returns the configured logger or one that discards everything
+func (c *Config) logger() Logger {
+	if c.Logger == nil {
+		return nopLogger{}
+	}
+
+	return c.Logger
+}
+
+// usageTracker returns a usage tracker when usage tracking is enabled on a writable database
+func (c *Config) usageTracker(db *bolt.DB) *usageTracker {
+	if !c.TrackUsage || db.IsReadOnly() {
+		return nil
+	}
+
+	interval := c.UsageFlushInterval
+	if interval <= 0 {
+		interval = DefaultUsageFlushInterval
+	}
+
+	return newUsageTracker(interval)
+}
+
+// clock returns the configured clock or the wall clock
+func (c *Config) clock() Clock {
+	if c.Clock == nil {
+		return realClock{}
+	}
+
+	return c.Clock
+}
+
+// idGenerator returns the configured ID generator or the random UUID one
+func (c *Config) idGenerator() IDGenerator {
+	if c.IDGenerator == nil {
+		return randomUUID
+	}
+
+	return c.IDGenerator
+}
+
+// codec returns the configured codec or the JSON one
+func (c *Config) codec() Codec {
+	if c.Codec == nil {
+		return encodingCodec{JSONCodec}
+	}
+
+	return encodingCodec{c.Codec}
 }
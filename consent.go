@@ -0,0 +1,234 @@
+package boltdb
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// consentKeyPrefix is the prefix of the consent keys, so they don't collide with the token
+// keys sharing the TTL buckets
+var consentKeyPrefix = []byte("consent:")
+
+// Consent records the scopes a user approved for a client on the consent screen
+type Consent struct {
+	UserID   string
+	ClientID string
+	// Scopes are sorted and unique
+	Scopes    []string
+	GrantedAt time.Time
+	// ExpiresAt is when the user has to approve the scopes again, zero when never
+	ExpiresAt time.Time
+}
+
+// Covers reports if the consent approved every scope of scope, separated by spaces as in OAuth 2.0
+func (c *Consent) Covers(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		i := sort.SearchStrings(c.Scopes, s)
+		if i == len(c.Scopes) || c.Scopes[i] != s {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ConsentStore stores the consents of the users to the clients. It shares the database and
+// the cleaner of a token store, expired consents are swept with its tokens
+type ConsentStore struct {
+	ts *TokenStore
+}
+
+// NewConsentStore creates a consent store on the database of ts
+func NewConsentStore(ts *TokenStore) *ConsentStore {
+	return &ConsentStore{ts: ts}
+}
+
+// consentKey returns the key of the consent of userID to clientID. The ids are keyed
+// with the cipher, like the values of the user and client indexes
+func consentKey(c *tokenCipher, userID, clientID string) []byte {
+	key := append([]byte(nil), consentKeyPrefix...)
+	key = append(key, c.key(userID)...)
+	key = append(key, indexSeparator)
+
+	return append(key, c.key(clientID)...)
+}
+
+// SaveConsent records that userID approved scopes for clientID, on top of the scopes
+// approved before, which expire with them after expiresIn. Zero never expires
+func (cs *ConsentStore) SaveConsent(userID, clientID string, scopes []string, expiresIn time.Duration) error {
+	key := consentKey(cs.ts.cipher, userID, clientID)
+
+	return cs.ts.update(context.Background(), func(tx *bolt.Tx) error {
+		consent, err := cs.get(tx, key)
+		if err == ErrTokenNotFound || err == ErrTokenExpired {
+			consent, err = &Consent{UserID: userID, ClientID: clientID}, nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		now := cs.ts.clock.Now()
+		consent.Scopes = mergeScopes(consent.Scopes, scopes)
+		consent.GrantedAt = now
+		consent.ExpiresAt = time.Time{}
+
+		if expiresIn > 0 {
+			consent.ExpiresAt = now.Add(expiresIn)
+		}
+
+		err = cs.put(tx, key, consent)
+		if err != nil {
+			return err
+		}
+
+		ttl := cs.ts.ttlBuckets(tx)
+		if consent.ExpiresAt.IsZero() {
+			return ttl.remove(key)
+		}
+
+		return ttl.createAt(key, consent.ExpiresAt)
+	})
+}
+
+// GetConsent returns the consent of userID to clientID, ErrTokenNotFound when the user
+// didn't approve any scope for it and ErrTokenExpired when the consent expired
+func (cs *ConsentStore) GetConsent(userID, clientID string) (*Consent, error) {
+	var consent *Consent
+
+	err := cs.ts.view(context.Background(), func(tx *bolt.Tx) error {
+		var err error
+		consent, err = cs.get(tx, consentKey(cs.ts.cipher, userID, clientID))
+		return err
+	})
+
+	return consent, err
+}
+
+// RevokeConsent deletes the consent of userID to clientID, so the consent screen asks again.
+// The tokens already issued are kept, see RevokeByUserID
+func (cs *ConsentStore) RevokeConsent(userID, clientID string) error {
+	return cs.ts.update(context.Background(), func(tx *bolt.Tx) error {
+		return cs.ts.deleteRecords(tx, consentKey(cs.ts.cipher, userID, clientID))
+	})
+}
+
+// get returns the consent of key, ErrTokenExpired when it's expired but not swept yet
+func (cs *ConsentStore) get(tx *bolt.Tx, key []byte) (*Consent, error) {
+	consents := tx.Bucket(cs.ts.bucketConsentsName)
+	if consents == nil {
+		// older read-only databases have no consents
+		return nil, ErrTokenNotFound
+	}
+
+	consent, err := cs.decode(consents.Get(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if consent == nil {
+		return nil, ErrTokenNotFound
+	}
+
+	if !consent.ExpiresAt.IsZero() && !consent.ExpiresAt.After(cs.ts.clock.Now()) {
+		return nil, ErrTokenExpired
+	}
+
+	return consent, nil
+}
+
+// decode decodes a stored consent, nil when value is
+func (cs *ConsentStore) decode(value []byte) (*Consent, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	jv, err := cs.ts.cipher.open(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var consent Consent
+
+	err = cs.ts.codec.Unmarshal(jv, &consent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &consent, nil
+}
+
+// put stores consent under key
+func (cs *ConsentStore) put(tx *bolt.Tx, key []byte, consent *Consent) error {
+	jv, err := cs.ts.codec.Marshal(consent)
+	if err != nil {
+		return err
+	}
+
+	jv, err = cs.ts.cipher.seal(jv)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(cs.ts.bucketConsentsName).Put(key, jv)
+}
+
+// mergeScopes returns the sorted union of the scopes of a and b
+func mergeScopes(a, b []string) []string {
+	seen := map[string]bool{}
+	var merged []string
+
+	for _, scopes := range [][]string{a, b} {
+		for _, scope := range scopes {
+			for _, s := range strings.Fields(scope) {
+				if !seen[s] {
+					seen[s] = true
+					merged = append(merged, s)
+				}
+			}
+		}
+	}
+
+	sort.Strings(merged)
+
+	return merged
+}
+
+// consentExpirations returns the expiration of the consent keys that expire
+func (ts *TokenStore) consentExpirations(tx *bolt.Tx) []ttlEntry {
+	consents := tx.Bucket(ts.bucketConsentsName)
+	if consents == nil {
+		return nil
+	}
+
+	cs := NewConsentStore(ts)
+
+	var entries []ttlEntry
+
+	consents.ForEach(func(k, v []byte) error {
+		consent, err := cs.decode(v)
+		if err == nil && consent != nil && !consent.ExpiresAt.IsZero() {
+			entries = append(entries, ttlEntry{append([]byte(nil), k...), consent.ExpiresAt})
+		}
+
+		return nil
+	})
+
+	return entries
+}
+
+// rotatedConsentKey returns the key of a consent, decoded from v, under the new cipher of r
+func rotatedConsentKey(r *keyRotation, k, v []byte) ([]byte, []byte, error) {
+	var consent Consent
+
+	err := r.ts.codec.Unmarshal(v, &consent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return consentKey(r.newCipher, consent.UserID, consent.ClientID), v, nil
+}
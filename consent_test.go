@@ -0,0 +1,94 @@
+package boltdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newConsentStore(t *testing.T, config *Config) (*ConsentStore, *TokenStore) {
+	t.Helper()
+
+	config.DbName = filepath.Join(t.TempDir(), "oauth2.db")
+	config.BucketName = "oauthTokens"
+
+	store, closeFn, err := NewTokenStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeFn)
+
+	ts := store.(*TokenStore)
+
+	return NewConsentStore(ts), ts
+}
+
+func TestConsentKeyHidesTheIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    []byte
+		hidden bool
+	}{
+		{"plain text", nil, false},
+		{"encrypted", testOldKey, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, ts := newConsentStore(t, &Config{EncryptionKey: tt.key})
+
+			err := cs.SaveConsent("user-id", "client-id", []string{"read"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = ts.db.View(func(tx *bolt.Tx) error {
+				k, _ := tx.Bucket(ts.bucketConsentsName).Cursor().First()
+
+				visible := bytes.Contains(k, []byte("user-id")) || bytes.Contains(k, []byte("client-id"))
+				if visible == tt.hidden {
+					t.Errorf("consent key %q, want the ids hidden: %v", k, tt.hidden)
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := cs.GetConsent("user-id", "client-id"); err != nil {
+				t.Fatalf("GetConsent: %v", err)
+			}
+		})
+	}
+}
+
+func TestRevokeConsentIsNotATokenChange(t *testing.T) {
+	cs, ts := newConsentStore(t, &Config{ChangeRetention: time.Hour})
+
+	err := cs.SaveConsent("user", "client", []string{"read"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cs.RevokeConsent("user", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cs.GetConsent("user", "client"); err != ErrTokenNotFound {
+		t.Fatalf("GetConsent after RevokeConsent = %v, want ErrTokenNotFound", err)
+	}
+
+	if _, ok := expiryOf(t, ts, consentKey(ts.cipher, "user", "client")); ok {
+		t.Error("the TTL entry of the revoked consent was kept")
+	}
+
+	events, _, err := ts.changesSince(0)
+	if err != nil || len(events) != 0 {
+		t.Fatalf("changesSince = %v, %v, want no change", events, err)
+	}
+}
@@ -0,0 +1,143 @@
+package boltdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// CorruptionPolicy decides what NewTokenStore does when the database file is corrupted.
+// It returns a backup to restore, nil to start with an empty database, or an error to fail.
+// The corrupted file is kept next to the database with a ".corrupt-" suffix either way
+type CorruptionPolicy func(path string, cause error) (backup io.Reader, err error)
+
+var (
+	// FailOnCorruption fails to open a corrupted database with ErrCorrupted. It's the default policy
+	FailOnCorruption CorruptionPolicy = func(path string, cause error) (io.Reader, error) {
+		return nil, cause
+	}
+
+	// RecreateOnCorruption replaces a corrupted database with an empty one,
+	// so the server keeps running while every token is lost
+	RecreateOnCorruption CorruptionPolicy = func(path string, cause error) (io.Reader, error) {
+		return nil, nil
+	}
+)
+
+// RestoreOnCorruption replaces a corrupted database with the backup returned by fn,
+// like the ones written by TokenStore.Backup
+func RestoreOnCorruption(fn func() (io.Reader, error)) CorruptionPolicy {
+	return func(path string, cause error) (io.Reader, error) {
+		return fn()
+	}
+}
+
+// openRecovering opens the database of config, applying config.OnCorruption when it's corrupted.
+// With a policy set the whole file is checked first, which reads every page
+func openRecovering(config *Config) (*bolt.DB, error) {
+	path := config.dbPath()
+
+	err := config.createDir()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openDB(path, config.fileMode(), config.boltOptions())
+	if err == nil && config.OnCorruption != nil {
+		err = checkDB(db)
+		if err != nil {
+			closeDB(db)
+		}
+	}
+
+	if !isCorruption(err) {
+		return db, err
+	}
+
+	err = fmt.Errorf("%w: %s: %v", ErrCorrupted, path, err)
+
+	if config.OnCorruption == nil || config.ReadOnly {
+		return nil, err
+	}
+
+	backup, err := config.OnCorruption(path, err)
+	if err != nil {
+		return nil, err
+	}
+
+	corruptPath := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+
+	err = os.Rename(path, corruptPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if closer, ok := backup.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if backup != nil {
+		err = writeBackup(path, config.fileMode(), backup)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config.logger().Printf("boltdb: %s was corrupted, moved to %s and recreated", path, corruptPath)
+
+	return openDB(path, config.fileMode(), config.boltOptions())
+}
+
+// isCorruption reports if err comes from a corrupted database file
+func isCorruption(err error) bool {
+	return errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrChecksum) ||
+		errors.Is(err, bolt.ErrVersionMismatch) || errors.Is(err, errCheckFailed)
+}
+
+// errCheckFailed is returned by checkDB for the inconsistencies found by bolt
+var errCheckFailed = errors.New("consistency check failed")
+
+// checkDB runs the bolt consistency check, which may panic on pages that are too damaged
+func checkDB(db *bolt.DB) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errCheckFailed, r)
+		}
+	}()
+
+	return db.View(func(tx *bolt.Tx) error {
+		for checkErr := range tx.Check() {
+			if err == nil {
+				err = fmt.Errorf("%w: %v", errCheckFailed, checkErr)
+			}
+		}
+
+		return err
+	})
+}
+
+// writeBackup writes backup to path, with mode, through a temporary file, so path is never partial
+func writeBackup(path string, mode os.FileMode, backup io.Reader) error {
+	tmpPath := path + ".restore"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, backup)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
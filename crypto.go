@@ -0,0 +1,481 @@
+package boltdb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrInvalidCiphertext is returned when a stored value can't be decrypted with the configured key
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+
+// tokenCipher compresses and encrypts the stored token information with AES-GCM, and
+// hides the code, access and refresh keys with HMAC-SHA256.
+// Without a key, or with a nil tokenCipher, everything is stored in plain text
+type tokenCipher struct {
+	aead        cipher.AEAD
+	macKey      []byte
+	compression Compression
+}
+
+// newTokenCipher creates a cipher for an AES-128, AES-192 or AES-256 key, or
+// only compressing when key is empty
+func newTokenCipher(key []byte, compression Compression) (*tokenCipher, error) {
+	if len(key) == 0 {
+		return &tokenCipher{compression: compression}, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// the HMAC key is derived so the encryption key is never used twice
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("go-oauth2-boltdb keys"))
+
+	return &tokenCipher{
+		aead:        aead,
+		macKey:      mac.Sum(nil),
+		compression: compression,
+	}, nil
+}
+
+// key returns the bucket key of a code, access or refresh token
+func (c *tokenCipher) key(key string) []byte {
+	if c == nil || c.aead == nil {
+		return []byte(key)
+	}
+
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write([]byte(key))
+
+	return mac.Sum(nil)
+}
+
+// keyCheckKey is the key of the key check value on the meta bucket
+var keyCheckKey = []byte("key-check")
+
+// keyCheck returns the value recorded on the meta bucket to tell the encryption key of the
+// database. It's keyed like the tokens, so it doesn't reveal the key
+func (c *tokenCipher) keyCheck() []byte {
+	return c.key("go-oauth2-boltdb key check")
+}
+
+// seal compresses and encrypts plain, prepending the random nonce
+func (c *tokenCipher) seal(plain []byte) ([]byte, error) {
+	if c == nil {
+		return plain, nil
+	}
+
+	plain, err := c.compression.compress(plain)
+	if err != nil || c.aead == nil {
+		return plain, err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return c.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// open decrypts and decompresses a value created by seal. Missing values are returned as is
+func (c *tokenCipher) open(sealed []byte) ([]byte, error) {
+	if c == nil || sealed == nil {
+		return sealed, nil
+	}
+
+	if c.aead == nil {
+		return decompress(sealed)
+	}
+
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+
+	plain, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+
+	return decompress(plain)
+}
+
+// RotateEncryptionKey re-encrypts the buckets of config, currently encrypted with
+// config.EncryptionKey, with newKey, and moves the entries keyed by codes and tokens to
+// their keys under newKey. An empty key means plain text, so it can also encrypt or
+// decrypt an existing database. Rotated refresh tokens are gone, so their rotations
+// are dropped and presenting them again is no longer reported as a reuse.
+// The database must not be open by a token store while rotating
+func RotateEncryptionKey(config *Config, newKey []byte) error {
+	oldCipher, err := newTokenCipher(config.EncryptionKey, config.Compression)
+	if err != nil {
+		return err
+	}
+
+	newCipher, err := newTokenCipher(newKey, config.Compression)
+	if err != nil {
+		return err
+	}
+
+	// HashKeys without a secret of its own is keyed with the encryption key too
+	rotated := *config
+	rotated.EncryptionKey = newKey
+	newHasher := rotated.keyHasher()
+
+	db, err := openDB(config.dbPath(), config.fileMode(), config.BoltOptions)
+	if err != nil {
+		return err
+	}
+	defer closeDB(db)
+
+	ts, _, err := newTokenStoreWithDB(db, &Config{
+		BucketName:     config.BucketName,
+		EncryptionKey:  config.EncryptionKey,
+		Compression:    config.Compression,
+		Codec:          config.Codec,
+		KeyHasher:      config.KeyHasher,
+		HashKeys:       config.HashKeys,
+		HashKeysSecret: config.HashKeysSecret,
+		Shards:         config.Shards,
+	})
+	if err != nil {
+		return err
+	}
+	ts.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		ttl := ts.ttlBuckets(tx)
+
+		moved, err := rotate(ts.tokenBucket(tx), ttl, ts.codec, ts.keyHasher, newHasher, oldCipher, newCipher)
+		if err != nil {
+			return err
+		}
+
+		r := &keyRotation{
+			tx:        tx,
+			ts:        ts,
+			oldCipher: oldCipher,
+			newCipher: newCipher,
+			newHasher: newHasher,
+			moved:     moved,
+		}
+
+		for _, bucket := range ts.rotatedBuckets() {
+			err = r.rotateBucket(tx, ttl, bucket)
+			if err != nil {
+				return err
+			}
+		}
+
+		// indexed values are also keyed with the cipher
+		ts.cipher = newCipher
+
+		err = ts.rebuildIndexes(tx)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(ts.bucketMetaName).Put(keyCheckKey, newCipher.keyCheck())
+		if err != nil {
+			return err
+		}
+
+		// without a secret of its own, the audit log is chained with the rotated key too
+		return ts.rechainAudit(tx, ts.auditKey, rotated.auditKey())
+	})
+}
+
+// rotatedBucket is a bucket rewritten by RotateEncryptionKey after the token bucket
+type rotatedBucket struct {
+	name []byte
+	// sealed is set when the values are sealed with the cipher
+	sealed bool
+	// rekey returns the key and plain value of an entry under the new cipher, or a nil key
+	// to drop entries that can't be moved. Nil when the keys don't depend on the cipher
+	rekey func(r *keyRotation, k, v []byte) ([]byte, []byte, error)
+}
+
+// rotatedBuckets returns the buckets rewritten by RotateEncryptionKey. Every bucket sealing
+// its values, or keyed by codes and tokens, has to be listed, or it can't be read once rotated.
+// Indexes are rebuilt instead
+func (ts *TokenStore) rotatedBuckets() []rotatedBucket {
+	return []rotatedBucket{
+		{name: ts.bucketAuditName, sealed: true},
+		{name: ts.bucketUsageName, rekey: movedKey},
+		{name: ts.bucketMetadataName, sealed: true, rekey: movedKey},
+		// the revocations keep the key hashes of the old keys, their tokens are gone
+		{name: ts.bucketRevocationsName, sealed: true},
+		{name: ts.bucketRotatedName, rekey: droppedKey},
+		// user codes read their device request, so they are rotated first
+		{name: ts.bucketUserCodesName, rekey: rotatedUserCodeKey},
+		{name: ts.bucketDevicesName, sealed: true, rekey: rotatedDeviceKey},
+		{name: ts.bucketChallengesName, sealed: true, rekey: movedKey},
+		{name: ts.bucketSessionsName, sealed: true},
+		{name: ts.bucketSessionMembersName, rekey: rotatedMemberKey},
+		// the changes keep the key hashes of the old keys, like the revocations
+		{name: ts.bucketChangesName, sealed: true},
+		{name: ts.bucketConsentsName, sealed: true, rekey: rotatedConsentKey},
+	}
+}
+
+// keyRotation is the state of a RotateEncryptionKey
+type keyRotation struct {
+	tx        *bolt.Tx
+	ts        *TokenStore
+	oldCipher *tokenCipher
+	newCipher *tokenCipher
+	// newHasher differs from the hasher of ts when HashKeys is keyed with the encryption key
+	newHasher KeyHasher
+	// moved maps the old keys of the codes, access and refresh tokens to their new keys
+	moved map[string][]byte
+}
+
+// tokenKey returns the key of a code or token under the new cipher
+func (r *keyRotation) tokenKey(token string) []byte {
+	return tokenKey(r.newHasher, r.newCipher, token)
+}
+
+// movedKey rekeys the entries keyed by a code, access or refresh key, dropping the
+// entries of keys that are gone
+func movedKey(r *keyRotation, k, v []byte) ([]byte, []byte, error) {
+	return r.moved[string(k)], v, nil
+}
+
+// droppedKey drops the entries keyed by tokens that are gone, so they can't be moved
+func droppedKey(r *keyRotation, k, v []byte) ([]byte, []byte, error) {
+	return nil, nil, nil
+}
+
+// rotatedEntry is a bucket entry rewritten by rotateBucket
+type rotatedEntry struct {
+	key    []byte
+	newKey []byte
+	value  []byte
+}
+
+// rotateBucket reseals and rekeys the entries of b, when it exists, moving their TTL entries
+func (r *keyRotation) rotateBucket(tx *bolt.Tx, ttl ttlBuckets, b rotatedBucket) error {
+	bucket := tx.Bucket(b.name)
+	if bucket == nil {
+		return nil
+	}
+
+	var entries []rotatedEntry
+
+	err := bucket.ForEach(func(k, v []byte) error {
+		key := append([]byte(nil), k...)
+		value := append([]byte(nil), v...)
+
+		var err error
+
+		if b.sealed {
+			value, err = r.oldCipher.open(value)
+			if err != nil {
+				return err
+			}
+		}
+
+		newKey := key
+		if b.rekey != nil {
+			newKey, value, err = b.rekey(r, key, value)
+			if err != nil {
+				return err
+			}
+		}
+
+		if b.sealed && newKey != nil {
+			value, err = r.newCipher.seal(value)
+			if err != nil {
+				return err
+			}
+		}
+
+		entries = append(entries, rotatedEntry{key: key, newKey: newKey, value: value})
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// the bucket can't be modified while iterating it, and the old keys are deleted
+	// first so they are not confused with the new ones
+	for _, entry := range entries {
+		if entry.newKey == nil || !bytes.Equal(entry.key, entry.newKey) {
+			err = bucket.Delete(entry.key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.newKey == nil {
+			err = ttl.remove(entry.key)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		err = bucket.Put(entry.newKey, entry.value)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(entry.key, entry.newKey) {
+			continue
+		}
+
+		err = moveTTL(ttl, entry.key, entry.newKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rotateEntry is a bucket entry that has to be rewritten
+type rotateEntry struct {
+	key   []byte
+	value []byte
+	keys  storedToken
+}
+
+// rotate re-encrypts every token information and moves the code, access and refresh
+// keys, with their TTL entries, to the keys of newHasher and newCipher, returning the keys moved
+func rotate(bucket tokenBucket, ttl ttlBuckets, codec Codec, oldHasher, newHasher KeyHasher, oldCipher, newCipher *tokenCipher) (map[string][]byte, error) {
+	var entries []rotateEntry
+	moved := map[string][]byte{}
+
+	// mappings from tokens to basic IDs are not token information, so they fail to
+	// decrypt or decode, or hold no token, and are moved with their token information
+	err := bucket.ForEach(func(k, v []byte) error {
+		jv, err := oldCipher.open(v)
+		if err != nil {
+			return nil
+		}
+
+		var keys storedToken
+		if codec.Unmarshal(jv, &keys) != nil || !isTokenInfo(keys.Code, keys.Access, keys.Refresh) {
+			return nil
+		}
+
+		entries = append(entries, rotateEntry{
+			key:   append([]byte(nil), k...),
+			value: jv,
+			keys:  keys,
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		sealed, err := newCipher.seal(entry.value)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.keys.Code != "" {
+			err = bucket.Delete(entry.key)
+			if err != nil {
+				return nil, err
+			}
+
+			newKey := tokenKey(newHasher, newCipher, entry.keys.Code)
+			moved[string(entry.key)] = newKey
+
+			err = moveKey(bucket, ttl, entry.key, newKey, sealed)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		err = bucket.Put(entry.key, sealed)
+		if err != nil {
+			return nil, err
+		}
+
+		// basic IDs don't depend on the cipher
+		moved[string(entry.key)] = entry.key
+
+		for _, token := range []string{entry.keys.Access, entry.keys.Refresh} {
+			if token == "" {
+				continue
+			}
+
+			oldKey := tokenKey(oldHasher, oldCipher, token)
+
+			basicID := bucket.Get(oldKey)
+			if basicID == nil {
+				continue
+			}
+			basicID = append([]byte(nil), basicID...)
+
+			err = bucket.Delete(oldKey)
+			if err != nil {
+				return nil, err
+			}
+
+			newKey := tokenKey(newHasher, newCipher, token)
+			moved[string(oldKey)] = newKey
+
+			err = moveKey(bucket, ttl, oldKey, newKey, basicID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return moved, nil
+}
+
+// moveKey stores value under newKey and moves the TTL entry of oldKey to it
+func moveKey(bucket tokenBucket, ttl ttlBuckets, oldKey, newKey, value []byte) error {
+	err := bucket.Put(newKey, value)
+	if err != nil {
+		return err
+	}
+
+	return moveTTL(ttl, oldKey, newKey)
+}
+
+// moveTTL moves the TTL entry of oldKey, if it has one, to newKey
+func moveTTL(ttl ttlBuckets, oldKey, newKey []byte) error {
+	expiration, ok := ttl.expiry(oldKey)
+	if !ok {
+		return nil
+	}
+
+	err := ttl.remove(oldKey)
+	if err != nil {
+		return err
+	}
+
+	return ttl.createAt(newKey, expiration)
+}
@@ -0,0 +1,321 @@
+package boltdb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+var (
+	testOldKey = []byte("0123456789abcdef")
+	testNewKey = []byte("fedcba9876543210")
+)
+
+// rotatedStore fills a store of config encrypted with testOldKey, rotates it to
+// testNewKey and returns the store reopened with it
+func rotatedStore(t *testing.T, config *Config, fill func(ts *TokenStore)) *TokenStore {
+	t.Helper()
+
+	config.DbName = filepath.Join(t.TempDir(), "oauth2.db")
+	config.BucketName = "oauthTokens"
+	config.EncryptionKey = testOldKey
+
+	store, closeFn, err := NewTokenStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fill(store.(*TokenStore))
+	closeFn()
+
+	err = RotateEncryptionKey(config, testNewKey)
+	if err != nil {
+		t.Fatalf("RotateEncryptionKey: %v", err)
+	}
+
+	rotated := *config
+	rotated.EncryptionKey = testNewKey
+
+	store, closeFn, err = NewTokenStore(&rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeFn)
+
+	return store.(*TokenStore)
+}
+
+func TestRotateEncryptionKeyMovesTokens(t *testing.T) {
+	now := time.Now()
+
+	ts := rotatedStore(t, &Config{}, func(ts *TokenStore) {
+		err := ts.Create(&models.Token{
+			ClientID:      "client",
+			UserID:        "user",
+			Code:          "code",
+			CodeCreateAt:  now,
+			CodeExpiresIn: time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ts.Create(&models.Token{
+			ClientID:         "client",
+			UserID:           "user",
+			Access:           "access",
+			AccessCreateAt:   now,
+			AccessExpiresIn:  time.Hour,
+			Refresh:          "refresh",
+			RefreshCreateAt:  now,
+			RefreshExpiresIn: 24 * time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	tests := []struct {
+		token string
+		get   func(string) (oauth2.TokenInfo, error)
+	}{
+		{"code", ts.GetByCode},
+		{"access", ts.GetByAccess},
+		{"refresh", ts.GetByRefresh},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			info, err := tt.get(tt.token)
+			if err != nil || info == nil || info.GetUserID() != "user" {
+				t.Fatalf("get %s = %v, %v, want the stored token", tt.token, info, err)
+			}
+
+			if _, ok := expiryOf(t, ts, ts.tokenKey(tt.token)); !ok {
+				t.Errorf("%s has no TTL entry after rotating", tt.token)
+			}
+		})
+	}
+}
+
+// expiryOf returns the expiration of the TTL entry of key
+func expiryOf(t *testing.T, ts *TokenStore, key []byte) (time.Time, bool) {
+	t.Helper()
+
+	var expiry time.Time
+	var ok bool
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		expiry, ok = ts.ttlBuckets(tx).expiry(key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return expiry, ok
+}
+
+func TestRotateEncryptionKeyMovesMetadata(t *testing.T) {
+	ts := rotatedStore(t, &Config{}, func(ts *TokenStore) {
+		err := ts.CreateWithMetadata(&models.Token{
+			Access:          "access",
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: time.Hour,
+		}, map[string]string{"device": "laptop"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	meta, err := ts.GetMetadataByAccess("access")
+	if err != nil || meta["device"] != "laptop" {
+		t.Fatalf("GetMetadataByAccess = %v, %v, want the stored metadata", meta, err)
+	}
+}
+
+func TestRotateEncryptionKeyReseals(t *testing.T) {
+	ts := rotatedStore(t, &Config{RevocationRetention: time.Hour}, func(ts *TokenStore) {
+		err := ts.Create(&models.Token{
+			UserID:          "user",
+			Access:          "access",
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ts.RemoveByAccess("access")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	revocations, err := ts.ListRevocations(time.Now().Add(-time.Hour))
+	if err != nil || len(revocations) != 1 || revocations[0].UserID != "user" {
+		t.Fatalf("ListRevocations = %v, %v, want the revocation of the access token", revocations, err)
+	}
+}
+
+func TestRotateEncryptionKeyDropsRotations(t *testing.T) {
+	now := time.Now()
+	pair := func(access, refresh string) *models.Token {
+		return &models.Token{
+			Access:           access,
+			AccessCreateAt:   now,
+			AccessExpiresIn:  time.Hour,
+			Refresh:          refresh,
+			RefreshCreateAt:  now,
+			RefreshExpiresIn: 24 * time.Hour,
+		}
+	}
+
+	ts := rotatedStore(t, &Config{}, func(ts *TokenStore) {
+		err := ts.Create(pair("access1", "refresh1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ts.RotateRefresh("refresh1", pair("access2", "refresh2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if _, err := ts.GetByRefresh("refresh2"); err != nil {
+		t.Fatalf("GetByRefresh of the current token: %v", err)
+	}
+
+	if _, err := ts.GetByRefresh("refresh1"); err != ErrTokenNotFound {
+		t.Fatalf("GetByRefresh of the rotated token = %v, want ErrTokenNotFound", err)
+	}
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(ts.bucketRotatedName).Cursor().First(); k != nil {
+			t.Errorf("rotation %x was not dropped", k)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateEncryptionKeyMovesDeviceRequests(t *testing.T) {
+	ts := rotatedStore(t, &Config{}, func(ts *TokenStore) {
+		err := NewDeviceStore(ts).Create(&DeviceAuthorization{
+			DeviceCode: "device-code",
+			UserCode:   "USER-CODE",
+			ClientID:   "client",
+			ExpiresIn:  10 * time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	ds := NewDeviceStore(ts)
+
+	if auth, err := ds.GetByDeviceCode("device-code"); err != nil || auth.ClientID != "client" {
+		t.Fatalf("GetByDeviceCode = %v, %v, want the stored request", auth, err)
+	}
+
+	if auth, err := ds.GetByUserCode("USER-CODE"); err != nil || auth.DeviceCode != "device-code" {
+		t.Fatalf("GetByUserCode = %v, %v, want the stored request", auth, err)
+	}
+
+	if _, ok := expiryOf(t, ts, ds.userCodeKey("USER-CODE")); !ok {
+		t.Error("the user code has no TTL entry after rotating")
+	}
+}
+
+func TestRotateEncryptionKeyMovesCodeChallenges(t *testing.T) {
+	ts := rotatedStore(t, &Config{}, func(ts *TokenStore) {
+		err := ts.CreateWithCodeChallenge(&models.Token{
+			Code:          "code",
+			CodeCreateAt:  time.Now(),
+			CodeExpiresIn: time.Minute,
+		}, CodeChallenge{Challenge: "challenge", Method: "S256"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	challenge, err := ts.GetCodeChallenge("code")
+	if err != nil || challenge == nil || challenge.Challenge != "challenge" {
+		t.Fatalf("GetCodeChallenge = %v, %v, want the stored challenge", challenge, err)
+	}
+}
+
+func TestRotateEncryptionKeyMovesSessions(t *testing.T) {
+	ts := rotatedStore(t, &Config{}, func(ts *TokenStore) {
+		err := ts.Create(&models.Token{
+			UserID:        "user",
+			ClientID:      "client",
+			Code:          "code",
+			CodeCreateAt:  time.Now(),
+			CodeExpiresIn: time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	session, err := ts.GetSessionByCode("code")
+	if err != nil || session == nil || session.UserID != "user" {
+		t.Fatalf("GetSessionByCode = %v, %v, want the session of the code", session, err)
+	}
+
+	err = ts.RemoveByCode("code")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := ts.ListSessionsByUser("user")
+	if err != nil || len(sessions) != 0 {
+		t.Fatalf("ListSessionsByUser = %v, %v, want the session ended with its code", sessions, err)
+	}
+}
+
+func TestRotateEncryptionKeyResealsChanges(t *testing.T) {
+	ts := rotatedStore(t, &Config{ChangeRetention: time.Hour}, func(ts *TokenStore) {
+		err := ts.Create(&models.Token{
+			Access:          "access",
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	events, _, err := ts.changesSince(0)
+	if err != nil || len(events) != 1 || events[0].Operation != ChangeCreate {
+		t.Fatalf("changesSince = %v, %v, want the creation of the access token", events, err)
+	}
+}
+
+func TestRotateEncryptionKeyMovesConsents(t *testing.T) {
+	ts := rotatedStore(t, &Config{}, func(ts *TokenStore) {
+		err := NewConsentStore(ts).SaveConsent("user", "client", []string{"read"}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	consent, err := NewConsentStore(ts).GetConsent("user", "client")
+	if err != nil || !consent.Covers("read") {
+		t.Fatalf("GetConsent = %v, %v, want the saved consent", consent, err)
+	}
+
+	key := consentKey(ts.cipher, "user", "client")
+	if _, ok := expiryOf(t, ts, key); !ok {
+		t.Error("the consent has no TTL entry after rotating")
+	}
+}
@@ -0,0 +1,343 @@
+package boltdb
+
+import (
+	"context"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DeviceStatus is the state of a device authorization request
+type DeviceStatus string
+
+const (
+	// DevicePending requests wait for the user to enter the user code
+	DevicePending DeviceStatus = "pending"
+	// DeviceApproved requests can be exchanged for a token pair
+	DeviceApproved DeviceStatus = "approved"
+	// DeviceDenied requests were refused by the user
+	DeviceDenied DeviceStatus = "denied"
+)
+
+// Key prefixes of the device and user codes, so they don't collide with the token keys
+// sharing the TTL buckets
+var (
+	deviceKeyPrefix   = []byte("device:")
+	userCodeKeyPrefix = []byte("user-code:")
+)
+
+// DeviceAuthorization is a device authorization request of RFC 8628
+type DeviceAuthorization struct {
+	DeviceCode string
+	UserCode   string
+	ClientID   string
+	Scope      string
+	Status     DeviceStatus
+	// UserID is the user that approved or denied the request
+	UserID    string
+	CreatedAt time.Time
+	ExpiresIn time.Duration
+	// Interval is the minimum time between two polls of the device
+	Interval time.Duration
+	// LastPolledAt is when the device polled last, zero until it does
+	LastPolledAt time.Time
+}
+
+// DeviceStore stores the device authorization requests of the device authorization grant
+// (RFC 8628). It shares the database and the cleaner of a token store, expired requests are
+// swept with its tokens
+type DeviceStore struct {
+	ts *TokenStore
+}
+
+// NewDeviceStore creates a device store on the database of ts
+func NewDeviceStore(ts *TokenStore) *DeviceStore {
+	return &DeviceStore{ts: ts}
+}
+
+// deviceKey returns the key of a device code
+func (ds *DeviceStore) deviceKey(deviceCode string) []byte {
+	return append(append([]byte(nil), deviceKeyPrefix...), ds.ts.tokenKey(deviceCode)...)
+}
+
+// userCodeKey returns the key of a user code
+func (ds *DeviceStore) userCodeKey(userCode string) []byte {
+	return append(append([]byte(nil), userCodeKeyPrefix...), ds.ts.tokenKey(userCode)...)
+}
+
+// Create stores a pending device authorization request that expires after its ExpiresIn.
+// CreatedAt defaults to now. User codes are short, so a user code already in use by
+// another request returns ErrUserCodeInUse
+func (ds *DeviceStore) Create(auth *DeviceAuthorization) error {
+	stored := *auth
+	stored.Status = DevicePending
+
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = ds.ts.clock.Now()
+	}
+
+	deviceKey := ds.deviceKey(stored.DeviceCode)
+	userCodeKey := ds.userCodeKey(stored.UserCode)
+
+	return ds.ts.update(context.Background(), func(tx *bolt.Tx) error {
+		userCodes := tx.Bucket(ds.ts.bucketUserCodesName)
+
+		current := userCodes.Get(userCodeKey)
+		if current != nil {
+			// the request of the user code may be expired but not swept yet
+			_, err := ds.get(tx, current)
+			if err != ErrTokenExpired && err != ErrTokenNotFound {
+				if err == nil {
+					err = ErrUserCodeInUse
+				}
+
+				return err
+			}
+		}
+
+		err := ds.put(tx, deviceKey, &stored)
+		if err != nil {
+			return err
+		}
+
+		err = userCodes.Put(userCodeKey, deviceKey)
+		if err != nil {
+			return err
+		}
+
+		ttl := ds.ts.ttlBuckets(tx)
+
+		// the TTL of the expired request would sweep the user code of this one
+		if current != nil {
+			err = ttl.remove(userCodeKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		if stored.ExpiresIn <= 0 {
+			return nil
+		}
+
+		expiration := stored.CreatedAt.Add(stored.ExpiresIn)
+
+		err = ttl.createAt(deviceKey, expiration)
+		if err != nil {
+			return err
+		}
+
+		return ttl.createAt(userCodeKey, expiration)
+	})
+}
+
+// GetByDeviceCode returns the request of a device code
+func (ds *DeviceStore) GetByDeviceCode(deviceCode string) (*DeviceAuthorization, error) {
+	var auth *DeviceAuthorization
+
+	err := ds.ts.view(context.Background(), func(tx *bolt.Tx) error {
+		var err error
+		auth, err = ds.get(tx, ds.deviceKey(deviceCode))
+		return err
+	})
+
+	return auth, err
+}
+
+// GetByUserCode returns the request of a user code, for the verification page
+func (ds *DeviceStore) GetByUserCode(userCode string) (*DeviceAuthorization, error) {
+	var auth *DeviceAuthorization
+
+	err := ds.ts.view(context.Background(), func(tx *bolt.Tx) error {
+		deviceKey, err := ds.userCodeDevice(tx, userCode)
+		if err != nil {
+			return err
+		}
+
+		auth, err = ds.get(tx, deviceKey)
+		return err
+	})
+
+	return auth, err
+}
+
+// Poll returns the request of a device code and records the poll. Devices polling again
+// before the Interval of the request get ErrSlowDown, as the token endpoint should answer
+func (ds *DeviceStore) Poll(deviceCode string) (*DeviceAuthorization, error) {
+	var auth *DeviceAuthorization
+	var tooFast bool
+	key := ds.deviceKey(deviceCode)
+
+	err := ds.ts.update(context.Background(), func(tx *bolt.Tx) error {
+		var err error
+
+		auth, err = ds.get(tx, key)
+		if err != nil {
+			return err
+		}
+
+		now := ds.ts.clock.Now()
+		last := auth.LastPolledAt
+		auth.LastPolledAt = now
+
+		// polls that are too fast are recorded too, so the device has to wait a whole interval
+		tooFast = !last.IsZero() && now.Sub(last) < auth.Interval
+
+		return ds.put(tx, key, auth)
+	})
+
+	if err == nil && tooFast {
+		err = ErrSlowDown
+	}
+
+	return auth, err
+}
+
+// Approve approves the pending request of a user code on behalf of userID
+func (ds *DeviceStore) Approve(userCode, userID string) error {
+	return ds.decide(userCode, userID, DeviceApproved)
+}
+
+// Deny denies the pending request of a user code on behalf of userID
+func (ds *DeviceStore) Deny(userCode, userID string) error {
+	return ds.decide(userCode, userID, DeviceDenied)
+}
+
+// Remove deletes the request of a device code, once exchanged for a token pair
+func (ds *DeviceStore) Remove(deviceCode string) error {
+	return ds.ts.update(context.Background(), func(tx *bolt.Tx) error {
+		key := ds.deviceKey(deviceCode)
+
+		auth, err := ds.decode(tx.Bucket(ds.ts.bucketDevicesName).Get(key))
+		if err != nil || auth == nil {
+			return err
+		}
+
+		return ds.ts.deleteRecords(tx, key, ds.userCodeKey(auth.UserCode))
+	})
+}
+
+// decide moves the pending request of a user code to status.
+// Requests already approved or denied return ErrDeviceNotPending
+func (ds *DeviceStore) decide(userCode, userID string, status DeviceStatus) error {
+	return ds.ts.update(context.Background(), func(tx *bolt.Tx) error {
+		deviceKey, err := ds.userCodeDevice(tx, userCode)
+		if err != nil {
+			return err
+		}
+
+		auth, err := ds.get(tx, deviceKey)
+		if err != nil {
+			return err
+		}
+
+		if auth.Status != DevicePending {
+			return ErrDeviceNotPending
+		}
+
+		auth.Status = status
+		auth.UserID = userID
+
+		return ds.put(tx, deviceKey, auth)
+	})
+}
+
+// userCodeDevice returns the device key of a user code
+func (ds *DeviceStore) userCodeDevice(tx *bolt.Tx, userCode string) ([]byte, error) {
+	userCodes := tx.Bucket(ds.ts.bucketUserCodesName)
+	if userCodes == nil {
+		// older read-only databases have no device requests
+		return nil, ErrTokenNotFound
+	}
+
+	deviceKey := userCodes.Get(ds.userCodeKey(userCode))
+	if deviceKey == nil {
+		return nil, ErrTokenNotFound
+	}
+
+	return deviceKey, nil
+}
+
+// get returns the request of deviceKey, ErrTokenExpired when it's expired but not swept yet
+func (ds *DeviceStore) get(tx *bolt.Tx, deviceKey []byte) (*DeviceAuthorization, error) {
+	devices := tx.Bucket(ds.ts.bucketDevicesName)
+	if devices == nil {
+		return nil, ErrTokenNotFound
+	}
+
+	auth, err := ds.decode(devices.Get(deviceKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if auth == nil {
+		return nil, ErrTokenNotFound
+	}
+
+	if expiredAt(auth.CreatedAt, auth.ExpiresIn, ds.ts.clock.Now()) {
+		return nil, ErrTokenExpired
+	}
+
+	return auth, nil
+}
+
+// decode decodes a stored request, nil when value is
+func (ds *DeviceStore) decode(value []byte) (*DeviceAuthorization, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	jv, err := ds.ts.cipher.open(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth DeviceAuthorization
+
+	err = ds.ts.codec.Unmarshal(jv, &auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth, nil
+}
+
+// put stores auth under deviceKey
+func (ds *DeviceStore) put(tx *bolt.Tx, deviceKey []byte, auth *DeviceAuthorization) error {
+	jv, err := ds.ts.codec.Marshal(auth)
+	if err != nil {
+		return err
+	}
+
+	jv, err = ds.ts.cipher.seal(jv)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(ds.ts.bucketDevicesName).Put(deviceKey, jv)
+}
+
+// rotatedDeviceKey returns the key of a device request, decoded from v, under the new cipher of r
+func rotatedDeviceKey(r *keyRotation, k, v []byte) ([]byte, []byte, error) {
+	var auth DeviceAuthorization
+
+	err := r.ts.codec.Unmarshal(v, &auth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(append([]byte(nil), deviceKeyPrefix...), r.tokenKey(auth.DeviceCode)...), v, nil
+}
+
+// rotatedUserCodeKey returns the key of a user code, and the key of its device request,
+// under the new cipher of r. User codes of requests that are gone are dropped
+func rotatedUserCodeKey(r *keyRotation, k, v []byte) ([]byte, []byte, error) {
+	auth, err := NewDeviceStore(r.ts).decode(r.tx.Bucket(r.ts.bucketDevicesName).Get(v))
+	if err != nil || auth == nil {
+		return nil, nil, err
+	}
+
+	userCodeKey := append(append([]byte(nil), userCodeKeyPrefix...), r.tokenKey(auth.UserCode)...)
+	deviceKey := append(append([]byte(nil), deviceKeyPrefix...), r.tokenKey(auth.DeviceCode)...)
+
+	return userCodeKey, deviceKey, nil
+}
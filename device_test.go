@@ -0,0 +1,111 @@
+package boltdb
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestDeviceRemoveIsNotATokenChange(t *testing.T) {
+	store, closeFn, err := NewTokenStore(&Config{
+		DbName:          filepath.Join(t.TempDir(), "oauth2.db"),
+		BucketName:      "oauthTokens",
+		ChangeRetention: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ts := store.(*TokenStore)
+	ds := NewDeviceStore(ts)
+
+	err = ds.Create(&DeviceAuthorization{
+		DeviceCode: "device-code",
+		UserCode:   "USER-CODE",
+		ExpiresIn:  10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.Remove("device-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		get  func(string) (*DeviceAuthorization, error)
+		code string
+	}{
+		{"device code", ds.GetByDeviceCode, "device-code"},
+		{"user code", ds.GetByUserCode, "USER-CODE"},
+	}
+
+	for _, tt := range tests {
+		if _, err := tt.get(tt.code); err != ErrTokenNotFound {
+			t.Errorf("get by %s after Remove = %v, want ErrTokenNotFound", tt.name, err)
+		}
+	}
+
+	events, _, err := ts.changesSince(0)
+	if err != nil || len(events) != 0 {
+		t.Fatalf("changesSince = %v, %v, want no change", events, err)
+	}
+}
+
+func TestDeviceCreateReusesExpiredUserCodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+	}{
+		{"expiring", time.Hour},
+		{"not expiring", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testutil.NewFakeClock(time.Now())
+			ts := newTestStore(t, Config{Clock: clock})
+			ds := NewDeviceStore(ts)
+
+			err := ds.Create(&DeviceAuthorization{DeviceCode: "old", UserCode: "USER-CODE", ExpiresIn: time.Minute})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clock.Advance(2 * time.Minute)
+
+			err = ds.Create(&DeviceAuthorization{DeviceCode: "new", UserCode: "USER-CODE", ExpiresIn: tt.expiresIn})
+			if err != nil {
+				t.Fatalf("Create with the expired user code = %v", err)
+			}
+
+			if _, err := ts.sweep(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			auth, err := ds.GetByUserCode("USER-CODE")
+			if err != nil || auth.DeviceCode != "new" {
+				t.Fatalf("GetByUserCode after the sweep = %+v, %v, want the new request", auth, err)
+			}
+
+			err = ts.db.View(func(tx *bolt.Tx) error {
+				expiry, ok := ts.ttlBuckets(tx).expiry(ds.userCodeKey("USER-CODE"))
+				if want := clock.Now().Add(tt.expiresIn); ok != (tt.expiresIn > 0) || ok && !expiry.Equal(want) {
+					t.Errorf("user code expiry = %v, %v, want %v", expiry, ok, want)
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
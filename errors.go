@@ -0,0 +1,115 @@
+package boltdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTokenNotFound is returned when the code, access or refresh token is not stored
+var ErrTokenNotFound = errors.New("token not found")
+
+// ErrTokenExpired is returned when the token exists but its TTL is already due.
+// Expired tokens are kept until the cleaner sweeps them, unless Config.DeleteExpiredOnRead is set
+var ErrTokenExpired = errors.New("token expired")
+
+// ErrStoreClosed is returned by the operations of a store after it's closed
+var ErrStoreClosed = errors.New("store closed")
+
+// ErrBucketMissing is returned, wrapped with the bucket name, when a bucket of the store is
+// not in the database: read-only stores can't create them, or they were deleted
+var ErrBucketMissing = errors.New("bucket missing")
+
+// ErrEncoding is returned, wrapping the error of the codec, when token information or
+// the records of the store can't be encoded or decoded
+var ErrEncoding = errors.New("encoding failed")
+
+// bucketMissing returns ErrBucketMissing wrapped with the bucket name
+func bucketMissing(name []byte) error {
+	return fmt.Errorf("%w: %s", ErrBucketMissing, name)
+}
+
+// ErrDbNameRequired is returned when Config.DbName is empty
+var ErrDbNameRequired = errors.New("db name required")
+
+// ErrCodeDbNameConflict is returned when Config.CodeDbName is the same file as Config.DbName
+var ErrCodeDbNameConflict = errors.New("code db name must differ from db name")
+
+// ErrHashKeysSecretRequired is returned when Config.HashKeys is set without
+// Config.HashKeysSecret or Config.EncryptionKey
+var ErrHashKeysSecretRequired = errors.New("hash keys secret required")
+
+// ErrCodeDbTxn is returned by the code operations of TokenStore.Txn when Config.CodeDbName is set
+var ErrCodeDbTxn = errors.New("codes on their own file can't join the transaction")
+
+// ErrNoCodeDb is returned by BackupCodes and RestoreCodesFrom when Config.CodeDbName is not set,
+// codes are then on the backups of the store
+var ErrNoCodeDb = errors.New("codes are not on their own file")
+
+// ErrInvalidID is returned when Config.IDGenerator keeps returning empty IDs, IDs longer
+// than 64 bytes, IDs already stored, or IDs that decode as token information
+var ErrInvalidID = errors.New("id generator returned no usable id")
+
+// ErrBucketNameRequired is returned when Config.BucketName is empty
+var ErrBucketNameRequired = errors.New("bucket name required")
+
+// ErrBucketNameReserved is returned when Config.BucketName, or a tenant id, clashes with the
+// buckets derived from other bucket names, like the "-ttl" suffix or the "tenant-" prefix
+var ErrBucketNameReserved = errors.New("bucket name reserved")
+
+// ErrCorrupted is returned when the database file is corrupted and Config.OnCorruption doesn't recover it
+var ErrCorrupted = errors.New("database corrupted")
+
+// ErrDatabaseLocked is returned when the database file is already open writable by this
+// process, or by another one when Config.BoltOptions sets a Timeout
+var ErrDatabaseLocked = errors.New("database file locked")
+
+// ErrReadOnly is returned by the writes of a store on a read-only database
+var ErrReadOnly = errors.New("store is read-only")
+
+// ErrUnsupportedSchema is returned when the database was written by a newer version of the package
+var ErrUnsupportedSchema = errors.New("unsupported schema version")
+
+// ErrShardsMismatch is returned when Config.Shards differs from the shards of a bucket that has tokens
+var ErrShardsMismatch = errors.New("shards mismatch")
+
+// ErrEncryptionKeyMismatch is returned when Config.EncryptionKey differs from the key the database was written with
+var ErrEncryptionKeyMismatch = errors.New("encryption key mismatch")
+
+// ErrCodecMismatch is returned when Config.Codec differs from the codec the database was written with
+var ErrCodecMismatch = errors.New("codec mismatch")
+
+// ErrUsageTrackingDisabled is returned by the usage methods when Config.TrackUsage is not set
+var ErrUsageTrackingDisabled = errors.New("usage tracking disabled")
+
+// ErrRefreshTokenReused is returned by GetByRefresh for refresh tokens exchanged with RotateRefresh
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// ErrUserCodeInUse is returned by DeviceStore.Create when another pending request has the user code
+var ErrUserCodeInUse = errors.New("user code in use")
+
+// ErrDeviceNotPending is returned when approving or denying a device request that was already decided
+var ErrDeviceNotPending = errors.New("device request not pending")
+
+// ErrSlowDown is returned by DeviceStore.Poll when the device polls faster than its interval
+var ErrSlowDown = errors.New("slow down")
+
+// ErrQuotaExceeded is returned when creating a token pair over Config.MaxTokensPerUser or
+// Config.MaxTokensPerClient with the RejectNewTokens policy
+var ErrQuotaExceeded = errors.New("token quota exceeded")
+
+// ErrTenantRequired is returned by ForTenant when the tenant id is empty
+var ErrTenantRequired = errors.New("tenant id required")
+
+// ErrChangeLogDisabled is returned by Watch when the database has no change log, see Config.ChangeRetention
+var ErrChangeLogDisabled = errors.New("change log disabled")
+
+// ErrAuditTampered is returned by VerifyAudit when the hash chain of the audit log is broken
+var ErrAuditTampered = errors.New("audit log tampered")
+
+// BatchError reports, by their index on the batch, the tokens that CreateBatch couldn't store
+type BatchError map[int]error
+
+// Error summarizes the failed tokens
+func (e BatchError) Error() string {
+	return fmt.Sprintf("%d tokens of the batch were not stored", len(e))
+}
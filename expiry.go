@@ -0,0 +1,137 @@
+package boltdb
+
+import (
+	"context"
+	"time"
+)
+
+// ExpiryStrategy decides when the expired tokens are deleted. Expired tokens are
+// never returned, whatever the strategy, but they take space until deleted.
+// Use SweepExpiry, LazyExpiry or HybridExpiry, or implement your own
+type ExpiryStrategy interface {
+	// Start starts deleting the expired tokens of ts, usually calling ts.DeleteExpired,
+	// until ctx is done. The returned function is called once when the store is closed
+	Start(ctx context.Context, ts *TokenStore) (stop func() error)
+	// DeleteOnRead reports if the expired tokens found while reading are deleted right away
+	DeleteOnRead() bool
+}
+
+var (
+	// SweepExpiry deletes the expired tokens from a background cleaner that wakes up when the
+	// next token expires, at least once per Config.CleanupInterval. It's the default strategy
+	SweepExpiry ExpiryStrategy = sweepStrategy{}
+
+	// LazyExpiry only deletes the expired tokens found while reading, without any background I/O.
+	// Tokens that are never read again are kept until DeleteExpired is called
+	LazyExpiry ExpiryStrategy = lazyStrategy{}
+
+	// HybridExpiry deletes the expired tokens found while reading and sweeps the rest from
+	// the background cleaner
+	HybridExpiry ExpiryStrategy = sweepStrategy{deleteOnRead: true}
+)
+
+// sweepStrategy runs the TokenStoreCleaner
+type sweepStrategy struct {
+	deleteOnRead bool
+}
+
+// Start starts the cleaner, which sweeps one last time when stopped
+func (s sweepStrategy) Start(ctx context.Context, ts *TokenStore) func() error {
+	tsc := &TokenStoreCleaner{
+		ts:       ts,
+		interval: ts.cleanupInterval,
+	}
+
+	tsc.monitor(ctx)
+
+	return tsc.close
+}
+
+// DeleteOnRead reports if the strategy is hybrid
+func (s sweepStrategy) DeleteOnRead() bool {
+	return s.deleteOnRead
+}
+
+// lazyStrategy has no background work
+type lazyStrategy struct{}
+
+// Start does nothing
+func (lazyStrategy) Start(ctx context.Context, ts *TokenStore) func() error {
+	return func() error {
+		return nil
+	}
+}
+
+// DeleteOnRead is always true
+func (lazyStrategy) DeleteOnRead() bool {
+	return true
+}
+
+// SweepIOLimit limits the disk time sweeps take from the reads. Each limit set shrinks the
+// transactions of the sweep, which pauses between them
+type SweepIOLimit struct {
+	// KeysPerSecond is the maximum rate of expired keys deleted. The keys are deleted on
+	// transactions of a tenth of it, or Config.CleanupBatchSize when smaller
+	KeysPerSecond int
+	// MaxTxDuration is the time a sweep transaction should take. The number of keys of each
+	// transaction adapts to the time the previous one took, and the sweep pauses as long as
+	// each transaction took, so it holds the write lock at most half of the time
+	MaxTxDuration time.Duration
+}
+
+// enabled reports if any limit is set
+func (l SweepIOLimit) enabled() bool {
+	return l.KeysPerSecond > 0 || l.MaxTxDuration > 0
+}
+
+// batchSize returns the number of keys of the first transaction of a sweep, up to max
+func (l SweepIOLimit) batchSize(max int) int {
+	if l.KeysPerSecond > 0 && l.KeysPerSecond/10 < max {
+		return maxInt(1, l.KeysPerSecond/10)
+	}
+
+	return max
+}
+
+// nextBatchSize returns the number of keys of the next transaction, up to the first one,
+// after a transaction deleted n keys in took
+func (l SweepIOLimit) nextBatchSize(first, n int, took time.Duration) int {
+	if l.MaxTxDuration <= 0 || n == 0 || took <= 0 {
+		return first
+	}
+
+	next := int(int64(n) * int64(l.MaxTxDuration) / int64(took))
+	if next > first {
+		return first
+	}
+
+	return maxInt(1, next)
+}
+
+// pause returns how long the sweep started at start waits after a transaction that took took,
+// having deleted deleted keys so far
+func (l SweepIOLimit) pause(start time.Time, deleted int, took time.Duration) time.Duration {
+	var pause time.Duration
+
+	if l.MaxTxDuration > 0 {
+		pause = took
+	}
+
+	if l.KeysPerSecond > 0 {
+		due := start.Add(time.Duration(deleted) * time.Second / time.Duration(l.KeysPerSecond))
+		if wait := time.Until(due); wait > pause {
+			pause = wait
+		}
+	}
+
+	return pause
+}
+
+// maxInt returns the larger of a and b
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,139 @@
+package boltdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// importBatchSize is the number of tokens Import stores per transaction
+const importBatchSize = 1000
+
+// Export writes the active codes and token pairs to w as JSON lines, one
+// go-oauth2 models.Token per line, whatever the codec of the store
+func (ts *TokenStore) Export(w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	return ts.eachToken(func(info oauth2.TokenInfo) error {
+		return enc.Encode(info)
+	})
+}
+
+// ExportTo copies the active codes and token pairs to another token store, like
+// the redis or mysql stores of go-oauth2, to migrate away from this one
+func (ts *TokenStore) ExportTo(dst oauth2.TokenStore) error {
+	return ts.eachToken(dst.Create)
+}
+
+// eachToken calls fn with every active code and token pair
+func (ts *TokenStore) eachToken(fn func(info oauth2.TokenInfo) error) error {
+	opts := ListOptions{}
+
+	for {
+		infos, cursor, err := ts.ListTokens(opts)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "" {
+			return nil
+		}
+
+		opts.Cursor = cursor
+	}
+}
+
+// Import stores the tokens of r, in the JSON lines format written by Export, on batches
+// of importBatchSize tokens. The token information stored by the redis and mysql stores
+// of go-oauth2 is a models.Token in JSON too, so their values can be imported as is.
+// Expired tokens are skipped. Tokens that can't be stored are reported by their line,
+// starting at 0, on a BatchError while the rest are stored
+func (ts *TokenStore) Import(r io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	importErr := BatchError{}
+
+	var batch []oauth2.TokenInfo
+	var lines []int
+
+	flush := func() error {
+		err := ts.CreateBatch(batch)
+
+		if batchErr, ok := err.(BatchError); ok {
+			for i, err := range batchErr {
+				importErr[lines[i]] = err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		batch, lines = batch[:0], lines[:0]
+		return nil
+	}
+
+	for line := 0; ; line++ {
+		var tm models.Token
+
+		err := dec.Decode(&tm)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if tokenExpired(&tm, ts.clock.Now()) {
+			continue
+		}
+
+		batch = append(batch, &tm)
+		lines = append(lines, line)
+
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(importErr) > 0 {
+		return importErr
+	}
+
+	return nil
+}
+
+// tokenExpired reports if the code, or the access and refresh tokens, expired before now
+func tokenExpired(info oauth2.TokenInfo, now time.Time) bool {
+	if info.GetCode() != "" {
+		return expiredAt(info.GetCodeCreateAt(), info.GetCodeExpiresIn(), now)
+	}
+
+	if info.GetRefresh() != "" {
+		return expiredAt(info.GetRefreshCreateAt(), info.GetRefreshExpiresIn(), now)
+	}
+
+	return expiredAt(info.GetAccessCreateAt(), info.GetAccessExpiresIn(), now)
+}
+
+// expiredAt reports if a token created at createAt that expires in expiresIn expired before now.
+// Tokens without an expiration never expire
+func expiredAt(createAt time.Time, expiresIn time.Duration, now time.Time) bool {
+	return expiresIn > 0 && !createAt.Add(expiresIn).After(now)
+}
@@ -0,0 +1,166 @@
+package boltdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// exportedLines returns the number of lines ts exports
+func exportedLines(t *testing.T, ts *TokenStore) int {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	if err := ts.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := 0
+	for scanner := bufio.NewScanner(&buf); scanner.Scan(); {
+		lines++
+	}
+
+	return lines
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		from Config
+		to   Config
+	}{
+		{"json", Config{}, Config{}},
+		{"gob to msgpack", Config{Codec: GobCodec}, Config{Codec: MsgpackCodec}},
+		{"encrypted to sharded", Config{EncryptionKey: testOldKey}, Config{Shards: 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := newTestStore(t, tt.from)
+			now := time.Now()
+
+			for _, token := range []oauth2.TokenInfo{
+				&models.Token{ClientID: "client", Code: "code", CodeCreateAt: now, CodeExpiresIn: time.Hour},
+				&models.Token{
+					ClientID:         "client",
+					UserID:           "user",
+					Scope:            "read",
+					Access:           "access",
+					AccessCreateAt:   now,
+					AccessExpiresIn:  time.Hour,
+					Refresh:          "refresh",
+					RefreshCreateAt:  now,
+					RefreshExpiresIn: 24 * time.Hour,
+				},
+				&models.Token{Access: "expired", AccessCreateAt: now.Add(-time.Hour), AccessExpiresIn: time.Minute},
+			} {
+				if err := from.Create(token); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var buf bytes.Buffer
+
+			if err := from.Export(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			to := newTestStore(t, tt.to)
+
+			if err := to.Import(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			if info, err := to.GetByCode("code"); err != nil || info.GetClientID() != "client" {
+				t.Errorf("GetByCode = %v, %v, want the exported code", info, err)
+			}
+
+			info, err := to.GetByRefresh("refresh")
+			if err != nil || info.GetAccess() != "access" || info.GetScope() != "read" || info.GetUserID() != "user" {
+				t.Errorf("GetByRefresh = %v, %v, want the exported pair", info, err)
+			}
+
+			if _, err := to.GetByAccess("expired"); err != ErrTokenNotFound {
+				t.Errorf("GetByAccess(expired) = %v, want ErrTokenNotFound", err)
+			}
+		})
+	}
+}
+
+// importLine returns an exported access token of user, expiring after ttl
+func importLine(t *testing.T, access, user string, ttl time.Duration) string {
+	t.Helper()
+
+	jv, err := json.Marshal(&models.Token{UserID: user, Access: access, AccessCreateAt: time.Now(), AccessExpiresIn: ttl})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(jv) + "\n"
+}
+
+func TestImport(t *testing.T) {
+	var overABatch strings.Builder
+	for i := 0; i <= importBatchSize; i++ {
+		overABatch.WriteString(importLine(t, fmt.Sprintf("access-%d", i), "", time.Hour))
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		input  string
+		// failed are the lines of the BatchError, nil when Import doesn't fail with one
+		failed   []int
+		err      bool
+		imported int
+	}{
+		{"empty", Config{}, "", nil, false, 0},
+		{"expired tokens are skipped", Config{}, importLine(t, "a", "", time.Hour) + importLine(t, "b", "", -time.Minute), nil, false, 1},
+		{"over a batch", Config{}, overABatch.String(), nil, false, importBatchSize + 1},
+		{"invalid line", Config{}, importLine(t, "a", "", time.Hour) + "{not json\n", nil, true, 0},
+		{
+			"tokens that can't be stored",
+			Config{MaxTokensPerUser: 1},
+			importLine(t, "a", "user", time.Hour) + importLine(t, "b", "user", time.Hour) + importLine(t, "c", "other", time.Hour),
+			[]int{1},
+			true,
+			2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestStore(t, tt.config)
+
+			err := ts.Import(strings.NewReader(tt.input))
+			if (err != nil) != tt.err {
+				t.Fatalf("Import = %v, want failing: %v", err, tt.err)
+			}
+
+			if tt.failed != nil {
+				batchErr, ok := err.(BatchError)
+				if !ok || len(batchErr) != len(tt.failed) {
+					t.Fatalf("Import = %v, want the lines %v failed", err, tt.failed)
+				}
+
+				for _, line := range tt.failed {
+					if batchErr[line] == nil {
+						t.Fatalf("Import = %v, want the lines %v failed", batchErr, tt.failed)
+					}
+				}
+			}
+
+			if imported := exportedLines(t, ts); imported != tt.imported {
+				t.Fatalf("imported %d tokens, want %d", imported, tt.imported)
+			}
+		})
+	}
+}
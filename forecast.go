@@ -0,0 +1,195 @@
+package boltdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultForecastHorizons are the horizons of the ExpiryForecastHandler: an hour, a day and a week
+var DefaultForecastHorizons = []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// forecastCache keeps the forecasts computed since the last sweep, by their horizons
+type forecastCache struct {
+	mu        sync.Mutex
+	forecasts map[string]map[time.Duration]int
+}
+
+// get returns a copy of the cached forecast of horizons
+func (c *forecastCache) get(horizons string) (map[time.Duration]int, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	forecast, ok := c.forecasts[horizons]
+	if !ok {
+		return nil, false
+	}
+
+	return copyForecast(forecast), true
+}
+
+// add caches the forecast of horizons
+func (c *forecastCache) add(horizons string, forecast map[time.Duration]int) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.forecasts == nil {
+		c.forecasts = map[string]map[time.Duration]int{}
+	}
+
+	c.forecasts[horizons] = copyForecast(forecast)
+}
+
+// reset forgets the cached forecasts, once a sweep changed the TTL bucket
+func (c *forecastCache) reset() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.forecasts = nil
+	c.mu.Unlock()
+}
+
+// copyForecast returns a copy of forecast, so callers can't change the cached one
+func copyForecast(forecast map[time.Duration]int) map[time.Duration]int {
+	copied := make(map[time.Duration]int, len(forecast))
+	for horizon, n := range forecast {
+		copied[horizon] = n
+	}
+
+	return copied
+}
+
+// ExpiryForecast returns, for every horizon, how many codes, access and refresh tokens expire
+// from now until then, with a range scan of the TTL bucket. Tokens that never expire and the
+// expired ones waiting for the sweep are not counted. With Config.CacheExpiryForecast the
+// forecasts are reused until the next sweep, so they miss the tokens created meanwhile
+func (ts *TokenStore) ExpiryForecast(horizons []time.Duration) (map[time.Duration]int, error) {
+	cacheKey := forecastKey(horizons)
+
+	if forecast, ok := ts.forecasts.get(cacheKey); ok {
+		return forecast, nil
+	}
+
+	sorted := append([]time.Duration(nil), horizons...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	forecast := make(map[time.Duration]int, len(horizons))
+	for _, horizon := range horizons {
+		forecast[horizon] = 0
+	}
+
+	if len(sorted) == 0 || sorted[len(sorted)-1] <= 0 {
+		return forecast, nil
+	}
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		bucket := ts.tokenBucket(tx)
+		now := ts.clock.Now()
+
+		ts.ttlBuckets(tx).due(now.Add(sorted[len(sorted)-1]), func(ttlKey, key []byte) bool {
+			expiration := ttlKeyTime(ttlKey)
+			if !expiration.After(now) || !ts.isTokenKey(bucket, key) {
+				return true
+			}
+
+			for _, horizon := range sorted {
+				if !expiration.After(now.Add(horizon)) {
+					forecast[horizon]++
+				}
+			}
+
+			return true
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	ts.forecasts.add(cacheKey, forecast)
+
+	return forecast, nil
+}
+
+// isTokenKey reports if key is a code, access or refresh token, and not a basic ID
+// holding token information or the key of another record sharing the TTL bucket
+func (ts *TokenStore) isTokenKey(bucket tokenBucket, key []byte) bool {
+	value := bucket.Get(key)
+	if value == nil {
+		return false
+	}
+
+	stored, err := ts.decodeStored(value)
+	if err != nil || stored == nil {
+		// access and refresh tokens point to a basic ID
+		return true
+	}
+
+	return stored.Code != ""
+}
+
+// forecastKey returns the cache key of horizons
+func forecastKey(horizons []time.Duration) string {
+	keys := make([]string, len(horizons))
+	for i, horizon := range horizons {
+		keys[i] = horizon.String()
+	}
+
+	return strings.Join(keys, ",")
+}
+
+// ExpiryForecastHandler returns an http.Handler that writes the ExpiryForecast as a JSON
+// object by horizon, like {"1h0m0s": 42}. The horizons are set with a comma separated
+// within query parameter, like ?within=1h,24h, and default to DefaultForecastHorizons
+func (ts *TokenStore) ExpiryForecastHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		horizons := DefaultForecastHorizons
+
+		if within := r.URL.Query().Get("within"); within != "" {
+			horizons = nil
+
+			for _, s := range strings.Split(within, ",") {
+				horizon, err := time.ParseDuration(strings.TrimSpace(s))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				horizons = append(horizons, horizon)
+			}
+		}
+
+		forecast, err := ts.ExpiryForecast(horizons)
+		if err != nil {
+			ts.logger.Printf("boltdb: expiry forecast: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		byName := make(map[string]int, len(forecast))
+		for horizon, n := range forecast {
+			byName[horizon.String()] = n
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(byName)
+	})
+}
@@ -0,0 +1,183 @@
+package boltdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// forecastStore returns a store with an expired access token, a code expiring in 10 minutes,
+// a pair expiring in an hour and a day, a token that never expires and a device request
+func forecastStore(t *testing.T, config Config) (*TokenStore, *testutil.FakeClock) {
+	t.Helper()
+
+	clock := testutil.NewFakeClock(time.Now())
+	config.Clock = clock
+	config.ExpiryStrategy = LazyExpiry
+
+	ts := newTestStore(t, config)
+
+	err := ts.Create(&models.Token{Access: "expired", AccessCreateAt: clock.Now(), AccessExpiresIn: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(2 * time.Minute)
+
+	for _, token := range []*models.Token{
+		{Code: "code", CodeCreateAt: clock.Now(), CodeExpiresIn: 10 * time.Minute},
+		{
+			Access:           "access",
+			AccessCreateAt:   clock.Now(),
+			AccessExpiresIn:  time.Hour,
+			Refresh:          "refresh",
+			RefreshCreateAt:  clock.Now(),
+			RefreshExpiresIn: 24 * time.Hour,
+		},
+		{Access: "forever", AccessCreateAt: clock.Now()},
+	} {
+		if err := ts.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = NewDeviceStore(ts).Create(&DeviceAuthorization{DeviceCode: "device", UserCode: "USER", ExpiresIn: 30 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ts, clock
+}
+
+func TestExpiryForecast(t *testing.T) {
+	tests := []struct {
+		name     string
+		horizons []time.Duration
+		want     map[time.Duration]int
+	}{
+		{"nothing due", []time.Duration{5 * time.Minute}, map[time.Duration]int{5 * time.Minute: 0}},
+		{"code", []time.Duration{15 * time.Minute}, map[time.Duration]int{15 * time.Minute: 1}},
+		{"code and access token", []time.Duration{2 * time.Hour}, map[time.Duration]int{2 * time.Hour: 2}},
+		{
+			"unsorted horizons",
+			[]time.Duration{48 * time.Hour, 15 * time.Minute},
+			map[time.Duration]int{48 * time.Hour: 3, 15 * time.Minute: 1},
+		},
+		{"no horizons", nil, map[time.Duration]int{}},
+		{"past horizon", []time.Duration{-time.Hour}, map[time.Duration]int{-time.Hour: 0}},
+	}
+
+	ts, _ := forecastStore(t, Config{})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forecast, err := ts.ExpiryForecast(tt.horizons)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(forecast) != len(tt.want) {
+				t.Fatalf("ExpiryForecast = %v, want %v", forecast, tt.want)
+			}
+
+			for horizon, n := range tt.want {
+				if forecast[horizon] != n {
+					t.Fatalf("ExpiryForecast = %v, want %v", forecast, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestExpiryForecastCache(t *testing.T) {
+	tests := []struct {
+		name   string
+		cached bool
+		// before and after the sweep, of the tokens expiring within an hour
+		beforeSweep int
+		afterSweep  int
+	}{
+		{"not cached", false, 3, 3},
+		{"cached until the sweep", true, 2, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, clock := forecastStore(t, Config{CacheExpiryForecast: tt.cached})
+			horizons := []time.Duration{time.Hour}
+
+			if _, err := ts.ExpiryForecast(horizons); err != nil {
+				t.Fatal(err)
+			}
+
+			err := ts.Create(&models.Token{Access: "new", AccessCreateAt: clock.Now(), AccessExpiresIn: time.Minute})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			forecast, err := ts.ExpiryForecast(horizons)
+			if err != nil || forecast[time.Hour] != tt.beforeSweep {
+				t.Fatalf("ExpiryForecast before the sweep = %v, %v, want %d", forecast, err, tt.beforeSweep)
+			}
+
+			if _, err := ts.sweep(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			forecast, err = ts.ExpiryForecast(horizons)
+			if err != nil || forecast[time.Hour] != tt.afterSweep {
+				t.Fatalf("ExpiryForecast after the sweep = %v, %v, want %d", forecast, err, tt.afterSweep)
+			}
+		})
+	}
+}
+
+func TestExpiryForecastHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		status int
+		want   map[string]int
+	}{
+		{"horizons", "/forecast?within=15m,2h", http.StatusOK, map[string]int{"15m0s": 1, "2h0m0s": 2}},
+		{"invalid horizon", "/forecast?within=soon", http.StatusBadRequest, nil},
+	}
+
+	ts, _ := forecastStore(t, Config{})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ts.ExpiryForecastHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			if tt.want == nil {
+				return
+			}
+
+			var got map[string]int
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("forecast = %v, want %v", got, tt.want)
+			}
+
+			for horizon, n := range tt.want {
+				if got[horizon] != n {
+					t.Fatalf("forecast = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
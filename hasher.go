@@ -0,0 +1,57 @@
+package boltdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// KeyHasher derives the bucket key of a code, access or refresh token, so long tokens
+// like JWTs don't bloat the bucket. Lookups hash the presented token the same way.
+// Changing the hasher of an existing database makes its tokens unreachable
+type KeyHasher interface {
+	HashKey(token string) []byte
+}
+
+// KeyHasherFunc adapts a function, e.g. one that extracts the jti claim of a JWT, to KeyHasher
+type KeyHasherFunc func(token string) []byte
+
+// HashKey calls f(token)
+func (f KeyHasherFunc) HashKey(token string) []byte {
+	return f(token)
+}
+
+// SHA256KeyHasher stores the SHA-256 of the tokens as keys
+var SHA256KeyHasher KeyHasher = KeyHasherFunc(func(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+})
+
+// hmacKeyHasher stores the HMAC-SHA256, keyed with secret, of the keys returned by hasher,
+// or of the tokens when nil
+func hmacKeyHasher(hasher KeyHasher, secret []byte) KeyHasher {
+	return KeyHasherFunc(func(token string) []byte {
+		if hasher != nil {
+			token = string(hasher.HashKey(token))
+		}
+
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(token))
+
+		return mac.Sum(nil)
+	})
+}
+
+// tokenKey returns the bucket key of a code, access or refresh token.
+// Tokens are hashed before the cipher hides them
+func tokenKey(hasher KeyHasher, c *tokenCipher, token string) []byte {
+	if hasher != nil {
+		token = string(hasher.HashKey(token))
+	}
+
+	return c.key(token)
+}
+
+// tokenKey returns the bucket key of a code, access or refresh token
+func (ts *TokenStore) tokenKey(token string) []byte {
+	return tokenKey(ts.keyHasher, ts.cipher, token)
+}
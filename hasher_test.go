@@ -0,0 +1,84 @@
+package boltdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestHashKeysRequiresASecret(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		err    error
+	}{
+		{"secret", Config{HashKeys: true, HashKeysSecret: []byte("secret")}, nil},
+		{"encryption key", Config{HashKeys: true, EncryptionKey: testOldKey}, nil},
+		{"neither", Config{HashKeys: true}, ErrHashKeysSecretRequired},
+		{"not hashed", Config{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.DbName = filepath.Join(t.TempDir(), "oauth2.db")
+			config.BucketName = "oauthTokens"
+
+			if err := config.Validate(); err != tt.err {
+				t.Fatalf("Validate = %v, want %v", err, tt.err)
+			}
+
+			db, err := bolt.Open(config.DbName, 0600, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			_, closeFn, err := NewTokenStoreWithDB(db, &config)
+			if err != tt.err {
+				t.Fatalf("NewTokenStoreWithDB = %v, want %v", err, tt.err)
+			}
+
+			if err == nil {
+				closeFn()
+			}
+		})
+	}
+}
+
+func TestHashKeysAreKeyedWithTheSecret(t *testing.T) {
+	a := (&Config{HashKeys: true, HashKeysSecret: []byte("a")}).keyHasher().HashKey("access")
+	b := (&Config{HashKeys: true, HashKeysSecret: []byte("b")}).keyHasher().HashKey("access")
+
+	if bytes.Equal(a, b) {
+		t.Fatal("hashed keys don't depend on the secret")
+	}
+}
+
+func TestRotateEncryptionKeyRehashesKeys(t *testing.T) {
+	now := time.Now()
+
+	// without a secret of its own, HashKeys is keyed with the rotated key
+	ts := rotatedStore(t, &Config{HashKeys: true}, func(ts *TokenStore) {
+		err := ts.Create(&models.Token{
+			Access:           "access",
+			AccessCreateAt:   now,
+			AccessExpiresIn:  time.Hour,
+			Refresh:          "refresh",
+			RefreshCreateAt:  now,
+			RefreshExpiresIn: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	info, err := ts.GetByRefresh("refresh")
+	if err != nil || info == nil || info.GetAccess() != "access" {
+		t.Fatalf("GetByRefresh = %v, %v, want the stored pair", info, err)
+	}
+}
@@ -0,0 +1,131 @@
+package boltdb
+
+import (
+	"bytes"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// TokenEvent describes the tokens a hook is called for
+type TokenEvent struct {
+	// Code, Access and Refresh are the tokens created, removed or expired, empty when not affected
+	Code    string
+	Access  string
+	Refresh string
+	UserID  string
+	// ClientID is the client the tokens were issued to
+	ClientID string
+	// Reason is the revocation reason of OnRemove events
+	Reason string
+}
+
+// Hooks are called when tokens are created, removed or expired by the cleaner.
+// They run once the transaction is committed, outside of it, but on the goroutine
+// that wrote it, so they should hand the event off instead of blocking
+type Hooks struct {
+	// OnCreate is called for every token information stored
+	OnCreate func(event TokenEvent)
+	// OnRemove is called for the tokens removed by RemoveBy*, Revoke and RevokeBy*
+	OnRemove func(event TokenEvent)
+	// OnExpire is called for the expired tokens deleted by the cleaner or, when
+	// the expiry strategy does so, while reading
+	OnExpire func(event TokenEvent)
+}
+
+// enabled reports if any hook is set
+func (h Hooks) enabled() bool {
+	return h.OnCreate != nil || h.OnRemove != nil || h.OnExpire != nil
+}
+
+// createEvent returns the event of storing info
+func createEvent(info tokenKeys) TokenEvent {
+	return TokenEvent{
+		Code:     info.GetCode(),
+		Access:   info.GetAccess(),
+		Refresh:  info.GetRefresh(),
+		UserID:   info.GetUserID(),
+		ClientID: info.GetClientID(),
+	}
+}
+
+// onCommit calls hook with the events once tx is committed
+func onCommit(tx *bolt.Tx, hook func(TokenEvent), events ...TokenEvent) {
+	if hook == nil || len(events) == 0 {
+		return
+	}
+
+	tx.OnCommit(func() {
+		for _, event := range events {
+			hook(event)
+		}
+	})
+}
+
+// deleteEvents returns the events of deleting keys, one per token information.
+// It must be called before the keys are deleted
+func (ts *TokenStore) deleteEvents(tx *bolt.Tx, reason string, keys ...[]byte) []TokenEvent {
+	if !ts.hooks.enabled() {
+		return nil
+	}
+
+	return ts.tokenEvents(tx, reason, keys...)
+}
+
+// tokenEvents returns the events of keys, one per token information
+func (ts *TokenStore) tokenEvents(tx *bolt.Tx, reason string, keys ...[]byte) []TokenEvent {
+	bucket := ts.tokenBucket(tx)
+
+	var events []TokenEvent
+	byInfo := map[string]int{}
+
+	for _, key := range keys {
+		value := bucket.Get(key)
+		if value == nil {
+			continue
+		}
+
+		infoKey := key
+
+		stored, err := ts.decodeStored(value)
+		if err != nil || stored == nil {
+			// key is an access or refresh token pointing to a basic ID
+			infoKey = value
+
+			stored, _ = ts.decodeStored(bucket.Get(value))
+			if stored == nil {
+				continue
+			}
+		}
+
+		i, ok := byInfo[string(infoKey)]
+		if !ok {
+			i = len(events)
+			byInfo[string(infoKey)] = i
+
+			events = append(events, TokenEvent{
+				UserID:   stored.UserID,
+				ClientID: stored.ClientID,
+				Reason:   reason,
+			})
+		}
+
+		switch {
+		case stored.Code != "":
+			events[i].Code = stored.Code
+		case stored.Access != "" && bytes.Equal(key, ts.tokenKey(stored.Access)):
+			events[i].Access = stored.Access
+		case stored.Refresh != "" && bytes.Equal(key, ts.tokenKey(stored.Refresh)):
+			events[i].Refresh = stored.Refresh
+		}
+	}
+
+	// the basic ID holding the token information is not a token
+	filtered := events[:0]
+	for _, event := range events {
+		if event.Code != "" || event.Access != "" || event.Refresh != "" {
+			filtered = append(filtered, event)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,49 @@
+package boltdb
+
+import "crypto/rand"
+
+// IDGenerator returns the basic IDs the token pairs are stored under. Empty IDs, IDs longer
+// than 64 bytes, IDs already stored, and IDs that would be read as token information are regenerated
+type IDGenerator func() []byte
+
+// maxIDSize is the size of the longest basic ID. Longer values are token information, so
+// Vacuum never takes them for mappings
+const maxIDSize = 64
+
+// maxIDAttempts is how many IDs a store generates for a token pair before giving up
+const maxIDAttempts = 10
+
+// randomUUID returns a random version 4 UUID, read from crypto/rand, like the basic IDs of
+// previous versions, which are still read as they are
+func randomUUID() []byte {
+	id := make([]byte, 16)
+
+	// crypto/rand only fails when the OS has no entropy source, which can't be recovered from
+	if _, err := rand.Read(id); err != nil {
+		panic("boltdb: read random id: " + err.Error())
+	}
+
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return id
+}
+
+// newBasicID returns a new basic ID for bucket. Mappings from the tokens to the basic ID must not
+// decode as token information, so IDs that do are regenerated like the empty and stored ones
+func (ts *TokenStore) newBasicID(bucket tokenBucket) ([]byte, error) {
+	for i := 0; i < maxIDAttempts; i++ {
+		id := ts.newID()
+		if len(id) == 0 || len(id) > maxIDSize || bucket.Get(id) != nil {
+			continue
+		}
+
+		if stored, err := ts.decodeStored(id); err == nil && stored != nil {
+			continue
+		}
+
+		return id, nil
+	}
+
+	return nil, ErrInvalidID
+}
@@ -0,0 +1,54 @@
+package boltdb
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestCreateRegeneratesUnusableIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []string
+		err  error
+	}{
+		{"usable", []string{"id-1", "id-2"}, nil},
+		{"empty", []string{"", "id-1", "id-2"}, nil},
+		{"already stored", []string{"id-1", "id-1", "id-2"}, nil},
+		{"token information", []string{`{"Access":"access"}`, "id-1", "id-2"}, nil},
+		{"never usable", []string{"id-1", "", "", "", "", "", "", "", "", "", ""}, ErrInvalidID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := 0
+
+			ts := newTestStore(t, Config{IDGenerator: func() []byte {
+				id := tt.ids[next%len(tt.ids)]
+				next++
+				return []byte(id)
+			}})
+
+			var err error
+
+			for i := 1; i <= 2 && err == nil; i++ {
+				err = ts.Create(benchPair("", i))
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Create = %v, want %v", err, tt.err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			for i := 1; i <= 2; i++ {
+				info, err := ts.GetByAccess("access-" + strconv.Itoa(i))
+				if err != nil || info == nil || info.GetRefresh() != "refresh-"+strconv.Itoa(i) {
+					t.Fatalf("GetByAccess = %v, %v, want pair %d", info, err, i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// indexSeparator separates the indexed value from the token key on index keys
+const indexSeparator = 0x00
+
+// tokenIndex is a secondary index bucket from a token field to the keys holding
+// the token information: the code for authorization codes, the basic ID otherwise.
+// Values are keyed with the cipher, unless the index is sorted by them
+type tokenIndex struct {
+	bucketName []byte
+	values     func(stored *storedToken) []string
+	sorted     bool
+}
+
+// indexes returns the secondary indexes of the store
+func (ts *TokenStore) indexes() []tokenIndex {
+	return []tokenIndex{
+		{
+			bucketName: ts.bucketUserIndexName,
+			values: func(stored *storedToken) []string {
+				return []string{stored.UserID}
+			},
+		},
+		{
+			bucketName: ts.bucketClientIndexName,
+			values: func(stored *storedToken) []string {
+				return []string{stored.ClientID}
+			},
+		},
+		{
+			bucketName: ts.bucketScopeIndexName,
+			values: func(stored *storedToken) []string {
+				return strings.Fields(stored.Scope)
+			},
+		},
+		{
+			bucketName: ts.bucketCreatedIndexName,
+			values: func(stored *storedToken) []string {
+				// only token pairs are preloaded into the cache, by their access token
+				if stored.Access == "" || stored.AccessCreateAt.IsZero() {
+					return nil
+				}
+
+				return []string{string(ttlTime(stored.AccessCreateAt))}
+			},
+			sorted: true,
+		},
+	}
+}
+
+// indexPrefix returns the prefix of all the index keys of value
+func (ts *TokenStore) indexPrefix(value string) []byte {
+	return append(ts.cipher.key(value), indexSeparator)
+}
+
+// keyPrefix returns the prefix of the keys of value on idx
+func (ts *TokenStore) keyPrefix(idx tokenIndex, value string) []byte {
+	if idx.sorted {
+		return append([]byte(value), indexSeparator)
+	}
+
+	return ts.indexPrefix(value)
+}
+
+// index adds the token information stored under key to the secondary indexes
+func (ts *TokenStore) index(tx *bolt.Tx, key []byte, stored *storedToken) error {
+	for _, idx := range ts.indexes() {
+		bucket := tx.Bucket(idx.bucketName)
+
+		for _, value := range idx.values(stored) {
+			if value == "" {
+				continue
+			}
+
+			err := bucket.Put(append(ts.keyPrefix(idx, value), key...), key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// unindex deletes the secondary index entries of key when it holds token information
+func (ts *TokenStore) unindex(tx *bolt.Tx, key []byte) error {
+	stored, err := ts.decodeStored(ts.tokenBucket(tx).Get(key))
+	if err != nil || stored == nil {
+		// mappings from tokens to basic IDs are not indexed
+		return nil
+	}
+
+	for _, idx := range ts.indexes() {
+		bucket := tx.Bucket(idx.bucketName)
+
+		for _, value := range idx.values(stored) {
+			err := bucket.Delete(append(ts.keyPrefix(idx, value), key...))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// decodeStored decodes the keys and indexed fields of a stored token information,
+// nil when value is a mapping from a token to its basic ID
+func (ts *TokenStore) decodeStored(value []byte) (*storedToken, error) {
+	jv, err := ts.cipher.open(value)
+	if err != nil || jv == nil {
+		return nil, err
+	}
+
+	var stored storedToken
+	err = ts.codec.Unmarshal(jv, &stored)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isTokenInfo(stored.Code, stored.Access, stored.Refresh) {
+		return nil, nil
+	}
+
+	return &stored, nil
+}
+
+// indexedKeys returns the keys holding token information indexed under value
+func (ts *TokenStore) indexedKeys(tx *bolt.Tx, bucketName []byte, value string) [][]byte {
+	var keys [][]byte
+
+	bucket := tx.Bucket(bucketName)
+	if bucket == nil {
+		// indexes created by a migration are missing on older read-only databases
+		return nil
+	}
+
+	prefix := ts.indexPrefix(value)
+	c := bucket.Cursor()
+
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		keys = append(keys, append([]byte(nil), v...))
+	}
+
+	return keys
+}
+
+// revokeIndexed deletes all the tokens indexed under value on a single transaction,
+// returning the number of codes and token pairs deleted
+func (ts *TokenStore) revokeIndexed(ctx context.Context, bucketName []byte, value, reason string) (int, error) {
+	var revoked, codesRevoked int
+
+	if ts.codes != nil {
+		var err error
+
+		// the code store has the same bucket names
+		codesRevoked, err = ts.codes.revokeIndexed(ctx, bucketName, value, reason)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err := ts.update(ctx, func(tx *bolt.Tx) error {
+		// batched transactions can be retried
+		revoked = 0
+
+		for _, key := range ts.indexedKeys(tx, bucketName, value) {
+			keys, err := ts.rootFamily(tx, key)
+			if err != nil {
+				return err
+			}
+
+			err = ts.deleteKeys(tx, reason, keys...)
+			if err != nil {
+				return err
+			}
+
+			// entries of tokens deleted before they were indexed
+			err = tx.Bucket(bucketName).Delete(append(ts.indexPrefix(value), key...))
+			if err != nil {
+				return err
+			}
+
+			revoked++
+		}
+
+		return nil
+	})
+
+	return revoked + codesRevoked, err
+}
+
+// RebuildIndexes recreates the secondary indexes from the stored token information.
+// Use it to index the tokens created before an index existed
+func (ts *TokenStore) RebuildIndexes() error {
+	return ts.update(context.Background(), ts.rebuildIndexes)
+}
+
+// rebuildIndexes recreates the secondary indexes inside tx
+func (ts *TokenStore) rebuildIndexes(tx *bolt.Tx) error {
+	for _, idx := range ts.indexes() {
+		err := tx.DeleteBucket(idx.bucketName)
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		_, err = tx.CreateBucket(idx.bucketName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ts.tokenBucket(tx).ForEach(func(k, v []byte) error {
+		stored, err := ts.decodeStored(v)
+		if err != nil || stored == nil {
+			// mappings from tokens to basic IDs are not indexed
+			return nil
+		}
+
+		return ts.index(tx, k, stored)
+	})
+}
+
+// RevokeByUserID deletes all the codes, access and refresh tokens of the user on a single transaction.
+// Tokens created before the user index existed are not found until RebuildIndexes is called
+func (ts *TokenStore) RevokeByUserID(userID string) error {
+	_, err := ts.revokeIndexed(context.Background(), ts.bucketUserIndexName, userID, ReasonUserRevoked)
+	return err
+}
+
+// RevokeByClientID deletes all the codes, access and refresh tokens issued to the client on a single transaction.
+// Tokens created before the client index existed are not found until RebuildIndexes is called
+func (ts *TokenStore) RevokeByClientID(clientID string) error {
+	_, err := ts.revokeIndexed(context.Background(), ts.bucketClientIndexName, clientID, ReasonClientRevoked)
+	return err
+}
+
+// RevokeByScope deletes all the codes, access and refresh tokens granted the scope on a single transaction,
+// returning the number of codes and token pairs revoked. Scopes are separated by spaces, as in OAuth 2.0
+func (ts *TokenStore) RevokeByScope(scope string) (int, error) {
+	return ts.revokeIndexed(context.Background(), ts.bucketScopeIndexName, scope, ReasonScopeRevoked)
+}
+
+// CountByClientID returns the number of authorization codes and token pairs issued to the client
+func (ts *TokenStore) CountByClientID(clientID string) (int, error) {
+	var count int
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		count = len(ts.indexedKeys(tx, ts.bucketClientIndexName, clientID))
+		return nil
+	})
+
+	if err != nil || ts.codes == nil {
+		return count, err
+	}
+
+	codes, err := ts.codes.CountByClientID(clientID)
+
+	return count + codes, err
+}
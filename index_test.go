@@ -0,0 +1,223 @@
+package boltdb
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+// indexConfigs are the layouts the indexes are checked with
+func indexConfigs(t *testing.T) map[string]func() Config {
+	return map[string]func() Config{
+		"plain": func() Config { return Config{} },
+		"code db": func() Config {
+			return Config{CodeDbName: filepath.Join(t.TempDir(), "codes.db")}
+		},
+		"sharded and hashed": func() Config {
+			return Config{Shards: 4, HashKeys: true, HashKeysSecret: []byte("secret")}
+		},
+	}
+}
+
+// indexStore returns a store with the codes and token pairs of alice and bob on the
+// web and cli clients, named after their user and client
+func indexStore(t *testing.T, config Config) *TokenStore {
+	t.Helper()
+
+	config.RevocationRetention = time.Hour
+	ts := newTestStore(t, config)
+	now := time.Now()
+
+	for _, token := range []*models.Token{
+		{ClientID: "web", UserID: "alice", Code: "alice-web-code", CodeCreateAt: now, CodeExpiresIn: time.Hour},
+		{ClientID: "cli", UserID: "bob", Code: "bob-cli-code", CodeCreateAt: now, CodeExpiresIn: time.Hour},
+		{
+			ClientID: "web", UserID: "alice", Scope: "read",
+			Access: "alice-web", AccessCreateAt: now, AccessExpiresIn: time.Hour,
+			Refresh: "alice-web-refresh", RefreshCreateAt: now, RefreshExpiresIn: time.Hour,
+		},
+		{ClientID: "cli", UserID: "alice", Scope: "read write", Access: "alice-cli", AccessCreateAt: now, AccessExpiresIn: time.Hour},
+		{
+			ClientID: "web", UserID: "bob", Scope: "write",
+			Access: "bob-web", AccessCreateAt: now, AccessExpiresIn: time.Hour,
+			Refresh: "bob-web-refresh", RefreshCreateAt: now, RefreshExpiresIn: time.Hour,
+		},
+	} {
+		if err := ts.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return ts
+}
+
+// remainingTokens returns the sorted tokens of indexStore still stored on ts
+func remainingTokens(t *testing.T, ts *TokenStore) []string {
+	t.Helper()
+
+	remaining := []string{}
+
+	for _, code := range []string{"alice-web-code", "bob-cli-code"} {
+		if _, err := ts.GetByCode(code); err == nil {
+			remaining = append(remaining, code)
+		} else if err != ErrTokenNotFound {
+			t.Fatal(err)
+		}
+	}
+
+	for _, access := range []string{"alice-web", "alice-cli", "bob-web"} {
+		if _, err := ts.GetByAccess(access); err == nil {
+			remaining = append(remaining, access)
+		} else if err != ErrTokenNotFound {
+			t.Fatal(err)
+		}
+	}
+
+	for _, refresh := range []string{"alice-web-refresh", "bob-web-refresh"} {
+		if _, err := ts.GetByRefresh(refresh); err == nil {
+			remaining = append(remaining, refresh)
+		} else if err != ErrTokenNotFound {
+			t.Fatal(err)
+		}
+	}
+
+	sort.Strings(remaining)
+
+	return remaining
+}
+
+// indexTokens is the number of tokens remainingTokens looks for
+const indexTokens = 7
+
+// checkRevocationReasons fails unless every revocation of ts was recorded with reason,
+// and some were recorded when tokens were revoked
+func checkRevocationReasons(t *testing.T, ts *TokenStore, reason string, revoked bool) {
+	t.Helper()
+
+	revocations, err := ts.ListRevocations(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked && len(revocations) == 0 {
+		t.Error("no revocations recorded")
+	}
+
+	for _, revocation := range revocations {
+		if revocation.Reason != reason {
+			t.Errorf("revocation reason = %q, want %q", revocation.Reason, reason)
+		}
+	}
+}
+
+func TestRevokeByUserID(t *testing.T) {
+	tests := []struct {
+		name   string
+		userID string
+		want   []string
+	}{
+		{"alice", "alice", []string{"bob-cli-code", "bob-web", "bob-web-refresh"}},
+		{"bob", "bob", []string{"alice-cli", "alice-web", "alice-web-code", "alice-web-refresh"}},
+		{
+			"unknown user",
+			"carol",
+			[]string{"alice-cli", "alice-web", "alice-web-code", "alice-web-refresh", "bob-cli-code", "bob-web", "bob-web-refresh"},
+		},
+		{
+			"no user",
+			"",
+			[]string{"alice-cli", "alice-web", "alice-web-code", "alice-web-refresh", "bob-cli-code", "bob-web", "bob-web-refresh"},
+		},
+	}
+
+	for configName, config := range indexConfigs(t) {
+		for _, tt := range tests {
+			t.Run(configName+"/"+tt.name, func(t *testing.T) {
+				ts := indexStore(t, config())
+
+				if err := ts.RevokeByUserID(tt.userID); err != nil {
+					t.Fatal(err)
+				}
+
+				if got := remainingTokens(t, ts); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("remaining tokens = %v, want %v", got, tt.want)
+				}
+
+				checkRevocationReasons(t, ts, ReasonUserRevoked, len(tt.want) < indexTokens)
+			})
+		}
+	}
+}
+
+func TestRevokeByClientID(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		want     []string
+	}{
+		{"web", "web", []string{"alice-cli", "bob-cli-code"}},
+		{"cli", "cli", []string{"alice-web", "alice-web-code", "alice-web-refresh", "bob-web", "bob-web-refresh"}},
+		{
+			"unknown client",
+			"mobile",
+			[]string{"alice-cli", "alice-web", "alice-web-code", "alice-web-refresh", "bob-cli-code", "bob-web", "bob-web-refresh"},
+		},
+	}
+
+	for configName, config := range indexConfigs(t) {
+		for _, tt := range tests {
+			t.Run(configName+"/"+tt.name, func(t *testing.T) {
+				ts := indexStore(t, config())
+
+				if err := ts.RevokeByClientID(tt.clientID); err != nil {
+					t.Fatal(err)
+				}
+
+				if got := remainingTokens(t, ts); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("remaining tokens = %v, want %v", got, tt.want)
+				}
+
+				checkRevocationReasons(t, ts, ReasonClientRevoked, len(tt.want) < indexTokens)
+			})
+		}
+	}
+}
+
+func TestCountByClientID(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		// revoke is removed before counting, when set
+		revoke string
+		want   int
+	}{
+		{"web", "web", "", 3},
+		{"cli", "cli", "", 2},
+		{"unknown client", "mobile", "", 0},
+		{"after removing a code", "web", "alice-web-code", 2},
+		{"after removing a pair", "web", "bob-web-refresh", 2},
+	}
+
+	for configName, config := range indexConfigs(t) {
+		for _, tt := range tests {
+			t.Run(configName+"/"+tt.name, func(t *testing.T) {
+				ts := indexStore(t, config())
+
+				if tt.revoke != "" {
+					if err := ts.Revoke(tt.revoke, ReasonRemoved); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				count, err := ts.CountByClientID(tt.clientID)
+				if err != nil || count != tt.want {
+					t.Fatalf("CountByClientID = %d, %v, want %d", count, err, tt.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package boltdb
+
+import (
+	"context"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// TokenType is the kind of token introspected, named like the RFC 7662 token type hints
+type TokenType string
+
+const (
+	// CodeToken is an authorization code
+	CodeToken TokenType = "code"
+	// AccessToken is an access token
+	AccessToken TokenType = "access_token"
+	// RefreshToken is a refresh token
+	RefreshToken TokenType = "refresh_token"
+)
+
+// TokenStatus is the status of an introspected token
+type TokenStatus string
+
+const (
+	// TokenActive tokens are stored and not expired
+	TokenActive TokenStatus = "active"
+	// TokenExpired tokens are stored but their TTL is due, they are deleted on the next sweep
+	TokenExpired TokenStatus = "expired"
+	// TokenRevoked tokens were removed and are still on the revocation log
+	TokenRevoked TokenStatus = "revoked"
+	// TokenUnknown tokens are not stored: they never existed or were swept. Removed tokens are
+	// unknown too, unless Config.RevocationRetention enables the revocation log and keeps them
+	TokenUnknown TokenStatus = "unknown"
+)
+
+// IntrospectionResult describes a token for RFC 7662 introspection
+type IntrospectionResult struct {
+	Status TokenStatus
+	// Type is empty for revoked and unknown tokens
+	Type TokenType
+	// Info is the token information, nil for revoked and unknown tokens
+	Info oauth2.TokenInfo
+	// CreatedAt is when the token was issued
+	CreatedAt time.Time
+	// ExpiresAt is when the token expires, zero when it doesn't
+	ExpiresAt time.Time
+	// ExpiresIn is the remaining TTL of active tokens
+	ExpiresIn time.Duration
+	// Revocation is the revocation log entry of revoked tokens
+	Revocation *Revocation
+}
+
+// Active reports if the token can be used, the active member of an introspection response
+func (r *IntrospectionResult) Active() bool {
+	return r.Status == TokenActive
+}
+
+// Introspect returns the status of a code, access or refresh token, and which one it is.
+// Unlike the Get methods it describes expired tokens instead of returning ErrTokenExpired
+func (ts *TokenStore) Introspect(token string) (*IntrospectionResult, error) {
+	result := &IntrospectionResult{Status: TokenUnknown}
+	key := ts.tokenKey(token)
+
+	var sealed []byte
+	var byBasicID bool
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		bucket := ts.tokenBucket(tx)
+		ttl := ts.ttlBuckets(tx)
+
+		value := bucket.Get(key)
+		if value == nil {
+			revocation, err := ts.revocation(tx, key)
+			if err != nil || revocation == nil {
+				return err
+			}
+
+			result.Status = TokenRevoked
+			result.Revocation = revocation
+			return nil
+		}
+
+		expiry, _ := ttl.expiry(key)
+
+		// codes hold their token information, access and refresh tokens point to a basic ID
+		if stored, err := ts.decodeStored(value); err != nil || stored == nil {
+			basicID := value
+			byBasicID = true
+
+			value = bucket.Get(basicID)
+			if value == nil {
+				return nil
+			}
+
+			dataExpiry, _ := ttl.expiry(basicID)
+			expiry = earliest(expiry, dataExpiry)
+		}
+
+		// values are only valid during the transaction
+		sealed = append([]byte(nil), value...)
+		result.ExpiresAt = expiry
+		return nil
+	})
+
+	if err == nil && sealed == nil && result.Status == TokenUnknown && ts.codes != nil {
+		return ts.codes.Introspect(token)
+	}
+
+	if err != nil || sealed == nil {
+		return result, err
+	}
+
+	jv, err := ts.cipher.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	var tm models.Token
+
+	err = ts.codec.Unmarshal(jv, &tm)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Info = &tm
+
+	switch {
+	case !byBasicID:
+		result.Type = CodeToken
+		result.CreatedAt = tm.CodeCreateAt
+	case tm.Refresh == token && tm.Access != token:
+		result.Type = RefreshToken
+		result.CreatedAt = tm.RefreshCreateAt
+	default:
+		result.Type = AccessToken
+		result.CreatedAt = tm.AccessCreateAt
+	}
+
+	result.Status = TokenActive
+
+	if !result.ExpiresAt.IsZero() {
+		result.ExpiresIn = result.ExpiresAt.Sub(ts.clock.Now())
+
+		if result.ExpiresIn <= 0 {
+			result.Status = TokenExpired
+			result.ExpiresIn = 0
+		}
+	}
+
+	return result, nil
+}
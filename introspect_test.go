@@ -0,0 +1,67 @@
+package boltdb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestIntrospectStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention time.Duration
+		token     string
+		want      TokenStatus
+	}{
+		{"active", 0, "active", TokenActive},
+		{"expired", 0, "expired", TokenExpired},
+		{"never stored", time.Hour, "missing", TokenUnknown},
+		{"removed with the revocation log", time.Hour, "removed", TokenRevoked},
+		{"removed without the revocation log", 0, "removed", TokenUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testutil.NewFakeClock(time.Now())
+			store, closeFn, err := NewTokenStore(&Config{
+				DbName:              filepath.Join(t.TempDir(), "oauth2.db"),
+				BucketName:          "oauthTokens",
+				ExpiryStrategy:      LazyExpiry,
+				RevocationRetention: tt.retention,
+				Clock:               clock,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+
+			ts := store.(*TokenStore)
+
+			for access, expiresIn := range map[string]time.Duration{
+				"active":  2 * time.Hour,
+				"expired": time.Hour,
+				"removed": 2 * time.Hour,
+			} {
+				err = ts.Create(&models.Token{Access: access, AccessCreateAt: clock.Now(), AccessExpiresIn: expiresIn})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = ts.RemoveByAccess("removed")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clock.Advance(90 * time.Minute)
+
+			result, err := ts.Introspect(tt.token)
+			if err != nil || result.Status != tt.want {
+				t.Fatalf("Introspect = %v, %v, want %s", result, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// DefaultListLimit is the page size of ListTokens when ListOptions.Limit is not set
+const DefaultListLimit = 100
+
+// ListOptions filters and paginates ListTokens
+type ListOptions struct {
+	// UserID only lists the tokens of the user
+	UserID string
+	// ClientID only lists the tokens issued to the client
+	ClientID string
+	// ExpiresAfter only lists the tokens that expire after it, when set
+	ExpiresAfter time.Time
+	// ExpiresBefore only lists the tokens that expire before it, when set
+	ExpiresBefore time.Time
+	// Limit is the maximum number of tokens returned. Defaults to DefaultListLimit
+	Limit int
+	// Cursor is the cursor returned by the previous page, empty for the first one
+	Cursor string
+}
+
+// ListTokens returns a page of active codes and token pairs and the cursor of the next page,
+// which is empty on the last page. Filtering by user or client scans their index
+func (ts *TokenStore) ListTokens(opts ListOptions) ([]oauth2.TokenInfo, string, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	after, err := hex.DecodeString(opts.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var tokens []oauth2.TokenInfo
+	var next string
+
+	err = ts.view(context.Background(), func(tx *bolt.Tx) error {
+		bucket := ts.tokenBucket(tx)
+		ttl := ts.ttlBuckets(tx)
+		now := ts.clock.Now()
+
+		c, prefix := ts.listCursor(tx, opts)
+		start := append(append([]byte(nil), prefix...), after...)
+
+		k, _ := c.Seek(start)
+		if len(after) > 0 && bytes.Equal(k, start) {
+			k, _ = c.Next()
+		}
+
+		var last []byte
+
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			// index keys end with the key holding the token information
+			key := k[len(prefix):]
+
+			if len(tokens) == limit {
+				next = hex.EncodeToString(last)
+				return nil
+			}
+
+			jv, err := ts.cipher.open(bucket.Get(key))
+			if err != nil || jv == nil {
+				continue
+			}
+
+			var tm models.Token
+			if ts.codec.Unmarshal(jv, &tm) != nil || !isTokenInfo(tm.Code, tm.Access, tm.Refresh) {
+				// mappings from tokens to basic IDs
+				continue
+			}
+
+			if opts.UserID != "" && tm.UserID != opts.UserID {
+				continue
+			}
+
+			if opts.ClientID != "" && tm.ClientID != opts.ClientID {
+				continue
+			}
+
+			expiration, ok := ttl.expiry(key)
+			if ok && !expiration.After(now) {
+				continue
+			}
+
+			if !opts.ExpiresAfter.IsZero() && (!ok || !expiration.After(opts.ExpiresAfter)) {
+				continue
+			}
+
+			if !opts.ExpiresBefore.IsZero() && (!ok || !expiration.Before(opts.ExpiresBefore)) {
+				continue
+			}
+
+			tokens = append(tokens, &tm)
+			last = key
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return tokens, next, nil
+}
+
+// listCursor returns the cursor to scan for opts and the prefix of the scanned keys
+func (ts *TokenStore) listCursor(tx *bolt.Tx, opts ListOptions) (keyCursor, []byte) {
+	if opts.UserID != "" {
+		return tx.Bucket(ts.bucketUserIndexName).Cursor(), ts.indexPrefix(opts.UserID)
+	}
+
+	if opts.ClientID != "" {
+		return tx.Bucket(ts.bucketClientIndexName).Cursor(), ts.indexPrefix(opts.ClientID)
+	}
+
+	return ts.tokenBucket(tx).Cursor(), nil
+}
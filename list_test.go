@@ -0,0 +1,197 @@
+package boltdb
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// listStore returns a store with, as of the returned time, the code "code" and the
+// access tokens "alice-web" and "bob-web" expiring in an hour, "alice-cli" expiring
+// in a day and "alice-gone" already expired
+func listStore(t *testing.T, config Config) (*TokenStore, time.Time) {
+	t.Helper()
+
+	start := time.Now()
+	clock := testutil.NewFakeClock(start)
+	config.Clock = clock
+	ts := newTestStore(t, config)
+
+	for _, token := range []*models.Token{
+		{ClientID: "web", UserID: "alice", Code: "code", CodeCreateAt: start, CodeExpiresIn: time.Hour},
+		{ClientID: "web", UserID: "alice", Access: "alice-web", AccessCreateAt: start, AccessExpiresIn: time.Hour},
+		{ClientID: "web", UserID: "bob", Access: "bob-web", AccessCreateAt: start, AccessExpiresIn: time.Hour},
+		{ClientID: "cli", UserID: "alice", Access: "alice-cli", AccessCreateAt: start, AccessExpiresIn: 24 * time.Hour},
+		{ClientID: "cli", UserID: "alice", Access: "alice-gone", AccessCreateAt: start, AccessExpiresIn: time.Minute},
+	} {
+		if err := ts.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(time.Minute)
+
+	return ts, start.Add(time.Minute)
+}
+
+// listedNames returns the sorted codes and access tokens of infos
+func listedNames(infos []oauth2.TokenInfo) []string {
+	names := []string{}
+	for _, info := range infos {
+		name := info.GetAccess()
+		if name == "" {
+			name = info.GetCode()
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func TestListTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(now time.Time) ListOptions
+		want []string
+	}{
+		{
+			"all active",
+			func(time.Time) ListOptions { return ListOptions{} },
+			[]string{"alice-cli", "alice-web", "bob-web", "code"},
+		},
+		{
+			"by user",
+			func(time.Time) ListOptions { return ListOptions{UserID: "alice"} },
+			[]string{"alice-cli", "alice-web", "code"},
+		},
+		{
+			"by client",
+			func(time.Time) ListOptions { return ListOptions{ClientID: "web"} },
+			[]string{"alice-web", "bob-web", "code"},
+		},
+		{
+			"by user and client",
+			func(time.Time) ListOptions { return ListOptions{UserID: "alice", ClientID: "cli"} },
+			[]string{"alice-cli"},
+		},
+		{
+			"unknown user",
+			func(time.Time) ListOptions { return ListOptions{UserID: "carol"} },
+			[]string{},
+		},
+		{
+			"expiring after",
+			func(now time.Time) ListOptions { return ListOptions{ExpiresAfter: now.Add(2 * time.Hour)} },
+			[]string{"alice-cli"},
+		},
+		{
+			"expiring before",
+			func(now time.Time) ListOptions { return ListOptions{ExpiresBefore: now.Add(2 * time.Hour)} },
+			[]string{"alice-web", "bob-web", "code"},
+		},
+		{
+			"expiring within a window",
+			func(now time.Time) ListOptions {
+				return ListOptions{UserID: "alice", ExpiresAfter: now, ExpiresBefore: now.Add(2 * time.Hour)}
+			},
+			[]string{"alice-web", "code"},
+		},
+	}
+
+	configs := map[string]Config{
+		"plain":              {},
+		"sharded and hashed": {Shards: 4, HashKeys: true, HashKeysSecret: []byte("secret")},
+	}
+
+	for configName, config := range configs {
+		ts, now := listStore(t, config)
+
+		for _, tt := range tests {
+			t.Run(configName+"/"+tt.name, func(t *testing.T) {
+				infos, next, err := ts.ListTokens(tt.opts(now))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if next != "" {
+					t.Errorf("next cursor = %q, want the last page", next)
+				}
+
+				if got := listedNames(infos); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("ListTokens = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestListTokensPages(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  ListOptions
+		want  []string
+		pages int
+	}{
+		{"one per page", ListOptions{Limit: 1}, []string{"alice-cli", "alice-web", "bob-web", "code"}, 4},
+		{"two per page", ListOptions{Limit: 2}, []string{"alice-cli", "alice-web", "bob-web", "code"}, 2},
+		{"user pages", ListOptions{UserID: "alice", Limit: 2}, []string{"alice-cli", "alice-web", "code"}, 2},
+		{"default limit", ListOptions{}, []string{"alice-cli", "alice-web", "bob-web", "code"}, 1},
+	}
+
+	ts, _ := listStore(t, Config{})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var all []oauth2.TokenInfo
+			opts := tt.opts
+			pages := 0
+
+			for {
+				infos, next, err := ts.ListTokens(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(infos) > 0 {
+					pages++
+				}
+
+				if limit := tt.opts.Limit; limit > 0 && len(infos) > limit {
+					t.Fatalf("page of %d tokens, want at most %d", len(infos), limit)
+				}
+
+				all = append(all, infos...)
+
+				if next == "" {
+					break
+				}
+
+				opts.Cursor = next
+			}
+
+			if got := listedNames(all); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pages listed %v, want %v", got, tt.want)
+			}
+
+			if pages != tt.pages {
+				t.Errorf("listed %d pages, want %d", pages, tt.pages)
+			}
+		})
+	}
+}
+
+func TestListTokensInvalidCursor(t *testing.T) {
+	ts := newTestStore(t, Config{})
+
+	if _, _, err := ts.ListTokens(ListOptions{Cursor: "not hex"}); err == nil {
+		t.Fatal("ListTokens accepted an invalid cursor")
+	}
+}
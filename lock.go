@@ -0,0 +1,90 @@
+package boltdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// openFiles counts the databases opened by this process by absolute path: the readers
+// of the read-only ones, or -1 when opened writable. bolt locks the file with flock, which
+// also blocks a second open from the same process, so it would wait forever instead of failing
+var openFiles = struct {
+	sync.Mutex
+	byPath map[string]int
+}{byPath: map[string]int{}}
+
+// openFilesKey returns the key of path on openFiles
+func openFilesKey(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+
+	return abs
+}
+
+// openDB opens the database file at path, created with mode, failing with ErrDatabaseLocked
+// when this process already has it open writable, or open at all to open it writable.
+// Databases opened with openDB must be closed with closeDB
+func openDB(path string, mode os.FileMode, options *bolt.Options) (*bolt.DB, error) {
+	readOnly := options != nil && options.ReadOnly
+	key := openFilesKey(path)
+
+	openFiles.Lock()
+	opens := openFiles.byPath[key]
+	if opens < 0 || (opens > 0 && !readOnly) {
+		openFiles.Unlock()
+		return nil, fmt.Errorf("%w: %s is already open in this process", ErrDatabaseLocked, path)
+	}
+
+	if readOnly {
+		openFiles.byPath[key] = opens + 1
+	} else {
+		openFiles.byPath[key] = -1
+	}
+	openFiles.Unlock()
+
+	db, err := bolt.Open(path, mode, options)
+	if err != nil {
+		releaseFile(key, readOnly)
+	}
+
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %s is locked by another process", ErrDatabaseLocked, path)
+	}
+
+	return db, err
+}
+
+// closeDB closes a database opened with openDB
+func closeDB(db *bolt.DB) error {
+	readOnly := db.IsReadOnly()
+	key := openFilesKey(db.Path())
+
+	err := db.Close()
+	releaseFile(key, readOnly)
+
+	return err
+}
+
+// releaseFile forgets an open of the file key
+func releaseFile(key string, readOnly bool) {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+
+	if readOnly && openFiles.byPath[key] > 1 {
+		openFiles.byPath[key]--
+		return
+	}
+
+	delete(openFiles.byPath, key)
+}
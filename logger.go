@@ -0,0 +1,20 @@
+package boltdb
+
+// Logger receives the errors and statistics of the store and its cleaner.
+// *log.Logger implements it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// reportError passes err to Config.OnError when it's set
+func (ts *TokenStore) reportError(op string, err error) {
+	if ts.onError != nil {
+		ts.onError(op, err)
+	}
+}
+
+// nopLogger discards everything, it is used when Config.Logger is not set
+type nopLogger struct{}
+
+// Printf does nothing
+func (nopLogger) Printf(format string, v ...interface{}) {}
@@ -0,0 +1,45 @@
+package boltdb
+
+import (
+	"gopkg.in/oauth2.v3/manage"
+)
+
+// clientBucketSuffix is appended to Config.BucketName for the clients stored by NewManager
+const clientBucketSuffix = "-clients"
+
+// NewManager returns a manage.Manager with the default token configs of go-oauth2, storing
+// the tokens and the clients on the database of config. The clients go to a bucket named
+// after config.BucketName with a "-clients" suffix, use the ClientStore to add them
+func NewManager(config *Config) (*manage.Manager, *ClientStore, func(), error) {
+	ts, closeTokens, err := newTokenStore(config)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	cs, _, err := NewClientStoreWithDB(ts.db, &Config{BucketName: config.BucketName + clientBucketSuffix})
+
+	if err != nil {
+		closeTokens()
+		return nil, nil, nil, err
+	}
+
+	// copies, so changing the configs of a manager doesn't change the defaults
+	authorizeCodeCfg := *manage.DefaultAuthorizeCodeTokenCfg
+	implicitCfg := *manage.DefaultImplicitTokenCfg
+	passwordCfg := *manage.DefaultPasswordTokenCfg
+	clientCfg := *manage.DefaultClientTokenCfg
+	refreshCfg := *manage.DefaultRefreshTokenCfg
+
+	manager := manage.NewDefaultManager()
+	manager.SetAuthorizeCodeExp(manage.DefaultCodeExp)
+	manager.SetAuthorizeCodeTokenCfg(&authorizeCodeCfg)
+	manager.SetImplicitTokenCfg(&implicitCfg)
+	manager.SetPasswordTokenCfg(&passwordCfg)
+	manager.SetClientTokenCfg(&clientCfg)
+	manager.SetRefreshTokenCfg(&refreshCfg)
+	manager.MapTokenStorage(ts)
+	manager.MapClientStorage(cs)
+
+	return manager, cs, closeTokens, nil
+}
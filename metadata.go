@@ -0,0 +1,84 @@
+package boltdb
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3"
+)
+
+// CreateWithMetadata stores the token information like Create, and meta, like device
+// fingerprints or session data, on the same transaction. The metadata is deleted with the token
+func (ts *TokenStore) CreateWithMetadata(info oauth2.TokenInfo, meta map[string]string) error {
+	jv, err := ts.codec.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	mv, err := ts.codec.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return ts.create(context.Background(), info, jv, mv)
+}
+
+// GetMetadataByAccess returns the metadata stored with the access token, nil when it was created without.
+// Like GetByAccess, it fails with ErrTokenNotFound or ErrTokenExpired when the token can't be used
+func (ts *TokenStore) GetMetadataByAccess(access string) (map[string]string, error) {
+	key := ts.tokenKey(access)
+
+	var sealed []byte
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		basicID := ts.tokenBucket(tx).Get(key)
+		if basicID == nil {
+			return ErrTokenNotFound
+		}
+
+		ttl := ts.ttlBuckets(tx)
+		keyExpiry, _ := ttl.expiry(key)
+		dataExpiry, _ := ttl.expiry(basicID)
+		expiry := earliest(keyExpiry, dataExpiry)
+
+		if !expiry.IsZero() && !expiry.After(ts.clock.Now()) {
+			return ErrTokenExpired
+		}
+
+		metadata := tx.Bucket(ts.bucketMetadataName)
+		if metadata == nil {
+			// older read-only databases have no metadata
+			return nil
+		}
+
+		// values are only valid during the transaction
+		if value := metadata.Get(basicID); value != nil {
+			sealed = append([]byte(nil), value...)
+		}
+
+		return nil
+	})
+
+	if err == ErrTokenNotFound && ts.nilOnNotFound {
+		return nil, nil
+	}
+
+	if err != nil || sealed == nil {
+		return nil, err
+	}
+
+	mv, err := ts.cipher.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta map[string]string
+
+	err = ts.codec.Unmarshal(mv, &meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,149 @@
+package boltdb
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// metrics are the prometheus collectors of a token store.
+// A nil metrics records nothing
+type metrics struct {
+	creates       *prometheus.CounterVec
+	gets          *prometheus.CounterVec
+	removes       *prometheus.CounterVec
+	sweepDuration prometheus.Histogram
+	sweepExpired  prometheus.Histogram
+}
+
+// newMetrics registers the collectors of the store on reg.
+// Collectors are labeled with the bucket name so several stores can share reg
+func newMetrics(reg prometheus.Registerer, db *bolt.DB, bucketName string) (*metrics, error) {
+	if reg == nil {
+		return nil, nil
+	}
+
+	labels := prometheus.Labels{"bucket": bucketName}
+
+	m := &metrics{
+		creates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "oauth2_boltdb",
+			Name:        "creates_total",
+			Help:        "Number of tokens created, by result.",
+			ConstLabels: labels,
+		}, []string{"result"}),
+		gets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "oauth2_boltdb",
+			Name:        "gets_total",
+			Help:        "Number of token reads, by result: hit, miss, expired or error.",
+			ConstLabels: labels,
+		}, []string{"result"}),
+		removes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "oauth2_boltdb",
+			Name:        "removes_total",
+			Help:        "Number of tokens removed, by result.",
+			ConstLabels: labels,
+		}, []string{"result"}),
+		sweepDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   "oauth2_boltdb",
+			Name:        "sweep_duration_seconds",
+			Help:        "Duration of the sweeps of expired keys.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.001, 4, 8),
+		}),
+		sweepExpired: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   "oauth2_boltdb",
+			Name:        "sweep_expired_keys",
+			Help:        "Number of keys expired per sweep.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(1, 10, 7),
+		}),
+	}
+
+	dbSize := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "oauth2_boltdb",
+		Name:        "db_size_bytes",
+		Help:        "Size of the database file.",
+		ConstLabels: labels,
+	}, func() float64 {
+		var size int64
+
+		db.View(func(tx *bolt.Tx) error {
+			size = tx.Size()
+			return nil
+		})
+
+		return float64(size)
+	})
+
+	collectors := []prometheus.Collector{m.creates, m.gets, m.removes, m.sweepDuration, m.sweepExpired, dbSize}
+
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// result returns the result label of an operation
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "ok"
+}
+
+// create records a token creation
+func (m *metrics) create(err error) {
+	if m == nil {
+		return
+	}
+
+	m.creates.WithLabelValues(result(err)).Inc()
+}
+
+// getResult returns the result label of a token read
+func getResult(err error) string {
+	switch err {
+	case nil:
+		return "hit"
+	case ErrTokenNotFound:
+		return "miss"
+	case ErrTokenExpired:
+		return "expired"
+	default:
+		return "error"
+	}
+}
+
+// get records a token read
+func (m *metrics) get(err error) {
+	if m == nil {
+		return
+	}
+
+	m.gets.WithLabelValues(getResult(err)).Inc()
+}
+
+// remove records a token removal
+func (m *metrics) remove(err error) {
+	if m == nil {
+		return
+	}
+
+	m.removes.WithLabelValues(result(err)).Inc()
+}
+
+// sweep records a sweep that expired keys
+func (m *metrics) sweep(duration time.Duration, expired int) {
+	if m == nil {
+		return
+	}
+
+	m.sweepDuration.Observe(duration.Seconds())
+	m.sweepExpired.Observe(float64(expired))
+}
@@ -0,0 +1,200 @@
+package boltdb
+
+import (
+	"errors"
+
+	"gopkg.in/oauth2.v3"
+)
+
+// MirrorOptions configure a MirroredStore
+type MirrorOptions struct {
+	// OnDivergence is called when the stores disagree: a write failed on the secondary, a token
+	// was only found on one of them, or, with CompareReads, they read different token information.
+	// It's called on the goroutine of the call, so it should hand the divergence off
+	OnDivergence func(Divergence)
+	// CompareReads reads the secondary too when the primary finds the token, to report the
+	// tokens that differ. It doubles the reads
+	CompareReads bool
+	// StrictWrites fails the writes that fail on the secondary. By default they are only reported,
+	// so a token whose removal failed on the secondary is still there once the stores are swapped
+	StrictWrites bool
+}
+
+// Divergence describes a call the stores of a MirroredStore disagreed on
+type Divergence struct {
+	// Method is the oauth2.TokenStore method called, like "Create" or "GetByAccess"
+	Method string
+	// PrimaryErr and SecondaryErr are the errors of each store, nil when it succeeded
+	PrimaryErr   error
+	SecondaryErr error
+	// Primary and Secondary are the token information each store read, nil on writes
+	// and when the store didn't find the token
+	Primary   oauth2.TokenInfo
+	Secondary oauth2.TokenInfo
+}
+
+// MirroredStore is an oauth2.TokenStore writing to two stores and reading from the primary,
+// to move the tokens to another store without downtime: mirror the writes to the new store
+// while tokens issued before are exported to it, watch the divergences, then swap the stores
+// and finally drop the old one
+type MirroredStore struct {
+	primary   oauth2.TokenStore
+	secondary oauth2.TokenStore
+	opts      MirrorOptions
+}
+
+// NewMirroredStore returns a store writing to primary and then to secondary, and reading from
+// primary, or from secondary when primary fails
+func NewMirroredStore(primary, secondary oauth2.TokenStore, opts MirrorOptions) *MirroredStore {
+	return &MirroredStore{
+		primary:   primary,
+		secondary: secondary,
+		opts:      opts,
+	}
+}
+
+// diverge reports a divergence
+func (ms *MirroredStore) diverge(d Divergence) {
+	if ms.opts.OnDivergence != nil {
+		ms.opts.OnDivergence(d)
+	}
+}
+
+// write calls fn on the primary and, when it succeeds, on the secondary.
+// Secondary failures are reported, and returned with MirrorOptions.StrictWrites
+func (ms *MirroredStore) write(method string, fn func(store oauth2.TokenStore) error) error {
+	err := fn(ms.primary)
+	if err != nil {
+		return err
+	}
+
+	err = fn(ms.secondary)
+	if err == nil {
+		return nil
+	}
+
+	ms.diverge(Divergence{Method: method, SecondaryErr: err})
+
+	if ms.opts.StrictWrites {
+		return err
+	}
+
+	return nil
+}
+
+// read calls fn on the primary, falling back to the secondary when it fails, and on both with
+// MirrorOptions.CompareReads. Tokens the primary doesn't have, or reports expired or reused,
+// are not read from the secondary, which still has the ones whose removal failed there
+func (ms *MirroredStore) read(method string, fn func(store oauth2.TokenStore) (oauth2.TokenInfo, error)) (oauth2.TokenInfo, error) {
+	primary, primaryErr := fn(ms.primary)
+	found := primaryErr == nil && primary != nil
+	failed := isFailure(primaryErr)
+
+	if !failed && !ms.opts.CompareReads {
+		return primary, primaryErr
+	}
+
+	secondary, secondaryErr := fn(ms.secondary)
+	secondaryFound := secondaryErr == nil && secondary != nil
+
+	agree := found && secondaryFound && sameTokenInfo(primary, secondary) ||
+		!found && !secondaryFound && isMissing(primaryErr) && isMissing(secondaryErr)
+
+	if !agree {
+		ms.diverge(Divergence{
+			Method:       method,
+			PrimaryErr:   primaryErr,
+			SecondaryErr: secondaryErr,
+			Primary:      primary,
+			Secondary:    secondary,
+		})
+	}
+
+	if failed && !isFailure(secondaryErr) {
+		return secondary, secondaryErr
+	}
+
+	return primary, primaryErr
+}
+
+// isFailure reports if err is a failure of a store rather than its answer about a token
+func isFailure(err error) bool {
+	return err != nil && !isMissing(err) && !isTokenState(err)
+}
+
+// isTokenState reports if err is the state of a token a store has, rather than a failure
+func isTokenState(err error) bool {
+	return errors.Is(err, ErrTokenExpired) || errors.Is(err, ErrRefreshTokenReused)
+}
+
+// isMissing reports if err is how stores respond to tokens they don't have, or no longer
+func isMissing(err error) bool {
+	return err == nil || errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenExpired)
+}
+
+// sameTokenInfo reports if a and b hold the same token information. Times are compared
+// to the second, as stores don't keep the same precision
+func sameTokenInfo(a, b oauth2.TokenInfo) bool {
+	return a.GetClientID() == b.GetClientID() &&
+		a.GetUserID() == b.GetUserID() &&
+		a.GetRedirectURI() == b.GetRedirectURI() &&
+		a.GetScope() == b.GetScope() &&
+		a.GetCode() == b.GetCode() &&
+		a.GetCodeCreateAt().Unix() == b.GetCodeCreateAt().Unix() &&
+		a.GetCodeExpiresIn() == b.GetCodeExpiresIn() &&
+		a.GetAccess() == b.GetAccess() &&
+		a.GetAccessCreateAt().Unix() == b.GetAccessCreateAt().Unix() &&
+		a.GetAccessExpiresIn() == b.GetAccessExpiresIn() &&
+		a.GetRefresh() == b.GetRefresh() &&
+		a.GetRefreshCreateAt().Unix() == b.GetRefreshCreateAt().Unix() &&
+		a.GetRefreshExpiresIn() == b.GetRefreshExpiresIn()
+}
+
+// Create stores the token information on both stores
+func (ms *MirroredStore) Create(info oauth2.TokenInfo) error {
+	return ms.write("Create", func(store oauth2.TokenStore) error {
+		return store.Create(info)
+	})
+}
+
+// RemoveByCode removes the code from both stores
+func (ms *MirroredStore) RemoveByCode(code string) error {
+	return ms.write("RemoveByCode", func(store oauth2.TokenStore) error {
+		return store.RemoveByCode(code)
+	})
+}
+
+// RemoveByAccess removes the access token from both stores
+func (ms *MirroredStore) RemoveByAccess(access string) error {
+	return ms.write("RemoveByAccess", func(store oauth2.TokenStore) error {
+		return store.RemoveByAccess(access)
+	})
+}
+
+// RemoveByRefresh removes the refresh token from both stores
+func (ms *MirroredStore) RemoveByRefresh(refresh string) error {
+	return ms.write("RemoveByRefresh", func(store oauth2.TokenStore) error {
+		return store.RemoveByRefresh(refresh)
+	})
+}
+
+// GetByCode reads the code from the primary, or from the secondary when the primary fails
+func (ms *MirroredStore) GetByCode(code string) (oauth2.TokenInfo, error) {
+	return ms.read("GetByCode", func(store oauth2.TokenStore) (oauth2.TokenInfo, error) {
+		return store.GetByCode(code)
+	})
+}
+
+// GetByAccess reads the access token from the primary, or from the secondary when the primary fails
+func (ms *MirroredStore) GetByAccess(access string) (oauth2.TokenInfo, error) {
+	return ms.read("GetByAccess", func(store oauth2.TokenStore) (oauth2.TokenInfo, error) {
+		return store.GetByAccess(access)
+	})
+}
+
+// GetByRefresh reads the refresh token from the primary, or from the secondary when the primary fails
+func (ms *MirroredStore) GetByRefresh(refresh string) (oauth2.TokenInfo, error) {
+	return ms.read("GetByRefresh", func(store oauth2.TokenStore) (oauth2.TokenInfo, error) {
+		return store.GetByRefresh(refresh)
+	})
+}
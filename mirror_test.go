@@ -0,0 +1,93 @@
+package boltdb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// newMirrorTestStore returns a store on its own file
+func newMirrorTestStore(t *testing.T, name string) oauth2.TokenStore {
+	t.Helper()
+
+	store, closeFn, err := NewTokenStore(&Config{
+		DbName:     filepath.Join(t.TempDir(), name+".db"),
+		BucketName: "oauthTokens",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeFn)
+
+	return store
+}
+
+func TestMirroredStoreFallsBackOnlyOnFailures(t *testing.T) {
+	token := func(access string) *models.Token {
+		return &models.Token{
+			ClientID:        "client",
+			Access:          access,
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: time.Hour,
+		}
+	}
+
+	tests := []struct {
+		name         string
+		primaryFails bool
+		onPrimary    bool
+		onSecondary  bool
+		wantErr      error
+		wantFound    bool
+	}{
+		{"on both", false, true, true, nil, true},
+		{"only on the primary", false, true, false, nil, true},
+		{"only on the secondary", false, false, true, ErrTokenNotFound, false},
+		{"on neither", false, false, false, ErrTokenNotFound, false},
+		{"primary fails", true, true, true, nil, true},
+		{"primary fails, not on the secondary", true, true, false, ErrTokenNotFound, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newMirrorTestStore(t, "primary")
+			secondary := newMirrorTestStore(t, "secondary")
+
+			if tt.onPrimary {
+				if err := primary.Create(token("access")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.onSecondary {
+				if err := secondary.Create(token("access")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			policy := testutil.FaultPolicy{}
+			if tt.primaryFails {
+				policy.ErrorRate = 1
+			}
+
+			var divergences []Divergence
+
+			ms := NewMirroredStore(testutil.NewFaultyStore(primary, policy), secondary, MirrorOptions{
+				OnDivergence: func(d Divergence) { divergences = append(divergences, d) },
+			})
+
+			info, err := ms.GetByAccess("access")
+			if err != tt.wantErr || (info != nil) != tt.wantFound {
+				t.Fatalf("GetByAccess = %v, %v, want found %v, %v", info, err, tt.wantFound, tt.wantErr)
+			}
+
+			if tt.primaryFails && len(divergences) != 1 {
+				t.Errorf("divergences = %v, want the primary failure reported", divergences)
+			}
+		})
+	}
+}
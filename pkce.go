@@ -0,0 +1,134 @@
+package boltdb
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+
+	oauth2v4 "github.com/go-oauth2/oauth2/v4"
+	"gopkg.in/oauth2.v3"
+)
+
+// CodeChallenge is the PKCE (RFC 7636) challenge of an authorization code
+type CodeChallenge struct {
+	Challenge string
+	// Method is "plain" or "S256"
+	Method string
+}
+
+// challengedToken is a token information created with CreateWithCodeChallenge
+type challengedToken struct {
+	oauth2.TokenInfo
+	challenge CodeChallenge
+}
+
+// CreateWithCodeChallenge stores the authorization code of info like Create, and its PKCE
+// challenge on the same transaction, since the models.Token of oauth2.v3 has no field for it.
+// The challenge is deleted with the code. oauth2.v4 codes store their challenge on Create
+func (ts *TokenStore) CreateWithCodeChallenge(info oauth2.TokenInfo, challenge CodeChallenge) error {
+	jv, err := ts.codec.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return ts.create(context.Background(), &challengedToken{TokenInfo: info, challenge: challenge}, jv, nil)
+}
+
+// codeChallengeOf returns the PKCE challenge of the code of info, nil when there is none
+func codeChallengeOf(info tokenKeys) *CodeChallenge {
+	if info.GetCode() == "" {
+		return nil
+	}
+
+	var challenge CodeChallenge
+
+	switch info := info.(type) {
+	case *challengedToken:
+		challenge = info.challenge
+	case oauth2v4.TokenInfo:
+		challenge = CodeChallenge{
+			Challenge: info.GetCodeChallenge(),
+			Method:    string(info.GetCodeChallengeMethod()),
+		}
+	}
+
+	if challenge.Challenge == "" {
+		return nil
+	}
+
+	return &challenge
+}
+
+// putCodeChallenge stores the PKCE challenge of the code of info under key, if it has one
+func (ts *TokenStore) putCodeChallenge(tx *bolt.Tx, key []byte, info tokenKeys) error {
+	challenge := codeChallengeOf(info)
+	if challenge == nil {
+		return nil
+	}
+
+	jv, err := ts.codec.Marshal(challenge)
+	if err != nil {
+		return err
+	}
+
+	jv, err = ts.cipher.seal(jv)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(ts.bucketChallengesName).Put(key, jv)
+}
+
+// GetCodeChallenge returns the PKCE challenge of an authorization code, nil when it was created without.
+// Like GetByCode, it fails with ErrTokenNotFound or ErrTokenExpired when the code can't be used
+func (ts *TokenStore) GetCodeChallenge(code string) (*CodeChallenge, error) {
+	if ts.codes != nil {
+		return ts.codes.GetCodeChallenge(code)
+	}
+
+	key := ts.tokenKey(code)
+
+	var sealed []byte
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		if ts.tokenBucket(tx).Get(key) == nil {
+			return ErrTokenNotFound
+		}
+
+		expiry, _ := ts.ttlBuckets(tx).expiry(key)
+		if !expiry.IsZero() && !expiry.After(ts.clock.Now()) {
+			return ErrTokenExpired
+		}
+
+		challenges := tx.Bucket(ts.bucketChallengesName)
+		if challenges == nil {
+			// older read-only databases have no challenges
+			return nil
+		}
+
+		// values are only valid during the transaction
+		if value := challenges.Get(key); value != nil {
+			sealed = append([]byte(nil), value...)
+		}
+
+		return nil
+	})
+
+	if err != nil || sealed == nil {
+		return nil, err
+	}
+
+	jv, err := ts.cipher.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	var challenge CodeChallenge
+
+	err = ts.codec.Unmarshal(jv, &challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return &challenge, nil
+}
@@ -0,0 +1,100 @@
+package boltdb
+
+import (
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// QuotaPolicy decides what Create does when a user or client already has its maximum of token pairs
+type QuotaPolicy int
+
+const (
+	// RejectNewTokens fails the new token pair with ErrQuotaExceeded. It's the default policy
+	RejectNewTokens QuotaPolicy = iota
+	// RevokeOldestTokens revokes the oldest token pairs to make room for the new one
+	RevokeOldestTokens
+)
+
+// quotaToken is a token pair counted by a quota
+type quotaToken struct {
+	key       []byte
+	createdAt time.Time
+}
+
+// enforceQuotas makes room for a new token pair of stored inside tx, or fails with
+// ErrQuotaExceeded, when its user or client has reached its maximum of token pairs.
+// Authorization codes don't count
+func (ts *TokenStore) enforceQuotas(tx *bolt.Tx, stored *storedToken) error {
+	if stored.Code != "" {
+		return nil
+	}
+
+	if ts.maxTokensPerUser > 0 && stored.UserID != "" {
+		err := ts.enforceQuota(tx, ts.bucketUserIndexName, stored.UserID, ts.maxTokensPerUser)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ts.maxTokensPerClient > 0 && stored.ClientID != "" {
+		return ts.enforceQuota(tx, ts.bucketClientIndexName, stored.ClientID, ts.maxTokensPerClient)
+	}
+
+	return nil
+}
+
+// enforceQuota makes room for a new token pair indexed under value, keeping up to max
+// token pairs. Expired token pairs waiting for the sweep don't count
+func (ts *TokenStore) enforceQuota(tx *bolt.Tx, bucketName []byte, value string, max int) error {
+	bucket := ts.tokenBucket(tx)
+	ttl := ts.ttlBuckets(tx)
+	now := ts.clock.Now()
+
+	var tokens []quotaToken
+
+	for _, key := range ts.indexedKeys(tx, bucketName, value) {
+		expiry, _ := ttl.expiry(key)
+		if !expiry.IsZero() && !expiry.After(now) {
+			continue
+		}
+
+		stored, err := ts.decodeStored(bucket.Get(key))
+		if err != nil {
+			return err
+		}
+
+		if stored == nil || stored.Code != "" {
+			continue
+		}
+
+		tokens = append(tokens, quotaToken{key: key, createdAt: stored.AccessCreateAt})
+	}
+
+	if len(tokens) < max {
+		return nil
+	}
+
+	if ts.quotaPolicy != RevokeOldestTokens {
+		return ErrQuotaExceeded
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].createdAt.Before(tokens[j].createdAt)
+	})
+
+	for _, token := range tokens[:len(tokens)-max+1] {
+		keys, err := ts.rootFamily(tx, token.key)
+		if err != nil {
+			return err
+		}
+
+		err = ts.deleteKeys(tx, ReasonQuotaExceeded, keys...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
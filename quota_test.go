@@ -0,0 +1,135 @@
+package boltdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// quotaPair returns a token pair of user and client, created after the given number of minutes
+func quotaPair(user, client, access string, minutes int) *models.Token {
+	created := time.Now().Add(time.Duration(minutes) * time.Minute)
+
+	return &models.Token{
+		UserID:          user,
+		ClientID:        client,
+		Access:          access,
+		AccessCreateAt:  created,
+		AccessExpiresIn: time.Hour,
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		// tokens are created in order, the clock advancing a minute after each one
+		tokens []*models.Token
+		err    error
+		// stored are the access tokens left once the last token is created
+		stored  []string
+		removed []string
+	}{
+		{
+			name:   "user quota rejects",
+			config: Config{MaxTokensPerUser: 2},
+			tokens: []*models.Token{
+				quotaPair("user", "a", "first", 0),
+				quotaPair("user", "b", "second", 1),
+				quotaPair("user", "c", "third", 2),
+			},
+			err:     ErrQuotaExceeded,
+			stored:  []string{"first", "second"},
+			removed: []string{"third"},
+		},
+		{
+			name:   "user quota revokes the oldest",
+			config: Config{MaxTokensPerUser: 2, QuotaPolicy: RevokeOldestTokens},
+			tokens: []*models.Token{
+				quotaPair("user", "a", "first", 0),
+				quotaPair("user", "b", "second", 1),
+				quotaPair("user", "c", "third", 2),
+			},
+			stored:  []string{"second", "third"},
+			removed: []string{"first"},
+		},
+		{
+			name:   "client quota rejects",
+			config: Config{MaxTokensPerClient: 1},
+			tokens: []*models.Token{
+				quotaPair("a", "client", "first", 0),
+				quotaPair("b", "client", "second", 1),
+			},
+			err:     ErrQuotaExceeded,
+			stored:  []string{"first"},
+			removed: []string{"second"},
+		},
+		{
+			name:   "other users don't count",
+			config: Config{MaxTokensPerUser: 1},
+			tokens: []*models.Token{
+				quotaPair("user", "client", "first", 0),
+				quotaPair("other", "client", "second", 1),
+			},
+			stored: []string{"first", "second"},
+		},
+		{
+			name:   "codes don't count",
+			config: Config{MaxTokensPerUser: 1},
+			tokens: []*models.Token{
+				{UserID: "user", Code: "code", CodeCreateAt: time.Now(), CodeExpiresIn: time.Hour},
+				quotaPair("user", "client", "first", 1),
+			},
+			stored: []string{"first"},
+		},
+		{
+			name:   "expired tokens don't count",
+			config: Config{MaxTokensPerUser: 1},
+			tokens: []*models.Token{
+				{UserID: "user", Access: "first", AccessCreateAt: time.Now(), AccessExpiresIn: 30 * time.Second},
+				quotaPair("user", "client", "second", 1),
+			},
+			stored: []string{"second"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testutil.NewFakeClock(time.Now())
+
+			config := tt.config
+			config.Clock = clock
+			config.ExpiryStrategy = LazyExpiry
+
+			ts := newTestStore(t, config)
+
+			var err error
+			for i, token := range tt.tokens {
+				err = ts.Create(token)
+				if err != nil && i < len(tt.tokens)-1 {
+					t.Fatal(err)
+				}
+
+				clock.Advance(time.Minute)
+			}
+
+			if err != tt.err {
+				t.Fatalf("Create of the last token = %v, want %v", err, tt.err)
+			}
+
+			for _, access := range tt.stored {
+				if _, err := ts.GetByAccess(access); err != nil {
+					t.Errorf("GetByAccess(%s) = %v, want it stored", access, err)
+				}
+			}
+
+			for _, access := range tt.removed {
+				if _, err := ts.GetByAccess(access); err != ErrTokenNotFound {
+					t.Errorf("GetByAccess(%s) = %v, want ErrTokenNotFound", access, err)
+				}
+			}
+		})
+	}
+}
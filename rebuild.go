@@ -0,0 +1,246 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// openKey is set on the meta bucket while a writable store has the database open, so finding
+// it when opening means the last store didn't close cleanly
+var openKey = []byte("open")
+
+// ttlEntry is the expiration of a key, recomputed by RebuildTTLIndex
+type ttlEntry struct {
+	key        []byte
+	expiration time.Time
+}
+
+// RebuildTTLIndex recomputes the TTL entries of the codes and token pairs from the creation
+// times and lifetimes stored in their token information, and of the device requests and
+// consents from theirs, then deletes the TTL entries of keys that are gone. Use it when the
+// TTL buckets were lost or damaged, which leaves tokens that never expire. It runs on every
+// store opening a database that wasn't closed cleanly
+func (ts *TokenStore) RebuildTTLIndex() error {
+	return ts.update(context.Background(), ts.rebuildTTLIndex)
+}
+
+// rebuildTTLIndex rewrites the TTL entries of ts inside tx
+func (ts *TokenStore) rebuildTTLIndex(tx *bolt.Tx) error {
+	bucket := ts.tokenBucket(tx)
+	ttl := ts.ttlBuckets(tx)
+
+	var entries []ttlEntry
+
+	// TTL entries are written once the bucket is read, so the shards are not modified while iterating
+	bucket.ForEach(func(k, v []byte) error {
+		stored, err := ts.decodeStored(v)
+		if err != nil || stored == nil {
+			// mappings get the TTL entries of their token information
+			return nil
+		}
+
+		jv, err := ts.cipher.open(v)
+		if err != nil {
+			return nil
+		}
+
+		var tm models.Token
+		if err := ts.codec.Unmarshal(jv, &tm); err != nil {
+			return nil
+		}
+
+		key := append([]byte(nil), k...)
+
+		if tm.Code != "" {
+			entries = append(entries, ttlEntry{key, ts.codeExpiration(&tm)})
+			return nil
+		}
+
+		access, refresh := ts.pairExpiration(&tm)
+		entries = append(entries, ttlEntry{key, refresh})
+
+		if accessKey := ts.tokenKey(tm.Access); bytes.Equal(bucket.Get(accessKey), k) {
+			entries = append(entries, ttlEntry{accessKey, access})
+		}
+
+		if tm.Refresh == "" {
+			return nil
+		}
+
+		if refreshKey := ts.tokenKey(tm.Refresh); bytes.Equal(bucket.Get(refreshKey), k) {
+			entries = append(entries, ttlEntry{refreshKey, refresh})
+		}
+
+		return nil
+	})
+
+	entries = append(entries, ts.deviceExpirations(tx)...)
+	entries = append(entries, ts.consentExpirations(tx)...)
+
+	for _, e := range entries {
+		if err := ttl.createAt(e.key, e.expiration); err != nil {
+			return err
+		}
+	}
+
+	// rotations expire with the old refresh token, whose expiration is gone with the entry,
+	// so the ones without an entry are kept as long as the token they were rotated to
+	if rotated := tx.Bucket(ts.bucketRotatedName); rotated != nil {
+		var missing []ttlEntry
+
+		rotated.ForEach(func(k, v []byte) error {
+			if _, ok := ttl.expiry(k); ok || len(v) <= ttlTimeSize {
+				return nil
+			}
+
+			if expiration, ok := ttl.expiry(v[ttlTimeSize:]); ok {
+				missing = append(missing, ttlEntry{append([]byte(nil), k...), expiration})
+			}
+
+			return nil
+		})
+
+		for _, e := range missing {
+			if err := ttl.createAt(e.key, e.expiration); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := ts.deleteStaleTTLEntries(tx)
+
+	return err
+}
+
+// deviceExpirations returns the expiration of the device and user code keys of the device requests
+func (ts *TokenStore) deviceExpirations(tx *bolt.Tx) []ttlEntry {
+	var entries []ttlEntry
+
+	devices := tx.Bucket(ts.bucketDevicesName)
+	userCodes := tx.Bucket(ts.bucketUserCodesName)
+	if devices == nil || userCodes == nil {
+		// device buckets are created by a migration, older databases don't have them
+		return nil
+	}
+
+	ds := NewDeviceStore(ts)
+	expirations := map[string]time.Time{}
+
+	devices.ForEach(func(k, v []byte) error {
+		auth, err := ds.decode(v)
+		if err != nil || auth == nil || auth.ExpiresIn <= 0 {
+			return nil
+		}
+
+		expirations[string(k)] = auth.CreatedAt.Add(auth.ExpiresIn)
+		return nil
+	})
+
+	userCodes.ForEach(func(k, v []byte) error {
+		if expiration, ok := expirations[string(v)]; ok {
+			entries = append(entries, ttlEntry{append([]byte(nil), k...), expiration})
+		}
+
+		return nil
+	})
+
+	for key, expiration := range expirations {
+		entries = append(entries, ttlEntry{[]byte(key), expiration})
+	}
+
+	return entries
+}
+
+// codeExpiration returns when the code of tm expires, like put computes it when it's created
+func (ts *TokenStore) codeExpiration(tm *models.Token) time.Time {
+	created := ts.createdAt(tm.CodeCreateAt)
+
+	return created.Add(capTTL(tm.CodeExpiresIn, ts.ttlOverride(tm)))
+}
+
+// pairExpiration returns when the access token and the refresh token, with the token
+// information, of tm expire, like put computes it when they are created
+func (ts *TokenStore) pairExpiration(tm *models.Token) (time.Time, time.Time) {
+	created := ts.createdAt(tm.AccessCreateAt)
+	override := ts.ttlOverride(tm)
+	aexp := tm.AccessExpiresIn
+	rexp := aexp
+
+	if tm.Refresh != "" {
+		rexp = tm.RefreshCreateAt.Add(tm.RefreshExpiresIn).Sub(created)
+		if aexp.Seconds() > rexp.Seconds() {
+			aexp = rexp
+		}
+
+		if tm.RefreshExpiresIn > 0 {
+			rexp += ts.refreshGracePeriod
+		}
+	}
+
+	return created.Add(capTTL(aexp, override)), created.Add(capTTL(rexp, override))
+}
+
+// createdAt returns the creation time the expirations are computed from.
+// Tokens stored without one expire counting from now
+func (ts *TokenStore) createdAt(created time.Time) time.Time {
+	if created.IsZero() {
+		return ts.clock.Now()
+	}
+
+	return created
+}
+
+// markOpen sets the open flag on the meta bucket, returning true when it was already set
+func (ts *TokenStore) markOpen() (bool, error) {
+	var unclean bool
+
+	err := ts.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(ts.bucketMetaName)
+		if err != nil {
+			return err
+		}
+
+		unclean = meta.Get(openKey) != nil
+
+		return meta.Put(openKey, []byte{1})
+	})
+
+	return unclean, err
+}
+
+// markClosed clears the open flag on the meta bucket. Databases shared with
+// NewTokenStoreWithDB may be closed by their owner first, leaving the flag set
+func (ts *TokenStore) markClosed() error {
+	err := ts.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(ts.bucketMetaName)
+		if meta == nil {
+			return nil
+		}
+
+		return meta.Delete(openKey)
+	})
+
+	if err == bolt.ErrDatabaseNotOpen {
+		return nil
+	}
+
+	return err
+}
+
+// recoverUncleanShutdown rebuilds the TTL entries of the store and its tenant stores
+func (ts *TokenStore) recoverUncleanShutdown() error {
+	ts.logger.Printf("boltdb: bucket %s was not closed cleanly, rebuilding the ttl index", ts.bucketName)
+
+	for _, store := range ts.stores() {
+		if err := store.db.Update(store.rebuildTTLIndex); err != nil {
+			return fmt.Errorf("rebuild ttl index of bucket %s: %w", store.bucketName, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package boltdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestRebuildTTLIndex(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		config Config
+		create func(ts *TokenStore) error
+		// want returns the TTLs of the keys the rebuild has to restore
+		want func(ts *TokenStore) map[string]time.Duration
+	}{
+		{
+			name: "code",
+			create: func(ts *TokenStore) error {
+				return ts.Create(&models.Token{Code: "code", CodeCreateAt: now, CodeExpiresIn: 10 * time.Minute})
+			},
+			want: func(ts *TokenStore) map[string]time.Duration {
+				return map[string]time.Duration{string(ts.tokenKey("code")): 10 * time.Minute}
+			},
+		},
+		{
+			name: "access token",
+			create: func(ts *TokenStore) error {
+				return ts.Create(&models.Token{Access: "access", AccessCreateAt: now, AccessExpiresIn: time.Hour})
+			},
+			want: func(ts *TokenStore) map[string]time.Duration {
+				return map[string]time.Duration{string(ts.tokenKey("access")): time.Hour}
+			},
+		},
+		{
+			name:   "token pair with a grace period",
+			config: Config{RefreshGracePeriod: time.Minute},
+			create: func(ts *TokenStore) error {
+				return ts.Create(&models.Token{
+					Access:           "access",
+					AccessCreateAt:   now,
+					AccessExpiresIn:  time.Hour,
+					Refresh:          "refresh",
+					RefreshCreateAt:  now,
+					RefreshExpiresIn: 24 * time.Hour,
+				})
+			},
+			want: func(ts *TokenStore) map[string]time.Duration {
+				return map[string]time.Duration{
+					string(ts.tokenKey("access")):  time.Hour,
+					string(ts.tokenKey("refresh")): 24*time.Hour + time.Minute,
+				}
+			},
+		},
+		{
+			name: "device request",
+			create: func(ts *TokenStore) error {
+				return NewDeviceStore(ts).Create(&DeviceAuthorization{
+					DeviceCode: "device-code",
+					UserCode:   "USER-CODE",
+					ExpiresIn:  15 * time.Minute,
+				})
+			},
+			want: func(ts *TokenStore) map[string]time.Duration {
+				ds := NewDeviceStore(ts)
+
+				return map[string]time.Duration{
+					string(ds.deviceKey("device-code")): 15 * time.Minute,
+					string(ds.userCodeKey("USER-CODE")): 15 * time.Minute,
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.Clock = testutil.NewFakeClock(now)
+
+			ts := newTestStore(t, config)
+
+			if err := tt.create(ts); err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.want(ts)
+			gone := ts.tokenKey("gone")
+
+			// the TTL entries are lost, and one of a key that's gone is left behind
+			err := ts.db.Update(func(tx *bolt.Tx) error {
+				ttl := ts.ttlBuckets(tx)
+
+				for key := range want {
+					if err := ttl.remove([]byte(key)); err != nil {
+						return err
+					}
+				}
+
+				return ttl.create(gone, time.Hour)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ts.RebuildTTLIndex(); err != nil {
+				t.Fatal(err)
+			}
+
+			for key, ttl := range want {
+				if expiry, ok := expiryOf(t, ts, []byte(key)); !ok || !expiry.Equal(now.Add(ttl)) {
+					t.Errorf("expiry of %q = %v, %v, want %v", key, expiry, ok, now.Add(ttl))
+				}
+			}
+
+			if expiry, ok := expiryOf(t, ts, gone); ok {
+				t.Errorf("the TTL entry of a key that's gone is kept, expiring at %v", expiry)
+			}
+		})
+	}
+}
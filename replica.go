@@ -0,0 +1,220 @@
+package boltdb
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+)
+
+// ReplicaStore serves reads from a snapshot of a token database, like the ones written by
+// Backup, and reopens it when the file changes. Writes return ErrReadOnly
+type ReplicaStore struct {
+	mu      sync.RWMutex
+	current *TokenStore
+	config  Config
+	// modTime and size identify the snapshot the current store was opened on
+	modTime time.Time
+	size    int64
+
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewReplicaStore creates a read-only token store on the snapshot config.DbName, checking
+// every reloadInterval if it was replaced to reopen it. Replace the snapshot by renaming a
+// complete file over it, so the replica never opens a partial copy.
+// The store never deletes expired tokens and config.MetricsRegisterer is ignored
+func NewReplicaStore(config *Config, reloadInterval time.Duration) (oauth2.TokenStore, func(), error) {
+	rs := &ReplicaStore{
+		config: *config,
+		stop:   make(chan struct{}),
+	}
+
+	rs.config.ReadOnly = true
+	rs.config.DeleteExpiredOnRead = false
+	rs.config.ExpiryStrategy = SweepExpiry
+	rs.config.MetricsRegisterer = nil
+	rs.config.CompactFreeRatio = 0
+
+	err := rs.Reload()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if reloadInterval > 0 {
+		rs.wg.Add(1)
+		go rs.reloader(reloadInterval)
+	}
+
+	return rs, rs.closeFunction, nil
+}
+
+// Reload reopens the snapshot when it changed since it was opened.
+// The previous snapshot keeps serving reads if the new one can't be opened
+func (rs *ReplicaStore) Reload() error {
+	info, err := os.Stat(rs.config.dbPath())
+	if err != nil {
+		return err
+	}
+
+	rs.mu.RLock()
+	unchanged := rs.current != nil && info.ModTime().Equal(rs.modTime) && info.Size() == rs.size
+	rs.mu.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	ts, _, err := newTokenStore(&rs.config)
+	if err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	previous := rs.current
+	rs.current, rs.modTime, rs.size = ts, info.ModTime(), info.Size()
+	rs.mu.Unlock()
+
+	// reads hold the read lock, so none is using the previous snapshot anymore
+	if previous != nil {
+		return previous.Close()
+	}
+
+	return nil
+}
+
+// reloader reloads the snapshot every interval until the store is closed
+func (rs *ReplicaStore) reloader(interval time.Duration) {
+	defer rs.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := rs.Reload()
+			if err != nil {
+				rs.config.logger().Printf("boltdb: reload snapshot %s: %v", rs.config.DbName, err)
+
+				if rs.config.OnError != nil {
+					rs.config.OnError("reload", err)
+				}
+			}
+
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+// Close stops reloading and closes the snapshot. It can be called more than once
+func (rs *ReplicaStore) Close() error {
+	rs.closeOnce.Do(func() {
+		close(rs.stop)
+		rs.wg.Wait()
+
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+
+		rs.closeErr = rs.current.Close()
+	})
+
+	return rs.closeErr
+}
+
+// closeFunction is the close function returned by NewReplicaStore
+func (rs *ReplicaStore) closeFunction() {
+	rs.Close()
+}
+
+// read runs fn on the current snapshot
+func (rs *ReplicaStore) read(fn func(ts *TokenStore) (oauth2.TokenInfo, error)) (oauth2.TokenInfo, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	return fn(rs.current)
+}
+
+// Create returns ErrReadOnly
+func (rs *ReplicaStore) Create(info oauth2.TokenInfo) error {
+	return ErrReadOnly
+}
+
+// RemoveByCode returns ErrReadOnly
+func (rs *ReplicaStore) RemoveByCode(code string) error {
+	return ErrReadOnly
+}
+
+// RemoveByAccess returns ErrReadOnly
+func (rs *ReplicaStore) RemoveByAccess(access string) error {
+	return ErrReadOnly
+}
+
+// RemoveByRefresh returns ErrReadOnly
+func (rs *ReplicaStore) RemoveByRefresh(refresh string) error {
+	return ErrReadOnly
+}
+
+// GetByCode use the authorization code for token information data
+func (rs *ReplicaStore) GetByCode(code string) (oauth2.TokenInfo, error) {
+	return rs.read(func(ts *TokenStore) (oauth2.TokenInfo, error) {
+		return ts.GetByCode(code)
+	})
+}
+
+// GetByAccess use the access token for token information data
+func (rs *ReplicaStore) GetByAccess(access string) (oauth2.TokenInfo, error) {
+	return rs.read(func(ts *TokenStore) (oauth2.TokenInfo, error) {
+		return ts.GetByAccess(access)
+	})
+}
+
+// GetByRefresh use the refresh token for token information data
+func (rs *ReplicaStore) GetByRefresh(refresh string) (oauth2.TokenInfo, error) {
+	return rs.read(func(ts *TokenStore) (oauth2.TokenInfo, error) {
+		return ts.GetByRefresh(refresh)
+	})
+}
+
+// Watch returns a channel receiving the changes recorded on the snapshots after it's called,
+// like TokenStore.Watch, as they are reloaded. The channel is closed when ctx is done or the
+// store closed. Snapshots replaced by older ones send nothing until they catch up
+func (rs *ReplicaStore) Watch(ctx context.Context) (<-chan ChangeEvent, error) {
+	return watchChanges(ctx, rs, rs.config.watchInterval(), rs.stop, func(err error) {
+		rs.config.logger().Printf("boltdb: watch snapshot %s: %v", rs.config.DbName, err)
+
+		if rs.config.OnError != nil {
+			rs.config.OnError("watch", err)
+		}
+	})
+}
+
+// lastChange returns the sequence of the last change of the current snapshot
+func (rs *ReplicaStore) lastChange() (uint64, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	return rs.current.lastChange()
+}
+
+// changesSince returns the changes of the current snapshot after last
+func (rs *ReplicaStore) changesSince(last uint64) ([]ChangeEvent, uint64, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	return rs.current.changesSince(last)
+}
+
+// Introspect returns the status of a code, access or refresh token on the current snapshot
+func (rs *ReplicaStore) Introspect(token string) (*IntrospectionResult, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	return rs.current.Introspect(token)
+}
@@ -0,0 +1,138 @@
+package boltdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+// writeSnapshot replaces the snapshot at path with data, renaming a complete file over it
+func writeSnapshot(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// backupBytes returns a backup of ts
+func backupBytes(t *testing.T, ts *TokenStore) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	if err := ts.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReplicaStore(t *testing.T) {
+	tests := []struct {
+		name string
+		// replace replaces the snapshot once the replica is open, after "first" was created
+		replace func(t *testing.T, primary *TokenStore, snapshot string)
+		// reloadFails is set when Reload can't open the replaced snapshot
+		reloadFails bool
+		stored      []string
+		missing     []string
+	}{
+		{
+			name:    "unchanged",
+			replace: func(t *testing.T, primary *TokenStore, snapshot string) {},
+			stored:  []string{"first"},
+			missing: []string{"second"},
+		},
+		{
+			name: "replaced",
+			replace: func(t *testing.T, primary *TokenStore, snapshot string) {
+				err := primary.Create(&models.Token{Access: "second", AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				writeSnapshot(t, snapshot, backupBytes(t, primary))
+			},
+			stored: []string{"first", "second"},
+		},
+		{
+			name: "replaced by a broken file",
+			replace: func(t *testing.T, primary *TokenStore, snapshot string) {
+				writeSnapshot(t, snapshot, []byte("not a database"))
+			},
+			reloadFails: true,
+			stored:      []string{"first"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newTestStore(t, Config{})
+
+			err := primary.Create(&models.Token{Access: "first", AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			snapshot := filepath.Join(t.TempDir(), "snapshot.db")
+			writeSnapshot(t, snapshot, backupBytes(t, primary))
+
+			store, closeFn, err := NewReplicaStore(&Config{DbName: snapshot, BucketName: "oauthTokens"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeFn()
+
+			rs := store.(*ReplicaStore)
+
+			tt.replace(t, primary, snapshot)
+
+			if err := rs.Reload(); (err != nil) != tt.reloadFails {
+				t.Fatalf("Reload = %v, want failing: %v", err, tt.reloadFails)
+			}
+
+			for _, access := range tt.stored {
+				if _, err := rs.GetByAccess(access); err != nil {
+					t.Errorf("GetByAccess(%s) = %v, want it stored", access, err)
+				}
+			}
+
+			for _, access := range tt.missing {
+				if _, err := rs.GetByAccess(access); err != ErrTokenNotFound {
+					t.Errorf("GetByAccess(%s) = %v, want ErrTokenNotFound", access, err)
+				}
+			}
+
+			writes := map[string]error{
+				"Create":          rs.Create(&models.Token{Access: "third"}),
+				"RemoveByCode":    rs.RemoveByCode("code"),
+				"RemoveByAccess":  rs.RemoveByAccess("first"),
+				"RemoveByRefresh": rs.RemoveByRefresh("refresh"),
+			}
+
+			for name, err := range writes {
+				if err != ErrReadOnly {
+					t.Errorf("%s = %v, want ErrReadOnly", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicaStoreWithoutSnapshot(t *testing.T) {
+	_, _, err := NewReplicaStore(&Config{DbName: filepath.Join(t.TempDir(), "missing.db"), BucketName: "oauthTokens"}, 0)
+	if !os.IsNotExist(err) {
+		t.Fatalf("NewReplicaStore = %v, want a missing file error", err)
+	}
+}
@@ -0,0 +1,256 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Reasons of the revocations recorded by the store
+const (
+	// ReasonRemoved is recorded by RemoveByCode, RemoveByAccess and RemoveByRefresh
+	ReasonRemoved = "removed"
+	// ReasonUserRevoked is recorded by RevokeByUserID
+	ReasonUserRevoked = "user_revoked"
+	// ReasonClientRevoked is recorded by RevokeByClientID
+	ReasonClientRevoked = "client_revoked"
+	// ReasonScopeRevoked is recorded by RevokeByScope
+	ReasonScopeRevoked = "scope_revoked"
+	// ReasonIdle is recorded by RevokeIdleSince
+	ReasonIdle = "idle"
+	// ReasonRotated is recorded by RotateRefresh for the exchanged token pair
+	ReasonRotated = "rotated"
+	// ReasonRefreshReused is recorded for the family of a reused refresh token
+	ReasonRefreshReused = "refresh_reused"
+	// ReasonConsumed is recorded for the authorization codes redeemed with ConsumeByCode
+	ReasonConsumed = "consumed"
+	// ReasonQuotaExceeded is recorded for the token pairs revoked to make room with RevokeOldestTokens
+	ReasonQuotaExceeded = "quota_exceeded"
+	// ReasonSessionRevoked is recorded by RevokeSession
+	ReasonSessionRevoked = "session_revoked"
+)
+
+// Revocation is a tombstone of a removed code, access or refresh token
+type Revocation struct {
+	// KeyHash is the hex encoded SHA-256 of the key of the token, the token itself is not recorded
+	KeyHash   string
+	Reason    string
+	RevokedAt time.Time
+	UserID    string
+	ClientID  string
+}
+
+// revocationKeyHash returns the hash recorded for a token key
+func revocationKeyHash(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// Revoke deletes a code, access or refresh token, and the tokens issued with it,
+// recording reason on the revocation log
+func (ts *TokenStore) Revoke(token, reason string) error {
+	if ts.codes != nil {
+		err := ts.codes.Revoke(token, reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ts.removeFamily(context.Background(), token, reason)
+}
+
+// createRevocationBuckets creates the revocation log buckets when the log is enabled
+func (ts *TokenStore) createRevocationBuckets() error {
+	if ts.revocationRetention <= 0 {
+		return nil
+	}
+
+	return createBuckets(ts.db, ts.bucketRevocationsName, ts.bucketRevocationsIndexName)
+}
+
+// logRevocation records the revocation of key on the revocation log when it's enabled.
+// Basic IDs holding token information are not tokens, so they are not recorded
+func (ts *TokenStore) logRevocation(tx *bolt.Tx, key []byte, reason string) error {
+	log := tx.Bucket(ts.bucketRevocationsName)
+	if log == nil || ts.revocationRetention <= 0 || reason == "" {
+		return nil
+	}
+
+	bucket := ts.tokenBucket(tx)
+
+	value := bucket.Get(key)
+	if value == nil {
+		return nil
+	}
+
+	stored, err := ts.decodeStored(value)
+	if err != nil || stored == nil {
+		// key is an access or refresh token pointing to a basic ID
+		stored, _ = ts.decodeStored(bucket.Get(value))
+	} else if stored.Code == "" {
+		return nil
+	}
+
+	revocation := Revocation{
+		KeyHash:   revocationKeyHash(key),
+		Reason:    reason,
+		RevokedAt: ts.clock.Now(),
+	}
+
+	if stored != nil {
+		revocation.UserID = stored.UserID
+		revocation.ClientID = stored.ClientID
+	}
+
+	jv, err := ts.codec.Marshal(&revocation)
+	if err != nil {
+		return err
+	}
+
+	jv, err = ts.cipher.seal(jv)
+	if err != nil {
+		return err
+	}
+
+	logKey := ttlKey(revocation.RevokedAt, []byte(revocation.KeyHash))
+
+	err = log.Put(logKey, jv)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(ts.bucketRevocationsIndexName).Put([]byte(revocation.KeyHash), logKey)
+}
+
+// decodeRevocation decodes a revocation log entry
+func (ts *TokenStore) decodeRevocation(value []byte) (*Revocation, error) {
+	jv, err := ts.cipher.open(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var revocation Revocation
+
+	err = ts.codec.Unmarshal(jv, &revocation)
+	if err != nil {
+		return nil, err
+	}
+
+	return &revocation, nil
+}
+
+// revocation returns the revocation of key, or nil when it's not recorded
+func (ts *TokenStore) revocation(tx *bolt.Tx, key []byte) (*Revocation, error) {
+	index := tx.Bucket(ts.bucketRevocationsIndexName)
+	if index == nil {
+		return nil, nil
+	}
+
+	logKey := index.Get([]byte(revocationKeyHash(key)))
+	if logKey == nil {
+		return nil, nil
+	}
+
+	value := tx.Bucket(ts.bucketRevocationsName).Get(logKey)
+	if value == nil {
+		return nil, nil
+	}
+
+	return ts.decodeRevocation(value)
+}
+
+// ListRevocations returns the revocations recorded since the given time, oldest first
+func (ts *TokenStore) ListRevocations(since time.Time) ([]Revocation, error) {
+	var revocations []Revocation
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		log := tx.Bucket(ts.bucketRevocationsName)
+		if log == nil {
+			return nil
+		}
+
+		c := log.Cursor()
+
+		for k, v := c.Seek(ttlTime(since)); k != nil; k, v = c.Next() {
+			revocation, err := ts.decodeRevocation(v)
+			if err != nil {
+				return err
+			}
+
+			revocations = append(revocations, *revocation)
+		}
+
+		return nil
+	})
+
+	return revocations, err
+}
+
+// purgeRevocations deletes the revocations older than the retention. Sweeps only open
+// a write transaction when the oldest revocation is due
+func (ts *TokenStore) purgeRevocations() (int, error) {
+	if ts.revocationRetention <= 0 || ts.db.IsReadOnly() {
+		return 0, nil
+	}
+
+	purged := 0
+	max := ttlTime(ts.clock.Now().Add(-ts.revocationRetention))
+
+	due, err := ts.revocationsDue(max)
+	if err != nil || !due {
+		return 0, err
+	}
+
+	err = ts.db.Update(func(tx *bolt.Tx) error {
+		log := tx.Bucket(ts.bucketRevocationsName)
+		if log == nil {
+			return nil
+		}
+
+		index := tx.Bucket(ts.bucketRevocationsIndexName)
+		c := log.Cursor()
+
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:ttlTimeSize], max) < 0; k, _ = c.First() {
+			keyHash := k[ttlTimeSize:]
+
+			// the index points to the last revocation of the key
+			if bytes.Equal(index.Get(keyHash), k) {
+				if err := index.Delete(keyHash); err != nil {
+					return err
+				}
+			}
+
+			if err := c.Delete(); err != nil {
+				return err
+			}
+
+			purged++
+		}
+
+		return nil
+	})
+
+	return purged, err
+}
+
+// revocationsDue reports if the oldest revocation was recorded before max
+func (ts *TokenStore) revocationsDue(max []byte) (bool, error) {
+	due := false
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		log := tx.Bucket(ts.bucketRevocationsName)
+		if log == nil {
+			return nil
+		}
+
+		k, _ := log.Cursor().First()
+		due = k != nil && bytes.Compare(k[:ttlTimeSize], max) < 0
+		return nil
+	})
+
+	return due, err
+}
@@ -0,0 +1,83 @@
+package boltdb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// lastTxID returns the id of the last write transaction committed to the database of ts
+func lastTxID(t *testing.T, ts *TokenStore) int {
+	t.Helper()
+
+	var id int
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		id = tx.ID()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func TestPurgeRevocationsOnlyWritesWhenDue(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now())
+
+	store, closeFn, err := NewTokenStore(&Config{
+		DbName:              filepath.Join(t.TempDir(), "oauth2.db"),
+		BucketName:          "oauthTokens",
+		ExpiryStrategy:      LazyExpiry,
+		RevocationRetention: time.Hour,
+		Clock:               clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ts := store.(*TokenStore)
+
+	err = ts.Create(&models.Token{Access: "access", AccessCreateAt: clock.Now(), AccessExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ts.RemoveByAccess("access")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		purged  int
+		writes  bool
+	}{
+		{"within the retention", 30 * time.Minute, 0, false},
+		{"after the retention", time.Hour, 1, true},
+		{"nothing left", time.Hour, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.Advance(tt.advance)
+			before := lastTxID(t, ts)
+
+			purged, err := ts.purgeRevocations()
+			if err != nil || purged != tt.purged {
+				t.Fatalf("purgeRevocations = %d, %v, want %d", purged, err, tt.purged)
+			}
+
+			if writes := lastTxID(t, ts) != before; writes != tt.writes {
+				t.Fatalf("wrote = %v, want %v", writes, tt.writes)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package boltdb
+
+import (
+	"context"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3"
+)
+
+// RefreshReuse describes a rotated refresh token presented again, a sign it was stolen
+type RefreshReuse struct {
+	// Refresh is the rotated refresh token
+	Refresh string
+	// RotatedAt is when it was exchanged
+	RotatedAt time.Time
+	// UserID and ClientID are the ones of the current tokens of the family, empty when
+	// they were already removed
+	UserID   string
+	ClientID string
+}
+
+// RotateRefresh stores the token information issued in exchange for the refresh token
+// and deletes the old token pair on a single transaction. The old refresh token is kept
+// as rotated, pointing to the new one, until it would have expired, so presenting it
+// again calls Config.OnRefreshReuse
+func (ts *TokenStore) RotateRefresh(refresh string, info oauth2.TokenInfo) error {
+	jv, err := ts.codec.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	jv, err = ts.cipher.seal(jv)
+	if err != nil {
+		return err
+	}
+
+	oldKey := ts.tokenKey(refresh)
+
+	return ts.update(context.Background(), func(tx *bolt.Tx) error {
+		if ts.tokenBucket(tx).Get(oldKey) == nil {
+			return ErrTokenNotFound
+		}
+
+		ttl := ts.ttlBuckets(tx)
+		expiry, _ := ttl.expiry(oldKey)
+		sessionID := ts.sessionOf(tx, ts.tokenBucket(tx).Get(oldKey))
+
+		keys, err := ts.familyKeys(tx, oldKey)
+		if err != nil {
+			return err
+		}
+
+		err = ts.deleteKeys(tx, ReasonRotated, keys...)
+		if err != nil {
+			return err
+		}
+
+		// the new token pair stays on the session of the old one
+		_, err = ts.put(tx, &sessionToken{TokenInfo: info, sessionID: sessionID}, jv)
+		if err != nil {
+			return err
+		}
+
+		onCommit(tx, ts.hooks.OnCreate, createEvent(info))
+
+		newToken := info.GetRefresh()
+		if newToken == "" {
+			newToken = info.GetAccess()
+		}
+
+		if newToken == refresh {
+			return nil
+		}
+
+		err = tx.Bucket(ts.bucketRotatedName).Put(oldKey, ttlKey(ts.clock.Now(), ts.tokenKey(newToken)))
+		if err != nil || expiry.IsZero() {
+			return err
+		}
+
+		// the sweep deletes the rotation when the old refresh token would have expired
+		return ttl.createAt(oldKey, expiry)
+	})
+}
+
+// checkReuse calls Config.OnRefreshReuse when key is a rotated refresh token, and revokes
+// the current tokens of its family if the callback asks to. It reports if key was rotated
+func (ts *TokenStore) checkReuse(ctx context.Context, refresh string, key []byte) (bool, error) {
+	var reuse *RefreshReuse
+	var current []byte
+
+	err := ts.view(ctx, func(tx *bolt.Tx) error {
+		rotated := tx.Bucket(ts.bucketRotatedName)
+		if rotated == nil {
+			// older read-only databases have no rotations
+			return nil
+		}
+
+		value := rotated.Get(key)
+		if value == nil {
+			return nil
+		}
+
+		rotatedAt, err := parseTtlKey(value)
+		if err != nil {
+			return err
+		}
+
+		reuse = &RefreshReuse{Refresh: refresh, RotatedAt: rotatedAt}
+		current = ts.currentRotation(tx, value[ttlTimeSize:])
+
+		stored, _ := ts.decodeStored(ts.tokenInfoValue(tx, current))
+		if stored != nil {
+			reuse.UserID = stored.UserID
+			reuse.ClientID = stored.ClientID
+		}
+
+		return nil
+	})
+
+	if err != nil || reuse == nil {
+		return false, err
+	}
+
+	if ts.onRefreshReuse == nil || !ts.onRefreshReuse(*reuse) {
+		return true, nil
+	}
+
+	return true, ts.update(ctx, func(tx *bolt.Tx) error {
+		// the family may have been rotated again since the read
+		current := ts.currentRotation(tx, current)
+
+		keys, err := ts.familyKeys(tx, current)
+		if err != nil {
+			return err
+		}
+
+		return ts.deleteKeys(tx, ReasonRefreshReused, keys...)
+	})
+}
+
+// currentRotation follows the rotations from key to the key of the last token of the family
+func (ts *TokenStore) currentRotation(tx *bolt.Tx, key []byte) []byte {
+	rotated := tx.Bucket(ts.bucketRotatedName)
+	seen := map[string]bool{}
+
+	for !seen[string(key)] {
+		seen[string(key)] = true
+
+		next := rotated.Get(key)
+		if len(next) <= ttlTimeSize {
+			break
+		}
+
+		key = next[ttlTimeSize:]
+	}
+
+	return append([]byte(nil), key...)
+}
+
+// tokenInfoValue returns the stored token information of an access or refresh key
+func (ts *TokenStore) tokenInfoValue(tx *bolt.Tx, key []byte) []byte {
+	bucket := ts.tokenBucket(tx)
+
+	basicID := bucket.Get(key)
+	if basicID == nil {
+		return nil
+	}
+
+	return bucket.Get(basicID)
+}
+
+// reuseError returns the error of GetByRefresh for a refresh key that was not found: ErrRefreshTokenReused
+// when it was rotated, unless Config.NilOnNotFound is set, and err otherwise
+func (ts *TokenStore) reuseError(ctx context.Context, refresh string, key []byte, err error) error {
+	reused, reuseErr := ts.checkReuse(ctx, refresh, key)
+	if reuseErr != nil {
+		return reuseErr
+	}
+
+	if reused && !ts.nilOnNotFound {
+		return ErrRefreshTokenReused
+	}
+
+	return err
+}
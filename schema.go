@@ -0,0 +1,269 @@
+package boltdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SchemaVersion is the version of the storage layout written by this version of the package.
+// Databases with an older schema are migrated when opened, newer ones are refused
+const SchemaVersion = 12
+
+// schemaVersionKey is the key of the schema version on the meta bucket
+var schemaVersionKey = []byte("schema-version")
+
+// migration upgrades the buckets of ts from the previous schema version inside tx
+type migration func(ts *TokenStore, tx *bolt.Tx) error
+
+// migrations upgrade the schema step by step: migrations[i] upgrades version i to i+1.
+// Databases created before the schema was versioned are version 0
+var migrations = []migration{
+	// 1: TTL keys are binary expirations followed by the key, so they don't collide
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		for _, shard := range ts.ttlBuckets(tx).shards() {
+			if err := migrateTtlKeys(shard); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+	// 2: tokens are indexed by user and client
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		return ts.rebuildIndexes(tx)
+	},
+	// 3: tokens are indexed by scope
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		return ts.rebuildIndexes(tx)
+	},
+	// 4: token metadata is stored on its own bucket
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ts.bucketMetadataName)
+		return err
+	},
+	// 5: uses of access tokens are tracked on their own bucket
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ts.bucketUsageName)
+		return err
+	},
+	// 6: rotated refresh tokens are kept on their own bucket
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ts.bucketRotatedName)
+		return err
+	},
+	// 7: device authorization requests are stored on their own buckets
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ts.bucketDevicesName)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(ts.bucketUserCodesName)
+		return err
+	},
+	// 8: PKCE challenges of the codes are stored on their own bucket
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ts.bucketChallengesName)
+		return err
+	},
+	// 9: codes and token pairs are grouped on sessions
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ts.bucketSessionsName)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(ts.bucketSessionMembersName)
+		return err
+	},
+	// 10: token pairs are indexed by the creation of their access token
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		return ts.rebuildIndexes(tx)
+	},
+	// 11: consents of the users to the clients are stored on their own bucket
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ts.bucketConsentsName)
+		return err
+	},
+	// 12: the audit log is chained with HMAC-SHA256, keyed with the secret of the store
+	func(ts *TokenStore, tx *bolt.Tx) error {
+		return ts.rechainAudit(tx, nil, ts.auditKey)
+	},
+}
+
+// schemaVersion returns the schema version of the buckets of ts, 0 when it's not recorded
+func (ts *TokenStore) schemaVersion(tx *bolt.Tx) uint64 {
+	meta := tx.Bucket(ts.bucketMetaName)
+	if meta == nil {
+		return 0
+	}
+
+	version := meta.Get(schemaVersionKey)
+	if len(version) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(version)
+}
+
+// migrate upgrades the buckets of ts to SchemaVersion, one transaction per version.
+// Read-only databases are not upgraded, older layouts are still readable
+func (ts *TokenStore) migrate() error {
+	var version uint64
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		version = ts.schemaVersion(tx)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: bucket %s has schema version %d, this version supports up to %d",
+			ErrUnsupportedSchema, ts.bucketName, version, SchemaVersion)
+	}
+
+	if version == SchemaVersion || ts.db.IsReadOnly() {
+		return nil
+	}
+
+	for ; version < SchemaVersion; version++ {
+		next := version + 1
+
+		err := ts.db.Update(func(tx *bolt.Tx) error {
+			err := migrations[version](ts, tx)
+			if err != nil {
+				return err
+			}
+
+			meta, err := tx.CreateBucketIfNotExists(ts.bucketMetaName)
+			if err != nil {
+				return err
+			}
+
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, next)
+
+			return meta.Put(schemaVersionKey, value)
+		})
+
+		if err != nil {
+			return fmt.Errorf("migrate bucket %s to schema version %d: %w", ts.bucketName, next, err)
+		}
+
+		ts.logger.Printf("boltdb: migrated bucket %s to schema version %d", ts.bucketName, next)
+	}
+
+	return nil
+}
+
+// checkSettings records the key check value and the codec name of ts on the meta bucket, failing
+// when the recorded ones differ: a wrong Config.EncryptionKey or Config.Codec can't read the
+// tokens, and Vacuum would take them for garbage. Read-only databases are only compared
+func (ts *TokenStore) checkSettings() error {
+	if ts.db.IsReadOnly() {
+		return ts.db.View(ts.checkRecordedSettings)
+	}
+
+	return ts.db.Update(func(tx *bolt.Tx) error {
+		err := ts.checkRecordedSettings(tx)
+		if err != nil {
+			return err
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(ts.bucketMetaName)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range ts.settings() {
+			err = meta.Put(s.key, s.value)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// setting is a setting of the store recorded on the meta bucket
+type setting struct {
+	key   []byte
+	value []byte
+	// mismatch is the error returned when the recorded value differs
+	mismatch error
+}
+
+// settings returns the settings of ts recorded on the meta bucket
+func (ts *TokenStore) settings() []setting {
+	return []setting{
+		{keyCheckKey, ts.cipher.keyCheck(), ErrEncryptionKeyMismatch},
+		{codecKey, []byte(codecName(ts.codec)), ErrCodecMismatch},
+	}
+}
+
+// checkRecordedSettings fails when the settings recorded on the meta bucket of ts inside tx,
+// which may be a backup, differ from the ones of ts. Settings not recorded are not compared
+func (ts *TokenStore) checkRecordedSettings(tx *bolt.Tx) error {
+	meta := tx.Bucket(ts.bucketMetaName)
+	if meta == nil {
+		return nil
+	}
+
+	for _, s := range ts.settings() {
+		if recorded := meta.Get(s.key); recorded != nil && !bytes.Equal(recorded, s.value) {
+			return fmt.Errorf("%w: bucket %s", s.mismatch, ts.bucketName)
+		}
+	}
+
+	return nil
+}
+
+// LoadRecordedSettings sets Codec and Shards to the ones recorded on the meta bucket of
+// BucketName, so tools can open databases without knowing how they were created. Settings
+// not recorded are left as they are. The database is opened read-only with BoltOptions, and
+// codecs other than the ones of the package fail with ErrCodecMismatch
+func (c *Config) LoadRecordedSettings() error {
+	if c.DbName == "" {
+		return ErrDbNameRequired
+	}
+
+	readOnly := *c
+	readOnly.ReadOnly = true
+
+	db, err := openDB(c.dbPath(), c.fileMode(), readOnly.boltOptions())
+	if err != nil {
+		return err
+	}
+	defer closeDB(db)
+
+	ts := &TokenStore{}
+	ts.setBucketNames(c.BucketName)
+
+	return db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(ts.bucketMetaName)
+		if meta == nil {
+			return nil
+		}
+
+		if name := meta.Get(codecKey); name != nil {
+			codec, ok := codecNamed(string(name))
+			if !ok {
+				return fmt.Errorf("%w: bucket %s has the codec %s", ErrCodecMismatch, c.BucketName, name)
+			}
+
+			c.Codec = codec
+		}
+
+		// unsharded buckets don't record their shards
+		c.Shards = ts.recordedShards(tx)
+
+		return nil
+	})
+}
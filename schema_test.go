@@ -0,0 +1,212 @@
+package boltdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// setSchemaVersion records version as the schema version of the store of config
+func setSchemaVersion(t *testing.T, config *Config, version uint64) {
+	t.Helper()
+
+	db, err := bolt.Open(config.DbName, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, version)
+
+		return tx.Bucket([]byte(config.BucketName+"-meta")).Put(schemaVersionKey, value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint64
+		err     error
+	}{
+		{"unversioned", 0, nil},
+		{"previous version", SchemaVersion - 1, nil},
+		{"current version", SchemaVersion, nil},
+		{"newer version", SchemaVersion + 1, ErrUnsupportedSchema},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				DbName:     filepath.Join(t.TempDir(), "oauth2.db"),
+				BucketName: "oauthTokens",
+			}
+
+			store, closeFn, err := NewTokenStore(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = store.Create(&models.Token{
+				Access:           "access",
+				AccessCreateAt:   time.Now(),
+				AccessExpiresIn:  time.Hour,
+				Refresh:          "refresh",
+				RefreshCreateAt:  time.Now(),
+				RefreshExpiresIn: time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeFn()
+
+			setSchemaVersion(t, config, tt.version)
+
+			store, closeFn, err = NewTokenStore(config)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("NewTokenStore = %v, want %v", err, tt.err)
+			}
+
+			if err != nil {
+				return
+			}
+			defer closeFn()
+
+			ts := store.(*TokenStore)
+
+			err = ts.db.View(func(tx *bolt.Tx) error {
+				if version := ts.schemaVersion(tx); version != SchemaVersion {
+					t.Errorf("schema version = %d, want %d", version, SchemaVersion)
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := ts.GetByRefresh("refresh")
+			if err != nil || info == nil || info.GetAccess() != "access" {
+				t.Fatalf("GetByRefresh after migrating = %v, %v, want the stored pair", info, err)
+			}
+		})
+	}
+}
+
+func TestSettingsMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		created  Config
+		reopened Config
+		err      error
+	}{
+		{"same settings", Config{EncryptionKey: testOldKey, Codec: GobCodec}, Config{EncryptionKey: testOldKey, Codec: GobCodec}, nil},
+		{"default codec", Config{}, Config{Codec: JSONCodec}, nil},
+		{"another key", Config{EncryptionKey: testOldKey}, Config{EncryptionKey: testNewKey}, ErrEncryptionKeyMismatch},
+		{"key dropped", Config{EncryptionKey: testOldKey}, Config{}, ErrEncryptionKeyMismatch},
+		{"key added", Config{}, Config{EncryptionKey: testOldKey}, ErrEncryptionKeyMismatch},
+		{"another codec", Config{Codec: MsgpackCodec}, Config{Codec: GobCodec}, ErrCodecMismatch},
+		{"read-only with another key", Config{EncryptionKey: testOldKey}, Config{EncryptionKey: testNewKey, ReadOnly: true}, ErrEncryptionKeyMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbName := filepath.Join(t.TempDir(), "oauth2.db")
+
+			created := tt.created
+			created.DbName, created.BucketName = dbName, "oauthTokens"
+
+			store, closeFn, err := NewTokenStore(&created)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = store.Create(&models.Token{Access: "access", AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeFn()
+
+			reopened := tt.reopened
+			reopened.DbName, reopened.BucketName = dbName, "oauthTokens"
+
+			store, closeFn, err = NewTokenStore(&reopened)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("NewTokenStore = %v, want %v", err, tt.err)
+			}
+
+			if err != nil {
+				return
+			}
+			defer closeFn()
+
+			info, err := store.GetByAccess("access")
+			if err != nil || info == nil {
+				t.Fatalf("GetByAccess = %v, %v, want the stored token", info, err)
+			}
+		})
+	}
+}
+
+// upperJSONCodec is a codec of its own, named by its type on the meta bucket
+type upperJSONCodec struct{ jsonCodec }
+
+func TestLoadRecordedSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		created Config
+		codec   Codec
+		shards  int
+		err     error
+	}{
+		{"defaults", Config{}, JSONCodec, 0, nil},
+		{"gob and shards", Config{Codec: GobCodec, Shards: 16}, GobCodec, 16, nil},
+		{"msgpack", Config{Codec: MsgpackCodec}, MsgpackCodec, 0, nil},
+		{"codec of its own", Config{Codec: upperJSONCodec{}}, nil, 0, ErrCodecMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created := tt.created
+			created.DbName = filepath.Join(t.TempDir(), "oauth2.db")
+			created.BucketName = "oauthTokens"
+
+			_, closeFn, err := NewTokenStore(&created)
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeFn()
+
+			// the tools don't know the settings
+			loaded := &Config{DbName: created.DbName, BucketName: created.BucketName, Shards: 4}
+
+			err = loaded.LoadRecordedSettings()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("LoadRecordedSettings = %v, want %v", err, tt.err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if loaded.Codec != tt.codec || loaded.Shards != tt.shards {
+				t.Fatalf("loaded codec %v and %d shards, want %v and %d", loaded.Codec, loaded.Shards, tt.codec, tt.shards)
+			}
+
+			_, closeFn, err = NewTokenStore(loaded)
+			if err != nil {
+				t.Fatalf("NewTokenStore with the loaded settings = %v", err)
+			}
+			closeFn()
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3"
+)
+
+// sessionKeyPrefix prefixes the keys of the session records and their member entries,
+// so they don't collide with the token keys holding the membership of a token
+var sessionKeyPrefix = []byte("session:")
+
+// Session groups the code and token pairs issued in one authorization, and the
+// pairs refreshed from them, like a signed in device
+type Session struct {
+	ID        string
+	UserID    string
+	ClientID  string
+	CreatedAt time.Time
+}
+
+// sessionToken is a token information created with CreateInSession
+type sessionToken struct {
+	oauth2.TokenInfo
+	sessionID string
+}
+
+// CreateInSession stores the token information like Create, on the session sessionID instead
+// of a new one. Use it to keep the token pair exchanged for an authorization code on the
+// session of the code, see GetSessionByCode. Unknown sessions are created
+func (ts *TokenStore) CreateInSession(info oauth2.TokenInfo, sessionID string) error {
+	jv, err := ts.codec.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return ts.create(context.Background(), &sessionToken{TokenInfo: info, sessionID: sessionID}, jv, nil)
+}
+
+// sessionKey returns the key of the record of a session
+func sessionKey(id string) []byte {
+	return append(append([]byte(nil), sessionKeyPrefix...), id...)
+}
+
+// sessionMembersPrefix returns the prefix of the member entries of a session
+func sessionMembersPrefix(id string) []byte {
+	return append(sessionKey(id), indexSeparator)
+}
+
+// sessionOfInfo returns the session the code or token pair of info joins: the one it's created
+// on with CreateInSession, or the one of the token pair its refresh token was issued with, like
+// when the manager refreshes a pair without rotating the refresh token. Empty starts a new one.
+// It must be called before the keys of info are written
+func (ts *TokenStore) sessionOfInfo(tx *bolt.Tx, info tokenKeys) string {
+	if info, ok := info.(*sessionToken); ok && info.sessionID != "" {
+		return info.sessionID
+	}
+
+	if info.GetCode() != "" || info.GetRefresh() == "" {
+		return ""
+	}
+
+	basicID := ts.tokenBucket(tx).Get(ts.tokenKey(info.GetRefresh()))
+	if basicID == nil {
+		return ""
+	}
+
+	return ts.sessionOf(tx, basicID)
+}
+
+// newSessionID returns the id of a new session, from the generator of the basic IDs
+func (ts *TokenStore) newSessionID() string {
+	return hex.EncodeToString(ts.newID())
+}
+
+// joinSession adds key, holding the token information of info, to the session id inside tx.
+// An empty id starts a new session
+func (ts *TokenStore) joinSession(tx *bolt.Tx, key []byte, info tokenKeys, id string) error {
+	sessions := tx.Bucket(ts.bucketSessionsName)
+	members := tx.Bucket(ts.bucketSessionMembersName)
+	if sessions == nil || members == nil {
+		// older read-only databases have no sessions
+		return nil
+	}
+
+	if id == "" {
+		id = ts.newSessionID()
+	}
+
+	if sessions.Get(sessionKey(id)) == nil {
+		err := ts.putSession(sessions, &Session{
+			ID:        id,
+			UserID:    info.GetUserID(),
+			ClientID:  info.GetClientID(),
+			CreatedAt: ts.clock.Now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := members.Put(key, []byte(id))
+	if err != nil {
+		return err
+	}
+
+	return members.Put(append(sessionMembersPrefix(id), key...), key)
+}
+
+// deleteSessionEntries deletes the membership of key inside tx, and the record of its
+// session when it was the last member, so sessions end with their last code or token pair
+func (ts *TokenStore) deleteSessionEntries(tx *bolt.Tx, key []byte) error {
+	members := tx.Bucket(ts.bucketSessionMembersName)
+	if members == nil {
+		return nil
+	}
+
+	value := members.Get(key)
+	if value == nil {
+		return nil
+	}
+
+	id := string(value)
+	prefix := sessionMembersPrefix(id)
+
+	err := members.Delete(append(prefix, key...))
+	if err != nil {
+		return err
+	}
+
+	err = members.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	if k, _ := members.Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+		return nil
+	}
+
+	return tx.Bucket(ts.bucketSessionsName).Delete(sessionKey(id))
+}
+
+// sessionOf returns the id of the session of the token information key, empty when it has none
+func (ts *TokenStore) sessionOf(tx *bolt.Tx, key []byte) string {
+	members := tx.Bucket(ts.bucketSessionMembersName)
+	if members == nil {
+		return ""
+	}
+
+	return string(members.Get(key))
+}
+
+// GetSessionByAccess returns the session of the access token, nil when it was created before sessions.
+// Like GetByAccess, it fails with ErrTokenNotFound or ErrTokenExpired when the token can't be used
+func (ts *TokenStore) GetSessionByAccess(access string) (*Session, error) {
+	return ts.sessionByToken(access, true)
+}
+
+// GetSessionByCode returns the session of the authorization code, nil when it was created before sessions.
+// Like GetByCode, it fails with ErrTokenNotFound or ErrTokenExpired when the code can't be used
+func (ts *TokenStore) GetSessionByCode(code string) (*Session, error) {
+	if ts.codes != nil {
+		return ts.codes.GetSessionByCode(code)
+	}
+
+	return ts.sessionByToken(code, false)
+}
+
+// sessionByToken returns the session of token. When byBasicID is set the token key holds a basic ID
+func (ts *TokenStore) sessionByToken(token string, byBasicID bool) (*Session, error) {
+	var session *Session
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		key := ts.tokenKey(token)
+
+		_, _, _, err := ts.readTx(tx, key, byBasicID)
+		if err != nil {
+			return err
+		}
+
+		if byBasicID {
+			key = ts.tokenBucket(tx).Get(key)
+		}
+
+		id := ts.sessionOf(tx, key)
+		if id == "" {
+			return nil
+		}
+
+		session, err = ts.getSession(tx, id)
+		return err
+	})
+
+	return session, err
+}
+
+// ListSessionsByUser returns the sessions with codes or token pairs of the user
+func (ts *TokenStore) ListSessionsByUser(userID string) ([]Session, error) {
+	var sessions []Session
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		seen := map[string]bool{}
+
+		for _, key := range ts.indexedKeys(tx, ts.bucketUserIndexName, userID) {
+			id := ts.sessionOf(tx, key)
+			if id == "" || seen[id] {
+				continue
+			}
+
+			seen[id] = true
+
+			session, err := ts.getSession(tx, id)
+			if err != nil {
+				return err
+			}
+
+			if session != nil {
+				sessions = append(sessions, *session)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil || ts.codes == nil {
+		return sessions, err
+	}
+
+	codeSessions, err := ts.codes.ListSessionsByUser(userID)
+
+	return append(sessions, codeSessions...), err
+}
+
+// RevokeSession deletes the codes and token pairs of a session, like signing out of a device,
+// recording ReasonSessionRevoked on the revocation log
+func (ts *TokenStore) RevokeSession(id string) error {
+	if ts.codes != nil {
+		err := ts.codes.RevokeSession(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ts.update(context.Background(), func(tx *bolt.Tx) error {
+		members := tx.Bucket(ts.bucketSessionMembersName)
+		if members == nil {
+			return nil
+		}
+
+		var roots [][]byte
+
+		prefix := sessionMembersPrefix(id)
+		c := members.Cursor()
+
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			roots = append(roots, append([]byte(nil), v...))
+		}
+
+		for _, root := range roots {
+			keys, err := ts.rootFamily(tx, root)
+			if err != nil {
+				return err
+			}
+
+			err = ts.deleteKeys(tx, ReasonSessionRevoked, keys...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// getSession returns the record of a session, nil when it's not stored
+func (ts *TokenStore) getSession(tx *bolt.Tx, id string) (*Session, error) {
+	value := tx.Bucket(ts.bucketSessionsName).Get(sessionKey(id))
+	if value == nil {
+		return nil, nil
+	}
+
+	jv, err := ts.cipher.open(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+
+	err = ts.codec.Unmarshal(jv, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// putSession stores the record of a session
+func (ts *TokenStore) putSession(sessions *bolt.Bucket, session *Session) error {
+	jv, err := ts.codec.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	jv, err = ts.cipher.seal(jv)
+	if err != nil {
+		return err
+	}
+
+	return sessions.Put(sessionKey(session.ID), jv)
+}
+
+// rotatedMemberKey moves a session membership, keyed by the token information key, or a member
+// entry of a session, holding it, to the new key of the token information
+func rotatedMemberKey(r *keyRotation, k, v []byte) ([]byte, []byte, error) {
+	if !bytes.HasPrefix(k, sessionKeyPrefix) {
+		return r.moved[string(k)], v, nil
+	}
+
+	newKey := r.moved[string(v)]
+	if newKey == nil {
+		return nil, nil, nil
+	}
+
+	prefix := k[:len(k)-len(v)]
+
+	return append(append([]byte(nil), prefix...), newKey...), newKey, nil
+}
@@ -0,0 +1,94 @@
+package boltdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestCreateJoinsTheSessionOfTheRefreshToken(t *testing.T) {
+	ids := 0
+
+	store, closeFn, err := NewTokenStore(&Config{
+		DbName:     filepath.Join(t.TempDir(), "oauth2.db"),
+		BucketName: "oauthTokens",
+		IDGenerator: func() []byte {
+			ids++
+			return []byte(fmt.Sprintf("id-%d", ids))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ts := store.(*TokenStore)
+	now := time.Now()
+
+	pair := func(access, refresh string) *models.Token {
+		return &models.Token{
+			UserID:           "user",
+			ClientID:         "client",
+			Access:           access,
+			AccessCreateAt:   now,
+			AccessExpiresIn:  time.Hour,
+			Refresh:          refresh,
+			RefreshCreateAt:  now,
+			RefreshExpiresIn: 24 * time.Hour,
+		}
+	}
+
+	err = ts.Create(pair("access1", "refresh1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ts.GetSessionByAccess("access1")
+	if err != nil || first == nil {
+		t.Fatalf("GetSessionByAccess = %v, %v, want a new session", first, err)
+	}
+
+	tests := []struct {
+		name        string
+		access      string
+		refresh     string
+		sameSession bool
+	}{
+		// the manager refreshes without rotating: the new pair keeps the refresh token
+		{"refreshed pair", "access2", "refresh1", true},
+		{"new pair", "access3", "refresh3", false},
+		{"pair without refresh token", "access4", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ts.Create(pair(tt.access, tt.refresh))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			session, err := ts.GetSessionByAccess(tt.access)
+			if err != nil || session == nil {
+				t.Fatalf("GetSessionByAccess = %v, %v, want a session", session, err)
+			}
+
+			if same := session.ID == first.ID; same != tt.sameSession {
+				t.Errorf("session %s, first session %s, want the same session: %v", session.ID, first.ID, tt.sameSession)
+			}
+		})
+	}
+
+	// the manager removes the refreshed access token once the new pair is stored
+	err = ts.RemoveByAccess("access1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := ts.GetSessionByAccess("access2")
+	if err != nil || session == nil || session.ID != first.ID {
+		t.Fatalf("GetSessionByAccess after removing the refreshed pair = %v, %v, want session %s", session, err, first.ID)
+	}
+}
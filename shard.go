@@ -0,0 +1,413 @@
+package boltdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// shardsKey is the key of the number of shards of the token bucket on the meta bucket
+var shardsKey = []byte("shards")
+
+// shardName returns the name of the nested bucket of shard i, on the token and TTL buckets
+func shardName(i int) []byte {
+	return []byte(fmt.Sprintf("shard-%d", i))
+}
+
+// shardOf returns the shard of key among n
+func shardOf(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+
+	return int(h.Sum32() % uint32(n))
+}
+
+// createShards records the number of shards of the token bucket, which is fixed once it has
+// entries, and creates their nested buckets on the token, TTL and TTL index buckets
+func (ts *TokenStore) createShards() error {
+	names := [][]byte{ts.bucketName, ts.bucketTtlName, ts.bucketTtlIndexName}
+
+	// recorded returns the number of shards the bucket was created with, failing when it has
+	// tokens and it's not the configured one
+	recorded := func(tx *bolt.Tx) (int, error) {
+		shards := ts.recordedShards(tx)
+
+		if shards == ts.shards {
+			return shards, nil
+		}
+
+		if bucket := (tokenBucket{bucket: tx.Bucket(ts.bucketName), n: shards}); bucket.exists() {
+			if k, _ := bucket.Cursor().First(); k != nil {
+				return 0, fmt.Errorf("%w: bucket %s has %d shards, the config %d",
+					ErrShardsMismatch, ts.bucketName, shards, ts.shards)
+			}
+		}
+
+		return shards, nil
+	}
+
+	if ts.db.IsReadOnly() {
+		return ts.db.View(func(tx *bolt.Tx) error {
+			_, err := recorded(tx)
+			return err
+		})
+	}
+
+	return ts.db.Update(func(tx *bolt.Tx) error {
+		shards, err := recorded(tx)
+		if err != nil {
+			return err
+		}
+
+		if shards != ts.shards {
+			// the bucket is empty, the shards of the previous number are dropped
+			for _, name := range names {
+				for i := 0; i < shards; i++ {
+					err := tx.Bucket(name).DeleteBucket(shardName(i))
+					if err != nil && err != bolt.ErrBucketNotFound {
+						return err
+					}
+				}
+			}
+
+			meta, err := tx.CreateBucketIfNotExists(ts.bucketMetaName)
+			if err != nil {
+				return err
+			}
+
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, uint64(ts.shards))
+
+			err = meta.Put(shardsKey, value)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, name := range names {
+			for i := 0; i < ts.shards; i++ {
+				_, err := tx.Bucket(name).CreateBucketIfNotExists(shardName(i))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// recordedShards returns the number of shards recorded for the token bucket inside tx
+func (ts *TokenStore) recordedShards(tx *bolt.Tx) int {
+	meta := tx.Bucket(ts.bucketMetaName)
+	if meta == nil || len(meta.Get(shardsKey)) != 8 {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint64(meta.Get(shardsKey)))
+}
+
+// tokenBucket is the token bucket of a store inside a transaction. Sharded stores split
+// it on nested buckets by the hash of the key, opened when a key of theirs is accessed
+type tokenBucket struct {
+	bucket *bolt.Bucket
+	// n is the number of shards, 0 when the bucket is not sharded
+	n int
+}
+
+// tokenBucket returns the token bucket of ts inside tx
+func (ts *TokenStore) tokenBucket(tx *bolt.Tx) tokenBucket {
+	return tokenBucket{bucket: tx.Bucket(ts.bucketName), n: ts.shards}
+}
+
+// exists reports if the bucket and its shards, which are created together, exist
+func (b tokenBucket) exists() bool {
+	return b.bucket != nil && (b.n == 0 || b.bucket.Bucket(shardName(0)) != nil)
+}
+
+// shards returns the buckets of every shard
+func (b tokenBucket) shards() []*bolt.Bucket {
+	if b.n == 0 {
+		return []*bolt.Bucket{b.bucket}
+	}
+
+	shards := make([]*bolt.Bucket, b.n)
+	for i := range shards {
+		shards[i] = b.bucket.Bucket(shardName(i))
+	}
+
+	return shards
+}
+
+// shard returns the shard of key
+func (b tokenBucket) shard(key []byte) *bolt.Bucket {
+	if b.n == 0 {
+		return b.bucket
+	}
+
+	return b.bucket.Bucket(shardName(shardOf(key, b.n)))
+}
+
+// Get returns the value of key, nil when it's missing
+func (b tokenBucket) Get(key []byte) []byte {
+	return b.shard(key).Get(key)
+}
+
+// Put stores value under key
+func (b tokenBucket) Put(key, value []byte) error {
+	return b.shard(key).Put(key, value)
+}
+
+// Delete deletes key
+func (b tokenBucket) Delete(key []byte) error {
+	return b.shard(key).Delete(key)
+}
+
+// ForEach calls fn with the entries of every shard, in key order within each shard
+func (b tokenBucket) ForEach(fn func(k, v []byte) error) error {
+	for _, shard := range b.shards() {
+		if err := shard.ForEach(fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Cursor returns a cursor over the entries of every shard, in key order
+func (b tokenBucket) Cursor() keyCursor {
+	if b.n == 0 {
+		return b.bucket.Cursor()
+	}
+
+	c := &shardCursor{
+		cursors: make([]*bolt.Cursor, b.n),
+		keys:    make([][]byte, b.n),
+		values:  make([][]byte, b.n),
+	}
+
+	for i, shard := range b.shards() {
+		c.cursors[i] = shard.Cursor()
+	}
+
+	return c
+}
+
+// keyCount returns the number of keys of every shard
+func (b tokenBucket) keyCount() int {
+	n := 0
+	for _, shard := range b.shards() {
+		n += shard.Stats().KeyN
+	}
+
+	return n
+}
+
+// keyCursor iterates the entries of a bucket in key order, like *bolt.Cursor
+type keyCursor interface {
+	First() ([]byte, []byte)
+	Next() ([]byte, []byte)
+	Seek(seek []byte) ([]byte, []byte)
+}
+
+// shardCursor merges the cursors of the shards, so entries come in key order
+type shardCursor struct {
+	cursors []*bolt.Cursor
+	// keys and values are the current entry of each cursor
+	keys    [][]byte
+	values  [][]byte
+	current int
+}
+
+// First moves to the first entry of all the shards
+func (c *shardCursor) First() ([]byte, []byte) {
+	for i, cursor := range c.cursors {
+		c.keys[i], c.values[i] = cursor.First()
+	}
+
+	return c.min()
+}
+
+// Next moves to the next entry of all the shards
+func (c *shardCursor) Next() ([]byte, []byte) {
+	if c.current < 0 {
+		return nil, nil
+	}
+
+	c.keys[c.current], c.values[c.current] = c.cursors[c.current].Next()
+
+	return c.min()
+}
+
+// Seek moves to the first entry of all the shards at or after seek
+func (c *shardCursor) Seek(seek []byte) ([]byte, []byte) {
+	for i, cursor := range c.cursors {
+		c.keys[i], c.values[i] = cursor.Seek(seek)
+	}
+
+	return c.min()
+}
+
+// min returns the smallest current entry and makes its cursor the current one
+func (c *shardCursor) min() ([]byte, []byte) {
+	c.current = -1
+
+	for i, k := range c.keys {
+		if k != nil && (c.current < 0 || bytes.Compare(k, c.keys[c.current]) < 0) {
+			c.current = i
+		}
+	}
+
+	if c.current < 0 {
+		return nil, nil
+	}
+
+	return c.keys[c.current], c.values[c.current]
+}
+
+// ttlBuckets are the TTL buckets of the shards of a store inside a transaction.
+// TTL entries are sharded like the keys they expire
+type ttlBuckets struct {
+	ttl   *bolt.Bucket
+	index *bolt.Bucket
+	// n is the number of shards, 0 when the buckets are not sharded
+	n          int
+	clock      Clock
+	shardByDay bool
+}
+
+// ttlBuckets returns the TTL buckets of the store inside tx
+func (ts *TokenStore) ttlBuckets(tx *bolt.Tx) ttlBuckets {
+	return ttlBuckets{
+		ttl:        tx.Bucket(ts.bucketTtlName),
+		index:      tx.Bucket(ts.bucketTtlIndexName),
+		n:          ts.shards,
+		clock:      ts.clock,
+		shardByDay: ts.shardTTLByDay,
+	}
+}
+
+// shardAt returns the TTL bucket of shard i
+func (t ttlBuckets) shardAt(i int) ttlBucket {
+	bucket := ttlBucket{
+		clock:      t.clock,
+		shardByDay: t.shardByDay,
+		ttl:        t.ttl,
+		index:      t.index,
+	}
+
+	if t.n > 0 {
+		bucket.ttl = t.ttl.Bucket(shardName(i))
+		bucket.index = t.index.Bucket(shardName(i))
+	}
+
+	return bucket
+}
+
+// shards returns the TTL buckets of every shard
+func (t ttlBuckets) shards() []ttlBucket {
+	if t.n == 0 {
+		return []ttlBucket{t.shardAt(0)}
+	}
+
+	shards := make([]ttlBucket, t.n)
+	for i := range shards {
+		shards[i] = t.shardAt(i)
+	}
+
+	return shards
+}
+
+// shard returns the TTL bucket of key
+func (t ttlBuckets) shard(key []byte) ttlBucket {
+	if t.n == 0 {
+		return t.shardAt(0)
+	}
+
+	return t.shardAt(shardOf(key, t.n))
+}
+
+// create creates the TTL entry of key, replacing the previous one
+func (t ttlBuckets) create(key []byte, ttl time.Duration) error {
+	return t.shard(key).create(key, ttl)
+}
+
+// createAt creates the TTL entry of key that expires at expiration, replacing the previous one
+func (t ttlBuckets) createAt(key []byte, expiration time.Time) error {
+	return t.shard(key).createAt(key, expiration)
+}
+
+// remove deletes the TTL entry of key, if any
+func (t ttlBuckets) remove(key []byte) error {
+	return t.shard(key).remove(key)
+}
+
+// expire deletes the expired TTL entry ttlKey of key
+func (t ttlBuckets) expire(ttlKey, key []byte) error {
+	return t.shard(key).expire(ttlKey, key)
+}
+
+// expired returns true when key has a TTL entry that is already due
+func (t ttlBuckets) expired(key []byte, now time.Time) bool {
+	return t.shard(key).expired(key, now)
+}
+
+// expiry returns the expiration time of key and false when it has no TTL entry
+func (t ttlBuckets) expiry(key []byte) (time.Time, bool) {
+	return t.shard(key).expiry(key)
+}
+
+// due calls fn with the TTL entries expiring up to max, shard by shard, until fn returns false
+func (t ttlBuckets) due(max time.Time, fn func(ttlKey, key []byte) bool) {
+	stopped := false
+
+	for _, shard := range t.shards() {
+		shard.due(max, func(ttlKey, key []byte) bool {
+			stopped = !fn(ttlKey, key)
+			return !stopped
+		})
+
+		if stopped {
+			return
+		}
+	}
+}
+
+// next returns the first expiration time of all the shards after the TTL key prefix after
+func (t ttlBuckets) next(after []byte) (time.Time, bool) {
+	var next time.Time
+	var found bool
+
+	for _, shard := range t.shards() {
+		if expiration, ok := shard.next(after); ok && (!found || expiration.Before(next)) {
+			next, found = expiration, true
+		}
+	}
+
+	return next, found
+}
+
+// dropEmptyShards deletes the day buckets before the day of now that have no entries left
+func (t ttlBuckets) dropEmptyShards(now time.Time) error {
+	for _, shard := range t.shards() {
+		if err := shard.dropEmptyShards(now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keyCount returns the number of keys of the TTL buckets of every shard
+func (t ttlBuckets) keyCount() int {
+	n := 0
+	for _, shard := range t.shards() {
+		n += shard.ttl.Stats().KeyN
+	}
+
+	return n
+}
@@ -0,0 +1,184 @@
+package boltdb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestShardedStores(t *testing.T) {
+	for _, shards := range []int{0, 16, 64} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			checkCreateGetRemove(t, newTestStore(t, Config{Shards: shards}))
+			checkSweep(t, Config{Shards: shards})
+		})
+	}
+}
+
+func TestShardOfSpreadsKeys(t *testing.T) {
+	tests := []struct {
+		shards int
+		keys   int
+	}{
+		{16, 1000},
+		{64, 10000},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("shards=%d", tt.shards), func(t *testing.T) {
+			counts := make([]int, tt.shards)
+
+			for i := 0; i < tt.keys; i++ {
+				key := []byte("access-" + strconv.Itoa(i))
+
+				shard := shardOf(key, tt.shards)
+				if shard != shardOf(key, tt.shards) {
+					t.Fatalf("shardOf(%s) isn't stable", key)
+				}
+
+				counts[shard]++
+			}
+
+			// every shard gets at least half its share
+			for shard, count := range counts {
+				if count < tt.keys/tt.shards/2 {
+					t.Errorf("shard %d has %d of %d keys", shard, count, tt.keys)
+				}
+			}
+		})
+	}
+}
+
+func TestShardsMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		shards   int
+		reopened int
+		tokens   bool
+		err      error
+	}{
+		{"same shards", 16, 16, true, nil},
+		{"resharded with tokens", 16, 64, true, ErrShardsMismatch},
+		{"unsharded with tokens", 16, 0, true, ErrShardsMismatch},
+		{"resharded empty", 16, 64, false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				DbName:     filepath.Join(t.TempDir(), "oauth2.db"),
+				BucketName: "oauthTokens",
+				Shards:     tt.shards,
+			}
+
+			store, closeFn, err := NewTokenStore(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.tokens {
+				err = store.Create(&models.Token{Access: "access", AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			closeFn()
+
+			config.Shards = tt.reopened
+
+			_, closeFn, err = NewTokenStore(config)
+			if err == nil {
+				closeFn()
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("NewTokenStore = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// benchmarkShards runs fn on stores with 1, 16 and 64 shards holding size token pairs
+func benchmarkShards(b *testing.B, size int, fn func(b *testing.B, ts *TokenStore)) {
+	for _, shards := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			ts := newTestStore(b, Config{
+				Shards:         shards,
+				ExpiryStrategy: LazyExpiry,
+				BoltOptions:    &bolt.Options{NoSync: true},
+			})
+
+			fillStore(b, ts, size)
+
+			b.ResetTimer()
+			fn(b, ts)
+		})
+	}
+}
+
+// fillStore creates count token pairs, with the access tokens access-0 to access-count
+func fillStore(b *testing.B, ts *TokenStore, count int) {
+	b.Helper()
+
+	for i := 0; i < count; i++ {
+		if err := ts.Create(benchPair("", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchPair returns the token pair i, its tokens prefixed with prefix
+func benchPair(prefix string, i int) *models.Token {
+	now := time.Now()
+
+	return &models.Token{
+		ClientID:         "client",
+		UserID:           "user-" + strconv.Itoa(i%100),
+		Scope:            "read write",
+		Access:           prefix + "access-" + strconv.Itoa(i),
+		AccessCreateAt:   now,
+		AccessExpiresIn:  time.Hour,
+		Refresh:          prefix + "refresh-" + strconv.Itoa(i),
+		RefreshCreateAt:  now,
+		RefreshExpiresIn: 24 * time.Hour,
+	}
+}
+
+func BenchmarkShardsCreate(b *testing.B) {
+	benchmarkShards(b, 1000, func(b *testing.B, ts *TokenStore) {
+		for i := 0; i < b.N; i++ {
+			if err := ts.Create(benchPair("bench-", i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkShardsGetByAccess(b *testing.B) {
+	benchmarkShards(b, 1000, func(b *testing.B, ts *TokenStore) {
+		for i := 0; i < b.N; i++ {
+			if _, err := ts.GetByAccess("access-" + strconv.Itoa(i%1000)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkShardsGetByAccessParallel(b *testing.B) {
+	benchmarkShards(b, 1000, func(b *testing.B, ts *TokenStore) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if _, err := ts.GetByAccess("access-" + strconv.Itoa(i%1000)); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,168 @@
+package boltdb
+
+import (
+	"context"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// TokenIterator streams the token information of a snapshot:
+//
+//	it, err := store.Snapshot()
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//
+//	for it.Next() {
+//		report(it.Token())
+//	}
+//
+//	return it.Err()
+type TokenIterator interface {
+	// Next advances to the next token, returning false when there are no more or it failed
+	Next() bool
+	// Token returns the current token
+	Token() oauth2.TokenInfo
+	// Err returns the error that stopped the iteration, if any
+	Err() error
+	// Close releases the snapshot, it must always be called
+	Close() error
+}
+
+// Snapshot returns an iterator over the active codes and token pairs as they were when it was
+// called, whatever is written afterwards. It holds a read transaction, which doesn't block
+// writers, except the ones that have to grow the database file: bolt can't remap it until the
+// snapshot is closed. Set a large InitialMmapSize on Config.BoltOptions to avoid that.
+// Codes stored on Config.CodeDbName are iterated after the pairs, from a snapshot of their own
+func (ts *TokenStore) Snapshot() (TokenIterator, error) {
+	if err := ts.checkOpen(context.Background()); err != nil {
+		return nil, err
+	}
+
+	tx, err := ts.db.Begin(false)
+	if err != nil {
+		return nil, closedError(err)
+	}
+
+	it := &snapshotIterator{
+		ts:     ts,
+		tx:     tx,
+		cursor: ts.tokenBucket(tx).Cursor(),
+		ttl:    ts.ttlBuckets(tx),
+		now:    ts.clock.Now(),
+	}
+
+	if ts.codes != nil {
+		codes, err := ts.codes.Snapshot()
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		it.codes = codes
+	}
+
+	return it, nil
+}
+
+// snapshotIterator iterates the token bucket on a read transaction
+type snapshotIterator struct {
+	ts      *TokenStore
+	tx      *bolt.Tx
+	cursor  keyCursor
+	ttl     ttlBuckets
+	now     time.Time
+	started bool
+	done    bool
+	token   oauth2.TokenInfo
+	// codes iterates the code store, once the token bucket is done
+	codes TokenIterator
+}
+
+// Next advances to the next active code or token pair. Entries that can't be decrypted or
+// decoded are skipped, like ListTokens does
+func (it *snapshotIterator) Next() bool {
+	if it.tx == nil {
+		return false
+	}
+
+	for !it.done {
+		var k, v []byte
+
+		if it.started {
+			k, v = it.cursor.Next()
+		} else {
+			k, v = it.cursor.First()
+			it.started = true
+		}
+
+		if k == nil {
+			it.done = true
+			break
+		}
+
+		jv, err := it.ts.cipher.open(v)
+		if err != nil || jv == nil {
+			continue
+		}
+
+		var tm models.Token
+		if it.ts.codec.Unmarshal(jv, &tm) != nil || !isTokenInfo(tm.Code, tm.Access, tm.Refresh) {
+			// mappings from tokens to basic IDs
+			continue
+		}
+
+		if expiration, ok := it.ttl.expiry(k); ok && !expiration.After(it.now) {
+			continue
+		}
+
+		it.token = &tm
+		return true
+	}
+
+	if it.codes != nil && it.codes.Next() {
+		it.token = it.codes.Token()
+		return true
+	}
+
+	it.token = nil
+	return false
+}
+
+// Token returns the current token
+func (it *snapshotIterator) Token() oauth2.TokenInfo {
+	return it.token
+}
+
+// Err returns the error that stopped the iteration of the code store.
+// The token bucket is read from memory, so its iteration doesn't fail
+func (it *snapshotIterator) Err() error {
+	if it.codes != nil {
+		return it.codes.Err()
+	}
+
+	return nil
+}
+
+// Close rolls back the read transactions. Closing it again does nothing
+func (it *snapshotIterator) Close() error {
+	if it.tx == nil {
+		return nil
+	}
+
+	err := it.tx.Rollback()
+	it.tx = nil
+
+	if it.codes != nil {
+		if codesErr := it.codes.Close(); err == nil {
+			err = codesErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,129 @@
+package boltdb
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// snapshotTokens returns the codes and access tokens iterated by it, sorted
+func snapshotTokens(t *testing.T, it TokenIterator) []string {
+	t.Helper()
+
+	var tokens []string
+
+	for it.Next() {
+		info := it.Token()
+
+		if info.GetCode() != "" {
+			tokens = append(tokens, info.GetCode())
+		} else {
+			tokens = append(tokens, info.GetAccess())
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(tokens)
+	return tokens
+}
+
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		name   string
+		codeDb bool
+		config Config
+	}{
+		{"default", false, Config{}},
+		{"codes on their own file", true, Config{}},
+		{"encrypted and sharded", false, Config{EncryptionKey: testOldKey, Shards: 4}},
+		{"msgpack", false, Config{Codec: MsgpackCodec}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testutil.NewFakeClock(time.Now())
+
+			config := tt.config
+			config.Clock = clock
+			config.ExpiryStrategy = LazyExpiry
+			// writers growing the file would wait for the snapshot to be closed
+			config.BoltOptions = &bolt.Options{InitialMmapSize: 1 << 24}
+			if tt.codeDb {
+				config.CodeDbName = filepath.Join(t.TempDir(), "codes.db")
+			}
+
+			ts := newTestStore(t, config)
+
+			for _, token := range []oauth2.TokenInfo{
+				&models.Token{Access: "expired", AccessCreateAt: clock.Now(), AccessExpiresIn: time.Minute},
+				&models.Token{Code: "code", CodeCreateAt: clock.Now(), CodeExpiresIn: time.Hour},
+				&models.Token{
+					Access:           "access",
+					AccessCreateAt:   clock.Now(),
+					AccessExpiresIn:  time.Hour,
+					Refresh:          "refresh",
+					RefreshCreateAt:  clock.Now(),
+					RefreshExpiresIn: 24 * time.Hour,
+				},
+				&models.Token{Access: "removed", AccessCreateAt: clock.Now(), AccessExpiresIn: time.Hour},
+			} {
+				if err := ts.Create(token); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			clock.Advance(2 * time.Minute)
+
+			it, err := ts.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+
+			// writes after the snapshot are not seen
+			if err := ts.RemoveByAccess("removed"); err != nil {
+				t.Fatal(err)
+			}
+
+			err = ts.Create(&models.Token{Access: "later", AccessCreateAt: clock.Now(), AccessExpiresIn: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := "access,code,removed"
+			if got := strings.Join(snapshotTokens(t, it), ","); got != want {
+				t.Fatalf("snapshot = %s, want %s", got, want)
+			}
+
+			if err := it.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if it.Next() {
+				t.Fatal("Next after Close = true")
+			}
+		})
+	}
+}
+
+func TestSnapshotOfAClosedStore(t *testing.T) {
+	store, closeFn, err := NewTokenStore(&Config{DbName: filepath.Join(t.TempDir(), "oauth2.db"), BucketName: "oauthTokens"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeFn()
+
+	if _, err := store.(*TokenStore).Snapshot(); err != ErrStoreClosed {
+		t.Fatalf("Snapshot = %v, want ErrStoreClosed", err)
+	}
+}
@@ -0,0 +1,143 @@
+package boltdb
+
+import (
+	"context"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Stats are the database statistics returned by TokenStore.Stats
+type Stats struct {
+	// FileSize is the size of the database in bytes, without the free space preallocated by bolt
+	FileSize int64
+	// Keys is the number of keys of the token bucket, including the mappings from tokens to basic IDs
+	Keys int
+	// TTLKeys is the number of keys waiting to expire
+	TTLKeys int
+	// ExpiredKeys is the number of keys already expired that the cleaner didn't sweep yet
+	ExpiredKeys int
+	// Codes, AccessTokens and RefreshTokens are the number of live tokens of each type
+	Codes         int
+	AccessTokens  int
+	RefreshTokens int
+	// NextSweep is when the next key expires, the cleaner sweeps then. Zero when no key expires
+	NextSweep time.Time
+	// Buckets are the statistics of each bucket of the store, by name
+	Buckets map[string]BucketStats
+	// FreePages is the number of free pages on the freelist
+	FreePages int
+	// PendingPages is the number of pages freed by transactions still open
+	PendingPages int
+}
+
+// BucketStats are the statistics of a bucket
+type BucketStats struct {
+	Keys int
+	// Bytes is the size of the pages the bucket uses
+	Bytes int
+}
+
+// Ping checks the database is open and the buckets of the store exist with a
+// read-only transaction. It's cheap enough to be used by readiness probes
+func (ts *TokenStore) Ping() error {
+	if err := ts.checkOpen(context.Background()); err != nil {
+		return err
+	}
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		for _, name := range ts.bucketNames() {
+			if tx.Bucket(name) == nil {
+				return bucketMissing(name)
+			}
+		}
+
+		return nil
+	})
+
+	return closedError(err)
+}
+
+// Stats returns the database statistics. Counting keys reads every page of
+// the store buckets, so use Ping for frequent health checks
+func (ts *TokenStore) Stats() (Stats, error) {
+	stats := Stats{Buckets: map[string]BucketStats{}}
+
+	if err := ts.checkOpen(context.Background()); err != nil {
+		return stats, err
+	}
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		stats.FileSize = tx.Size()
+		stats.Keys = ts.tokenBucket(tx).keyCount()
+		stats.TTLKeys = ts.ttlBuckets(tx).keyCount()
+
+		for _, name := range ts.ownedBuckets() {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				continue
+			}
+
+			bucketStats := bucket.Stats()
+			stats.Buckets[string(name)] = BucketStats{
+				Keys:  bucketStats.KeyN,
+				Bytes: bucketStats.BranchInuse + bucketStats.LeafInuse + bucketStats.InlineBucketInuse,
+			}
+		}
+
+		now := ts.clock.Now()
+		ttl := ts.ttlBuckets(tx)
+
+		ttl.due(now, func(ttlKey, key []byte) bool {
+			stats.ExpiredKeys++
+			return true
+		})
+
+		stats.NextSweep, _ = ttl.next(ttlTime(now.Add(time.Nanosecond)))
+
+		return ts.countTokens(tx, now, &stats)
+	})
+
+	if err != nil {
+		return Stats{}, err
+	}
+
+	dbStats := ts.db.Stats()
+	stats.FreePages = dbStats.FreePageN
+	stats.PendingPages = dbStats.PendingPageN
+
+	return stats, nil
+}
+
+// countTokens counts the live codes, access and refresh tokens inside tx
+func (ts *TokenStore) countTokens(tx *bolt.Tx, now time.Time, stats *Stats) error {
+	bucket := ts.tokenBucket(tx)
+	ttl := ts.ttlBuckets(tx)
+
+	live := func(key []byte) bool {
+		return bucket.Get(key) != nil && !ttl.expired(key, now)
+	}
+
+	return bucket.ForEach(func(k, v []byte) error {
+		stored, err := ts.decodeStored(v)
+		if err != nil || stored == nil || ttl.expired(k, now) {
+			// mappings from tokens to basic IDs are counted with their token information
+			return nil
+		}
+
+		if stored.Code != "" {
+			stats.Codes++
+			return nil
+		}
+
+		if stored.Access != "" && live(ts.tokenKey(stored.Access)) {
+			stats.AccessTokens++
+		}
+
+		if stored.Refresh != "" && live(ts.tokenKey(stored.Refresh)) {
+			stats.RefreshTokens++
+		}
+
+		return nil
+	})
+}
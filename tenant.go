@@ -0,0 +1,230 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// tenantBucketPrefix prefixes the token bucket name of every tenant
+const tenantBucketPrefix = "tenant-"
+
+// tenants are the tenant token stores sharing the database and the cleaner of a token store
+type tenants struct {
+	mu     sync.Mutex
+	stores map[string]*TokenStore
+}
+
+// ForTenant returns a token store whose tokens are isolated on the tenant-<id> buckets
+// of the same database, creating the buckets on the first call. Ids ending like the buckets
+// derived from a bucket name, like "-ttl", return ErrBucketNameReserved. Codes on
+// Config.CodeDbName are isolated on the tenant-<id> buckets of their file.
+// Tenant stores share the options, metrics and cleaner of ts, so closing them does nothing
+func (ts *TokenStore) ForTenant(id string) (*TokenStore, error) {
+	if id == "" {
+		return nil, ErrTenantRequired
+	}
+
+	if hasReservedSuffix(id) {
+		return nil, ErrBucketNameReserved
+	}
+
+	if err := ts.checkOpen(context.Background()); err != nil {
+		return nil, err
+	}
+
+	ts.tenants.mu.Lock()
+	defer ts.tenants.mu.Unlock()
+
+	if tenant, ok := ts.tenants.stores[id]; ok {
+		return tenant, nil
+	}
+
+	tenant := ts.withBucketName(tenantBucketPrefix + id)
+
+	err := createBuckets(ts.db, tenant.bucketNames()...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tenant.checkSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tenant.createShards()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tenant.createRevocationBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tenant.createAuditBucket()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tenant.createChangeBucket()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tenant.migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	if ts.codes != nil {
+		tenant.codes, err = ts.codes.ForTenant(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ts.tenants.stores[id] = tenant
+
+	return tenant, nil
+}
+
+// withBucketName returns a token store with the options of ts on the buckets of bucketName
+func (ts *TokenStore) withBucketName(bucketName string) *TokenStore {
+	scoped := &TokenStore{
+		db:                  ts.db,
+		cipher:              ts.cipher,
+		deleteExpiredOnRead: ts.deleteExpiredOnRead,
+		cleanupInterval:     ts.cleanupInterval,
+		cleanupBatchSize:    ts.cleanupBatchSize,
+		sweepIOLimit:        ts.sweepIOLimit,
+		fileMode:            ts.fileMode,
+		revocationRetention: ts.revocationRetention,
+		changeRetention:     ts.changeRetention,
+		watchInterval:       ts.watchInterval,
+		audit:               ts.audit,
+		auditKey:            ts.auditKey,
+		hooks:               ts.hooks,
+		onRefreshReuse:      ts.onRefreshReuse,
+		consumeCodes:        ts.consumeCodes,
+		maxTokensPerUser:    ts.maxTokensPerUser,
+		maxTokensPerClient:  ts.maxTokensPerClient,
+		quotaPolicy:         ts.quotaPolicy,
+		refreshGracePeriod:  ts.refreshGracePeriod,
+		ttlOverrides:        ts.ttlOverrides,
+		shardTTLByDay:       ts.shardTTLByDay,
+		shards:              ts.shards,
+		onError:             ts.onError,
+		nilOnNotFound:       ts.nilOnNotFound,
+		metrics:             ts.metrics,
+		tracer:              ts.tracer,
+		logger:              ts.logger,
+		codec:               ts.codec,
+		keyHasher:           ts.keyHasher,
+		batchWrites:         ts.batchWrites,
+		clock:               ts.clock,
+		newID:               ts.newID,
+		usage:               ts.usage,
+		cache:               newTokenCache(ts.cache.capacity(), ts.clock),
+		tenants:             ts.tenants,
+		closed:              ts.closed,
+	}
+	scoped.setBucketNames(bucketName)
+
+	if ts.forecasts != nil {
+		scoped.forecasts = &forecastCache{}
+	}
+
+	return scoped
+}
+
+// loadTenants registers the tenants created by previous runs, so the cleaner
+// sweeps their expired tokens before ForTenant is called again
+func (ts *TokenStore) loadTenants() error {
+	var ids []string
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !bytes.HasPrefix(name, []byte(tenantBucketPrefix)) {
+				return nil
+			}
+
+			// the TTL and index buckets of a tenant also have the prefix
+			tenant := ts.withBucketName(string(name))
+			for _, bucketName := range tenant.bucketNames()[1:] {
+				if tx.Bucket(bucketName) == nil {
+					return nil
+				}
+			}
+
+			ids = append(ids, string(name[len(tenantBucketPrefix):]))
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	ts.tenants.mu.Lock()
+	defer ts.tenants.mu.Unlock()
+
+	for _, id := range ids {
+		tenant := ts.withBucketName(tenantBucketPrefix + id)
+
+		err := tenant.createShards()
+		if err != nil {
+			return err
+		}
+
+		err = tenant.migrate()
+		if err != nil {
+			return err
+		}
+
+		ts.tenants.stores[id] = tenant
+	}
+
+	return nil
+}
+
+// loadTenantCodes gives the tenant stores loaded before the code store was opened
+// the tenant stores of the code store with their id
+func (ts *TokenStore) loadTenantCodes() error {
+	ts.tenants.mu.Lock()
+	defer ts.tenants.mu.Unlock()
+
+	for id, tenant := range ts.tenants.stores {
+		codes, err := ts.codes.ForTenant(id)
+		if err != nil {
+			return err
+		}
+
+		tenant.codes = codes
+	}
+
+	return nil
+}
+
+// stores returns ts and the tenant stores sharing its cleaner
+func (ts *TokenStore) stores() []*TokenStore {
+	stores := []*TokenStore{ts}
+
+	if ts.tenants == nil {
+		return stores
+	}
+
+	ts.tenants.mu.Lock()
+	defer ts.tenants.mu.Unlock()
+
+	for _, tenant := range ts.tenants.stores {
+		if tenant != ts {
+			stores = append(stores, tenant)
+		}
+	}
+
+	return stores
+}
@@ -0,0 +1,95 @@
+package boltdb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+func TestForTenantRejectsReservedIDs(t *testing.T) {
+	store, closeFn, err := NewTokenStore(&Config{
+		DbName:     filepath.Join(t.TempDir(), "oauth2.db"),
+		BucketName: "oauthTokens",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ts := store.(*TokenStore)
+
+	tests := []struct {
+		id  string
+		err error
+	}{
+		{"", ErrTenantRequired},
+		{"a-ttl", ErrBucketNameReserved},
+		{"a-ttl-index", ErrBucketNameReserved},
+		{"a-consents", ErrBucketNameReserved},
+		{"a", nil},
+		{"ttl-a", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if _, err := ts.ForTenant(tt.id); err != tt.err {
+				t.Errorf("ForTenant(%q) = %v, want %v", tt.id, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestForTenantIsolatesCodesOnTheirFile(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		DbName:     filepath.Join(dir, "oauth2.db"),
+		CodeDbName: filepath.Join(dir, "codes.db"),
+		BucketName: "oauthTokens",
+	}
+
+	code := &models.Token{
+		Code:          "code",
+		CodeCreateAt:  time.Now(),
+		CodeExpiresIn: time.Minute,
+	}
+
+	store, closeFn, err := NewTokenStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := store.(*TokenStore)
+
+	tenant, err := ts.ForTenant("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tenant.Create(code); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ts.GetByCode("code"); err != ErrTokenNotFound {
+		t.Fatalf("GetByCode of the root store = %v, want ErrTokenNotFound", err)
+	}
+
+	closeFn()
+
+	// tenants loaded when opening get their codes back
+	store, closeFn, err = NewTokenStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	tenant, err = store.(*TokenStore).ForTenant("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tenant.GetByCode("code"); err != nil {
+		t.Fatalf("GetByCode of the tenant after reopening: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package testutil
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gopkg.in/oauth2.v3"
+)
+
+// ErrInjected is the error FaultyStore fails with when FaultPolicy.Err is not set
+var ErrInjected = errors.New("testutil: injected fault")
+
+// FaultPolicy sets how often FaultyStore misbehaves. Rates are probabilities between 0 and 1,
+// drawn independently on every call
+type FaultPolicy struct {
+	// Latency is added to a call with probability LatencyRate, before anything else
+	Latency     time.Duration
+	LatencyRate float64
+	// ErrorRate is the probability of a call failing with Err without reaching the inner store
+	ErrorRate float64
+	// Err is the injected error. Defaults to ErrInjected
+	Err error
+	// NotFoundRate is the probability of a Get method responding that the token doesn't
+	// exist without reaching the inner store
+	NotFoundRate float64
+	// NotFoundErr is returned by the injected not found responses, set it to
+	// boltdb.ErrTokenNotFound to respond like the store does by default. When it's nil they
+	// return nil token information and no error, like boltdb.Config.NilOnNotFound
+	NotFoundErr error
+	// Seed makes the faults reproducible. Zero seeds from the time
+	Seed int64
+}
+
+// FaultCounts counts the faults a FaultyStore injected
+type FaultCounts struct {
+	Delays    int
+	Errors    int
+	NotFounds int
+}
+
+// FaultyStore is an oauth2.TokenStore that injects latency, errors and not found responses
+// in front of another store, to test how its consumers handle a misbehaving storage
+type FaultyStore struct {
+	inner  oauth2.TokenStore
+	policy FaultPolicy
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	counts FaultCounts
+}
+
+// NewFaultyStore returns a store calling inner, unless policy injects a fault first
+func NewFaultyStore(inner oauth2.TokenStore, policy FaultPolicy) *FaultyStore {
+	seed := policy.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	if policy.Err == nil {
+		policy.Err = ErrInjected
+	}
+
+	return &FaultyStore{
+		inner:  inner,
+		policy: policy,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Counts returns how many faults were injected so far
+func (s *FaultyStore) Counts() FaultCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.counts
+}
+
+// draw returns true with probability rate, counting it on count when it does
+func (s *FaultyStore) draw(rate float64, count *int) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rand.Float64() >= rate {
+		return false
+	}
+
+	*count++
+	return true
+}
+
+// fault adds the latency and returns the error injected on a call, if any
+func (s *FaultyStore) fault() error {
+	if s.draw(s.policy.LatencyRate, &s.counts.Delays) {
+		time.Sleep(s.policy.Latency)
+	}
+
+	if s.draw(s.policy.ErrorRate, &s.counts.Errors) {
+		return s.policy.Err
+	}
+
+	return nil
+}
+
+// get injects the faults of a Get method before calling fn
+func (s *FaultyStore) get(fn func() (oauth2.TokenInfo, error)) (oauth2.TokenInfo, error) {
+	if err := s.fault(); err != nil {
+		return nil, err
+	}
+
+	if s.draw(s.policy.NotFoundRate, &s.counts.NotFounds) {
+		return nil, s.policy.NotFoundErr
+	}
+
+	return fn()
+}
+
+// Create stores the token information on the inner store, unless an error is injected
+func (s *FaultyStore) Create(info oauth2.TokenInfo) error {
+	if err := s.fault(); err != nil {
+		return err
+	}
+
+	return s.inner.Create(info)
+}
+
+// RemoveByCode removes the code from the inner store, unless an error is injected
+func (s *FaultyStore) RemoveByCode(code string) error {
+	if err := s.fault(); err != nil {
+		return err
+	}
+
+	return s.inner.RemoveByCode(code)
+}
+
+// RemoveByAccess removes the access token from the inner store, unless an error is injected
+func (s *FaultyStore) RemoveByAccess(access string) error {
+	if err := s.fault(); err != nil {
+		return err
+	}
+
+	return s.inner.RemoveByAccess(access)
+}
+
+// RemoveByRefresh removes the refresh token from the inner store, unless an error is injected
+func (s *FaultyStore) RemoveByRefresh(refresh string) error {
+	if err := s.fault(); err != nil {
+		return err
+	}
+
+	return s.inner.RemoveByRefresh(refresh)
+}
+
+// GetByCode reads the code from the inner store, unless an error or not found is injected
+func (s *FaultyStore) GetByCode(code string) (oauth2.TokenInfo, error) {
+	return s.get(func() (oauth2.TokenInfo, error) {
+		return s.inner.GetByCode(code)
+	})
+}
+
+// GetByAccess reads the access token from the inner store, unless an error or not found is injected
+func (s *FaultyStore) GetByAccess(access string) (oauth2.TokenInfo, error) {
+	return s.get(func() (oauth2.TokenInfo, error) {
+		return s.inner.GetByAccess(access)
+	})
+}
+
+// GetByRefresh reads the refresh token from the inner store, unless an error or not found is injected
+func (s *FaultyStore) GetByRefresh(refresh string) (oauth2.TokenInfo, error) {
+	return s.get(func() (oauth2.TokenInfo, error) {
+		return s.inner.GetByRefresh(refresh)
+	})
+}
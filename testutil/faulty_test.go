@@ -0,0 +1,119 @@
+package testutil_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	boltdb "github.com/naxhh/go-oauth2-boltdb"
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// faultyGets calls GetByAccess calls times on a FaultyStore of policy, in front of an
+// in-memory store holding the token, and counts the errors and not founds it responded
+func faultyGets(t *testing.T, policy testutil.FaultPolicy, calls int) (testutil.FaultCounts, testutil.FaultCounts) {
+	t.Helper()
+
+	inner, closeFn, err := boltdb.NewInMemoryTokenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	err = inner.Create(&models.Token{Access: "access", AccessCreateAt: time.Now(), AccessExpiresIn: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := testutil.NewFaultyStore(inner, policy)
+
+	var seen testutil.FaultCounts
+
+	for i := 0; i < calls; i++ {
+		info, err := store.GetByAccess("access")
+
+		switch {
+		case errors.Is(err, testutil.ErrInjected):
+			seen.Errors++
+		case errors.Is(err, boltdb.ErrTokenNotFound):
+			seen.NotFounds++
+		case err != nil || info == nil:
+			t.Fatalf("GetByAccess = %v, %v, want the stored token", info, err)
+		}
+	}
+
+	return store.Counts(), seen
+}
+
+// faultRates are the rates of the faults injected by a FaultyStore
+type faultRates struct {
+	delays, errors, notFounds float64
+}
+
+func TestFaultyStoreRates(t *testing.T) {
+	const calls = 2000
+
+	tests := []struct {
+		name   string
+		policy testutil.FaultPolicy
+		want   faultRates
+	}{
+		{
+			name:   "no faults",
+			policy: testutil.FaultPolicy{Seed: 1},
+		},
+		{
+			name:   "errors",
+			policy: testutil.FaultPolicy{Seed: 2, ErrorRate: 0.3},
+			want:   faultRates{errors: 0.3},
+		},
+		{
+			name:   "not found",
+			policy: testutil.FaultPolicy{Seed: 3, NotFoundRate: 0.2, NotFoundErr: boltdb.ErrTokenNotFound},
+			want:   faultRates{notFounds: 0.2},
+		},
+		{
+			// not founds are only drawn for the calls that didn't fail
+			name:   "errors and not found",
+			policy: testutil.FaultPolicy{Seed: 4, ErrorRate: 0.5, NotFoundRate: 0.5, NotFoundErr: boltdb.ErrTokenNotFound},
+			want:   faultRates{errors: 0.5, notFounds: 0.25},
+		},
+		{
+			name:   "latency",
+			policy: testutil.FaultPolicy{Seed: 5, Latency: time.Nanosecond, LatencyRate: 0.4},
+			want:   faultRates{delays: 0.4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts, seen := faultyGets(t, tt.policy, calls)
+
+			if seen.Errors != counts.Errors || seen.NotFounds != counts.NotFounds {
+				t.Fatalf("Counts = %+v, but responded %d errors and %d not founds", counts, seen.Errors, seen.NotFounds)
+			}
+
+			for _, rate := range []struct {
+				fault string
+				count int
+				want  float64
+			}{
+				{"delays", counts.Delays, tt.want.delays},
+				{"errors", counts.Errors, tt.want.errors},
+				{"not founds", counts.NotFounds, tt.want.notFounds},
+			} {
+				if got := float64(rate.count) / calls; math.Abs(got-rate.want) > 0.05 {
+					t.Errorf("%s rate = %.3f, want %.2f", rate.fault, got, rate.want)
+				}
+			}
+
+			// the same seed injects the same faults
+			again, _ := faultyGets(t, tt.policy, calls)
+			if again != counts {
+				t.Errorf("Counts with the same seed = %+v, want %+v", again, counts)
+			}
+		})
+	}
+}
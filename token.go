@@ -2,180 +2,1198 @@ package boltdb
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
-	"github.com/boltdb/bolt"
-	"github.com/satori/go.uuid"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/trace"
 
 	"gopkg.in/oauth2.v3"
 	"gopkg.in/oauth2.v3/models"
 )
 
-// NewTokenStore creates a token store based on boltdb
+// NewTokenStore creates a token store based on boltdb.
+// The close function is equivalent to calling Close on the returned *TokenStore
 func NewTokenStore(config *Config) (oauth2.TokenStore, func(), error) {
-	db, err := bolt.Open(config.DbName, 0600, nil)
+	return newTokenStore(config)
+}
+
+// newTokenStore opens the database and starts the cleaner shared by all the token stores
+func newTokenStore(config *Config) (*TokenStore, func(), error) {
+	err := config.Validate()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := openCompacted(config)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ts, _, err := newTokenStoreWithDB(db, config)
+
+	if err != nil {
+		closeDB(db)
+		return nil, nil, err
+	}
+
+	if config.CodeDbName != "" {
+		ts.codes, err = newCodeStore(config)
+
+		if err != nil {
+			ts.Close()
+			closeDB(db)
+			return nil, nil, err
+		}
+
+		ts.closers = append(ts.closers, ts.codes.Close)
+
+		err = ts.loadTenantCodes()
+
+		if err != nil {
+			ts.Close()
+			closeDB(db)
+			return nil, nil, err
+		}
+	}
+
+	ts.closers = append(ts.closers, func() error {
+		return closeDB(db)
+	})
+
+	return ts, ts.closeFunction, nil
+}
+
+// NewTokenStoreWithDB creates a token store on an already open database,
+// so it can be shared with other stores or application data.
+// config.DbName and config.BoltOptions are ignored and the close function doesn't close db
+func NewTokenStoreWithDB(db *bolt.DB, config *Config) (oauth2.TokenStore, func(), error) {
+	return newTokenStoreWithDB(db, config)
+}
+
+// newTokenStoreWithDB creates the buckets and starts the cleaner on db
+func newTokenStoreWithDB(db *bolt.DB, config *Config) (*TokenStore, func(), error) {
+	err := config.validateWithDB()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tc, err := newTokenCipher(config.EncryptionKey, config.Compression)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ts := &TokenStore{
+		db:                  db,
+		cipher:              tc,
+		onRefreshReuse:      config.OnRefreshReuse,
+		consumeCodes:        config.ConsumeCodes,
+		maxTokensPerUser:    config.MaxTokensPerUser,
+		maxTokensPerClient:  config.MaxTokensPerClient,
+		quotaPolicy:         config.QuotaPolicy,
+		forecasts:           config.forecastCache(),
+		refreshGracePeriod:  config.RefreshGracePeriod,
+		ttlOverrides:        config.TTLOverrides,
+		shardTTLByDay:       config.ShardTTLByDay,
+		shards:              config.shards(),
+		onError:             config.OnError,
+		cachePreload:        config.CachePreload,
+		cachePreloadBudget:  config.cachePreloadBudget(),
+		deleteExpiredOnRead: config.DeleteExpiredOnRead || config.expiryStrategy().DeleteOnRead(),
+		cleanupInterval:     config.cleanupInterval(),
+		cleanupBatchSize:    config.cleanupBatchSize(),
+		sweepIOLimit:        config.SweepIOLimit,
+		vacuumInterval:      config.VacuumInterval,
+		fileMode:            config.fileMode(),
+		revocationRetention: config.RevocationRetention,
+		changeRetention:     config.ChangeRetention,
+		watchInterval:       config.watchInterval(),
+		audit:               config.Audit,
+		auditKey:            config.auditKey(),
+		hooks:               config.Hooks,
+		nilOnNotFound:       config.NilOnNotFound,
+		tracer:              newTracer(config.TracerProvider),
+		logger:              config.logger(),
+		codec:               config.codec(),
+		keyHasher:           config.keyHasher(),
+		batchWrites:         config.BatchWrites,
+		clock:               config.clock(),
+		newID:               config.idGenerator(),
+		usage:               config.usageTracker(db),
+		cache:               newTokenCache(config.CacheSize, config.clock()),
+		tenants:             &tenants{stores: map[string]*TokenStore{}},
+		closed:              make(chan struct{}),
+	}
+	ts.setBucketNames(config.BucketName)
+
+	err = createBuckets(db, ts.bucketNames()...)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ts.checkSettings()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ts.createShards()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ts.createRevocationBuckets()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ts.createAuditBucket()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ts.createChangeBucket()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ts.metrics, err = newMetrics(config.MetricsRegisterer, db, config.BucketName)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ts.migrate()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ts.loadTenants()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !db.IsReadOnly() {
+		unclean, err := ts.markOpen()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if unclean {
+			err = ts.recoverUncleanShutdown()
+
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	ts.preloadCache()
+
+	if db.IsReadOnly() {
+		return ts, ts.closeFunction, nil
+	}
+
+	ts.closers = append(ts.closers, config.expiryStrategy().Start(config.cleanerContext(), ts))
+
+	if ts.usage != nil {
+		ts.usage.start()
+		ts.closers = append(ts.closers, ts.usage.close)
+	}
+
+	// the flag is cleared once the final sweep is done
+	ts.closers = append(ts.closers, ts.markClosed)
+
+	return ts, ts.closeFunction, nil
+}
+
+// Close stops the cleaner after a final sweep and closes the database when the
+// store opened it. It can be called more than once and returns the first error
+func (ts *TokenStore) Close() error {
+	ts.closeOnce.Do(func() {
+		for _, closer := range ts.closers {
+			if err := closer(); err != nil && ts.closeErr == nil {
+				ts.closeErr = err
+			}
+		}
+
+		// the cleaner sweeps one last time while closing, so the store is closed after it
+		if ts.closed != nil {
+			close(ts.closed)
+		}
+	})
+
+	return ts.closeErr
+}
+
+// closeFunction is the close function returned by the constructors
+func (ts *TokenStore) closeFunction() {
+	ts.Close()
+}
+
+// setBucketNames sets the names of the buckets of the store from the name of the token bucket
+func (ts *TokenStore) setBucketNames(bucketName string) {
+	ts.bucketName = []byte(bucketName)
+	ts.bucketTtlName = []byte(fmt.Sprintf("%s-ttl", bucketName))
+	ts.bucketTtlIndexName = []byte(fmt.Sprintf("%s-ttl-index", bucketName))
+	ts.bucketUserIndexName = []byte(fmt.Sprintf("%s-user-index", bucketName))
+	ts.bucketClientIndexName = []byte(fmt.Sprintf("%s-client-index", bucketName))
+	ts.bucketScopeIndexName = []byte(fmt.Sprintf("%s-scope-index", bucketName))
+	ts.bucketCreatedIndexName = []byte(fmt.Sprintf("%s-created-index", bucketName))
+	ts.bucketRevocationsName = []byte(fmt.Sprintf("%s-revocations", bucketName))
+	ts.bucketRevocationsIndexName = []byte(fmt.Sprintf("%s-revocations-index", bucketName))
+	ts.bucketAuditName = []byte(fmt.Sprintf("%s-audit", bucketName))
+	ts.bucketChangesName = []byte(fmt.Sprintf("%s-changes", bucketName))
+	ts.bucketMetaName = []byte(fmt.Sprintf("%s-meta", bucketName))
+	ts.bucketMetadataName = []byte(fmt.Sprintf("%s-metadata", bucketName))
+	ts.bucketUsageName = []byte(fmt.Sprintf("%s-usage", bucketName))
+	ts.bucketRotatedName = []byte(fmt.Sprintf("%s-rotated", bucketName))
+	ts.bucketDevicesName = []byte(fmt.Sprintf("%s-devices", bucketName))
+	ts.bucketUserCodesName = []byte(fmt.Sprintf("%s-user-codes", bucketName))
+	ts.bucketChallengesName = []byte(fmt.Sprintf("%s-challenges", bucketName))
+	ts.bucketSessionsName = []byte(fmt.Sprintf("%s-sessions", bucketName))
+	ts.bucketSessionMembersName = []byte(fmt.Sprintf("%s-session-members", bucketName))
+	ts.bucketConsentsName = []byte(fmt.Sprintf("%s-consents", bucketName))
+}
+
+// bucketNames returns the names of all the buckets of the store
+func (ts *TokenStore) bucketNames() [][]byte {
+	return [][]byte{
+		ts.bucketName,
+		ts.bucketTtlName,
+		ts.bucketTtlIndexName,
+		ts.bucketUserIndexName,
+		ts.bucketClientIndexName,
+	}
+}
+
+// ownedBuckets returns the names of every bucket the store may have: the ones created on
+// opening, those created by migrations, the logs, created when enabled, and the meta bucket
+func (ts *TokenStore) ownedBuckets() [][]byte {
+	names := append(ts.bucketNames(), ts.bucketScopeIndexName, ts.bucketCreatedIndexName)
+	names = append(names, ts.sideBuckets()...)
+
+	return append(names,
+		ts.bucketSessionsName,
+		ts.bucketSessionMembersName,
+		ts.bucketRevocationsName,
+		ts.bucketRevocationsIndexName,
+		ts.bucketAuditName,
+		ts.bucketChangesName,
+		ts.bucketMetaName,
+	)
+}
+
+// sideBuckets returns the names of the buckets keyed like the token bucket, whose entries
+// are deleted with the token: the metadata, by token information key, the usage, by access key,
+// the rotations, by refresh key, the device requests, by device and user code key, the
+// PKCE challenges, by code key, and the consents, by consent key. The session membership
+// of the key is deleted too
+func (ts *TokenStore) sideBuckets() [][]byte {
+	return [][]byte{
+		ts.bucketMetadataName,
+		ts.bucketUsageName,
+		ts.bucketRotatedName,
+		ts.bucketDevicesName,
+		ts.bucketUserCodesName,
+		ts.bucketChallengesName,
+		ts.bucketConsentsName,
+	}
+}
+
+// deleteSideEntries deletes the entries of key on the side buckets
+func (ts *TokenStore) deleteSideEntries(tx *bolt.Tx, key []byte) error {
+	for _, name := range ts.sideBuckets() {
+		// side buckets are created by migrations, older read-only databases don't have them
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			continue
+		}
+
+		err := bucket.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ts.deleteSessionEntries(tx, key)
+}
+
+// createBuckets creates the buckets if they don't exist.
+// Read-only databases can't create buckets, so they only check they exist
+func createBuckets(db *bolt.DB, names ...[]byte) error {
+	if db.IsReadOnly() {
+		return db.View(func(tx *bolt.Tx) error {
+			for _, name := range names {
+				if tx.Bucket(name) == nil {
+					return bucketMissing(name)
+				}
+			}
+
+			return nil
+		})
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			_, err := tx.CreateBucketIfNotExists(name)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// NewTokenStoreTemp creates a token store on a temporary directory.
+// It is meant for tests: config.DbName is ignored and the close function
+// also removes the temporary directory.
+func NewTokenStoreTemp(config *Config) (oauth2.TokenStore, func(), error) {
+	return newTempTokenStore("", config)
+}
+
+// memoryDir is the tmpfs NewInMemoryTokenStore prefers, where files are only kept in memory
+const memoryDir = "/dev/shm"
+
+// NewInMemoryTokenStore creates a token store for tests that behaves like the file store, on a
+// temporary directory of the memory-backed /dev/shm when there's one, or like NewTokenStoreTemp
+// otherwise. Its token bucket is "oauthTokens", writes are not synced to disk, and the close
+// function removes the directory
+func NewInMemoryTokenStore() (oauth2.TokenStore, func(), error) {
+	config := &Config{
+		BucketName: "oauthTokens",
+		// the file doesn't outlive the store, so there's nothing to sync
+		BoltOptions: &bolt.Options{NoSync: true},
+	}
+
+	if info, err := os.Stat(memoryDir); err == nil && info.IsDir() {
+		ts, closeFn, err := newTempTokenStore(memoryDir, config)
+		if err == nil {
+			return ts, closeFn, nil
+		}
+
+		// the tmpfs may not be writable, e.g. inside a sandbox
+	}
+
+	return newTempTokenStore("", config)
+}
+
+// newTempTokenStore creates a token store on a temporary directory inside parent, the default
+// directory for temporary files when it's empty, that is removed by the close function
+func newTempTokenStore(parent string, config *Config) (oauth2.TokenStore, func(), error) {
+	dir, err := os.MkdirTemp(parent, "oauth2-boltdb-")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tempConfig := *config
+	tempConfig.DbName = filepath.Join(dir, "oauth2.db")
+
+	if config.CodeDbName != "" {
+		tempConfig.CodeDbName = filepath.Join(dir, "codes.db")
+	}
+
+	ts, _, err := newTokenStore(&tempConfig)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	ts.closers = append(ts.closers, func() error {
+		return os.RemoveAll(dir)
+	})
+
+	return ts, ts.closeFunction, nil
+}
+
+// TokenStore token storage based on bbolt(https://github.com/etcd-io/bbolt)
+type TokenStore struct {
+	db                    *bolt.DB
+	bucketName            []byte
+	bucketTtlName         []byte
+	bucketTtlIndexName    []byte
+	bucketUserIndexName   []byte
+	bucketClientIndexName []byte
+	// the scope and created indexes are created by migrations, so older databases can be opened read-only
+	bucketScopeIndexName   []byte
+	bucketCreatedIndexName []byte
+	// the revocation log buckets are only created when the log is enabled
+	bucketRevocationsName      []byte
+	bucketRevocationsIndexName []byte
+	bucketAuditName            []byte
+	bucketChangesName          []byte
+	// the metadata bucket is created by a migration
+	bucketMetadataName []byte
+	// the usage bucket is created by a migration
+	bucketUsageName []byte
+	// the rotated bucket is created by a migration
+	bucketRotatedName []byte
+	// the device buckets are created by a migration
+	bucketDevicesName   []byte
+	bucketUserCodesName []byte
+	// the challenges bucket is created by a migration
+	bucketChallengesName []byte
+	// the session buckets are created by a migration
+	bucketSessionsName       []byte
+	bucketSessionMembersName []byte
+	// the consents bucket is created by a migration
+	bucketConsentsName []byte
+	// the meta bucket is created by the first migration
+	bucketMetaName      []byte
+	cipher              *tokenCipher
+	deleteExpiredOnRead bool
+	nilOnNotFound       bool
+	metrics             *metrics
+	tracer              trace.Tracer
+	logger              Logger
+	codec               Codec
+	keyHasher           KeyHasher
+	batchWrites         bool
+	clock               Clock
+	newID               IDGenerator
+	usage               *usageTracker
+	cache               *tokenCache
+	// cachePreload access tokens are loaded into the cache when the store is opened
+	cachePreload        int
+	cachePreloadBudget  time.Duration
+	cleanupInterval     time.Duration
+	cleanupBatchSize    int
+	sweepIOLimit        SweepIOLimit
+	vacuumInterval      time.Duration
+	fileMode            os.FileMode
+	revocationRetention time.Duration
+	changeRetention     time.Duration
+	watchInterval       time.Duration
+	audit               bool
+	auditKey            []byte
+	hooks               Hooks
+	onRefreshReuse      func(reuse RefreshReuse) bool
+	consumeCodes        bool
+	maxTokensPerUser    int
+	maxTokensPerClient  int
+	quotaPolicy         QuotaPolicy
+	// forecasts is nil unless the expiry forecasts are cached
+	forecasts          *forecastCache
+	refreshGracePeriod time.Duration
+	ttlOverrides       map[string]time.Duration
+	shardTTLByDay      bool
+	// shards is the number of shards of the token and TTL buckets, 0 when they are not sharded
+	shards int
+
+	// codes is the store of the authorization codes when they have their own file
+	codes   *TokenStore
+	onError func(op string, err error)
+
+	// tenants are shared by the store and its tenant stores
+	tenants *tenants
+
+	// closers release the resources of the store on Close, the cleaner first
+	closers   []func() error
+	closeOnce sync.Once
+	closeErr  error
+	// closed is closed with the store, operations fail with ErrStoreClosed afterwards
+	closed chan struct{}
+}
+
+// tokenKeys are the token information fields needed to store a token.
+// Both oauth2.v3 and oauth2.v4 token information implement it
+type tokenKeys interface {
+	GetClientID() string
+	GetUserID() string
+	GetScope() string
+	GetCode() string
+	GetCodeExpiresIn() time.Duration
+	GetAccess() string
+	GetAccessCreateAt() time.Time
+	GetAccessExpiresIn() time.Duration
+	GetRefresh() string
+	GetRefreshCreateAt() time.Time
+	GetRefreshExpiresIn() time.Duration
+}
+
+// storedToken are the keys and indexed fields stored inside the token information
+type storedToken struct {
+	Code     string
+	Access   string
+	Refresh  string
+	UserID   string
+	ClientID string
+	Scope    string
+	// AccessCreateAt orders the token pairs evicted by the quotas
+	AccessCreateAt time.Time
+}
+
+// isTokenInfo reports if a decoded value is token information and not a mapping from a
+// token to its basic ID. Msgpack decodes some basic IDs, like the ones starting with 0xc0,
+// into empty tokens without failing, so values without a code nor a token are mappings
+func isTokenInfo(code, access, refresh string) bool {
+	return code != "" || access != "" || refresh != ""
+}
+
+// update runs fn on a write transaction that is rolled back if ctx is done before commit.
+// With batch writes fn can share the transaction with concurrent calls, and be run again alone if it fails
+func (ts *TokenStore) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ts.checkOpen(ctx); err != nil {
+		return err
+	}
+
+	if ts.db.IsReadOnly() {
+		return ErrReadOnly
+	}
+
+	write := ts.db.Update
+	if ts.batchWrites {
+		write = ts.db.Batch
+	}
+
+	err := write(func(tx *bolt.Tx) error {
+		if err := ts.checkBucket(tx); err != nil {
+			return err
+		}
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		return ctx.Err()
+	})
+
+	return closedError(err)
+}
+
+// view runs fn on a read transaction and fails if ctx is done before it finishes
+func (ts *TokenStore) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ts.checkOpen(ctx); err != nil {
+		return err
+	}
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		if err := ts.checkBucket(tx); err != nil {
+			return err
+		}
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		return ctx.Err()
+	})
+
+	return closedError(err)
+}
+
+// checkOpen fails with ErrStoreClosed once the store is closed, or with the error of ctx when it's done
+func (ts *TokenStore) checkOpen(ctx context.Context) error {
+	if ts.db == nil {
+		return ErrStoreClosed
+	}
+
+	select {
+	case <-ts.closed:
+		return ErrStoreClosed
+	default:
+	}
+
+	return ctx.Err()
+}
+
+// checkBucket fails with ErrBucketMissing when the token bucket was deleted from the database
+func (ts *TokenStore) checkBucket(tx *bolt.Tx) error {
+	if !ts.tokenBucket(tx).exists() {
+		return bucketMissing(ts.bucketName)
+	}
+
+	return nil
+}
+
+// closedError returns ErrStoreClosed for the error of bolt on closed databases, and err otherwise
+func closedError(err error) error {
+	if err == bolt.ErrDatabaseNotOpen {
+		return ErrStoreClosed
+	}
+
+	return err
+}
+
+// Create creates and store the new token information
+func (ts *TokenStore) Create(info oauth2.TokenInfo) error {
+	jv, err := ts.codec.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return ts.create(context.Background(), info, jv, nil)
+}
+
+// create stores the encoded token information jv under the keys of info,
+// and the encoded metadata meta when it's not nil
+func (ts *TokenStore) create(ctx context.Context, info tokenKeys, jv, meta []byte) error {
+	if ts.codes != nil && info.GetCode() != "" {
+		return ts.codes.create(ctx, info, jv, meta)
+	}
+
+	ctx, span := ts.startSpan(ctx, "create")
+
+	jv, err := ts.cipher.seal(jv)
+	if err != nil {
+		span.end(err)
+		return err
+	}
+
+	span.setBytes(len(jv))
+
+	if meta != nil {
+		meta, err = ts.cipher.seal(meta)
+		if err != nil {
+			span.end(err)
+			return err
+		}
+	}
+
+	err = ts.update(ctx, func(tx *bolt.Tx) error {
+		key, err := ts.put(tx, info, jv)
+		if err != nil {
+			return err
+		}
+
+		if meta != nil {
+			err = tx.Bucket(ts.bucketMetadataName).Put(key, meta)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = ts.putCodeChallenge(tx, key, info)
+		if err != nil {
+			return err
+		}
+
+		onCommit(tx, ts.hooks.OnCreate, createEvent(info))
+		return nil
+	})
+
+	ts.metrics.create(err)
+	span.end(err)
+
+	if err != nil {
+		ts.logger.Printf("boltdb: create token: %v", err)
+		ts.reportError("create", err)
+	}
+
+	return err
+}
+
+// put stores the sealed token information jv under the keys of info inside tx, returning
+// the key holding it. Keys and value are validated first, so a failed put doesn't leave partial writes
+func (ts *TokenStore) put(tx *bolt.Tx, info tokenKeys, jv []byte) ([]byte, error) {
+	err := ts.validate(info, jv)
+	if err != nil {
+		return nil, err
+	}
+
+	ct := ts.clock.Now()
+	bucket := ts.tokenBucket(tx)
+	ttl := ts.ttlBuckets(tx)
+	sessionID := ts.sessionOfInfo(tx, info)
+
+	stored := &storedToken{
+		Code:     info.GetCode(),
+		Access:   info.GetAccess(),
+		Refresh:  info.GetRefresh(),
+		UserID:   info.GetUserID(),
+		ClientID: info.GetClientID(),
+		Scope:    info.GetScope(),
+		// the created index orders the token pairs by it
+		AccessCreateAt: info.GetAccessCreateAt(),
+	}
+
+	if code := info.GetCode(); code != "" {
+		byteCode := ts.tokenKey(code)
+		err = bucket.Put(byteCode, jv)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = ts.index(tx, byteCode, stored)
+		if err != nil {
+			return nil, err
+		}
+
+		ts.cache.invalidate(tx, byteCode)
+
+		err = ttl.create(byteCode, capTTL(info.GetCodeExpiresIn(), ts.ttlOverride(info)))
+		if err != nil {
+			return nil, err
+		}
+
+		err = ts.auditIssue(tx, info)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ts.recordChange(tx, ChangeCreate, "", byteCode)
+		if err != nil {
+			return nil, err
+		}
+
+		return byteCode, ts.joinSession(tx, byteCode, info, sessionID)
+	}
+
+	err = ts.enforceQuotas(tx, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	basicID, err := ts.newBasicID(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	aexp := info.GetAccessExpiresIn()
+	rexp := aexp
+	refresh := info.GetRefresh()
+
+	if refresh != "" {
+		rexp = info.GetRefreshCreateAt().Add(info.GetRefreshExpiresIn()).Sub(ct)
+		if aexp.Seconds() > rexp.Seconds() {
+			aexp = rexp
+		}
+
+		// the access token keeps its nominal expiration
+		if info.GetRefreshExpiresIn() > 0 {
+			rexp += ts.refreshGracePeriod
+		}
+	}
+
+	override := ts.ttlOverride(info)
+	aexp = capTTL(aexp, override)
+	rexp = capTTL(rexp, override)
+
+	if refresh != "" {
+		byteRefresh := ts.tokenKey(refresh)
+		err := bucket.Put(byteRefresh, basicID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ttl.create(byteRefresh, rexp)
+		if err != nil {
+			return nil, err
+		}
+
+		ts.cache.invalidate(tx, byteRefresh)
+	}
+
+	err = bucket.Put(basicID, jv)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ts.index(tx, basicID, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ttl.create(basicID, rexp)
+	if err != nil {
+		return nil, err
+	}
+
+	byteAccess := ts.tokenKey(info.GetAccess())
+
+	err = bucket.Put(byteAccess, basicID)
+	if err != nil {
+		return nil, err
+	}
+
+	ts.cache.invalidate(tx, byteAccess)
+
+	err = ttl.create(byteAccess, aexp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ts.auditIssue(tx, info)
+	if err != nil {
+		return nil, err
+	}
+
+	written := [][]byte{byteAccess, basicID}
+	if refresh != "" {
+		written = append(written, ts.tokenKey(refresh))
+	}
+
+	err = ts.recordChange(tx, ChangeCreate, "", written...)
+	if err != nil {
+		return nil, err
+	}
+
+	return basicID, ts.joinSession(tx, basicID, info, sessionID)
+}
 
-	if err != nil {
-		return nil, nil, err
+// ttlOverride returns the TTL override of the grant type info was issued with, zero when there's none
+func (ts *TokenStore) ttlOverride(info tokenKeys) time.Duration {
+	if len(ts.ttlOverrides) == 0 {
+		return 0
+	}
+
+	return ts.ttlOverrides[grantType(info)]
+}
+
+// capTTL returns the TTL ttl capped to override, when it's set. TTLs that don't expire get override
+func capTTL(ttl, override time.Duration) time.Duration {
+	if override > 0 && (ttl <= 0 || ttl > override) {
+		return override
+	}
+
+	return ttl
+}
+
+// validate checks that bolt accepts the keys of info and the value jv
+func (ts *TokenStore) validate(info tokenKeys, jv []byte) error {
+	if len(jv) > bolt.MaxValueSize {
+		return bolt.ErrValueTooLarge
+	}
+
+	keys := []string{info.GetCode()}
+	if info.GetCode() == "" {
+		keys = []string{info.GetAccess(), info.GetRefresh()}
+	}
+
+	for i, key := range keys {
+		// the refresh token is optional
+		if key == "" && i == 1 {
+			continue
+		}
+
+		byteKey := ts.tokenKey(key)
+
+		// hashed and encrypted keys of empty tokens are not empty
+		if key == "" || len(byteKey) == 0 {
+			return bolt.ErrKeyRequired
+		}
+
+		if len(byteKey) > bolt.MaxKeySize {
+			return bolt.ErrKeyTooLarge
+		}
+	}
+
+	return nil
+}
+
+// CreateBatch creates and stores many tokens on a single transaction, which is much
+// faster than calling Create for each of them. Tokens that can't be stored are
+// reported by their index on a BatchError, the rest of the batch is still stored
+func (ts *TokenStore) CreateBatch(infos []oauth2.TokenInfo) error {
+	if ts.codes != nil {
+		return ts.createCodeBatch(infos)
 	}
 
-	bucketTtlName := []byte(fmt.Sprintf("%s-ttl", config.BucketName))
-	bucketName := []byte(config.BucketName)
+	return ts.createBatch(infos)
+}
+
+// createBatch stores infos on a single transaction of ts
+func (ts *TokenStore) createBatch(infos []oauth2.TokenInfo) error {
+	batchErr := BatchError{}
+	sealed := make([][]byte, len(infos))
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bucketName)
+	for i, info := range infos {
+		jv, err := ts.codec.Marshal(info)
+		if err == nil {
+			jv, err = ts.cipher.seal(jv)
+		}
 
 		if err != nil {
-			return err
+			batchErr[i] = err
+			continue
 		}
 
-		_, err = tx.CreateBucketIfNotExists(bucketTtlName)
+		sealed[i] = jv
+	}
 
-		return err
+	err := ts.update(context.Background(), func(tx *bolt.Tx) error {
+		for i, info := range infos {
+			if sealed[i] == nil {
+				continue
+			}
+
+			// a failed Put doesn't modify the transaction, so the rest can be stored
+			_, err := ts.put(tx, info, sealed[i])
+			if err != nil {
+				batchErr[i] = err
+				continue
+			}
+
+			onCommit(tx, ts.hooks.OnCreate, createEvent(info))
+		}
+
+		return nil
 	})
 
 	if err != nil {
-		return nil, nil, err
+		ts.logger.Printf("boltdb: create batch: %v", err)
+		ts.reportError("create", err)
+		return err
 	}
 
-	ts := &TokenStore{
-		db:            db,
-		bucketName:    bucketName,
-		bucketTtlName: bucketTtlName,
+	for i := range infos {
+		ts.metrics.create(batchErr[i])
 	}
 
-	tsc := &TokenStoreCleaner{
-		db:            db,
-		quit:          make(chan struct{}),
-		bucketName:    bucketName,
-		bucketTtlName: bucketTtlName,
+	if len(batchErr) > 0 {
+		ts.logger.Printf("boltdb: create batch: %v", batchErr)
+		ts.reportError("create", batchErr)
+		return batchErr
 	}
 
-	tsc.monitor()
+	return nil
+}
+
+// remove key and its TTL entry
+func (ts *TokenStore) remove(ctx context.Context, key string) error {
+	ctx, span := ts.startSpan(ctx, "remove")
+
+	err := ts.removeKeys(ctx, ReasonRemoved, ts.tokenKey(key))
+	ts.metrics.remove(err)
+	span.end(err)
 
-	closeFunction := func() {
-		tsc.close()
-		db.Close()
+	if err != nil {
+		ts.logger.Printf("boltdb: remove token: %v", err)
+		ts.reportError("remove", err)
 	}
 
-	return ts, closeFunction, nil
+	return err
 }
 
-// TokenStore token storage based on boltdb(https://github.com/boltdb/bolt)
-type TokenStore struct {
-	db            *bolt.DB
-	bucketName    []byte
-	bucketTtlName []byte
+// removeKeys deletes the bucket keys and their TTL entries
+func (ts *TokenStore) removeKeys(ctx context.Context, reason string, keys ...[]byte) error {
+	return ts.update(ctx, func(tx *bolt.Tx) error {
+		return ts.deleteKeys(tx, reason, keys...)
+	})
 }
 
-// createTtl creates an entry on the TTL bucket.
-func createTtl(bucket *bolt.Bucket, key []byte, ttl time.Duration) error {
-	expirationTime := time.Now().Add(ttl).UTC().Format(time.RFC3339Nano)
+// deleteKeys deletes the bucket keys and their TTL entries inside tx
+func (ts *TokenStore) deleteKeys(tx *bolt.Tx, reason string, keys ...[]byte) error {
+	bucket := ts.tokenBucket(tx)
+	ttl := ts.ttlBuckets(tx)
+
+	hook := ts.hooks.OnRemove
+	operation := ChangeRemove
+	if reason == "" {
+		// expired keys found while reading
+		hook = ts.hooks.OnExpire
+		operation = ChangeExpire
+	}
+
+	onCommit(tx, hook, ts.deleteEvents(tx, reason, keys...)...)
 
-	return bucket.Put([]byte(expirationTime), key)
-}
+	err := ts.auditRevoke(tx, reason, keys...)
+	if err != nil {
+		return err
+	}
 
-// Create creates and store the new token information
-func (ts *TokenStore) Create(info oauth2.TokenInfo) error {
-	ct := time.Now()
-	jv, err := json.Marshal(info)
+	err = ts.recordChange(tx, operation, reason, keys...)
 	if err != nil {
 		return err
 	}
 
-	return ts.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(ts.bucketName)
-		ttlBucket := tx.Bucket(ts.bucketTtlName)
+	for _, key := range keys {
+		err := ts.logRevocation(tx, key, reason)
+		if err != nil {
+			return err
+		}
 
-		if code := info.GetCode(); code != "" {
-			byteCode := []byte(code)
-			err := bucket.Put(byteCode, jv)
+		err = ttl.remove(key)
+		if err != nil {
+			return err
+		}
 
-			if err != nil {
-				return err
-			}
+		err = ts.unindex(tx, key)
+		if err != nil {
+			return err
+		}
+
+		err = ts.deleteSideEntries(tx, key)
+		if err != nil {
+			return err
+		}
 
-			return createTtl(ttlBucket, byteCode, info.GetCodeExpiresIn())
+		err = bucket.Delete(key)
+		if err != nil {
+			return err
 		}
+	}
 
-		basicID := uuid.NewV4().Bytes()
-		aexp := info.GetAccessExpiresIn()
-		rexp := aexp
+	ts.cache.invalidate(tx, keys...)
 
-		if refresh := info.GetRefresh(); refresh != "" {
-			rexp = info.GetRefreshCreateAt().Add(info.GetRefreshExpiresIn()).Sub(ct)
-			if aexp.Seconds() > rexp.Seconds() {
-				aexp = rexp
-			}
+	return nil
+}
 
-			byteRefresh := []byte(refresh)
-			err := bucket.Put(byteRefresh, basicID)
-			if err != nil {
-				return nil
-			}
+// recordKeyPrefixes are the prefixes of the keys sharing the TTL buckets that are not
+// codes or tokens, but records on the side buckets
+var recordKeyPrefixes = [][]byte{deviceKeyPrefix, userCodeKeyPrefix, consentKeyPrefix}
+
+// isRecordKey reports if key is the key of a record rather than of a code or token
+func isRecordKey(key []byte) bool {
+	for _, prefix := range recordKeyPrefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withoutRecords returns the keys of keys that are not record keys
+func withoutRecords(keys [][]byte) [][]byte {
+	var tokens [][]byte
 
-			return createTtl(ttlBucket, byteRefresh, rexp)
+	for _, key := range keys {
+		if !isRecordKey(key) {
+			tokens = append(tokens, key)
 		}
+	}
+
+	return tokens
+}
+
+// deleteRecords deletes the record keys, like device requests or consents, and their
+// TTL entries inside tx. Unlike deleteKeys, they are not tokens, so they are not reported
+// to the hooks nor recorded on the revocation, audit or change logs
+func (ts *TokenStore) deleteRecords(tx *bolt.Tx, keys ...[]byte) error {
+	ttl := ts.ttlBuckets(tx)
 
-		err := bucket.Put(basicID, jv)
+	for _, key := range keys {
+		err := ttl.remove(key)
 		if err != nil {
-			return nil
+			return err
 		}
 
-		err = createTtl(ttlBucket, basicID, rexp)
+		err = ts.deleteSideEntries(tx, key)
 		if err != nil {
-			return nil
+			return err
 		}
+	}
+
+	return nil
+}
 
-		byteAccess := []byte(info.GetAccess())
+// removeFamily deletes the access or refresh key, the token information it points to
+// and the other keys pointing to the same token information on a single transaction
+func (ts *TokenStore) removeFamily(ctx context.Context, key, reason string) error {
+	ctx, span := ts.startSpan(ctx, "remove")
 
-		err = bucket.Put(byteAccess, basicID)
+	err := ts.update(ctx, func(tx *bolt.Tx) error {
+		keys, err := ts.familyKeys(tx, ts.tokenKey(key))
 		if err != nil {
-			return nil
+			return err
 		}
 
-		return createTtl(ttlBucket, byteAccess, aexp)
+		return ts.deleteKeys(tx, reason, keys...)
 	})
+
+	ts.metrics.remove(err)
+	span.end(err)
+
+	if err != nil {
+		ts.logger.Printf("boltdb: remove token: %v", err)
+		ts.reportError("remove", err)
+	}
+
+	return err
 }
 
-// remove key
-func (ts *TokenStore) remove(key string) error {
-	return ts.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(ts.bucketName)
-		// TODO: TTL
+// familyKeys returns key, the basic ID it points to and the access and refresh
+// keys that still point to that basic ID
+func (ts *TokenStore) familyKeys(tx *bolt.Tx, key []byte) ([][]byte, error) {
+	basicID := ts.tokenBucket(tx).Get(key)
+	if basicID == nil {
+		return [][]byte{key}, nil
+	}
 
-		return bucket.Delete([]byte(key))
-	})
+	keys, err := ts.rootFamily(tx, append([]byte(nil), basicID...))
+	if err != nil {
+		return nil, err
+	}
+
+	return append([][]byte{key}, keys...), nil
+}
+
+// rootFamily returns the key holding token information with the access and
+// refresh keys that still point to it. Authorization codes have no family
+func (ts *TokenStore) rootFamily(tx *bolt.Tx, root []byte) ([][]byte, error) {
+	bucket := ts.tokenBucket(tx)
+	keys := [][]byte{root}
+
+	stored, err := ts.decodeStored(bucket.Get(root))
+	if err != nil || stored == nil || stored.Code != "" {
+		return keys, err
+	}
+
+	for _, token := range []string{stored.Access, stored.Refresh} {
+		if token == "" {
+			continue
+		}
+
+		tokenKey := ts.tokenKey(token)
+		if bytes.Equal(bucket.Get(tokenKey), root) {
+			keys = append(keys, tokenKey)
+		}
+	}
+
+	return keys, nil
 }
 
 // RemoveByCode use the authorization code to delete the token information
 func (ts *TokenStore) RemoveByCode(code string) error {
-	return ts.remove(code)
+	if ts.codes != nil {
+		return ts.codes.RemoveByCode(code)
+	}
+
+	return ts.remove(context.Background(), code)
 }
 
 // RemoveByAccess use the access token to delete the token information
 func (ts *TokenStore) RemoveByAccess(access string) error {
-	return ts.remove(access)
+	return ts.remove(context.Background(), access)
 }
 
-// RemoveByRefresh use the refresh token to delete the token information
+// RemoveByRefresh use the refresh token to delete the token information.
+// The access token issued with it is also deleted
 func (ts *TokenStore) RemoveByRefresh(refresh string) error {
-	return ts.remove(refresh)
+	return ts.removeFamily(context.Background(), refresh, ReasonRemoved)
 }
 
-func (ts *TokenStore) getData(key string) (oauth2.TokenInfo, error) {
-	var tm models.Token
-
-	err := ts.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(ts.bucketName)
+// decode decodes the token information returned by read
+func (ts *TokenStore) decode(jv []byte, err error) (oauth2.TokenInfo, error) {
+	ts.metrics.get(err)
 
-		jv := bucket.Get([]byte(key))
+	if err != nil {
+		return nil, ts.notFound(err)
+	}
 
-		return json.Unmarshal(jv, &tm)
-	})
+	var tm models.Token
 
+	err = ts.codec.Unmarshal(jv, &tm)
 	if err != nil {
 		return nil, err
 	}
@@ -183,107 +1201,434 @@ func (ts *TokenStore) getData(key string) (oauth2.TokenInfo, error) {
 	return &tm, nil
 }
 
-func (ts *TokenStore) getBasicID(key string) string {
-	var basicId []byte
+// notFound hides ErrTokenNotFound when the store returns nil for missing tokens
+func (ts *TokenStore) notFound(err error) error {
+	if err == ErrTokenNotFound && ts.nilOnNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// getToken returns the token information of key, from the cache when possible.
+// Access and refresh keys point to the basic ID holding the token information
+func (ts *TokenStore) getToken(ctx context.Context, key []byte, byBasicID bool) (oauth2.TokenInfo, error) {
+	// cached tokens are not read from the database, which may be closed
+	if err := ts.checkOpen(ctx); err != nil {
+		return nil, err
+	}
+
+	ctx, span := ts.startSpan(ctx, "get")
+
+	if tm, ok := ts.cache.get(key).(models.Token); ok {
+		ts.metrics.get(nil)
+		span.endGet(nil)
+		return &tm, nil
+	}
+
+	generation := ts.cache.version()
+
+	jv, expiry, err := ts.read(ctx, key, byBasicID)
+	span.setBytes(len(jv))
+	span.endGet(err)
+
+	ti, err := ts.decode(jv, err)
+	if err != nil || ti == nil {
+		return ti, err
+	}
+
+	ts.cache.add(key, *ti.(*models.Token), expiry, generation)
+
+	return ti, nil
+}
+
+// read returns the decrypted token information of key and when it expires, zero when it doesn't.
+// When byBasicID is set key holds a basic ID, which is resolved on the same transaction.
+// Missing keys return ErrTokenNotFound. Keys with an expired TTL entry return ErrTokenExpired,
+// and are deleted when the store is configured to do so
+func (ts *TokenStore) read(ctx context.Context, key []byte, byBasicID bool) ([]byte, time.Time, error) {
+	var value, expiredKey []byte
+	var expiry time.Time
 
-	ts.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(ts.bucketName)
+	err := ts.view(ctx, func(tx *bolt.Tx) error {
+		v, keyExpiry, keyExpired, err := ts.readTx(tx, key, byBasicID)
+		if err != nil {
+			// keys are only valid during the transaction
+			expiredKey = append([]byte(nil), keyExpired...)
+			return err
+		}
 
-		basicId = bucket.Get([]byte(key))
+		// values are only valid during the transaction
+		value = append([]byte(nil), v...)
+		expiry = keyExpiry
 		return nil
 	})
 
-	return string(basicId)
+	if len(expiredKey) > 0 && ts.deleteExpiredOnRead {
+		if err := ts.removeKeys(ctx, "", expiredKey); err != nil {
+			ts.logger.Printf("boltdb: delete expired key %x: %v", expiredKey, err)
+			ts.reportError("remove", err)
+		}
+	}
+
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	jv, err := ts.cipher.open(value)
+
+	return jv, expiry, err
+}
+
+// readTx returns the sealed token information of key inside tx and when it expires, like read.
+// Keys with an expired TTL entry return ErrTokenExpired and the expired key
+func (ts *TokenStore) readTx(tx *bolt.Tx, key []byte, byBasicID bool) ([]byte, time.Time, []byte, error) {
+	bucket := ts.tokenBucket(tx)
+	ttl := ts.ttlBuckets(tx)
+	now := ts.clock.Now()
+
+	var expiry time.Time
+
+	lookup := func(k []byte) ([]byte, []byte, error) {
+		keyExpiry, _ := ttl.expiry(k)
+		if !keyExpiry.IsZero() && !keyExpiry.After(now) {
+			return nil, k, ErrTokenExpired
+		}
+
+		v := bucket.Get(k)
+		if v == nil {
+			return nil, nil, ErrTokenNotFound
+		}
+
+		expiry = earliest(expiry, keyExpiry)
+
+		return v, nil, nil
+	}
+
+	v, expiredKey, err := lookup(key)
+	if err == nil && byBasicID {
+		v, expiredKey, err = lookup(v)
+	}
+
+	if err != nil {
+		return nil, time.Time{}, expiredKey, err
+	}
+
+	return v, expiry, nil, nil
+}
+
+// NextExpiry returns the closest expiration time stored on the TTL bucket
+// and false when there are no entries waiting to expire
+func (ts *TokenStore) NextExpiry() (time.Time, bool) {
+	return nextExpiry(ts)
 }
 
-// GetByCode use the authorization code for token information data
+// GetByCode use the authorization code for token information data.
+// With Config.ConsumeCodes the code is deleted, like ConsumeByCode does
 func (ts *TokenStore) GetByCode(code string) (oauth2.TokenInfo, error) {
-	return ts.getData(code)
+	if ts.codes != nil {
+		return ts.codes.GetByCode(code)
+	}
+
+	if ts.consumeCodes {
+		return ts.ConsumeByCode(code)
+	}
+
+	return ts.getToken(context.Background(), ts.tokenKey(code), false)
 }
 
 // GetByAccess use the access token for token information data
 func (ts *TokenStore) GetByAccess(access string) (oauth2.TokenInfo, error) {
-	basicID := ts.getBasicID(access)
-	return ts.getData(basicID)
+	key := ts.tokenKey(access)
+
+	ti, err := ts.getToken(context.Background(), key, true)
+	if err == nil && ti != nil {
+		ts.usage.record(ts, key, ts.clock.Now())
+	}
+
+	return ti, err
 }
 
 // GetByRefresh use the refresh token for token information data
 func (ts *TokenStore) GetByRefresh(refresh string) (oauth2.TokenInfo, error) {
-	basicID := ts.getBasicID(refresh)
-	return ts.getData(basicID)
+	ctx := context.Background()
+	key := ts.tokenKey(refresh)
+
+	ti, err := ts.getToken(ctx, key, true)
+	if ti != nil || (err != nil && err != ErrTokenNotFound) {
+		return ti, err
+	}
+
+	return nil, ts.reuseError(ctx, refresh, key, err)
 }
 
+// minSweepInterval avoids sweeping in a tight loop when many keys expire together
+const minSweepInterval = time.Second
+
 // TokenStoreCleaner is in charge of cleaning keys with expired ttl
 type TokenStoreCleaner struct {
-	db            *bolt.DB
-	quit          chan struct{}
-	bucketName    []byte
-	bucketTtlName []byte
+	ts       *TokenStore
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	interval time.Duration
 }
 
-// monitor is the start method and will create a monitor that will sweep every minute
-func (tsc *TokenStoreCleaner) monitor() {
-	ticker := time.NewTicker(30 * time.Second)
+// monitor is the start method and will create a monitor that will sweep at least once per interval
+// until ctx is done or the cleaner is closed
+func (tsc *TokenStoreCleaner) monitor(ctx context.Context) {
+	ctx, tsc.cancel = context.WithCancel(ctx)
 
-	go tsc.dispatcher(ticker)
+	tsc.wg.Add(1)
+	go tsc.dispatcher(ctx)
 }
 
-// close is the close method for the monitor
-func (tsc *TokenStoreCleaner) close() {
-	tsc.quit <- struct{}{}
+// close stops the monitor and waits for its final sweep. It doesn't block when
+// the monitor already stopped because its context is done
+func (tsc *TokenStoreCleaner) close() error {
+	tsc.cancel()
+	tsc.wg.Wait()
+
+	return nil
 }
 
-// dispatcher will receive close or tick calls and perform the required actions
-func (tsc *TokenStoreCleaner) dispatcher(ticker *time.Ticker) {
+// dispatcher will receive close or timer calls and perform the required actions.
+// Keys that expired since the last sweep are deleted before it returns
+func (tsc *TokenStoreCleaner) dispatcher(ctx context.Context) {
+	defer tsc.wg.Done()
+
+	timer := time.NewTimer(tsc.nextSweep())
+	defer timer.Stop()
+
+	// a nil channel never fires, so the store is only vacuumed when it's scheduled
+	var vacuum <-chan time.Time
+	if tsc.ts.vacuumInterval > 0 {
+		ticker := time.NewTicker(tsc.ts.vacuumInterval)
+		defer ticker.Stop()
+
+		vacuum = ticker.C
+	}
+
 	for {
 		select {
-		case <-ticker.C:
-			tsc.sweep()
+		case <-timer.C:
+			tsc.ts.sweep(ctx)
+			timer.Reset(tsc.nextSweep())
 
-		case <-tsc.quit:
-			ticker.Stop()
+		case <-vacuum:
+			tsc.ts.Vacuum()
+
+		case <-ctx.Done():
+			// ctx is done, so a sweep limited by Config.SweepIOLimit stops at its first pause
+			tsc.ts.sweep(ctx)
 			return
 		}
 	}
 }
 
-// sweep scans the ttl bucket searching for expired keys
-func (tsc *TokenStoreCleaner) sweep() error {
-	keys, ttlKeys, err := tsc.getExpired()
+// nextSweep returns how long the monitor should wait before the next sweep.
+// It wakes up when the next key expires but never waits more than the interval
+func (tsc *TokenStoreCleaner) nextSweep() time.Duration {
+	wait := tsc.interval
 
-	if err != nil || len(keys) == 0 {
-		return nil
+	for _, ts := range tsc.ts.stores() {
+		if next, ok := ts.NextExpiry(); ok {
+			if untilNext := next.Sub(ts.clock.Now()); untilNext < wait {
+				wait = untilNext
+			}
+		}
+	}
+
+	if wait < minSweepInterval {
+		wait = minSweepInterval
+	}
+
+	return wait
+}
+
+// DeleteExpired deletes the expired keys of the store and its tenant stores,
+// and returns how many were deleted. Expiry strategies call it to sweep the store
+func (ts *TokenStore) DeleteExpired() (int, error) {
+	return ts.sweep(context.Background())
+}
+
+// sweep deletes the expired keys of the store and its tenant stores. The pauses of
+// Config.SweepIOLimit end the sweep early when ctx is done or the store closed
+func (ts *TokenStore) sweep(ctx context.Context) (int, error) {
+	// the final sweep runs once ctx is done
+	if err := ts.checkOpen(context.Background()); err != nil {
+		return 0, err
 	}
 
-	return tsc.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(tsc.bucketName)
-		ttlBucket := tx.Bucket(tsc.bucketTtlName)
+	var sweepErr error
+	expired := 0
 
-		for _, key := range keys {
-			bucket.Delete(key)
+	for _, store := range ts.stores() {
+		n, err := store.deleteExpired(ctx)
+		if err != nil && sweepErr == nil {
+			sweepErr = err
 		}
 
-		for _, key := range ttlKeys {
-			ttlBucket.Delete(key)
+		expired += n
+
+		_, err = store.purgeRevocations()
+		if err != nil {
+			store.logger.Printf("boltdb: purge revocations: %v", err)
+			store.reportError("sweep", err)
+
+			if sweepErr == nil {
+				sweepErr = err
+			}
 		}
 
-		return nil
-	})
+		_, err = store.purgeChanges()
+		if err != nil {
+			store.logger.Printf("boltdb: purge changes: %v", err)
+			store.reportError("sweep", err)
+
+			if sweepErr == nil {
+				sweepErr = err
+			}
+		}
+	}
+
+	return expired, sweepErr
 }
 
-func (tsc *TokenStoreCleaner) getExpired() ([][]byte, [][]byte, error) {
-	keys := [][]byte{}
-	ttlKeys := [][]byte{}
+// deleteExpired scans the ttl bucket searching for expired keys.
+// Keys are deleted in batches so the write lock is released between them,
+// smaller ones with pauses between them when the sweep I/O is limited
+func (ts *TokenStore) deleteExpired(ctx context.Context) (int, error) {
+	_, span := ts.startSpan(ctx, "sweep")
+	start := time.Now()
+	expired := 0
+	first := ts.sweepIOLimit.batchSize(ts.cleanupBatchSize)
+	batch := first
+
+	var sweepErr error
+
+	defer func() {
+		ts.forecasts.reset()
+		ts.metrics.sweep(time.Since(start), expired)
+		span.setExpired(expired)
+		span.end(sweepErr)
+
+		if expired > 0 {
+			ts.logger.Printf("boltdb: sweep expired %d keys in %s", expired, time.Since(start))
+		}
+	}()
+
+	for {
+		keys, ttlKeys, err := ts.getExpired(batch)
+
+		if err != nil {
+			ts.logger.Printf("boltdb: sweep read expired keys: %v", err)
+			ts.reportError("sweep", err)
+			sweepErr = err
+			return expired, err
+		}
+
+		if len(keys) == 0 {
+			return expired, nil
+		}
 
-	err := tsc.db.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket(tsc.bucketTtlName).Cursor()
+		txStart := time.Now()
 
-		max := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+		err = ts.db.Update(func(tx *bolt.Tx) error {
+			bucket := ts.tokenBucket(tx)
+			ttl := ts.ttlBuckets(tx)
 
-		for k, v := c.First(); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
-			keys = append(keys, v)
-			ttlKeys = append(ttlKeys, k)
+			onCommit(tx, ts.hooks.OnExpire, ts.deleteEvents(tx, "", keys...)...)
+
+			for i, key := range keys {
+				if err := ts.unindex(tx, key); err != nil {
+					ts.logger.Printf("boltdb: sweep unindex key %x: %v", key, err)
+					ts.reportError("sweep", err)
+				}
+
+				if err := ts.deleteSideEntries(tx, key); err != nil {
+					ts.logger.Printf("boltdb: sweep delete side entries of key %x: %v", key, err)
+					ts.reportError("sweep", err)
+				}
+
+				if err := bucket.Delete(key); err != nil {
+					ts.logger.Printf("boltdb: sweep delete key %x: %v", key, err)
+					ts.reportError("sweep", err)
+				}
+
+				if err := ttl.expire(ttlKeys[i], key); err != nil {
+					ts.logger.Printf("boltdb: sweep delete ttl of key %x: %v", key, err)
+					ts.reportError("sweep", err)
+				}
+			}
+
+			ts.cache.invalidate(tx, keys...)
+
+			if err := ts.recordChange(tx, ChangeExpire, "", withoutRecords(keys)...); err != nil {
+				ts.logger.Printf("boltdb: sweep record change: %v", err)
+				ts.reportError("sweep", err)
+			}
+
+			if err := ttl.dropEmptyShards(ts.clock.Now()); err != nil {
+				ts.logger.Printf("boltdb: sweep drop empty ttl buckets: %v", err)
+				ts.reportError("sweep", err)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			ts.logger.Printf("boltdb: sweep: %v", err)
+			ts.reportError("sweep", err)
+			sweepErr = err
+			return expired, err
+		}
+
+		expired += len(keys)
+
+		if len(keys) < batch {
+			return expired, nil
+		}
+
+		if ts.sweepIOLimit.enabled() {
+			took := time.Since(txStart)
+			batch = ts.sweepIOLimit.nextBatchSize(first, len(keys), took)
+
+			if !ts.sweepPause(ctx, ts.sweepIOLimit.pause(start, expired, took)) {
+				return expired, nil
+			}
 		}
+	}
+}
+
+// sweepPause waits d between two transactions of a sweep. It reports false when
+// ctx is done or the store closed first, the keys left are swept the next time
+func (ts *TokenStore) sweepPause(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-ts.closed:
+		return false
+	}
+}
+
+// getExpired returns up to limit expired keys and their TTL entries
+func (ts *TokenStore) getExpired(limit int) ([][]byte, [][]byte, error) {
+	keys := [][]byte{}
+	ttlKeys := [][]byte{}
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		ts.ttlBuckets(tx).due(ts.clock.Now(), func(k, v []byte) bool {
+			// keys and values are only valid during the transaction
+			keys = append(keys, append([]byte(nil), v...))
+			ttlKeys = append(ttlKeys, append([]byte(nil), k...))
+
+			return len(keys) < limit
+		})
 
 		return nil
 	})
@@ -0,0 +1,448 @@
+package boltdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// newTestStore creates a store of config on a temporary database, closed with the test
+func newTestStore(tb testing.TB, config Config) *TokenStore {
+	tb.Helper()
+
+	config.DbName = filepath.Join(tb.TempDir(), "oauth2.db")
+	config.BucketName = "oauthTokens"
+
+	store, closeFn, err := NewTokenStore(&config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(closeFn)
+
+	return store.(*TokenStore)
+}
+
+// checkCreateGetRemove runs the Create, Get and Remove checks every token store has to pass
+func checkCreateGetRemove(t *testing.T, store oauth2.TokenStore) {
+	t.Helper()
+
+	type getter func(string) (oauth2.TokenInfo, error)
+
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		token  *models.Token
+		get    getter
+		key    string
+		remove func(string) error
+		// gone are the tokens deleted by the remove, with how they are read
+		gone map[string]getter
+	}{
+		{
+			name:   "code",
+			token:  &models.Token{ClientID: "client", UserID: "user", Code: "code", CodeCreateAt: now, CodeExpiresIn: time.Minute},
+			get:    store.GetByCode,
+			key:    "code",
+			remove: store.RemoveByCode,
+			gone:   map[string]getter{"code": store.GetByCode},
+		},
+		{
+			name: "access",
+			token: &models.Token{
+				ClientID: "client", UserID: "user",
+				Access: "access", AccessCreateAt: now, AccessExpiresIn: time.Hour,
+			},
+			get:    store.GetByAccess,
+			key:    "access",
+			remove: store.RemoveByAccess,
+			gone:   map[string]getter{"access": store.GetByAccess},
+		},
+		{
+			name: "refresh",
+			token: &models.Token{
+				ClientID: "client", UserID: "user",
+				Access: "paired-access", AccessCreateAt: now, AccessExpiresIn: time.Hour,
+				Refresh: "refresh", RefreshCreateAt: now, RefreshExpiresIn: 24 * time.Hour,
+			},
+			get:    store.GetByRefresh,
+			key:    "refresh",
+			remove: store.RemoveByRefresh,
+			gone:   map[string]getter{"refresh": store.GetByRefresh, "paired-access": store.GetByAccess},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := store.Create(tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := tt.get(tt.key)
+			if err != nil || info == nil || info.GetUserID() != "user" || info.GetClientID() != "client" {
+				t.Fatalf("get %s = %v, %v, want the stored token", tt.key, info, err)
+			}
+
+			err = tt.remove(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for token, get := range tt.gone {
+				info, err := get(token)
+				if info != nil || (err != nil && !errors.Is(err, ErrTokenNotFound)) {
+					t.Errorf("get %s after removing = %v, %v, want not found", token, info, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateGetRemove(t *testing.T) {
+	checkCreateGetRemove(t, newTestStore(t, Config{}))
+}
+
+// stored reports if the key of token is still on the token bucket of ts
+func stored(t *testing.T, ts *TokenStore, token string) bool {
+	t.Helper()
+
+	var found bool
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		found = ts.tokenBucket(tx).Get(ts.tokenKey(token)) != nil
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return found
+}
+
+// checkSweep runs the TTL sweep checks on a store of config
+func checkSweep(t *testing.T, config Config) {
+	t.Helper()
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		kept    []string
+		swept   []string
+	}{
+		{"nothing due", 30 * time.Second, []string{"code", "access", "refresh"}, nil},
+		{"code due", 2 * time.Minute, []string{"access", "refresh"}, []string{"code"}},
+		{"access due", 2 * time.Hour, []string{"refresh"}, []string{"code", "access"}},
+		{"everything due", 48 * time.Hour, nil, []string{"code", "access", "refresh"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testutil.NewFakeClock(time.Now())
+
+			config := config
+			config.ExpiryStrategy = LazyExpiry
+			config.Clock = clock
+			ts := newTestStore(t, config)
+
+			for _, token := range []*models.Token{
+				{Code: "code", CodeCreateAt: clock.Now(), CodeExpiresIn: time.Minute},
+				{
+					Access: "access", AccessCreateAt: clock.Now(), AccessExpiresIn: time.Hour,
+					Refresh: "refresh", RefreshCreateAt: clock.Now(), RefreshExpiresIn: 24 * time.Hour,
+				},
+			} {
+				if err := ts.Create(token); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			clock.Advance(tt.advance)
+
+			expired, err := ts.DeleteExpired()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (expired > 0) != (len(tt.swept) > 0) {
+				t.Errorf("DeleteExpired = %d, want %d tokens swept", expired, len(tt.swept))
+			}
+
+			for _, token := range tt.kept {
+				if !stored(t, ts, token) {
+					t.Errorf("%s was swept before it expired", token)
+				}
+			}
+
+			for _, token := range tt.swept {
+				if stored(t, ts, token) {
+					t.Errorf("%s was kept after it expired", token)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteExpiredSweepsDueTokens(t *testing.T) {
+	checkSweep(t, Config{})
+}
+
+func TestCreateWithRefreshStoresThePair(t *testing.T) {
+	store, closeFn, err := NewTokenStore(&Config{
+		DbName:     filepath.Join(t.TempDir(), "oauth2.db"),
+		BucketName: "oauthTokens",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	now := time.Now()
+	err = store.Create(&models.Token{
+		ClientID:         "client",
+		UserID:           "user",
+		Access:           "access",
+		AccessCreateAt:   now,
+		AccessExpiresIn:  time.Hour,
+		Refresh:          "refresh",
+		RefreshCreateAt:  now,
+		RefreshExpiresIn: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byAccess, err := store.GetByAccess("access")
+	if err != nil || byAccess == nil || byAccess.GetRefresh() != "refresh" {
+		t.Fatalf("GetByAccess = %v, %v, want the stored pair", byAccess, err)
+	}
+
+	byRefresh, err := store.GetByRefresh("refresh")
+	if err != nil || byRefresh == nil || byRefresh.GetAccess() != "access" {
+		t.Fatalf("GetByRefresh = %v, %v, want the stored pair", byRefresh, err)
+	}
+}
+
+func TestSweepStopsPausingWhenDone(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now())
+
+	store, closeFn, err := NewTokenStore(&Config{
+		DbName:         filepath.Join(t.TempDir(), "oauth2.db"),
+		BucketName:     "oauthTokens",
+		ExpiryStrategy: LazyExpiry,
+		Clock:          clock,
+		// one key per transaction, a second apart
+		SweepIOLimit: SweepIOLimit{KeysPerSecond: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFn()
+
+	ts := store.(*TokenStore)
+
+	for i := 0; i < 3; i++ {
+		err = ts.Create(&models.Token{
+			Code:          "code" + strconv.Itoa(i),
+			CodeCreateAt:  clock.Now(),
+			CodeExpiresIn: time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+
+	expired, err := ts.sweep(ctx)
+	if err != nil || expired != 1 {
+		t.Fatalf("sweep = %d, %v, want a single transaction", expired, err)
+	}
+
+	if took := time.Since(start); took >= time.Second {
+		t.Fatalf("sweep took %s, want no pause", took)
+	}
+}
+
+func TestSweepPause(t *testing.T) {
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	closed := make(chan struct{})
+	close(closed)
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		closed chan struct{}
+		pause  time.Duration
+		want   bool
+	}{
+		{"elapsed", context.Background(), nil, time.Millisecond, true},
+		{"ctx done", done, nil, time.Hour, false},
+		{"store closed", context.Background(), closed, time.Hour, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &TokenStore{closed: tt.closed}
+
+			if got := ts.sweepPause(tt.ctx, tt.pause); got != tt.want {
+				t.Fatalf("sweepPause = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadResolvesTheBasicID(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		advance time.Duration
+		dangle  bool
+		expiry  time.Duration
+		err     error
+	}{
+		{"access", "access", 0, false, time.Hour, nil},
+		{"refresh", "refresh", 0, false, 24 * time.Hour, nil},
+		{"refresh after its access expired", "refresh", 2 * time.Hour, false, 24 * time.Hour, nil},
+		{"expired access", "access", 2 * time.Hour, false, 0, ErrTokenExpired},
+		{"access without its token information", "access", 0, true, 0, ErrTokenNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testutil.NewFakeClock(time.Now())
+			ts := newTestStore(t, Config{ExpiryStrategy: LazyExpiry, Clock: clock})
+			created := clock.Now()
+
+			err := ts.Create(&models.Token{
+				Access: "access", AccessCreateAt: created, AccessExpiresIn: time.Hour,
+				Refresh: "refresh", RefreshCreateAt: created, RefreshExpiresIn: 24 * time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.dangle {
+				err = ts.db.Update(func(tx *bolt.Tx) error {
+					bucket := ts.tokenBucket(tx)
+					return bucket.Delete(bucket.Get(ts.tokenKey(tt.token)))
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			clock.Advance(tt.advance)
+
+			// access tokens expire before the token information they point to
+			_, expiry, err := ts.read(context.Background(), ts.tokenKey(tt.token), true)
+			if err != tt.err {
+				t.Fatalf("read = %v, want %v", err, tt.err)
+			}
+
+			if err == nil && !expiry.Equal(created.Add(tt.expiry)) {
+				t.Fatalf("expiry = %s, want %s", expiry, created.Add(tt.expiry))
+			}
+		})
+	}
+}
+
+// readOnTwoTransactions reads the token information of an access or refresh key like
+// before reads were made on a single transaction, for the benchmarks to compare
+func readOnTwoTransactions(ts *TokenStore, key []byte) ([]byte, error) {
+	var basicID []byte
+
+	err := ts.db.View(func(tx *bolt.Tx) error {
+		basicID = append([]byte(nil), ts.tokenBucket(tx).Get(key)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jv, _, err := ts.read(context.Background(), basicID, false)
+
+	return jv, err
+}
+
+func BenchmarkRead(b *testing.B) {
+	tests := []struct {
+		name string
+		read func(ts *TokenStore, key []byte) ([]byte, error)
+	}{
+		{"single transaction", func(ts *TokenStore, key []byte) ([]byte, error) {
+			jv, _, err := ts.read(context.Background(), key, true)
+			return jv, err
+		}},
+		{"two transactions", readOnTwoTransactions},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			ts := newTestStore(b, Config{ExpiryStrategy: LazyExpiry, BoltOptions: &bolt.Options{NoSync: true}})
+			fillStore(b, ts, 1000)
+
+			keys := make([][]byte, 1000)
+			for i := range keys {
+				keys[i] = ts.tokenKey("access-" + strconv.Itoa(i))
+			}
+
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := tt.read(ts, keys[i%len(keys)]); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestTemporaryStores(t *testing.T) {
+	tests := []struct {
+		name string
+		open func() (oauth2.TokenStore, func(), error)
+	}{
+		{"file", func() (oauth2.TokenStore, func(), error) {
+			return NewTokenStoreTemp(&Config{BucketName: "oauthTokens"})
+		}},
+		{"in memory", NewInMemoryTokenStore},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, closeFn, err := tt.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := filepath.Dir(store.(*TokenStore).db.Path())
+
+			checkCreateGetRemove(t, store)
+			closeFn()
+
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Fatalf("stat %s after closing = %v, want it removed", dir, err)
+			}
+		})
+	}
+}
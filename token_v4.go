@@ -0,0 +1,159 @@
+package boltdb
+
+import (
+	"context"
+
+	oauth2v4 "github.com/go-oauth2/oauth2/v4"
+	modelsv4 "github.com/go-oauth2/oauth2/v4/models"
+)
+
+// NewContextTokenStore creates a token store based on boltdb for oauth2.v4.
+// It shares the storage format with NewTokenStore, so both can open the same database
+func NewContextTokenStore(config *Config) (oauth2v4.TokenStore, func(), error) {
+	ts, closeFunction, err := newTokenStore(config)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &ContextTokenStore{ts: ts}, closeFunction, nil
+}
+
+// ContextTokenStore token storage based on boltdb that implements the oauth2.v4 interface.
+// Transactions are rolled back when the context is done before they finish
+type ContextTokenStore struct {
+	ts *TokenStore
+}
+
+// Close stops the cleaner after a final sweep and closes the database.
+// It can be called more than once
+func (cts *ContextTokenStore) Close() error {
+	return cts.ts.Close()
+}
+
+// Create creates and store the new token information
+func (cts *ContextTokenStore) Create(ctx context.Context, info oauth2v4.TokenInfo) error {
+	jv, err := cts.ts.codec.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return cts.ts.create(ctx, info, jv, nil)
+}
+
+// RemoveByCode use the authorization code to delete the token information
+func (cts *ContextTokenStore) RemoveByCode(ctx context.Context, code string) error {
+	return cts.codes().ts.remove(ctx, code)
+}
+
+// codes returns the store of the authorization codes, which is cts unless they have their own file
+func (cts *ContextTokenStore) codes() *ContextTokenStore {
+	if cts.ts.codes == nil {
+		return cts
+	}
+
+	return &ContextTokenStore{ts: cts.ts.codes}
+}
+
+// RemoveByAccess use the access token to delete the token information
+func (cts *ContextTokenStore) RemoveByAccess(ctx context.Context, access string) error {
+	return cts.ts.remove(ctx, access)
+}
+
+// RemoveByRefresh use the refresh token to delete the token information.
+// The access token issued with it is also deleted
+func (cts *ContextTokenStore) RemoveByRefresh(ctx context.Context, refresh string) error {
+	return cts.ts.removeFamily(ctx, refresh, ReasonRemoved)
+}
+
+// getToken returns the token information of key, from the cache when possible
+func (cts *ContextTokenStore) getToken(ctx context.Context, key []byte, byBasicID bool) (oauth2v4.TokenInfo, error) {
+	// cached tokens are not read from the database, which may be closed
+	if err := cts.ts.checkOpen(ctx); err != nil {
+		return nil, err
+	}
+
+	ctx, span := cts.ts.startSpan(ctx, "get")
+
+	if tm, ok := cts.ts.cache.get(key).(modelsv4.Token); ok {
+		cts.ts.metrics.get(nil)
+		span.endGet(nil)
+		return &tm, nil
+	}
+
+	generation := cts.ts.cache.version()
+
+	jv, expiry, err := cts.ts.read(ctx, key, byBasicID)
+	span.setBytes(len(jv))
+	span.endGet(err)
+
+	ti, err := cts.decode(jv, err)
+	if err != nil || ti == nil {
+		return ti, err
+	}
+
+	cts.ts.cache.add(key, *ti.(*modelsv4.Token), expiry, generation)
+
+	return ti, nil
+}
+
+// decode decodes the token information returned by read
+func (cts *ContextTokenStore) decode(jv []byte, err error) (oauth2v4.TokenInfo, error) {
+	cts.ts.metrics.get(err)
+
+	if err != nil {
+		return nil, cts.ts.notFound(err)
+	}
+
+	var tm modelsv4.Token
+
+	err = cts.ts.codec.Unmarshal(jv, &tm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tm, nil
+}
+
+// GetByCode use the authorization code for token information data
+func (cts *ContextTokenStore) GetByCode(ctx context.Context, code string) (oauth2v4.TokenInfo, error) {
+	codes := cts.codes()
+
+	if codes.ts.consumeCodes {
+		return codes.ConsumeByCode(ctx, code)
+	}
+
+	return codes.getToken(ctx, codes.ts.tokenKey(code), false)
+}
+
+// ConsumeByCode returns the token information of the authorization code and deletes it on the
+// same transaction, so a code can only be redeemed once
+func (cts *ContextTokenStore) ConsumeByCode(ctx context.Context, code string) (oauth2v4.TokenInfo, error) {
+	codes := cts.codes()
+
+	return codes.decode(codes.ts.consume(ctx, codes.ts.tokenKey(code)))
+}
+
+// GetByAccess use the access token for token information data
+func (cts *ContextTokenStore) GetByAccess(ctx context.Context, access string) (oauth2v4.TokenInfo, error) {
+	key := cts.ts.tokenKey(access)
+
+	ti, err := cts.getToken(ctx, key, true)
+	if err == nil && ti != nil {
+		cts.ts.usage.record(cts.ts, key, cts.ts.clock.Now())
+	}
+
+	return ti, err
+}
+
+// GetByRefresh use the refresh token for token information data
+func (cts *ContextTokenStore) GetByRefresh(ctx context.Context, refresh string) (oauth2v4.TokenInfo, error) {
+	key := cts.ts.tokenKey(refresh)
+
+	ti, err := cts.getToken(ctx, key, true)
+	if ti != nil || (err != nil && err != ErrTokenNotFound) {
+		return ti, err
+	}
+
+	return nil, cts.ts.reuseError(ctx, refresh, key, err)
+}
@@ -0,0 +1,93 @@
+package boltdb
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer of the store
+const instrumentationName = "github.com/naxhh/go-oauth2-boltdb"
+
+// newTracer returns the tracer of the store, nil when provider is nil
+func newTracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		return nil
+	}
+
+	return provider.Tracer(instrumentationName)
+}
+
+// span is an operation traced on a span. A nil span records nothing
+type span struct {
+	span trace.Span
+}
+
+// startSpan starts the span of operation as a child of the span of ctx, if any
+func (ts *TokenStore) startSpan(ctx context.Context, operation string) (context.Context, *span) {
+	if ts.tracer == nil {
+		return ctx, nil
+	}
+
+	ctx, s := ts.tracer.Start(ctx, "boltdb."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "boltdb"),
+			attribute.String("boltdb.operation", operation),
+			attribute.String("boltdb.bucket", string(ts.bucketName)),
+		),
+	)
+
+	return ctx, &span{span: s}
+}
+
+// setBytes records the size of the value read or written
+func (s *span) setBytes(n int) {
+	if s == nil {
+		return
+	}
+
+	s.span.SetAttributes(attribute.Int("boltdb.bytes", n))
+}
+
+// setExpired records the number of keys expired by a sweep
+func (s *span) setExpired(n int) {
+	if s == nil {
+		return
+	}
+
+	s.span.SetAttributes(attribute.Int("boltdb.expired_keys", n))
+}
+
+// end ends a create, remove or sweep span
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+
+	s.finish(result(err), err)
+}
+
+// endGet ends a read span with its hit, miss, expired or error result.
+// Missing and expired tokens are not span errors
+func (s *span) endGet(err error) {
+	if s == nil {
+		return
+	}
+
+	s.finish(getResult(err), err)
+}
+
+// finish records the result and the error, when it is one, and ends the span
+func (s *span) finish(result string, err error) {
+	s.span.SetAttributes(attribute.String("boltdb.result", result))
+
+	if result == "error" {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+
+	s.span.End()
+}
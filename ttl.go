@@ -0,0 +1,341 @@
+package boltdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// errInvalidTtlKey is returned when a TTL key is too short to hold an expiration time
+var errInvalidTtlKey = errors.New("invalid ttl key")
+
+// ttlBucket is a TTL bucket, keyed by expiration time and key, and its reverse index,
+// keyed by the key that expires, inside a transaction.
+// When shardByDay is set new entries are stored on a nested bucket per expiration day, named
+// like 2006-01-02, that sort after the entries stored directly on the TTL bucket
+type ttlBucket struct {
+	ttl        *bolt.Bucket
+	index      *bolt.Bucket
+	clock      Clock
+	shardByDay bool
+}
+
+// ttlShardName returns the name of the nested bucket of the entries expiring on the day of expiration
+func ttlShardName(expiration time.Time) []byte {
+	return []byte(expiration.UTC().Format("2006-01-02"))
+}
+
+// ttlKeyTime returns the expiration time of a TTL key, which starts with it
+func ttlKeyTime(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k[:ttlTimeSize])))
+}
+
+// create creates an entry on the TTL bucket.
+// A previous TTL entry of the same key is replaced
+func (t ttlBucket) create(key []byte, ttl time.Duration) error {
+	return t.createAt(key, t.clock.Now().Add(ttl))
+}
+
+// createAt creates an entry on the TTL bucket that expires at expiration.
+// A previous TTL entry of the same key is replaced
+func (t ttlBucket) createAt(key []byte, expiration time.Time) error {
+	err := t.remove(key)
+	if err != nil {
+		return err
+	}
+
+	expirationKey := ttlKey(expiration, key)
+
+	bucket := t.ttl
+	if t.shardByDay {
+		bucket, err = t.ttl.CreateBucketIfNotExists(ttlShardName(expiration))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = bucket.Put(expirationKey, key)
+	if err != nil {
+		return err
+	}
+
+	return t.index.Put(key, expirationKey)
+}
+
+// remove deletes the TTL entry of key, if any
+func (t ttlBucket) remove(key []byte) error {
+	ttlKey := t.index.Get(key)
+	if ttlKey == nil {
+		return nil
+	}
+
+	err := t.deleteEntry(ttlKey)
+	if err != nil {
+		return err
+	}
+
+	return t.index.Delete(key)
+}
+
+// deleteEntry deletes the TTL entry ttlKey, stored directly on the TTL bucket or on its day
+func (t ttlBucket) deleteEntry(ttlKey []byte) error {
+	err := t.ttl.Delete(ttlKey)
+	if err != nil || len(ttlKey) < ttlTimeSize || isLegacyTtlKey(ttlKey) {
+		return err
+	}
+
+	shard := t.ttl.Bucket(ttlShardName(ttlKeyTime(ttlKey)))
+	if shard == nil {
+		return nil
+	}
+
+	return shard.Delete(ttlKey)
+}
+
+// due calls fn with the TTL entries expiring up to max, the ones stored directly on the TTL
+// bucket first and then day by day, until fn returns false
+func (t ttlBucket) due(max time.Time, fn func(ttlKey, key []byte) bool) {
+	maxKey := ttlTime(max)
+	maxShard := ttlShardName(max)
+
+	c := t.ttl.Cursor()
+	k, v := c.First()
+
+	for ; k != nil && v != nil; k, v = c.Next() {
+		if bytes.Compare(k[:ttlTimeSize], maxKey) > 0 {
+			break
+		}
+
+		if !fn(k, v) {
+			return
+		}
+	}
+
+	// day buckets sort after the entries, which start with the expiration time
+	for k, v = c.Seek([]byte("0")); k != nil && bytes.Compare(k, maxShard) <= 0; k, v = c.Next() {
+		shard := t.ttl.Bucket(k)
+		if v != nil || shard == nil {
+			continue
+		}
+
+		sc := shard.Cursor()
+
+		for sk, sv := sc.First(); sk != nil && bytes.Compare(sk[:ttlTimeSize], maxKey) <= 0; sk, sv = sc.Next() {
+			if !fn(sk, sv) {
+				return
+			}
+		}
+	}
+}
+
+// next returns the first expiration time after the TTL key prefix after, and false when
+// no entry expires after it. An empty after returns the first expiration time
+func (t ttlBucket) next(after []byte) (time.Time, bool) {
+	var next []byte
+
+	c := t.ttl.Cursor()
+	if k, v := c.Seek(after); k != nil && v != nil && !isLegacyTtlKey(k) {
+		next = k
+	}
+
+	firstShard := []byte("0")
+	if len(after) >= ttlTimeSize {
+		firstShard = ttlShardName(ttlKeyTime(after))
+	}
+
+	for k, v := c.Seek(firstShard); k != nil; k, v = c.Next() {
+		shard := t.ttl.Bucket(k)
+		if v != nil || shard == nil {
+			continue
+		}
+
+		if sk, _ := shard.Cursor().Seek(after); sk != nil {
+			if next == nil || bytes.Compare(sk, next) < 0 {
+				next = sk
+			}
+
+			break
+		}
+	}
+
+	if next == nil {
+		return time.Time{}, false
+	}
+
+	expiration, err := parseTtlKey(next)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return expiration, true
+}
+
+// dropEmptyShards deletes the day buckets before the day of now that have no entries left
+func (t ttlBucket) dropEmptyShards(now time.Time) error {
+	today := ttlShardName(now)
+
+	var empty [][]byte
+
+	c := t.ttl.Cursor()
+	for k, v := c.Seek([]byte("0")); k != nil && bytes.Compare(k, today) < 0; k, v = c.Next() {
+		shard := t.ttl.Bucket(k)
+		if v != nil || shard == nil {
+			continue
+		}
+
+		if first, _ := shard.Cursor().First(); first == nil {
+			empty = append(empty, append([]byte(nil), k...))
+		}
+	}
+
+	for _, name := range empty {
+		err := t.ttl.DeleteBucket(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expire deletes an expired TTL entry.
+// The index is kept when it already points to a newer entry of the same key
+func (t ttlBucket) expire(ttlKey, key []byte) error {
+	err := t.deleteEntry(ttlKey)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(t.index.Get(key), ttlKey) {
+		return t.index.Delete(key)
+	}
+
+	return nil
+}
+
+// expired returns true when key has a TTL entry that is already due
+func (t ttlBucket) expired(key []byte, now time.Time) bool {
+	expiration, ok := t.expiry(key)
+
+	return ok && !expiration.After(now)
+}
+
+// expiry returns the expiration time of key and false when it has no TTL entry
+func (t ttlBucket) expiry(key []byte) (time.Time, bool) {
+	ttlKey := t.index.Get(key)
+	if ttlKey == nil {
+		return time.Time{}, false
+	}
+
+	expiration, err := parseTtlKey(ttlKey)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return expiration, true
+}
+
+// ttlTimeSize is the size of the expiration time at the start of TTL keys
+const ttlTimeSize = 8
+
+// ttlTime encodes expiration as big endian unix nanoseconds, so TTL keys sort by expiration
+func ttlTime(expiration time.Time) []byte {
+	b := make([]byte, ttlTimeSize)
+	binary.BigEndian.PutUint64(b, uint64(expiration.UnixNano()))
+
+	return b
+}
+
+// ttlKey returns the TTL key of key: its expiration time followed by the key itself,
+// so keys expiring at the same time don't collide
+func ttlKey(expiration time.Time, key []byte) []byte {
+	return append(ttlTime(expiration), key...)
+}
+
+// parseTtlKey returns the expiration time of a TTL entry
+func parseTtlKey(k []byte) (time.Time, error) {
+	if isLegacyTtlKey(k) {
+		return time.Parse(time.RFC3339Nano, string(k))
+	}
+
+	if len(k) < ttlTimeSize {
+		return time.Time{}, errInvalidTtlKey
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k[:ttlTimeSize]))).UTC(), nil
+}
+
+// legacyTtlKeyMinSize is the size of the shortest RFC3339Nano timestamp, without fraction
+const legacyTtlKeyMinSize = len("2006-01-02T15:04:05Z")
+
+// isLegacyTtlKey returns true for the TTL keys of previous versions, which were RFC3339Nano
+// timestamps. Current keys can start with ASCII digits too, from 2079, so the whole key is parsed
+func isLegacyTtlKey(k []byte) bool {
+	if len(k) < legacyTtlKeyMinSize || k[4] != '-' {
+		return false
+	}
+
+	_, err := time.Parse(time.RFC3339Nano, string(k))
+	return err == nil
+}
+
+// migrateTtlKeys rewrites the legacy TTL keys, which collide when two keys expire
+// at the same time, to the current format
+func migrateTtlKeys(t ttlBucket) error {
+	type entry struct {
+		ttlKey     []byte
+		key        []byte
+		expiration time.Time
+	}
+
+	var legacy []entry
+
+	// legacy keys start with a digit, like the day buckets and the current keys expiring from 2079
+	c := t.ttl.Cursor()
+	for k, v := c.Seek([]byte("0")); k != nil && k[0] <= '9'; k, v = c.Next() {
+		if v == nil || !isLegacyTtlKey(k) {
+			continue
+		}
+
+		expiration, err := parseTtlKey(k)
+		if err != nil {
+			continue
+		}
+
+		legacy = append(legacy, entry{
+			ttlKey:     append([]byte(nil), k...),
+			key:        append([]byte(nil), v...),
+			expiration: expiration,
+		})
+	}
+
+	for _, e := range legacy {
+		err := t.ttl.Delete(e.ttlKey)
+		if err != nil {
+			return err
+		}
+
+		err = t.createAt(e.key, e.expiration)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nextExpiry returns the closest expiration time of the TTL buckets of ts
+func nextExpiry(ts *TokenStore) (time.Time, bool) {
+	var next time.Time
+	var found bool
+
+	ts.db.View(func(tx *bolt.Tx) error {
+		next, found = ts.ttlBuckets(tx).next([]byte{})
+		return nil
+	})
+
+	return next, found
+}
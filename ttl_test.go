@@ -0,0 +1,189 @@
+package boltdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// farExpiration is after 2079, when the current TTL keys start with ASCII digits
+var farExpiration = time.Date(2080, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestIsLegacyTtlKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  []byte
+		want bool
+	}{
+		{"legacy", []byte("2020-05-01T10:00:00.123456789Z"), true},
+		{"legacy without fraction", []byte("2020-05-01T10:00:00Z"), true},
+		{"current", ttlKey(time.Now(), []byte("access")), false},
+		{"current after 2079", ttlKey(farExpiration, []byte("access")), false},
+		{"day bucket", ttlShardName(farExpiration), false},
+		{"empty", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLegacyTtlKey(tt.key); got != tt.want {
+				t.Fatalf("isLegacyTtlKey(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrateTtlKeysKeepsCurrentKeys(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "oauth2.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	legacyExpiration := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		ttl, err := tx.CreateBucket([]byte("ttl"))
+		if err != nil {
+			return err
+		}
+
+		index, err := tx.CreateBucket([]byte("ttl-index"))
+		if err != nil {
+			return err
+		}
+
+		bucket := ttlBucket{ttl: ttl, index: index, clock: (&Config{}).clock()}
+
+		err = ttl.Put([]byte(legacyExpiration.Format(time.RFC3339Nano)), []byte("legacy"))
+		if err != nil {
+			return err
+		}
+
+		err = bucket.createAt([]byte("current"), farExpiration)
+		if err != nil {
+			return err
+		}
+
+		return migrateTtlKeys(bucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		ttl := tx.Bucket([]byte("ttl"))
+
+		tests := []struct {
+			key        string
+			expiration time.Time
+		}{
+			{"legacy", legacyExpiration},
+			{"current", farExpiration},
+		}
+
+		for _, tt := range tests {
+			if v := ttl.Get(ttlKey(tt.expiration, []byte(tt.key))); !bytes.Equal(v, []byte(tt.key)) {
+				t.Errorf("%s has no current TTL key after migrating", tt.key)
+			}
+		}
+
+		if v := ttl.Get([]byte(legacyExpiration.Format(time.RFC3339Nano))); v != nil {
+			t.Error("the legacy TTL key is still stored")
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTTLOverrides(t *testing.T) {
+	tests := []struct {
+		name  string
+		token models.Token
+		// access and refresh are the TTLs of the access and refresh tokens,
+		// refresh is also the TTL of the token information
+		access  time.Duration
+		refresh time.Duration
+	}{
+		{"access capped", models.Token{UserID: "user", AccessExpiresIn: time.Hour}, 30 * time.Minute, 30 * time.Minute},
+		{"access without expiration", models.Token{UserID: "user"}, 30 * time.Minute, 30 * time.Minute},
+		{"access under the cap", models.Token{UserID: "user", AccessExpiresIn: time.Minute}, time.Minute, time.Minute},
+		{
+			"refresh capped with its grace period",
+			models.Token{UserID: "user", AccessExpiresIn: time.Hour, Refresh: "refresh", RefreshExpiresIn: 24 * time.Hour},
+			30 * time.Minute,
+			30 * time.Minute,
+		},
+		{
+			"refresh under the cap",
+			models.Token{UserID: "user", AccessExpiresIn: time.Hour, Refresh: "refresh", RefreshExpiresIn: 10 * time.Minute},
+			10 * time.Minute,
+			20 * time.Minute,
+		},
+		{
+			"grant without override",
+			models.Token{AccessExpiresIn: time.Hour, Refresh: "refresh", RefreshExpiresIn: 2 * time.Hour},
+			time.Hour,
+			2*time.Hour + 10*time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testutil.NewFakeClock(time.Now())
+			ts := newTestStore(t, Config{
+				Clock:              clock,
+				RefreshGracePeriod: 10 * time.Minute,
+				TTLOverrides:       map[string]time.Duration{"password": 30 * time.Minute},
+			})
+
+			token := tt.token
+			token.Access = "access"
+			token.AccessCreateAt = clock.Now()
+			if token.Refresh != "" {
+				token.RefreshCreateAt = clock.Now()
+			}
+
+			if err := ts.Create(&token); err != nil {
+				t.Fatal(err)
+			}
+
+			var basicID []byte
+
+			err := ts.db.View(func(tx *bolt.Tx) error {
+				basicID = append(basicID, ts.tokenBucket(tx).Get(ts.tokenKey("access"))...)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := map[string][]byte{"access": ts.tokenKey("access"), "token information": basicID}
+			want := map[string]time.Duration{"access": tt.access, "token information": tt.refresh}
+			if token.Refresh != "" {
+				keys["refresh"] = ts.tokenKey("refresh")
+				want["refresh"] = tt.refresh
+			}
+
+			for name, key := range keys {
+				expiry, ok := expiryOf(t, ts, key)
+				if !ok || !expiry.Equal(clock.Now().Add(want[name])) {
+					t.Errorf("%s expires in %v, want %v", name, expiry.Sub(clock.Now()), want[name])
+				}
+			}
+
+			// rebuilt TTL indexes expire the tokens at the same time
+			accessAt, refreshAt := ts.pairExpiration(&token)
+			if !accessAt.Equal(clock.Now().Add(tt.access)) || !refreshAt.Equal(clock.Now().Add(tt.refresh)) {
+				t.Errorf("pairExpiration = %v, %v, want %v, %v", accessAt.Sub(clock.Now()), refreshAt.Sub(clock.Now()), tt.access, tt.refresh)
+			}
+		})
+	}
+}
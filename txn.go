@@ -0,0 +1,138 @@
+package boltdb
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// StoreTxn is the token store inside a single write transaction, see TokenStore.Txn
+type StoreTxn interface {
+	// Create stores the token information
+	Create(info oauth2.TokenInfo) error
+	// GetByAccess returns the token information of the access token
+	GetByAccess(access string) (oauth2.TokenInfo, error)
+	// GetByRefresh returns the token information of the refresh token
+	GetByRefresh(refresh string) (oauth2.TokenInfo, error)
+	// RemoveByCode deletes the authorization code
+	RemoveByCode(code string) error
+	// RemoveByAccess deletes the access token
+	RemoveByAccess(access string) error
+	// RemoveByRefresh deletes the refresh token and the access token issued with it
+	RemoveByRefresh(refresh string) error
+	// Revoke deletes a token and the tokens issued with it, recording reason on the revocation log
+	Revoke(token, reason string) error
+}
+
+// storeTxn is a StoreTxn on a bolt write transaction
+type storeTxn struct {
+	ts *TokenStore
+	tx *bolt.Tx
+}
+
+// Txn runs fn on a single write transaction, so its creates and removes are stored
+// all together or, when fn or any of them fails, not at all. Rotating a refresh token
+// can't leave both pairs, or none, behind on a crash. Hooks run once it's committed.
+// With Config.BatchWrites fn may run more than once, so it must not have side effects.
+// Authorization codes stored on Config.CodeDbName can't join the transaction and
+// return ErrCodeDbTxn
+func (ts *TokenStore) Txn(fn func(tx StoreTxn) error) error {
+	return ts.update(context.Background(), func(tx *bolt.Tx) error {
+		return fn(&storeTxn{ts: ts, tx: tx})
+	})
+}
+
+// Create stores the token information
+func (t *storeTxn) Create(info oauth2.TokenInfo) error {
+	if t.ts.codes != nil && info.GetCode() != "" {
+		return ErrCodeDbTxn
+	}
+
+	jv, err := t.ts.codec.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	jv, err = t.ts.cipher.seal(jv)
+	if err != nil {
+		return err
+	}
+
+	key, err := t.ts.put(t.tx, info, jv)
+	if err != nil {
+		return err
+	}
+
+	err = t.ts.putCodeChallenge(t.tx, key, info)
+	if err != nil {
+		return err
+	}
+
+	onCommit(t.tx, t.ts.hooks.OnCreate, createEvent(info))
+	return nil
+}
+
+// GetByAccess returns the token information of the access token
+func (t *storeTxn) GetByAccess(access string) (oauth2.TokenInfo, error) {
+	return t.get(access)
+}
+
+// GetByRefresh returns the token information of the refresh token
+func (t *storeTxn) GetByRefresh(refresh string) (oauth2.TokenInfo, error) {
+	return t.get(refresh)
+}
+
+// get returns the token information of an access or refresh token.
+// Expired tokens return ErrTokenExpired and are left to the sweep
+func (t *storeTxn) get(token string) (oauth2.TokenInfo, error) {
+	sealed, _, _, err := t.ts.readTx(t.tx, t.ts.tokenKey(token), true)
+	if err != nil {
+		return nil, err
+	}
+
+	jv, err := t.ts.cipher.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	var tm models.Token
+
+	err = t.ts.codec.Unmarshal(jv, &tm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tm, nil
+}
+
+// RemoveByCode deletes the authorization code
+func (t *storeTxn) RemoveByCode(code string) error {
+	if t.ts.codes != nil {
+		return ErrCodeDbTxn
+	}
+
+	return t.ts.deleteKeys(t.tx, ReasonRemoved, t.ts.tokenKey(code))
+}
+
+// RemoveByAccess deletes the access token
+func (t *storeTxn) RemoveByAccess(access string) error {
+	return t.ts.deleteKeys(t.tx, ReasonRemoved, t.ts.tokenKey(access))
+}
+
+// RemoveByRefresh deletes the refresh token and the access token issued with it
+func (t *storeTxn) RemoveByRefresh(refresh string) error {
+	return t.Revoke(refresh, ReasonRemoved)
+}
+
+// Revoke deletes a token and the tokens issued with it, recording reason on the revocation log
+func (t *storeTxn) Revoke(token, reason string) error {
+	keys, err := t.ts.familyKeys(t.tx, t.ts.tokenKey(token))
+	if err != nil {
+		return err
+	}
+
+	return t.ts.deleteKeys(t.tx, reason, keys...)
+}
@@ -0,0 +1,142 @@
+package boltdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+// txnPair returns a token pair of the transaction tests
+func txnPair(prefix string) *models.Token {
+	return &models.Token{
+		Access:           prefix + "-access",
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  time.Hour,
+		Refresh:          prefix + "-refresh",
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 24 * time.Hour,
+	}
+}
+
+func TestTxn(t *testing.T) {
+	errAbort := errors.New("abort")
+
+	tests := []struct {
+		name   string
+		codeDb bool
+		fn     func(tx StoreTxn) error
+		err    error
+		// stored and removed are the access tokens the store has, or not, afterwards
+		stored  []string
+		removed []string
+		// created is how many times OnCreate is called
+		created int
+	}{
+		{
+			name: "rotates a refresh token",
+			fn: func(tx StoreTxn) error {
+				info, err := tx.GetByRefresh("old-refresh")
+				if err != nil || info.GetAccess() != "old-access" {
+					return errors.New("the old pair isn't read inside the transaction")
+				}
+
+				if err := tx.Create(txnPair("new")); err != nil {
+					return err
+				}
+
+				return tx.RemoveByRefresh("old-refresh")
+			},
+			stored:  []string{"new-access"},
+			removed: []string{"old-access"},
+			created: 1,
+		},
+		{
+			name: "rolls back when fn fails",
+			fn: func(tx StoreTxn) error {
+				if err := tx.Create(txnPair("new")); err != nil {
+					return err
+				}
+
+				if err := tx.Revoke("old-access", ReasonRemoved); err != nil {
+					return err
+				}
+
+				return errAbort
+			},
+			err:     errAbort,
+			stored:  []string{"old-access"},
+			removed: []string{"new-access"},
+		},
+		{
+			name: "reads its own writes",
+			fn: func(tx StoreTxn) error {
+				if err := tx.Create(txnPair("new")); err != nil {
+					return err
+				}
+
+				_, err := tx.GetByAccess("new-access")
+				return err
+			},
+			stored:  []string{"old-access", "new-access"},
+			created: 1,
+		},
+		{
+			name:   "codes on their own file",
+			codeDb: true,
+			fn: func(tx StoreTxn) error {
+				if err := tx.Create(txnPair("new")); err != nil {
+					return err
+				}
+
+				return tx.Create(&models.Token{Code: "code", CodeCreateAt: time.Now(), CodeExpiresIn: time.Minute})
+			},
+			err:     ErrCodeDbTxn,
+			stored:  []string{"old-access"},
+			removed: []string{"new-access"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created := 0
+
+			// hooks run on the commit, on the goroutine of Txn
+			config := Config{Hooks: Hooks{OnCreate: func(TokenEvent) { created++ }}}
+
+			if tt.codeDb {
+				config.CodeDbName = filepath.Join(t.TempDir(), "codes.db")
+			}
+
+			ts := newTestStore(t, config)
+
+			if err := ts.Create(txnPair("old")); err != nil {
+				t.Fatal(err)
+			}
+
+			created = 0
+
+			if err := ts.Txn(tt.fn); !errors.Is(err, tt.err) {
+				t.Fatalf("Txn = %v, want %v", err, tt.err)
+			}
+
+			for _, access := range tt.stored {
+				if _, err := ts.GetByAccess(access); err != nil {
+					t.Errorf("GetByAccess(%s) = %v, want it stored", access, err)
+				}
+			}
+
+			for _, access := range tt.removed {
+				if _, err := ts.GetByAccess(access); err != ErrTokenNotFound {
+					t.Errorf("GetByAccess(%s) = %v, want ErrTokenNotFound", access, err)
+				}
+			}
+
+			if created != tt.created {
+				t.Errorf("OnCreate called %d times, want %d", created, tt.created)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package boltdb
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gopkg.in/oauth2.v3/models"
+)
+
+// usageSize is the size of a usage entry: the last use as unix nanoseconds and the use count
+const usageSize = 16
+
+// Usage is how many times an access token was read with GetByAccess, and when it was last
+type Usage struct {
+	LastUsed time.Time
+	Count    uint64
+}
+
+// usageTracker buffers the uses of access tokens in memory and writes them every
+// interval on a single transaction per store, so reads don't write the database.
+// A nil usageTracker tracks nothing
+type usageTracker struct {
+	mu       sync.Mutex
+	interval time.Duration
+	pending  map[*TokenStore]map[string]Usage
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newUsageTracker creates a tracker that flushes every interval once started
+func newUsageTracker(interval time.Duration) *usageTracker {
+	return &usageTracker{
+		interval: interval,
+		pending:  map[*TokenStore]map[string]Usage{},
+		stop:     make(chan struct{}),
+	}
+}
+
+// record adds a use of the access token key of ts at now
+func (u *usageTracker) record(ts *TokenStore, key []byte, now time.Time) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	uses, ok := u.pending[ts]
+	if !ok {
+		uses = map[string]Usage{}
+		u.pending[ts] = uses
+	}
+
+	usage := uses[string(key)]
+	usage.Count++
+	usage.LastUsed = now
+	uses[string(key)] = usage
+}
+
+// pendingUsage returns the uses of key of ts that are not flushed yet
+func (u *usageTracker) pendingUsage(ts *TokenStore, key []byte) Usage {
+	if u == nil {
+		return Usage{}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.pending[ts][string(key)]
+}
+
+// start flushes the pending uses every interval until close is called
+func (u *usageTracker) start() {
+	u.wg.Add(1)
+
+	go func() {
+		defer u.wg.Done()
+
+		ticker := time.NewTicker(u.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				u.flush()
+			case <-u.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops flushing and writes the pending uses
+func (u *usageTracker) close() error {
+	close(u.stop)
+	u.wg.Wait()
+
+	return u.flush()
+}
+
+// flush writes the pending uses of every store, returning the first error
+func (u *usageTracker) flush() error {
+	if u == nil {
+		return nil
+	}
+
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = map[*TokenStore]map[string]Usage{}
+	u.mu.Unlock()
+
+	var flushErr error
+
+	for ts, uses := range pending {
+		err := ts.db.Update(func(tx *bolt.Tx) error {
+			return ts.addUsage(tx, uses)
+		})
+
+		if err != nil {
+			ts.logger.Printf("boltdb: flush usage of %d tokens: %v", len(uses), err)
+			ts.reportError("flush_usage", err)
+
+			if flushErr == nil {
+				flushErr = err
+			}
+		}
+	}
+
+	return flushErr
+}
+
+// addUsage adds uses to the usage entries of the access tokens still stored inside tx
+func (ts *TokenStore) addUsage(tx *bolt.Tx, uses map[string]Usage) error {
+	bucket := ts.tokenBucket(tx)
+	usageBucket := tx.Bucket(ts.bucketUsageName)
+
+	for key, usage := range uses {
+		// tokens removed since they were used
+		if bucket.Get([]byte(key)) == nil {
+			continue
+		}
+
+		stored := decodeUsage(usageBucket.Get([]byte(key)))
+		stored.Count += usage.Count
+
+		if usage.LastUsed.After(stored.LastUsed) {
+			stored.LastUsed = usage.LastUsed
+		}
+
+		err := usageBucket.Put([]byte(key), encodeUsage(stored))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodeUsage encodes a usage entry
+func encodeUsage(usage Usage) []byte {
+	value := make([]byte, usageSize)
+	binary.BigEndian.PutUint64(value, uint64(usage.LastUsed.UnixNano()))
+	binary.BigEndian.PutUint64(value[8:], usage.Count)
+
+	return value
+}
+
+// decodeUsage decodes a usage entry, a missing or invalid one is an unused token
+func decodeUsage(value []byte) Usage {
+	if len(value) != usageSize {
+		return Usage{}
+	}
+
+	return Usage{
+		LastUsed: time.Unix(0, int64(binary.BigEndian.Uint64(value))),
+		Count:    binary.BigEndian.Uint64(value[8:]),
+	}
+}
+
+// GetUsageByAccess returns how many times the access token was read and when it was last,
+// including the uses not written yet. Unused tokens return a zero Usage
+func (ts *TokenStore) GetUsageByAccess(access string) (Usage, error) {
+	if ts.usage == nil {
+		return Usage{}, ErrUsageTrackingDisabled
+	}
+
+	key := ts.tokenKey(access)
+
+	var usage Usage
+
+	err := ts.view(context.Background(), func(tx *bolt.Tx) error {
+		usage = decodeUsage(tx.Bucket(ts.bucketUsageName).Get(key))
+		return nil
+	})
+
+	if err != nil {
+		return Usage{}, err
+	}
+
+	pending := ts.usage.pendingUsage(ts, key)
+	usage.Count += pending.Count
+
+	if pending.LastUsed.After(usage.LastUsed) {
+		usage.LastUsed = pending.LastUsed
+	}
+
+	return usage, nil
+}
+
+// RevokeIdleSince deletes the token pairs whose access token wasn't read for d, or since it was
+// created when it was never read, on a single transaction. It returns the number of token pairs
+// revoked. Authorization codes are not affected
+func (ts *TokenStore) RevokeIdleSince(d time.Duration) (int, error) {
+	if ts.usage == nil {
+		return 0, ErrUsageTrackingDisabled
+	}
+
+	err := ts.usage.flush()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := ts.clock.Now().Add(-d)
+	revoked := 0
+
+	err = ts.update(context.Background(), func(tx *bolt.Tx) error {
+		// batched transactions can be retried
+		revoked = 0
+
+		bucket := ts.tokenBucket(tx)
+		usageBucket := tx.Bucket(ts.bucketUsageName)
+
+		var idle [][]byte
+
+		err := bucket.ForEach(func(k, v []byte) error {
+			stored, err := ts.decodeStored(v)
+			if err != nil || stored == nil || stored.Code != "" {
+				// mappings from tokens to basic IDs, and codes
+				return nil
+			}
+
+			lastUsed := decodeUsage(usageBucket.Get(ts.tokenKey(stored.Access))).LastUsed
+
+			if lastUsed.IsZero() {
+				jv, err := ts.cipher.open(v)
+				if err != nil {
+					return err
+				}
+
+				var tm models.Token
+
+				err = ts.codec.Unmarshal(jv, &tm)
+				if err != nil {
+					return err
+				}
+
+				lastUsed = tm.AccessCreateAt
+			}
+
+			if lastUsed.Before(cutoff) {
+				idle = append(idle, append([]byte(nil), k...))
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// bolt doesn't support deleting while iterating with ForEach
+		for _, key := range idle {
+			keys, err := ts.rootFamily(tx, key)
+			if err != nil {
+				return err
+			}
+
+			err = ts.deleteKeys(tx, ReasonIdle, keys...)
+			if err != nil {
+				return err
+			}
+
+			revoked++
+		}
+
+		return nil
+	})
+
+	return revoked, err
+}
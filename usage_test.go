@@ -0,0 +1,128 @@
+package boltdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/naxhh/go-oauth2-boltdb/testutil"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// usageStore returns a store tracking usage, with its fake clock
+func usageStore(t *testing.T) (*TokenStore, *testutil.FakeClock) {
+	t.Helper()
+
+	clock := testutil.NewFakeClock(time.Now())
+	ts := newTestStore(t, Config{TrackUsage: true, ExpiryStrategy: LazyExpiry, Clock: clock})
+
+	return ts, clock
+}
+
+func TestGetUsageByAccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		reads   int
+		flushed bool
+	}{
+		{"never read", 0, false},
+		{"read, not flushed", 3, false},
+		{"read and flushed", 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, clock := usageStore(t)
+
+			err := ts.Create(&models.Token{Access: "access", AccessCreateAt: clock.Now(), AccessExpiresIn: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var lastUsed time.Time
+
+			for i := 0; i < tt.reads; i++ {
+				clock.Advance(time.Minute)
+				lastUsed = clock.Now()
+
+				if _, err := ts.GetByAccess("access"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.flushed {
+				if err := ts.usage.flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			usage, err := ts.GetUsageByAccess("access")
+			if err != nil || usage.Count != uint64(tt.reads) || !usage.LastUsed.Equal(lastUsed) {
+				t.Fatalf("GetUsageByAccess = %+v, %v, want %d uses, the last at %v", usage, err, tt.reads, lastUsed)
+			}
+		})
+	}
+}
+
+func TestRevokeIdleSince(t *testing.T) {
+	tests := []struct {
+		name    string
+		idle    time.Duration
+		revoked []string
+	}{
+		{"none idle", 2 * time.Hour, nil},
+		{"never read", 30 * time.Minute, []string{"unused"}},
+		{"all idle", 5 * time.Minute, []string{"unused", "used"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, clock := usageStore(t)
+
+			for _, token := range []*models.Token{
+				{Access: "unused", AccessCreateAt: clock.Now(), AccessExpiresIn: 24 * time.Hour},
+				{Access: "used", AccessCreateAt: clock.Now(), AccessExpiresIn: 24 * time.Hour},
+				{Code: "code", CodeCreateAt: clock.Now(), CodeExpiresIn: 24 * time.Hour},
+			} {
+				if err := ts.Create(token); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// used is read 10 minutes ago, unused was created an hour ago
+			clock.Advance(50 * time.Minute)
+
+			if _, err := ts.GetByAccess("used"); err != nil {
+				t.Fatal(err)
+			}
+
+			clock.Advance(10 * time.Minute)
+
+			revoked, err := ts.RevokeIdleSince(tt.idle)
+			if err != nil || revoked != len(tt.revoked) {
+				t.Fatalf("RevokeIdleSince = %d, %v, want %d", revoked, err, len(tt.revoked))
+			}
+
+			for _, access := range tt.revoked {
+				if _, err := ts.GetByAccess(access); err != ErrTokenNotFound {
+					t.Errorf("GetByAccess(%s) = %v, want ErrTokenNotFound", access, err)
+				}
+			}
+
+			if _, err := ts.GetByCode("code"); err != nil {
+				t.Errorf("GetByCode = %v, codes are not revoked", err)
+			}
+		})
+	}
+}
+
+func TestUsageTrackingDisabled(t *testing.T) {
+	ts := newTestStore(t, Config{})
+
+	if _, err := ts.GetUsageByAccess("access"); err != ErrUsageTrackingDisabled {
+		t.Errorf("GetUsageByAccess = %v, want ErrUsageTrackingDisabled", err)
+	}
+
+	if _, err := ts.RevokeIdleSince(time.Hour); err != ErrUsageTrackingDisabled {
+		t.Errorf("RevokeIdleSince = %v, want ErrUsageTrackingDisabled", err)
+	}
+}
@@ -0,0 +1,255 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// VacuumReport counts what Vacuum removed
+type VacuumReport struct {
+	// DanglingMappings are access and refresh keys pointing to a basic ID that's gone,
+	// or that holds a token pair they are not part of
+	DanglingMappings int
+	// OrphanedPayloads are basic IDs holding a token pair no access or refresh key points to
+	OrphanedPayloads int
+	// StaleTTLEntries are TTL entries of keys that are gone, or replaced by a newer entry of the key
+	StaleTTLEntries int
+}
+
+// add adds the counts of other
+func (r *VacuumReport) add(other VacuumReport) {
+	r.DanglingMappings += other.DanglingMappings
+	r.OrphanedPayloads += other.OrphanedPayloads
+	r.StaleTTLEntries += other.StaleTTLEntries
+}
+
+// Vacuum removes the entries of the store and its tenant stores that neither the sweep nor
+// the Get methods would ever touch: dangling mappings, orphaned payloads and stale TTL entries.
+// Each store is checked on a single write transaction. Set Config.VacuumInterval to run it
+// from the cleaner
+func (ts *TokenStore) Vacuum() (VacuumReport, error) {
+	var report VacuumReport
+
+	stores := ts.stores()
+	if ts.codes != nil {
+		stores = append(stores, ts.codes)
+	}
+
+	for _, store := range stores {
+		storeReport, err := store.vacuum()
+		report.add(storeReport)
+
+		if err != nil {
+			store.logger.Printf("boltdb: vacuum: %v", err)
+			store.reportError("vacuum", err)
+			return report, err
+		}
+	}
+
+	if report != (VacuumReport{}) {
+		ts.logger.Printf("boltdb: vacuum removed %d dangling mappings, %d orphaned payloads and %d stale ttl entries",
+			report.DanglingMappings, report.OrphanedPayloads, report.StaleTTLEntries)
+	}
+
+	return report, nil
+}
+
+// vacuum removes the dangling mappings, and then the payloads they orphaned, and the stale TTL entries of ts
+func (ts *TokenStore) vacuum() (VacuumReport, error) {
+	var report VacuumReport
+
+	err := ts.update(context.Background(), func(tx *bolt.Tx) error {
+		report = VacuumReport{}
+
+		dangling, err := ts.danglingMappings(tx)
+		if err != nil {
+			return err
+		}
+
+		err = ts.deleteKeys(tx, "", dangling...)
+		if err != nil {
+			return err
+		}
+
+		orphans := ts.orphanedPayloads(tx)
+
+		err = ts.deleteKeys(tx, "", orphans...)
+		if err != nil {
+			return err
+		}
+
+		stale, err := ts.deleteStaleTTLEntries(tx)
+		if err != nil {
+			return err
+		}
+
+		report = VacuumReport{
+			DanglingMappings: len(dangling),
+			OrphanedPayloads: len(orphans),
+			StaleTTLEntries:  stale,
+		}
+
+		return nil
+	})
+
+	return report, err
+}
+
+// danglingMappings returns the keys pointing to a basic ID that doesn't hold their token pair.
+// Only values up to the size of an ID are mappings: longer values that can't be decoded are
+// token information sealed with another key or codec, and abort the vacuum instead of being deleted
+func (ts *TokenStore) danglingMappings(tx *bolt.Tx) ([][]byte, error) {
+	bucket := ts.tokenBucket(tx)
+
+	var keys [][]byte
+
+	err := bucket.ForEach(func(k, v []byte) error {
+		stored, err := ts.decodeStored(v)
+		if err == nil && stored != nil {
+			return nil
+		}
+
+		if len(v) > maxIDSize {
+			return undecodable(k, err)
+		}
+
+		target := bucket.Get(v)
+
+		stored, err = ts.decodeStored(target)
+		if err != nil && len(target) > maxIDSize {
+			return undecodable(v, err)
+		}
+
+		if stored != nil && stored.Code == "" && (bytes.Equal(k, ts.tokenKey(stored.Access)) ||
+			stored.Refresh != "" && bytes.Equal(k, ts.tokenKey(stored.Refresh))) {
+			return nil
+		}
+
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+
+	return keys, err
+}
+
+// undecodable returns the error aborting the vacuum on the value of key, which can't be decoded
+func undecodable(key []byte, err error) error {
+	if err == nil {
+		// longer values decoding without a code nor a token
+		err = ErrEncoding
+	}
+
+	return fmt.Errorf("vacuum: value of key %x can't be decoded, check Config.EncryptionKey and Config.Codec: %w", key, err)
+}
+
+// orphanedPayloads returns the basic IDs holding a token pair that no key points to
+func (ts *TokenStore) orphanedPayloads(tx *bolt.Tx) [][]byte {
+	bucket := ts.tokenBucket(tx)
+
+	var keys [][]byte
+
+	bucket.ForEach(func(k, v []byte) error {
+		stored, err := ts.decodeStored(v)
+		if err != nil || stored == nil || stored.Code != "" {
+			// mappings and codes are not payloads
+			return nil
+		}
+
+		for _, token := range []string{stored.Access, stored.Refresh} {
+			if token != "" && bytes.Equal(bucket.Get(ts.tokenKey(token)), k) {
+				return nil
+			}
+		}
+
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+
+	return keys
+}
+
+// deleteStaleTTLEntries deletes the TTL entries of keys that are gone from the token and side
+// buckets, and the entries the index doesn't point to, returning how many were deleted
+func (ts *TokenStore) deleteStaleTTLEntries(tx *bolt.Tx) (int, error) {
+	bucket := ts.tokenBucket(tx)
+
+	exists := func(key []byte) bool {
+		if bucket.Get(key) != nil {
+			return true
+		}
+
+		for _, name := range ts.sideBuckets() {
+			// side buckets are created by migrations, older databases don't have them
+			if side := tx.Bucket(name); side != nil && side.Get(key) != nil {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	deleted := 0
+
+	for _, ttl := range ts.ttlBuckets(tx).shards() {
+		n, err := deleteStaleTTLShard(ttl, exists)
+		deleted += n
+
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// deleteStaleTTLShard deletes the stale entries of a TTL shard, returning how many were deleted
+func deleteStaleTTLShard(ttl ttlBucket, exists func(key []byte) bool) (int, error) {
+	var gone [][]byte
+
+	ttl.index.ForEach(func(k, _ []byte) error {
+		if !exists(k) {
+			gone = append(gone, append([]byte(nil), k...))
+		}
+
+		return nil
+	})
+
+	for _, key := range gone {
+		if err := ttl.remove(key); err != nil {
+			return 0, err
+		}
+	}
+
+	var unindexed [][]byte
+
+	collect := func(k, v []byte) error {
+		if v != nil && !bytes.Equal(ttl.index.Get(v), k) {
+			unindexed = append(unindexed, append([]byte(nil), k...))
+		}
+
+		return nil
+	}
+
+	err := ttl.ttl.ForEach(func(k, v []byte) error {
+		// day buckets hold the sharded entries
+		if shard := ttl.ttl.Bucket(k); v == nil && shard != nil {
+			return shard.ForEach(collect)
+		}
+
+		return collect(k, v)
+	})
+	if err != nil {
+		return len(gone), err
+	}
+
+	for _, ttlKey := range unindexed {
+		if err := ttl.deleteEntry(ttlKey); err != nil {
+			return len(gone), err
+		}
+	}
+
+	return len(gone) + len(unindexed), nil
+}
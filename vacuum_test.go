@@ -0,0 +1,192 @@
+package boltdb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/oauth2.v3/models"
+)
+
+// vacuumPair returns a token pair of the vacuum tests
+func vacuumPair(prefix string) *models.Token {
+	return &models.Token{
+		ClientID:         "client",
+		Access:           prefix + "-access",
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  time.Hour,
+		Refresh:          prefix + "-refresh",
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: time.Hour,
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	tests := []struct {
+		name string
+		// corrupt breaks the pairs "a" and "b" behind the back of the store
+		corrupt func(ts *TokenStore, bucket tokenBucket) error
+		want    VacuumReport
+	}{
+		{
+			name:    "clean",
+			corrupt: func(ts *TokenStore, bucket tokenBucket) error { return nil },
+		},
+		{
+			name: "basic id gone",
+			corrupt: func(ts *TokenStore, bucket tokenBucket) error {
+				return bucket.Delete(bucket.Get(ts.tokenKey("a-access")))
+			},
+			want: VacuumReport{DanglingMappings: 2, StaleTTLEntries: 1},
+		},
+		{
+			name: "mapping to another pair",
+			corrupt: func(ts *TokenStore, bucket tokenBucket) error {
+				return bucket.Put(ts.tokenKey("a-access"), bucket.Get(ts.tokenKey("b-access")))
+			},
+			want: VacuumReport{DanglingMappings: 1},
+		},
+		{
+			name: "mappings gone",
+			corrupt: func(ts *TokenStore, bucket tokenBucket) error {
+				err := bucket.Delete(ts.tokenKey("a-access"))
+				if err != nil {
+					return err
+				}
+
+				return bucket.Delete(ts.tokenKey("a-refresh"))
+			},
+			want: VacuumReport{OrphanedPayloads: 1, StaleTTLEntries: 2},
+		},
+		{
+			name: "access mapping gone",
+			corrupt: func(ts *TokenStore, bucket tokenBucket) error {
+				return bucket.Delete(ts.tokenKey("a-access"))
+			},
+			want: VacuumReport{StaleTTLEntries: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestStore(t, Config{})
+
+			for _, prefix := range []string{"a", "b"} {
+				if err := ts.Create(vacuumPair(prefix)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := ts.db.Update(func(tx *bolt.Tx) error {
+				return tt.corrupt(ts, ts.tokenBucket(tx))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := ts.Vacuum()
+			if err != nil || report != tt.want {
+				t.Fatalf("Vacuum = %+v, %v, want %+v", report, err, tt.want)
+			}
+
+			if report, err = ts.Vacuum(); err != nil || report != (VacuumReport{}) {
+				t.Fatalf("second Vacuum = %+v, %v, want nothing removed", report, err)
+			}
+
+			if info, err := ts.GetByRefresh("b-refresh"); err != nil || info == nil || info.GetAccess() != "b-access" {
+				t.Fatalf("GetByRefresh of the intact pair = %v, %v", info, err)
+			}
+		})
+	}
+}
+
+func TestVacuumAbortsOnUndecodableValues(t *testing.T) {
+	otherCipher, err := newTokenCipher(testNewKey, NoCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		// value returns the value stored under the key "undecodable"
+		value func(ts *TokenStore) ([]byte, error)
+		err   error
+	}{
+		{
+			name:   "sealed with another key",
+			config: Config{EncryptionKey: testOldKey},
+			value: func(ts *TokenStore) ([]byte, error) {
+				jv, err := ts.codec.Marshal(vacuumPair("c"))
+				if err != nil {
+					return nil, err
+				}
+
+				return otherCipher.seal(jv)
+			},
+			err: ErrInvalidCiphertext,
+		},
+		{
+			name:   "encoded with another codec",
+			config: Config{Codec: JSONCodec},
+			value: func(ts *TokenStore) ([]byte, error) {
+				return GobCodec.Marshal(vacuumPair("c"))
+			},
+			err: ErrEncoding,
+		},
+		{
+			name:   "long value without a token",
+			config: Config{},
+			value: func(ts *TokenStore) ([]byte, error) {
+				return bytes.Repeat([]byte("x"), maxIDSize+1), nil
+			},
+			err: ErrEncoding,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestStore(t, tt.config)
+
+			if err := ts.Create(vacuumPair("a")); err != nil {
+				t.Fatal(err)
+			}
+
+			value, err := tt.value(ts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			undecodable := ts.tokenKey("undecodable")
+
+			err = ts.db.Update(func(tx *bolt.Tx) error {
+				return ts.tokenBucket(tx).Put(undecodable, value)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := ts.Vacuum()
+			if !errors.Is(err, tt.err) || report != (VacuumReport{}) {
+				t.Fatalf("Vacuum = %+v, %v, want nothing removed and %v", report, err, tt.err)
+			}
+
+			err = ts.db.View(func(tx *bolt.Tx) error {
+				if !bytes.Equal(ts.tokenBucket(tx).Get(undecodable), value) {
+					t.Error("the undecodable value was deleted")
+				}
+
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info, err := ts.GetByAccess("a-access"); err != nil || info == nil {
+				t.Fatalf("GetByAccess = %v, %v, want the stored pair", info, err)
+			}
+		})
+	}
+}